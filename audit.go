@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// Audited file operations.
+const (
+	auditCreate = "create"
+	auditModify = "modify"
+	auditDelete = "delete"
+)
+
+// auditRecord is one line of the audit log.
+type auditRecord struct {
+	Time        time.Time `json:"time"`
+	Cert        string    `json:"cert"`
+	Path        string    `json:"path"`
+	Action      string    `json:"action"`
+	Bytes       int       `json:"bytes"`
+	Fingerprint string    `json:"fingerprint,omitempty"`
+	Actor       string    `json:"actor"`
+}
+
+var auditMu sync.Mutex
+
+// auditActor identifies this process in audit records.
+var auditActor = fmt.Sprintf("certwatch pid=%d uid=%d", os.Getpid(), os.Getuid())
+
+// writeAction returns the audit action for writing fname, which must be
+// called before the file is written.
+func writeAction(fname string) string {
+	_, err := os.Lstat(fname)
+	if err != nil {
+		return auditCreate
+	}
+	return auditModify
+}
+
+// audit appends a record to the audit log. The log is opened for every
+// record so it can be rotated by simply moving it away.
+func audit(cert string, fname string, action string, data []byte, fingerprint string) {
+	if len(config.AuditLog) == 0 {
+		return
+	}
+	line, err := json.Marshal(auditRecord{
+		Time:        time.Now().UTC(),
+		Cert:        cert,
+		Path:        fname,
+		Action:      action,
+		Bytes:       len(data),
+		Fingerprint: fingerprint,
+		Actor:       auditActor,
+	})
+	if err != nil {
+		slog.Error("audit", "err", err)
+		return
+	}
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	f, err := os.OpenFile(config.AuditLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		slog.Error("audit", "err", err)
+		return
+	}
+	_, err = f.Write(append(line, '\n'))
+	if err != nil {
+		f.Close()
+		slog.Error("audit", "err", err)
+		return
+	}
+	err = f.Close()
+	if err != nil {
+		slog.Error("audit", "err", err)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+)
+
+// backupName returns the name of backup generation n of fname.
+func backupName(fname string, n int) string {
+	name := fmt.Sprintf("%s.%d", fname, n)
+	if config.CompressBackups {
+		name += ".gz"
+	}
+	return name
+}
+
+// backupFile keeps the current contents of fname as backup generation 1
+// before it is replaced, shifting older generations up and dropping those
+// beyond -keep-backups. Backups are created with mode 0600 like the files
+// themselves and, with -compress-backups, gzipped.
+func backupFile(fname string) error {
+	if config.KeepBackups <= 0 {
+		return nil
+	}
+	finfo, err := os.Stat(fname)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	err = os.Remove(backupName(fname, config.KeepBackups))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	for n := config.KeepBackups - 1; n >= 1; n-- {
+		err = os.Rename(backupName(fname, n), backupName(fname, n+1))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	data, err := os.ReadFile(fname)
+	if err != nil {
+		return err
+	}
+	if config.CompressBackups {
+		var b bytes.Buffer
+		zw := gzip.NewWriter(&b)
+		zw.Name = finfo.Name()
+		zw.ModTime = finfo.ModTime()
+		_, err = zw.Write(data)
+		if err != nil {
+			return err
+		}
+		err = zw.Close()
+		if err != nil {
+			return err
+		}
+		data = b.Bytes()
+	}
+	return writeFileAtomic(backupName(fname, 1), data, finfo.ModTime())
+}
+
+// keepBackup backs up fname, logging instead of failing so a backup problem
+// never keeps a new cert from being installed.
+func keepBackup(fname string) {
+	err := backupFile(fname)
+	if err != nil {
+		slog.Warn("backup", "file", fname, "err", err)
+	}
+}
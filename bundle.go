@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"os"
+	"slices"
+	"sync"
+)
+
+// bundleMu serializes writes of the -bundle file.
+var bundleMu sync.Mutex
+
+// buildBundle concatenates the local chains of all watched certs in order of
+// cert name. Certs without a local chain, such as removed ones, are left
+// out.
+func buildBundle() ([]byte, int, error) {
+	certs := slices.Clone(config.Certs)
+	slices.Sort(certs)
+	var b bytes.Buffer
+	n := 0
+	for _, cert := range certs {
+		data, err := readLocal(localPath(cert, ".crt"))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		b.Write(data)
+		if len(data) > 0 && data[len(data)-1] != '\n' {
+			b.WriteByte('\n')
+		}
+		n++
+	}
+	return b.Bytes(), n, nil
+}
+
+// updateBundle regenerates the -bundle file if its contents changed.
+func updateBundle() {
+	if len(config.Bundle) == 0 {
+		return
+	}
+	bundleMu.Lock()
+	defer bundleMu.Unlock()
+	data, n, err := buildBundle()
+	if err != nil {
+		slog.Error("bundle", "file", config.Bundle, "err", err)
+		return
+	}
+	current, err := os.ReadFile(config.Bundle)
+	if err == nil && bytes.Equal(current, data) {
+		return
+	}
+	err = writeFileAtomic(config.Bundle, data, clk.Now())
+	if err != nil {
+		slog.Error("bundle", "file", config.Bundle, "err", err)
+		return
+	}
+	slog.Info("bundle written", "file", config.Bundle, "certs", n)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"crypto/x509"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// certChange describes an installed change of a cert to the functions
+// registered with onChange.
+type certChange struct {
+	Name string
+	// Leaf is the parsed leaf certificate, nil if the cert file is missing
+	// or could not be parsed.
+	Leaf *x509.Certificate
+	// Key and Crt are the current PEM contents of the files as written,
+	// nil if the file is not stored in redis.
+	Key []byte
+	Crt []byte
+	// Modified is the latest modification time stored for the files.
+	Modified time.Time
+	// KeyChanged and CrtChanged tell which of the files changed.
+	KeyChanged bool
+	CrtChanged bool
+}
+
+// changeFunc is called after a change of a cert was installed.
+type changeFunc func(certChange)
+
+var changeFuncs []changeFunc
+
+// reported holds the certs reported to changeFuncs at least once.
+var reported sync.Map
+
+// onChange registers f to be called for every installed change. It must be
+// called before certwatch starts syncing. The first sync of every cert is
+// reported even if nothing changed, with KeyChanged and CrtChanged unset, so
+// that a function learns the state of all certs. The functions are called in
+// the order of registration while the lock of the cert is held, so calls for
+// the same cert never overlap and arrive in the order the changes were
+// installed, while calls for different certs may run concurrently. A
+// function must therefore not block for long and must not trigger a sync
+// itself.
+func onChange(f changeFunc) {
+	changeFuncs = append(changeFuncs, f)
+}
+
+// notifyChange calls the registered functions for a change of cert. files
+// are all files of the cert, staged those that changed.
+func notifyChange(cert string, files []certFile, staged []stagedFile) {
+	if len(changeFuncs) == 0 {
+		return
+	}
+	_, seen := reported.LoadOrStore(cert, true)
+	if len(staged) == 0 && seen {
+		return
+	}
+	c := certChange{Name: cert}
+	for _, f := range files {
+		if f.modified.After(c.Modified) {
+			c.Modified = f.modified
+		}
+		switch f.suffix {
+		case ".key":
+			c.Key = f.data
+		case ".crt":
+			c.Crt = f.data
+		}
+	}
+	for _, sf := range staged {
+		switch sf.suffix {
+		case ".key":
+			c.KeyChanged = true
+		case ".crt":
+			c.CrtChanged = true
+		}
+	}
+	if c.Crt != nil {
+		leaf, err := parseLeaf(c.Crt)
+		if err != nil {
+			slog.Debug("parseLeaf", "cert", cert, "err", err)
+		} else {
+			c.Leaf = leaf
+		}
+	}
+	for _, f := range changeFuncs {
+		f(c)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// certbotCerts returns the cert names of a certbot live directory, one per
+// subdirectory.
+func certbotCerts(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var certs []string
+	for _, e := range entries {
+		if e.IsDir() {
+			certs = append(certs, e.Name())
+		}
+	}
+	return certs, nil
+}
+
+// runCertbotCheck maps the certs of an existing certbot live directory to
+// watched cert names and checks that redis holds all files for each of them,
+// without touching any local file. It prints a report to stdout and returns
+// the exit code: checkInSync if every cert can be served from redis,
+// checkOutOfSync if any is missing and checkFailed on errors.
+func runCertbotCheck(ctx context.Context, dir string) int {
+	certs, err := certbotCerts(dir)
+	if err != nil {
+		fmt.Printf("error\t%s\t%v\n", dir, err)
+		return checkFailed
+	}
+	var servable, missing []string
+	failed := 0
+	for _, cert := range certs {
+		var absent []string
+		for _, suf := range certSuffixes {
+			_, key, _, err := getValue(ctx, cert, suf)
+			if err != nil {
+				if errors.Is(err, redis.Nil) {
+					absent = append(absent, suf)
+					continue
+				}
+				fmt.Printf("error\t%s\t%v\n", cert, err)
+				failed++
+				continue
+			}
+			fmt.Printf("found\t%s\t%s\n", cert, key)
+		}
+		if len(absent) > 0 {
+			fmt.Printf("missing\t%s\t%v\n", cert, absent)
+			missing = append(missing, cert)
+		} else {
+			servable = append(servable, cert)
+		}
+	}
+	slices.Sort(servable)
+	fmt.Printf("%d of %d certs can be served from redis, %d missing, %d errors\n", len(servable), len(certs), len(missing), failed)
+	if len(servable) > 0 {
+		fmt.Printf("watch with: %s\n", strings.Join(servable, " "))
+	}
+	switch {
+	case failed > 0:
+		return checkFailed
+	case len(missing) > 0:
+		return checkOutOfSync
+	}
+	return checkInSync
+}
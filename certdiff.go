@@ -0,0 +1,77 @@
+package main
+
+import (
+	"crypto/x509"
+	"log/slog"
+	"slices"
+	"time"
+)
+
+// certNames returns the DNS names and IP addresses of the leaf.
+func certNames(leaf *x509.Certificate) []string {
+	names := slices.Clone(leaf.DNSNames)
+	for _, ip := range leaf.IPAddresses {
+		names = append(names, ip.String())
+	}
+	return names
+}
+
+// diffNames returns the names of new missing from old and those of old
+// missing from new.
+func diffNames(old []string, new []string) (added []string, removed []string) {
+	for _, n := range new {
+		if !slices.Contains(old, n) {
+			added = append(added, n)
+		}
+	}
+	for _, n := range old {
+		if !slices.Contains(new, n) {
+			removed = append(removed, n)
+		}
+	}
+	return added, removed
+}
+
+// diffCert logs what changed between the leaf in fname and the new chain
+// in data, for -diff-certs. Leaves that do not parse are logged and
+// otherwise ignored, the diff is purely informational.
+func diffCert(cert string, fname string, data []byte) {
+	if !config.DiffCerts {
+		return
+	}
+	old, err := readLocal(fname)
+	if err != nil {
+		slog.Warn("diff cert", "cert", cert, "file", fname, "err", err)
+		return
+	}
+	oldLeaf, err := parseLeaf(old)
+	if err != nil {
+		slog.Warn("diff cert, old leaf", "cert", cert, "file", fname, "err", err)
+		return
+	}
+	newLeaf, err := parseLeaf(data)
+	if err != nil {
+		slog.Warn("diff cert, new leaf", "cert", cert, "err", err)
+		return
+	}
+	added, removed := diffNames(certNames(oldLeaf), certNames(newLeaf))
+	attrs := []any{
+		"cert", cert,
+		"serial", oldLeaf.SerialNumber.Text(16) + " -> " + newLeaf.SerialNumber.Text(16),
+		"notAfter", oldLeaf.NotAfter.UTC().Format(time.RFC3339) + " -> " + newLeaf.NotAfter.UTC().Format(time.RFC3339),
+		"extended", newLeaf.NotAfter.Sub(oldLeaf.NotAfter).Round(time.Second),
+	}
+	if len(added) > 0 {
+		attrs = append(attrs, "namesAdded", added)
+	}
+	if len(removed) > 0 {
+		attrs = append(attrs, "namesRemoved", removed)
+	}
+	if oldLeaf.Issuer.String() != newLeaf.Issuer.String() {
+		attrs = append(attrs, "issuer", oldLeaf.Issuer.String()+" -> "+newLeaf.Issuer.String())
+	}
+	if oldLeaf.PublicKeyAlgorithm != newLeaf.PublicKeyAlgorithm {
+		attrs = append(attrs, "keyAlgorithm", oldLeaf.PublicKeyAlgorithm.String()+" -> "+newLeaf.PublicKeyAlgorithm.String())
+	}
+	slog.Info("cert diff", attrs...)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// certDetails describes the installed certificate of a watched cert.
+type certDetails struct {
+	Name      string     `json:"name"`
+	Subject   string     `json:"subject,omitempty"`
+	SANs      []string   `json:"sans,omitempty"`
+	NotBefore *time.Time `json:"not_before,omitempty"`
+	NotAfter  *time.Time `json:"not_after,omitempty"`
+	KeyType   string     `json:"key_type,omitempty"`
+	LastSync  *time.Time `json:"last_sync,omitempty"`
+	Error     string     `json:"error,omitempty"`
+}
+
+// keyType describes the public key of a certificate, e.g. RSA-2048.
+func keyType(c *x509.Certificate) string {
+	switch k := c.PublicKey.(type) {
+	case *rsa.PublicKey:
+		return fmt.Sprintf("RSA-%d", k.N.BitLen())
+	case *ecdsa.PublicKey:
+		return "ECDSA-" + k.Curve.Params().Name
+	case ed25519.PublicKey:
+		return "Ed25519"
+	}
+	return c.PublicKeyAlgorithm.String()
+}
+
+// readCertDetails parses the local certificate file of cert.
+func readCertDetails(cs certStatus) certDetails {
+	d := certDetails{Name: cs.Name, LastSync: cs.LastSync}
+	data, err := readLocal(localPath(cs.Name, ".crt"))
+	if err != nil {
+		d.Error = err.Error()
+		return d
+	}
+	leaf, err := parseLeaf(data)
+	if err != nil {
+		d.Error = err.Error()
+		return d
+	}
+	d.Subject = leaf.Subject.String()
+	d.SANs = append(d.SANs, leaf.DNSNames...)
+	for _, ip := range leaf.IPAddresses {
+		d.SANs = append(d.SANs, ip.String())
+	}
+	d.NotBefore = &leaf.NotBefore
+	d.NotAfter = &leaf.NotAfter
+	d.KeyType = keyType(leaf)
+	return d
+}
+
+// authorized checks the bearer token of r against -health-token.
+func authorized(r *http.Request) bool {
+	if len(config.HealthToken) == 0 {
+		return true
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(config.HealthToken)) == 1
+}
+
+func certsHandler(w http.ResponseWriter, r *http.Request) {
+	if !authorized(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	certs := []certDetails{}
+	for _, cs := range state.report().Certs {
+		certs = append(certs, readCertDetails(cs))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(certs)
+	if err != nil {
+		slog.Error("certs", "err", err)
+	}
+}
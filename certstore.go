@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+)
+
+// certStore keeps the latest key pair of every watched cert in memory for
+// use by tls.Config.GetCertificate, updated by the change callbacks.
+type certStore struct {
+	mu    sync.RWMutex
+	pairs map[string]*tls.Certificate // by cert name
+	names map[string]string           // DNS name to cert name
+}
+
+// healthCerts is the store of -health-tls, nil without it.
+var healthCerts *certStore
+
+// newCertStore returns a store registered for the changes of all certs.
+func newCertStore() *certStore {
+	s := &certStore{
+		pairs: make(map[string]*tls.Certificate),
+		names: make(map[string]string),
+	}
+	onChange(s.update)
+	return s
+}
+
+// remove drops the key pair of cert, which is no longer watched.
+func (s *certStore) remove(cert string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for name, c := range s.names {
+		if c == cert {
+			delete(s.names, name)
+		}
+	}
+	delete(s.pairs, cert)
+}
+
+// defaultCert returns the cert served to clients sending no server name or
+// one no cert covers, like health probes connecting by address: -primary if
+// it is stored, otherwise the stored cert first by name. Called with mu
+// held.
+func (s *certStore) defaultCert() (*tls.Certificate, bool) {
+	if pair, ok := s.pairs[config.Primary]; ok {
+		return pair, true
+	}
+	var first string
+	for cert := range s.pairs {
+		if len(first) == 0 || cert < first {
+			first = cert
+		}
+	}
+	pair, ok := s.pairs[first]
+	return pair, ok
+}
+
+func (s *certStore) update(c certChange) {
+	if c.Key == nil || c.Crt == nil || c.Leaf == nil {
+		return
+	}
+	pair, err := tls.X509KeyPair(c.Crt, c.Key)
+	if err != nil {
+		slog.Warn("cert store", "cert", c.Name, "err", err)
+		return
+	}
+	pair.Leaf = c.Leaf
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for name, cert := range s.names {
+		if cert == c.Name {
+			delete(s.names, name)
+		}
+	}
+	s.pairs[c.Name] = &pair
+	for _, name := range c.Leaf.DNSNames {
+		s.names[strings.ToLower(name)] = c.Name
+	}
+	slog.Debug("cert store", "cert", c.Name, "names", c.Leaf.DNSNames)
+}
+
+// GetCertificate returns the cert for the server name of hello, trying an
+// exact match before a wildcard for the first label and falling back to
+// the default cert. It is suitable for tls.Config.GetCertificate.
+func (s *certStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if cert, ok := s.names[name]; ok {
+		return s.pairs[cert], nil
+	}
+	if _, rest, ok := strings.Cut(name, "."); ok {
+		if cert, ok := s.names["*."+rest]; ok {
+			return s.pairs[cert], nil
+		}
+	}
+	if pair, ok := s.defaultCert(); ok {
+		return pair, nil
+	}
+	return nil, fmt.Errorf("no certificate for %q", hello.ServerName)
+}
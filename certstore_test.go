@@ -0,0 +1,72 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+)
+
+// storeChange returns the change of a cert named name for example.com.
+func storeChange(t *testing.T, name string) certChange {
+	key, chain := testChain(t, func() crypto.Signer {
+		k, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		return k
+	})
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(chain[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certChange{
+		Name: name,
+		Leaf: leaf,
+		Key:  pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}),
+		Crt:  pemChain(chain...),
+	}
+}
+
+func TestCertStoreDefault(t *testing.T) {
+	oldPrimary := config.Primary
+	defer func() { config.Primary = oldPrimary }()
+	s := &certStore{pairs: make(map[string]*tls.Certificate), names: make(map[string]string)}
+	s.update(storeChange(t, "b"))
+	s.update(storeChange(t, "a"))
+	tests := []struct {
+		primary    string
+		serverName string
+		want       string
+	}{
+		{"", "", "a"},
+		{"", "unknown.example.org", "a"},
+		{"b", "", "b"},
+		{"missing", "", "a"},
+	}
+	for _, tt := range tests {
+		config.Primary = tt.primary
+		got, err := s.GetCertificate(&tls.ClientHelloInfo{ServerName: tt.serverName})
+		if err != nil {
+			t.Errorf("primary %q, server name %q: %v", tt.primary, tt.serverName, err)
+			continue
+		}
+		if got != s.pairs[tt.want] {
+			t.Errorf("primary %q, server name %q: not the pair of %s", tt.primary, tt.serverName, tt.want)
+		}
+	}
+	config.Primary = ""
+	s.remove("a")
+	s.remove("b")
+	if _, err := s.GetCertificate(&tls.ClientHelloInfo{}); err == nil {
+		t.Error("removed certs still served")
+	}
+	if len(s.names) > 0 {
+		t.Errorf("names left after remove: %v", s.names)
+	}
+}
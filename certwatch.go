@@ -1,203 +1,1810 @@
 package main
 
 import (
+	"bytes"
 	"context"
-	"encoding/json"
 	"errors"
 	"flag"
+	"fmt"
 	"io/fs"
 	"log/slog"
+	"math/rand/v2"
+	"net"
 	"os"
-	"os/exec"
+	"os/signal"
 	"path"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type Config struct {
-	RedisUrl    string
-	KeyPrefix   string
-	ValuePrefix string
-	AcmeDirName string
+	RedisUrl           string
+	ReplicaUrl         string
+	PoolSize           int
+	MinIdleConns       int
+	MaxIdleConns       int
+	MaxActiveConns     int
+	RedisTLSMinVersion string
+	RedisTLSCiphers    stringsFlag
+	RedisTLSCA         string
+	RedisTLSCert       string
+	RedisTLSKey        string
+	RedisTLSInsecure   bool
+	KeyPrefixes        stringsFlag
+	Collisions         string
+	StrictCollisions   bool
+	ValuePrefix        string
+	ValueFormat        string
+	ValueEncoding      string
+	ValueRef           string
+	ValueField         string
+	ModifiedField      string
+	StrictDecode       bool
+	AcmeDirName        string
+	PKICAs             stringsFlag
+	PKIKeys            bool
 
-	CertDir   string
-	Certs     []string
-	Cmd       string
-	Debug     bool
-	SleepTime time.Duration
+	SentinelMaster       string
+	SentinelAddrs        stringsFlag
+	SentinelPassword     string
+	SentinelPasswordFile string
+	ClusterAddrs         stringsFlag
+
+	CertDir              string
+	ConfigFile           string
+	NameTemplate         string
+	SanitizeNames        bool
+	KeepIssuances        int
+	Compress             bool
+	FailFast             bool
+	Oneshot              bool
+	Poll                 time.Duration
+	PollSubscribe        bool
+	Required             stringsFlag
+	RequireAll           bool
+	AllowInsecureKey     bool
+	Certs                []string
+	NameRegex            string
+	CertsFromKey         string
+	CertsFromKeyInterval time.Duration
+	Discover             stringsFlag
+	CertKeys             map[string]map[string]string
+	IssuerCerts          map[string]issuerCert
+	MaxCerts             int
+	MaxErrors            int
+	MaxValueSize         int
+	MaxChainCerts        int
+	FollowSymlinks       bool
+	ForceFile            bool
+	ExpireGrace          time.Duration
+	RefreshInterval      time.Duration
+	DeleteOnEvict        bool
+	Umask                string
+	Restorecon           bool
+	FileContext          string
+	LineEnding           string
+	KeepBackups          int
+	CompressBackups      bool
+	AlwaysRefresh        bool
+	Sftp                 stringsFlag
+	SftpKey              string
+	SftpRetries          int
+	SftpRetryDelay       time.Duration
+	SftpDelay            time.Duration
+	SftpTimeout          time.Duration
+	OSStore              bool
+	OSStoreLocation      string
+
+	Cmd                string
+	CertCmds           mapFlag
+	HookKey            string
+	HookCrt            string
+	NewCertCmd         string
+	PreCmd             string
+	KeyAllow           stringsFlag
+	ServiceFromName    string
+	ServiceReloadCmd   string
+	SeenFile           string
+	EnvFile            string
+	StageCmd           string
+	CmdConcurrency     int
+	CmdNice            int
+	CmdIONice          string
+	CmdAsync           bool
+	InitialSettle      time.Duration
+	Debounce           time.Duration
+	DebounceMax        time.Duration
+	CmdMode            string
+	CmdResultJSON      bool
+	CmdResultField     string
+	CmdResultError     string
+	CmdSignal          string
+	CmdPidfile         string
+	CmdUnit            string
+	CmdUnitRestart     bool
+	CmdWebhook         string
+	CmdWebhookToken    string
+	NoInitialCmd       bool
+	VerifyServe        mapFlag
+	VerifyServeTimeout time.Duration
+
+	CmdWebhookTokenFile string
+
+	Debug            bool
+	Quiet            bool
+	LogFormat        string
+	SleepTime        time.Duration
+	ErrorLogInterval time.Duration
+	PingInterval     time.Duration
+	ReceiveRetries   int
+	ReconnectRate    float64
+	ReconnectBurst   int
+	StartupJitter    time.Duration
+	SweepRetries     int
+	SweepRetryDelay  time.Duration
+
+	ParseRetries      int
+	ParseRetryDelay   time.Duration
+	VerifyChain       bool
+	DiffCerts         bool
+	VerifyOnStart     bool
+	CheckMetadata     bool
+	FixChain          bool
+	MinRSABits        int
+	AllowedCurves     stringsFlag
+	KeyPassphrase     string
+	KeyPassphraseFile string
+	OutPassphrase     string
+	KeyFormat         string
+	Roots             string
+
+	NotifyFifo        string
+	AuditLog          string
+	Snapshot          string
+	HeartbeatFile     string
+	HeartbeatInterval time.Duration
+	StatusKey         string
+	StatusInterval    time.Duration
+	Bundle            string
+	ExplodeChain      bool
+	OutCombined       bool
+	OutP12            bool
+	P12Passphrase     string
+	P12PassphraseFile string
+	CheckKeyMatch     bool
+	SmtpAddr          string
+	SmtpFrom          string
+	SmtpTo            stringsFlag
+	SmtpUser          string
+	SmtpPassword      string
+	SmtpPasswordFile  string
+	SmtpAfter         time.Duration
+	SmtpRepeat        time.Duration
+	SmtpExpiry        time.Duration
+	Primary           string
+	PrimaryCrt        string
+	PrimaryKey        string
+	OrphanAction      string
+	EventsJSON        bool
+	KVURL             string
+	KVPrefix          string
+	KVToken           string
+	VaultAddr         string
+	VaultToken        string
+	VaultTokenFile    string
+	VaultRoleID       string
+	VaultSecretIDFile string
+	VaultNamespace    string
+	VaultMount        string
+	VaultPath         string
+	Otel              bool
+	HealthAddr        string
+	HealthTLS         bool
+	HealthToken       string
+	Pidfile           string
+	Force             bool
+
+	Check       bool
+	CertbotDir  string
+	Doctor      bool
+	PrintConfig bool
 }
 
 var (
 	config Config
-	client *redis.Client
+	client redis.UniversalClient
+	// readClient serves the GETs for cert values, client unless -replica-url
+	// is set.
+	readClient redis.UniversalClient
+
+	redisErrors = &dedupLog{msg: "listenRedis"}
+	// listenFailures counts the consecutive listenRedis errors without a
+	// successful subscription in between, for -max-errors.
+	listenFailures int
 )
 
 func main() {
 	flag.StringVar(&config.RedisUrl, "redisurl", "", "URL for redis instance")
-	flag.StringVar(&config.KeyPrefix, "keyprefix", "caddy", "prefix for keys")
+	flag.StringVar(&config.ReplicaUrl, "replica-url", "", "URL for a redis replica to read cert values from, notifications still come from -redisurl")
+	flag.Var(&config.KeyPrefixes, "keyprefix", "prefix for keys, optionally as prefix@db to read from another database, may be repeated (default caddy)")
+	flag.IntVar(&config.PoolSize, "pool-size", 0, "maximum number of pooled redis connections per client, 0 keeps the go-redis default")
+	flag.IntVar(&config.MinIdleConns, "min-idle-conns", 0, "minimum number of idle redis connections per client")
+	flag.IntVar(&config.MaxIdleConns, "max-idle-conns", 0, "maximum number of idle redis connections per client, 0 for no limit")
+	flag.IntVar(&config.MaxActiveConns, "max-active-conns", 0, "hard limit of pooled redis connections per client, 0 for no limit")
+	flag.StringVar(&config.RedisTLSMinVersion, "redis-tls-min-version", "", "minimum TLS version for rediss:// connections, 1.2 or 1.3, default the Go default")
+	flag.StringVar(&config.RedisTLSCA, "redis-tls-ca", "", "PEM file with the CA certs to verify rediss:// servers with instead of the system roots")
+	flag.StringVar(&config.RedisTLSCert, "redis-tls-cert", "", "PEM file with the client cert for rediss:// connections, needs -redis-tls-key")
+	flag.StringVar(&config.RedisTLSKey, "redis-tls-key", "", "PEM file with the private key of -redis-tls-cert")
+	flag.BoolVar(&config.RedisTLSInsecure, "redis-tls-insecure", false, "do not verify the certificate of rediss:// servers")
+	flag.StringVar(&config.SentinelMaster, "sentinel-master", "", "name of the master to ask the -sentinel servers for, -redisurl then only gives credentials, database and TLS")
+	flag.Var(&config.SentinelAddrs, "sentinel", "host:port of a redis sentinel, may be repeated or comma separated")
+	flag.StringVar(&config.SentinelPassword, "sentinel-password", "", "password of the -sentinel servers, if they require one")
+	flag.StringVar(&config.SentinelPasswordFile, "sentinel-password-file", "", "file holding the password for -sentinel-password")
+	flag.Var(&config.ClusterAddrs, "cluster", "host:port of a redis cluster node, may be repeated or comma separated, -redisurl then only gives credentials and TLS")
+	flag.Var(&config.RedisTLSCiphers, "redis-tls-ciphers", "comma separated TLS 1.2 cipher suites allowed for rediss:// connections, may be repeated, default the Go default")
 	flag.StringVar(&config.ValuePrefix, "valueprefix", "caddy-storage-redis", "prefix for values")
+	flag.StringVar(&config.ValueEncoding, "value-encoding", encodingAuto, "encoding of the stored Value field: "+strings.Join(valueEncodings, ", "))
+	flag.StringVar(&config.Collisions, "collisions", collisionsFirst, "which value to use if key prefixes hold different values for a cert: first, from the first prefix given, or newest")
+	flag.BoolVar(&config.StrictCollisions, "strict-collisions", false, "fail certs that key prefixes hold different values for instead of resolving it by -collisions")
+	flag.StringVar(&config.ValueFormat, "value-format", valueFormatJSON, "format of the stored values: json as written by caddy-storage-redis, raw for values holding the file contents as is, or length-prefixed for the file contents after a 4 byte big endian length")
+	flag.StringVar(&config.ValueRef, "value-ref", "", "marker for values that refer to another key: a decoded value starting with it names the key holding the raw file contents")
+	flag.StringVar(&config.ValueField, "value-field", "Value", "name of the JSON field holding the file contents")
+	flag.StringVar(&config.ModifiedField, "modified-field", "Modified", "name of the JSON field holding the modification time")
+	flag.BoolVar(&config.StrictDecode, "strict-decode", false, "abort the initial sync on the first value that cannot be decoded instead of skipping that cert")
+	flag.Var(&config.PKICAs, "pki-ca", "id of a CA of the caddy PKI app, e.g. local, whose root and intermediate certs are mirrored as pki-<id>-root and pki-<id>-intermediate, may be repeated")
+	flag.BoolVar(&config.PKIKeys, "pki-keys", false, "also mirror the private keys of the -pki-ca CAs")
 	flag.StringVar(&config.AcmeDirName, "acmedir", "acme-v02.api.letsencrypt.org-directory", "subdir for ACME")
 	flag.StringVar(&config.CertDir, "certdir", "/var/lib/certwatch", "directory for storing certificates locally")
+	flag.StringVar(&config.ConfigFile, "config", "", "YAML or JSON file listing certs to watch, each with its own directory, file mode, owner, group and reload command, see README")
+	flag.Var(certSpecFlag{}, "cert", "cert with explicit redis keys as name=local,keypath=<rediskey>,crtpath=<rediskey> or below another issuer as name=local,issuer=<issuer>,domain=<domain>, may be repeated")
+	flag.BoolVar(&config.DeleteOnEvict, "delete-on-evict", false, "remove the local files of keys evicted by redis under memory pressure instead of keeping them")
+	flag.DurationVar(&config.RefreshInterval, "refresh-interval", 0, "re-fetch every cert at least this often even without events, to catch missed notifications, jittered by up to a tenth")
+	flag.DurationVar(&config.ExpireGrace, "expire-grace", 0, "delay the removal of files whose key expired, cancelled if the key is set again meanwhile, 0 removes immediately")
+	flag.BoolVar(&config.ForceFile, "force-file", false, "remove a directory found in place of a cert file, or a file in place of its directory")
+	flag.BoolVar(&config.FollowSymlinks, "follow-symlinks", false, "write through a symlinked certdir or cert files instead of refusing them")
+	flag.IntVar(&config.KeepBackups, "keep-backups", 0, "number of previous generations of each cert file to keep as <file>.1, <file>.2, ...")
+	flag.BoolVar(&config.CompressBackups, "compress-backups", false, "gzip the backups kept by -keep-backups")
+	flag.StringVar(&config.LineEnding, "line-ending", lineEndingLF, "line ending of written files: lf writes the stored bytes unchanged, crlf re-encodes the PEM with CRLF line endings")
+	flag.Var(&config.Sftp, "sftp", "remote directory as [user@]host:dir[,delay=<duration>][,timeout=<duration>] to upload changed certs to with sftp, may be repeated")
+	flag.DurationVar(&config.SftpDelay, "sftp-delay", 0, "delay between writing the local files and uploading them, overridden by delay= of a -sftp target")
+	flag.DurationVar(&config.SftpTimeout, "sftp-timeout", 0, "timeout for a single -sftp upload, overridden by timeout= of a -sftp target, 0 for no limit")
+	flag.StringVar(&config.SftpKey, "sftp-key", "", "ssh identity file for -sftp")
+	flag.IntVar(&config.SftpRetries, "sftp-retries", 3, "number of retries of a failed -sftp upload")
+	flag.DurationVar(&config.SftpRetryDelay, "sftp-retry-delay", 5*time.Second, "delay before the first retry of a -sftp upload, doubled for each further retry")
+	flag.BoolVar(&config.OSStore, "os-store", false, "also install changed certs into the OS certificate store: the keychain on macOS, the user store on Windows")
+	flag.StringVar(&config.OSStoreLocation, "os-store-location", "", "keychain path on macOS or store name on Windows for -os-store, default the default keychain or My")
+	flag.BoolVar(&config.AlwaysRefresh, "always-refresh", false, "rewrite every cert once after start even if the local files look current, for a -certdir that must not be trusted across restarts")
+	flag.BoolVar(&config.AllowInsecureKey, "allow-insecure-key", false, "only warn about a key file found accessible by group or others after writing it instead of removing it")
+	flag.BoolVar(&config.Oneshot, "oneshot", false, "sync all certs once, run the command for the changed ones and exit, nonzero if anything failed, for cron or a systemd timer")
+	flag.DurationVar(&config.Poll, "poll", 0, "sync all certs this often instead of listening for keyspace notifications, for redis servers that do not allow enabling them")
+	flag.BoolVar(&config.PollSubscribe, "poll-subscribe", false, "with -poll, listen for keyspace notifications as well and use the polls as a safety net for missed ones")
+	flag.BoolVar(&config.FailFast, "fail-fast", false, "exit nonzero right away if the initial sync fails instead of retrying")
+	flag.Var(&config.Required, "required", "cert that must be present after the initial sync, its absence fails the health check, may be repeated")
+	flag.BoolVar(&config.RequireAll, "require-all", false, "require all certs given on the command line and by -cert to be present after the initial sync, see -required")
+	flag.BoolVar(&config.Compress, "compress", false, "write the cert files gzip compressed as .crt.gz and .key.gz")
+	flag.IntVar(&config.KeepIssuances, "keep-issuances", 0, "with {{.Serial}} or {{.NotBefore}} in -name-template, keep the files of this many issuances per cert including the installed one, 0 keeps all")
+	flag.StringVar(&config.NameTemplate, "name-template", "", "template for the local file names from the cert name {{.Name}}, the leaf {{.Serial}} and {{.NotBefore}}, default is the cert name, see README")
+	flag.BoolVar(&config.SanitizeNames, "sanitize-names", false, "default the local file names to the cert name with * replaced by wildcard_ and / \\ : and white space by _")
+	flag.StringVar(&config.NameRegex, "name-regex", "", "only watch certs whose name matches this regular expression")
+	flag.StringVar(&config.CertsFromKey, "certs-from-key", "", "redis set or list holding further cert names to watch, re-read every -certs-from-key-interval")
+	flag.Var(&config.Discover, "discover", "watch every cert below the key prefixes whose name matches this glob, like *.example.com or *, found at startup and whenever one is created, may be repeated")
+	flag.DurationVar(&config.CertsFromKeyInterval, "certs-from-key-interval", time.Minute, "interval to re-read -certs-from-key at")
+	flag.IntVar(&config.MaxChainCerts, "max-chain-certs", 10, "reject a .crt with more CERTIFICATE blocks than this, 0 for no limit")
+	flag.IntVar(&config.MaxValueSize, "max-value-size", 4<<20, "reject cert files larger than this many bytes, 0 for no limit")
+	flag.IntVar(&config.MaxErrors, "max-errors", 0, "exit with status 1 after this many consecutive redis errors without a successful subscription in between, 0 to retry forever")
+	flag.IntVar(&config.MaxCerts, "max-certs", 1000, "maximum number of watched certs, 0 for no limit")
 	flag.StringVar(&config.Cmd, "cmd", "", "command to execute if certificates have been changed")
+	config.CertCmds = make(mapFlag)
+	flag.Var(config.CertCmds, "certcmd", "per cert command as cert=command, run after -cmd when that cert changed, may be repeated")
+	config.VerifyServe = make(mapFlag)
+	flag.Var(config.VerifyServe, "verify-serve", "per cert TLS address as name=host:port, name is a cert or a host covered by a wildcard cert, checked after the commands ran to confirm the new cert is served, may be repeated")
+	flag.DurationVar(&config.VerifyServeTimeout, "verify-serve-timeout", 10*time.Second, "timeout for a -verify-serve check")
+	flag.StringVar(&config.HookKey, "hook-key", "", "command run after a key file was written, {{.Key}} is its path")
+	flag.StringVar(&config.ServiceFromName, "service-from-name", "", "regexp extracting the service owning a cert from its name, the first group or else the whole match")
+	flag.StringVar(&config.ServiceReloadCmd, "service-reload-cmd", "", "command run once per service owning changed certs, {{.Service}} is the service")
+	flag.Var(&config.KeyAllow, "key-allow", "glob in redis KEYS syntax the redis keys read must match, certwatch refuses to read or subscribe to other keys, may be repeated")
+	flag.StringVar(&config.SmtpAddr, "smtp-addr", "", "host:port of an SMTP server to mail alerts about persisting failures through")
+	flag.StringVar(&config.SmtpFrom, "smtp-from", "certwatch@localhost", "sender address of the alert mails")
+	flag.Var(&config.SmtpTo, "smtp-to", "recipient of the alert mails, may be repeated")
+	flag.StringVar(&config.SmtpUser, "smtp-user", "", "user name to authenticate to the SMTP server with")
+	flag.StringVar(&config.SmtpPassword, "smtp-password", "", "password to authenticate to the SMTP server with")
+	flag.StringVar(&config.SmtpPasswordFile, "smtp-password-file", "", "file holding the password for -smtp-password")
+	flag.DurationVar(&config.SmtpAfter, "smtp-after", 10*time.Minute, "how long a failure has to persist before it is mailed")
+	flag.DurationVar(&config.SmtpRepeat, "smtp-repeat", 24*time.Hour, "interval of reminders for a failure still going on, 0 mails it only once")
+	flag.DurationVar(&config.SmtpExpiry, "smtp-expiry", 14*24*time.Hour, "mail about installed certs expiring within this duration, 0 disables it")
+	flag.StringVar(&config.PreCmd, "pre-cmd", "", "command run once at startup before anything is written to -certdir, such as mounting it, certwatch exits if it fails")
+	flag.StringVar(&config.NewCertCmd, "new-cert-cmd", "", "command run once when a cert never seen before has been mirrored, {{.Changed}} holds its name")
+	flag.StringVar(&config.SeenFile, "seen-file", "", "file recording the certs mirrored so far for -new-cert-cmd, default .certwatch-seen in -certdir")
+	flag.StringVar(&config.HookCrt, "hook-crt", "", "command run after a cert file was written, {{.Crt}} is its path")
+	flag.StringVar(&config.EnvFile, "env-file", "", "file written before the commands run with CHANGED_CERTS and CERTDIR for hooks to source, removed on shutdown")
+	flag.StringVar(&config.StageCmd, "stage-cmd", "", "command validating a new cert before it is installed, {{.Key}} and {{.Crt}} are the staged files, the live files are kept if it fails")
+	flag.BoolVar(&config.NoInitialCmd, "no-initial-cmd", false, "do not run the commands for the certs written by the first sync after start, only for later changes")
+	flag.BoolVar(&config.CmdResultJSON, "cmd-result-json", false, "parse the standard output of the reload commands as a JSON result and treat it as a failure unless -cmd-result-field is true")
+	flag.StringVar(&config.CmdResultField, "cmd-result-field", "success", "field of the -cmd-result-json result telling success, a dotted path for nested objects")
+	flag.StringVar(&config.CmdResultError, "cmd-result-error", "error", "field of the -cmd-result-json result describing a failure, next to -cmd-result-field")
+	flag.StringVar(&config.CmdMode, "cmd-mode", cmdModeOneshot, "how to reload after a change: oneshot, running -cmd and waiting for it to exit, signal, sending -cmd-signal to the process in -cmd-pidfile, systemd, reloading -cmd-unit over D-Bus, or webhook, posting the changed certs to -cmd-webhook")
+	flag.StringVar(&config.CmdUnit, "cmd-unit", "", "systemd unit to reload with -cmd-mode systemd")
+	flag.BoolVar(&config.CmdUnitRestart, "cmd-unit-restart", false, "restart -cmd-unit instead of reloading it")
+	flag.StringVar(&config.CmdWebhook, "cmd-webhook", "", "URL to post the changed certs to with -cmd-mode webhook")
+	flag.StringVar(&config.CmdWebhookToken, "cmd-webhook-token", "", "bearer token sent to the reload webhooks")
+	flag.StringVar(&config.CmdWebhookTokenFile, "cmd-webhook-token-file", "", "file holding the bearer token for -cmd-webhook-token")
+	flag.StringVar(&config.CmdSignal, "cmd-signal", "HUP", "signal to send with -cmd-mode signal")
+	flag.StringVar(&config.CmdPidfile, "cmd-pidfile", "", "pidfile of the process to signal with -cmd-mode signal")
+	flag.DurationVar(&config.Debounce, "debounce", 2*time.Second, "time without further events to wait after a change before running the command, batching the changes into one run, 0 runs it right away")
+	flag.DurationVar(&config.DebounceMax, "debounce-max", 30*time.Second, "longest time to hold back the command after the first change while events keep arriving, 0 for no limit")
+	flag.DurationVar(&config.InitialSettle, "initial-settle", 0, "time to wait after the initial sync before running the command, changes arriving meanwhile are batched into the same run")
+	flag.BoolVar(&config.CmdAsync, "cmd-async", false, "run the commands in the background so that slow commands do not delay event processing, changes arriving meanwhile are batched into the next run")
+	flag.IntVar(&config.CmdNice, "cmd-nice", 0, "niceness increment to run commands with, using nice")
+	flag.StringVar(&config.CmdIONice, "cmd-ionice", "", "I/O scheduling class to run commands with, using ionice: idle, best-effort or best-effort:level, linux only")
+	flag.IntVar(&config.CmdConcurrency, "cmd-concurrency", 1, "maximum number of -certcmd commands running in parallel")
 	flag.BoolVar(&config.Debug, "debug", false, "verbose debug output")
+	flag.BoolVar(&config.Quiet, "quiet", false, "only log warnings and errors")
+	flag.StringVar(&config.LogFormat, "logformat", logFormatText, "log format: text, or journal to prefix lines with journal priorities when running under systemd")
 	flag.DurationVar(&config.SleepTime, "sleep", 10*time.Second, "sleep duration after error")
+	flag.DurationVar(&config.ErrorLogInterval, "error-log-interval", 5*time.Minute, "interval for summarizing repeated identical errors")
+	flag.IntVar(&config.ReceiveRetries, "receive-retries", 3, "number of consecutive failed receives the subscription is recovered from in place before reconnecting from scratch")
+	flag.Float64Var(&config.ReconnectRate, "reconnect-rate", 6, "maximum redis reconnect attempts per minute on average, 0 for no limit")
+	flag.IntVar(&config.ReconnectBurst, "reconnect-burst", 3, "number of reconnect attempts allowed in quick succession before -reconnect-rate applies")
+	flag.DurationVar(&config.PingInterval, "ping-interval", time.Minute, "interval for pinging an idle subscription, 0 disables")
+	flag.DurationVar(&config.StartupJitter, "startup-jitter", 0, "sleep a random duration up to this before the initial sync")
+	flag.IntVar(&config.SweepRetries, "sweep-retries", 0, "number of times to retry certs that failed in the initial sync before giving up")
+	flag.DurationVar(&config.SweepRetryDelay, "sweep-retry-delay", time.Second, "delay before the first retry of the initial sync, doubled for each further retry")
+	flag.BoolVar(&config.Restorecon, "restorecon", false, "run restorecon on each written file")
+	flag.StringVar(&config.FileContext, "file-context", "", "SELinux context to apply to each written file, takes precedence over -restorecon")
+	flag.IntVar(&config.ParseRetries, "parse-retries", 2, "number of times to re-fetch a cert whose leaf does not parse")
+	flag.DurationVar(&config.ParseRetryDelay, "parse-retry-delay", 500*time.Millisecond, "delay between re-fetches of a cert whose leaf does not parse")
+	flag.StringVar(&config.Umask, "umask", "0077", "octal process umask applied at startup")
+	flag.IntVar(&config.MinRSABits, "min-rsa-bits", 0, "reject certs with an RSA key of fewer bits, 0 for no limit")
+	flag.StringVar(&config.KeyPassphrase, "key-passphrase", "", "passphrase to decrypt encrypted private keys with before writing them")
+	flag.StringVar(&config.KeyPassphraseFile, "key-passphrase-file", "", "file holding the passphrase for -key-passphrase")
+	flag.StringVar(&config.KeyFormat, "key-format", keyFormatStored, "format to write private keys in: stored, as found in redis, or pkcs8")
+	flag.StringVar(&config.OutPassphrase, "out-passphrase", "", "passphrase to encrypt the written private keys with, as PKCS#8")
+	flag.Var(&config.AllowedCurves, "allowed-curves", "comma separated curves allowed for EC and Ed25519 keys, e.g. P-256,P-384,Ed25519, may be repeated, default any")
+	flag.BoolVar(&config.FixChain, "fix-chain", false, "reorder the cert chain from the leaf up and drop self-signed roots before writing")
+	flag.BoolVar(&config.CheckMetadata, "check-metadata", false, "warn if the serial or names in the .json metadata of a cert disagree with its newly written leaf")
+	flag.BoolVar(&config.VerifyOnStart, "verify-on-start", false, "compare the contents of all local files against redis during the initial sync and rewrite those that differ, instead of trusting modification time and size")
+	flag.BoolVar(&config.DiffCerts, "diff-certs", false, "log what changed between the old and the new leaf before a cert is replaced")
+	flag.BoolVar(&config.VerifyChain, "verify-chain", false, "verify the cert chain before installing it")
+	flag.StringVar(&config.Roots, "roots", "", "PEM file with trusted roots for -verify-chain instead of the system roots")
+	flag.StringVar(&config.NotifyFifo, "notify-fifo", "", "named pipe to write the names of changed certs to")
+	flag.StringVar(&config.VaultAddr, "vault-addr", "", "address of a HashiCorp Vault server to also write the certs to as KV version 2 secrets, e.g. https://vault:8200")
+	flag.StringVar(&config.VaultToken, "vault-token", "", "Vault token for -vault-addr, default -vault-token-file or VAULT_TOKEN")
+	flag.StringVar(&config.VaultTokenFile, "vault-token-file", "", "file holding the Vault token for -vault-addr")
+	flag.StringVar(&config.VaultRoleID, "vault-role-id", "", "AppRole role ID to log in to -vault-addr with instead of a token")
+	flag.StringVar(&config.VaultSecretIDFile, "vault-secret-id-file", "", "file holding the AppRole secret ID for -vault-role-id")
+	flag.StringVar(&config.VaultNamespace, "vault-namespace", "", "Vault Enterprise namespace for -vault-addr")
+	flag.StringVar(&config.VaultMount, "vault-mount", "secret", "mount path of the KV version 2 secrets engine for -vault-addr")
+	flag.StringVar(&config.VaultPath, "vault-path", "certwatch", "path below -vault-mount the secrets are written to, one per cert")
+	flag.StringVar(&config.KVURL, "kv-url", "", "key-value store to publish cert changes to, consul://host:8500 or etcd://host:2379, add +https to the scheme for TLS")
+	flag.StringVar(&config.KVPrefix, "kv-prefix", "certwatch", "key prefix for -kv-url")
+	flag.StringVar(&config.KVToken, "kv-token", "", "Consul ACL token for -kv-url")
+	flag.BoolVar(&config.EventsJSON, "events-json", false, "write a JSON line for every cert change to stdout")
+	flag.StringVar(&config.OrphanAction, "orphan-action", orphanKeep, "what to do at startup with cert files in -certdir that belong to no watched cert: keep, warn or remove")
+	flag.StringVar(&config.Primary, "primary", "", "watched cert whose files are also written under the fixed names -primary-crt and -primary-key")
+	flag.StringVar(&config.PrimaryCrt, "primary-crt", "cert.pem", "file name for the chain of -primary, relative to -certdir")
+	flag.StringVar(&config.PrimaryKey, "primary-key", "key.pem", "file name for the key of -primary, relative to -certdir")
+	flag.BoolVar(&config.OutCombined, "out-combined", false, "also write the key followed by the cert chain to a single <name>.pem, as used by HAProxy")
+	flag.BoolVar(&config.OutP12, "out-p12", false, "also write a PKCS#12 keystore with the key and the cert chain to <name>.p12, encrypted with -p12-passphrase")
+	flag.StringVar(&config.P12Passphrase, "p12-passphrase", "", "passphrase of the -out-p12 keystores")
+	flag.StringVar(&config.P12PassphraseFile, "p12-passphrase-file", "", "file holding the passphrase for -p12-passphrase")
+	flag.BoolVar(&config.CheckKeyMatch, "check-key-match", false, "reject a cert whose key does not match its leaf instead of writing it, implied by -out-combined and -out-p12")
+	flag.BoolVar(&config.ExplodeChain, "explode-chain", false, "also write every cert of the chain to its own numbered file, <name>.0.pem for the leaf, <name>.1.pem for the first intermediate and so on")
+	flag.StringVar(&config.Bundle, "bundle", "", "file to keep the chains of all watched certs in, concatenated in order of cert name")
+	flag.StringVar(&config.HeartbeatFile, "heartbeat-file", "", "file to touch periodically while subscribed to redis and the listen loop is alive, removed on shutdown")
+	flag.DurationVar(&config.HeartbeatInterval, "heartbeat-interval", 30*time.Second, "interval to touch -heartbeat-file at")
+	flag.StringVar(&config.StatusKey, "status-key", "", "redis key to publish the status to as JSON with a TTL, {host} is replaced by the host name, e.g. certwatch/status/{host}")
+	flag.DurationVar(&config.StatusInterval, "status-interval", 30*time.Second, "interval to publish -status-key at, the key expires after three intervals")
+	flag.StringVar(&config.Snapshot, "snapshot", "", "tar.gz archive to write all cert files and a manifest to after the first sync and on SIGUSR2")
+	flag.StringVar(&config.AuditLog, "audit-log", "", "file to append a JSON line to for every cert file operation")
+	flag.BoolVar(&config.Check, "check", false, "compare local files against redis, report and exit nonzero if any are out of sync")
+	flag.StringVar(&config.CertbotDir, "certbot-check", "", "certbot live directory to check for certs that can be served from redis, then exit")
+	flag.BoolVar(&config.Doctor, "doctor", false, "check redis, notifications, prefixes, certs, certdir and commands, print a report with hints and exit nonzero on any failure")
+	flag.BoolVar(&config.PrintConfig, "print-config", false, "print the effective configuration as JSON and exit")
+	flag.StringVar(&config.Pidfile, "pidfile", "", "file to write the pid to while running")
+	flag.BoolVar(&config.Force, "force", false, "take over the -pidfile of another running certwatch")
+	flag.BoolVar(&config.Otel, "otel", false, "export traces via OTLP/HTTP, configured by the standard OTEL_* environment variables")
+	flag.StringVar(&config.HealthAddr, "health-addr", "", "listen address for the HTTP status endpoint")
+	flag.BoolVar(&config.HealthTLS, "health-tls", false, "serve -health-addr over TLS with the watched certs, chosen by SNI")
+	flag.StringVar(&config.HealthToken, "health-token", "", "bearer token required for the /certs endpoint of -health-addr")
 	flag.Parse()
-	config.Certs = flag.Args()
+	addCertArgs(flag.Args())
+	if len(config.KeyPrefixes) == 0 {
+		config.KeyPrefixes = stringsFlag{"caddy"}
+	}
+	resolveIssuerCerts()
+	resolvePKICerts()
 	level := new(slog.LevelVar) // Info by default
 	if config.Debug {
 		level.Set(slog.LevelDebug)
+	} else if config.Quiet {
+		level.Set(slog.LevelWarn)
 	}
-	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
+	logger := slog.New(newLogHandler(config.LogFormat, &slog.HandlerOptions{
 		Level: level,
 	}))
 	slog.SetDefault(logger)
-	slog.Debug("config", "config", config)
-	if len(config.RedisUrl) == 0 || len(config.Certs) == 0 {
+	if config.Debug && config.Quiet {
+		slog.Warn("-debug and -quiet both given, -debug wins")
+	}
+	if config.LogFormat != logFormatText && config.LogFormat != logFormatJournal {
+		slog.Error("invalid log format", "logformat", config.LogFormat)
+		os.Exit(1)
+	}
+	err := loadConfigFile()
+	if err != nil {
+		slog.Error("loadConfigFile", "err", err)
+		os.Exit(1)
+	}
+	slog.Debug("config", "config", config.redacted())
+	if config.PrintConfig {
+		err := printConfig()
+		if err != nil {
+			slog.Error("printConfig", "err", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	err = filterNames()
+	if err != nil {
+		slog.Error("invalid name regex", "regex", config.NameRegex, "err", err)
+		os.Exit(1)
+	}
+	if len(config.RedisUrl) == 0 || (len(config.Certs) == 0 && len(config.CertbotDir) == 0 && !config.Doctor && len(config.CertsFromKey) == 0 && len(config.Discover) == 0) {
 		flag.Usage()
 		os.Exit(1)
 	}
-	err := os.MkdirAll(config.CertDir, 0700)
+	slog.Info("watching certs", "count", len(config.Certs), "max", config.MaxCerts)
+	if config.MaxCerts > 0 && len(config.Certs) > config.MaxCerts {
+		slog.Error("too many certs", "count", len(config.Certs), "max", config.MaxCerts)
+		os.Exit(1)
+	}
+	if config.LineEnding != lineEndingLF && config.LineEnding != lineEndingCRLF {
+		slog.Error("invalid line ending", "lineEnding", config.LineEnding)
+		os.Exit(1)
+	}
+	if !slices.Contains([]string{collisionsFirst, collisionsNewest}, config.Collisions) {
+		slog.Error("invalid collision resolution", "collisions", config.Collisions)
+		os.Exit(1)
+	}
+	if len(config.Primary) > 0 && !slices.Contains(config.Certs, config.Primary) {
+		slog.Error("primary cert is not watched", "primary", config.Primary)
+		os.Exit(1)
+	}
+	if config.Oneshot && config.Poll > 0 {
+		slog.Error("-oneshot and -poll cannot be combined")
+		os.Exit(1)
+	}
+	if config.PollSubscribe && config.Poll == 0 {
+		slog.Error("-poll-subscribe needs -poll")
+		os.Exit(1)
+	}
+	err = loadSecretFiles()
+	if err != nil {
+		slog.Error("loadSecretFiles", "err", err)
+		os.Exit(1)
+	}
+	if config.OutP12 && len(config.P12Passphrase) == 0 {
+		slog.Error("-out-p12 needs -p12-passphrase or -p12-passphrase-file")
+		os.Exit(1)
+	}
+	err = checkDiscover()
+	if err != nil {
+		slog.Error("invalid discover pattern", "discover", config.Discover, "err", err)
+		os.Exit(1)
+	}
+	for _, cert := range config.Required {
+		if !slices.Contains(config.Certs, cert) {
+			slog.Error("required cert is not watched", "cert", cert)
+			os.Exit(1)
+		}
+	}
+	if !slices.Contains([]string{orphanKeep, orphanWarn, orphanRemove}, config.OrphanAction) {
+		slog.Error("invalid orphan action", "action", config.OrphanAction)
+		os.Exit(1)
+	}
+	err = checkAllowedCurves()
+	if err != nil {
+		slog.Error("invalid allowed curves", "curves", config.AllowedCurves, "err", err)
+		os.Exit(1)
+	}
+	if config.KeyFormat != keyFormatStored && config.KeyFormat != keyFormatPKCS8 {
+		slog.Error("invalid key format", "format", config.KeyFormat)
+		os.Exit(1)
+	}
+	if _, ok := valueFramings[config.ValueFormat]; !ok {
+		slog.Error("invalid value format", "format", config.ValueFormat)
+		os.Exit(1)
+	}
+	if !slices.Contains(valueEncodings, config.ValueEncoding) {
+		slog.Error("invalid value encoding", "encoding", config.ValueEncoding)
+		os.Exit(1)
+	}
+	err = parseCmds()
+	if err != nil {
+		slog.Error("invalid cmd template", "cmd", config.Cmd, "err", err)
+		os.Exit(1)
+	}
+	err = parseServiceRegex()
 	if err != nil {
-		slog.Error("MkdirAll", "err", err)
+		slog.Error("invalid service regex", "regex", config.ServiceFromName, "err", err)
 		os.Exit(1)
 	}
+	err = parseKeyAllow()
+	if err != nil {
+		slog.Error("invalid key allow pattern", "allow", config.KeyAllow, "err", err)
+		os.Exit(1)
+	}
+	err = parseNameTemplate()
+	if err != nil {
+		slog.Error("invalid name template", "template", config.NameTemplate, "err", err)
+		os.Exit(1)
+	}
+	err = checkNameCollisions()
+	if err != nil {
+		slog.Error("local file names", "err", err)
+		os.Exit(1)
+	}
+	if len(config.VaultRoleID) > 0 && len(config.VaultSecretIDFile) == 0 {
+		slog.Error("-vault-role-id needs -vault-secret-id-file")
+		os.Exit(1)
+	}
+	if len(config.SmtpAddr) > 0 && len(config.SmtpTo) == 0 {
+		slog.Error("-smtp-addr needs at least one -smtp-to")
+		os.Exit(1)
+	}
+	if config.OSStore && anyCompressed() {
+		slog.Error("-compress cannot be combined with -os-store, the os store needs plain PEM files")
+		os.Exit(1)
+	}
+	if config.OSStore && !osStoreSupported {
+		slog.Warn("-os-store is not supported on this platform, ignoring it")
+		config.OSStore = false
+	}
+	err = checkCmdMode()
+	if err != nil {
+		slog.Error("invalid cmd mode", "mode", config.CmdMode, "err", err)
+		os.Exit(1)
+	}
+	err = parsePriority()
+	if err != nil {
+		slog.Error("invalid command priority", "nice", config.CmdNice, "ionice", config.CmdIONice, "err", err)
+		os.Exit(1)
+	}
+	err = parseSftpTargets()
+	if err != nil {
+		slog.Error("parseSftpTargets", "err", err)
+		os.Exit(1)
+	}
+	umask, err := strconv.ParseUint(config.Umask, 8, 32)
+	if err != nil {
+		slog.Error("invalid umask", "umask", config.Umask, "err", err)
+		os.Exit(1)
+	}
+	setUmask(int(umask))
+	if len(config.Roots) > 0 {
+		verifyRoots, err = loadRoots(config.Roots)
+		if err != nil {
+			slog.Error("loadRoots", "err", err)
+			os.Exit(1)
+		}
+	}
 	opt, err := redis.ParseURL(config.RedisUrl)
 	if err != nil {
 		slog.Error("redis.ParseURL", "err", err)
 		os.Exit(1)
 	}
-	client = redis.NewClient(opt)
-	ctx := context.Background()
-	for {
-		slog.Info("listening for cert changes")
-		err = listenRedis(ctx)
+	applyPoolOptions(opt)
+	err = applyTLSOptions(opt)
+	if err != nil {
+		slog.Error("invalid redis TLS options", "err", err)
+		os.Exit(1)
+	}
+	client, err = newClient(opt)
+	if err != nil {
+		slog.Error("newClient", "err", err)
+		os.Exit(1)
+	}
+	readClient = client
+	var ropt *redis.Options
+	if len(config.ReplicaUrl) > 0 {
+		ropt, err = redis.ParseURL(config.ReplicaUrl)
 		if err != nil {
+			slog.Error("redis.ParseURL", "err", err)
+			os.Exit(1)
+		}
+		applyPoolOptions(ropt)
+		err = applyTLSOptions(ropt)
+		if err != nil {
+			slog.Error("invalid redis TLS options", "err", err)
+			os.Exit(1)
+		}
+		readClient = redis.NewClient(ropt)
+	}
+	err = setupSources(ropt)
+	if err != nil {
+		slog.Error("setupSources", "err", err)
+		os.Exit(1)
+	}
+	err = checkSubscriptions()
+	if err != nil {
+		slog.Error("checkSubscriptions", "err", err)
+		os.Exit(1)
+	}
+	added, err := discoverCerts(context.Background())
+	if err != nil {
+		slog.Error("discoverCerts", "err", err)
+		os.Exit(1)
+	}
+	if len(config.Discover) > 0 {
+		slog.Info("discover", "patterns", config.Discover, "found", len(added), "watching", len(config.Certs))
+	}
+	err = loadManagedCerts(context.Background())
+	if err != nil {
+		slog.Error("loadManagedCerts", "err", err)
+		os.Exit(1)
+	}
+	if config.Check {
+		os.Exit(runCheck(context.Background()))
+	}
+	if config.Doctor {
+		os.Exit(runDoctor(context.Background()))
+	}
+	if len(config.CertbotDir) > 0 {
+		os.Exit(runCertbotCheck(context.Background(), config.CertbotDir))
+	}
+	err = runPreCmd(context.Background())
+	if err != nil {
+		slog.Error("pre cmd", "err", err)
+		os.Exit(1)
+	}
+	err = resolveCertDir()
+	if err != nil {
+		slog.Error("resolveCertDir", "err", err)
+		os.Exit(1)
+	}
+	for _, dir := range certDirs() {
+		err = os.MkdirAll(dir, 0700)
+		if err != nil {
+			slog.Error("MkdirAll", "err", err)
+			os.Exit(1)
+		}
+	}
+	err = removeStaleTemps()
+	if err != nil {
+		slog.Error("removeStaleTemps", "err", err)
+		os.Exit(1)
+	}
+	err = loadIssuances()
+	if err != nil {
+		slog.Error("loadIssuances", "err", err)
+		os.Exit(1)
+	}
+	err = loadSeen()
+	if err != nil {
+		slog.Error("loadSeen", "err", err)
+		os.Exit(1)
+	}
+	err = handleOrphans()
+	if err != nil {
+		slog.Error("handleOrphans", "err", err)
+		os.Exit(1)
+	}
+	if len(config.NotifyFifo) > 0 {
+		err = ensureFifo(config.NotifyFifo)
+		if err != nil {
+			slog.Error("ensureFifo", "err", err)
+			os.Exit(1)
+		}
+	}
+	// exitCode is the exit status after the deferred cleanup has run
+	exitCode := 0
+	defer func() {
+		if exitCode != 0 {
+			os.Exit(exitCode)
+		}
+	}()
+	if len(config.Pidfile) > 0 {
+		err = writePidfile(config.Pidfile, config.Force)
+		if err != nil {
+			slog.Error("writePidfile", "err", err)
+			os.Exit(1)
+		}
+		defer removePidfile(config.Pidfile)
+	}
+	if len(config.EnvFile) > 0 {
+		defer os.Remove(config.EnvFile)
+	}
+	state.watch(config.Certs...)
+	handleStatusSignals()
+	handleSnapshotSignals()
+	if len(config.HealthAddr) > 0 {
+		serveHealth(config.HealthAddr)
+	}
+	setupDestinations()
+	if len(config.KVURL) > 0 {
+		store, err := newKVStore(config.KVURL)
+		if err != nil {
+			slog.Error("newKVStore", "err", err)
+			os.Exit(1)
+		}
+		publishKV(store)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if config.Otel {
+		shutdown, err := setupTracing(ctx)
+		if err != nil {
+			slog.Error("setupTracing", "err", err)
+			os.Exit(1)
+		}
+		defer func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			err := shutdown(ctx)
+			if err != nil {
+				slog.Warn("tracing shutdown", "err", err)
+			}
+		}()
+	}
+	sdWatchdog()
+	stopHeartbeat := startHeartbeat(ctx)
+	startAlerts(ctx)
+	startSftp(ctx)
+	publishStatus(ctx)
+	if config.StartupJitter > 0 {
+		d := rand.N(config.StartupJitter)
+		slog.Info("startup jitter", "dur", d)
+		select {
+		case <-clk.After(d):
+		case <-ctx.Done():
+		}
+	}
+	limiter := newReconnectLimiter(config.ReconnectRate, config.ReconnectBurst)
+	for attempt := 0; ctx.Err() == nil; attempt++ {
+		state.beat()
+		if limiter.wait(ctx) != nil {
+			break
+		}
+		if attempt > 0 {
+			limiter.reconnected()
+		}
+		if config.Oneshot {
+			exitCode = syncOnce(ctx)
+			break
+		}
+		slog.Debug("listening for cert changes")
+		err = listenRedis(ctx)
+		if ctx.Err() != nil {
+			break
+		}
+		if errors.Is(err, errClusterRedirect) {
 			slog.Error("listenRedis", "err", err)
+			exitCode = 1
+			break
+		}
+		if err != nil && config.FailFast && !swept {
+			slog.Error("initial sync failed, exiting because of -fail-fast", "err", err)
+			exitCode = 1
+			break
+		}
+		if err != nil {
+			listenFailures++
+			if config.MaxErrors > 0 && listenFailures >= config.MaxErrors {
+				slog.Error("giving up after consecutive redis errors", "errors", listenFailures, "err", err)
+				exitCode = 1
+				break
+			}
+		}
+		if err != nil && redisErrors.Error(err) {
+			slog.Info("sleep after redis error", "dur", config.SleepTime)
+		} else {
+			slog.Debug("sleep after redis error", "dur", config.SleepTime)
+		}
+		select {
+		case <-clk.After(config.SleepTime):
+		case <-ctx.Done():
 		}
-		slog.Info("sleep after redis error", "dur", config.SleepTime)
-		time.Sleep(config.SleepTime)
 	}
+	stopHeartbeat()
+	sdNotify("STOPPING=1")
+	asyncCmds.drain()
+	slog.Info("shutting down")
 }
 
 func listenRedis(ctx context.Context) error {
-	needExec := false
-	for _, i := range config.Certs {
-		didOne, err := handleCert(ctx, i)
+	if config.Poll > 0 && !config.PollSubscribe {
+		return pollRedis(ctx)
+	}
+	if swept {
+		// catch up on the certs created while disconnected
+		_, err := discoverCerts(ctx)
 		if err != nil {
 			return err
 		}
-		if didOne {
-			needExec = true
-		}
 	}
-	if needExec {
-		if len(config.Cmd) > 0 {
-			slog.Info("exec", "cmd", config.Cmd)
-			cmd := exec.Command("sh", "-c", config.Cmd)
-			outerr, err := cmd.CombinedOutput()
-			if err != nil {
-				slog.Error("exec", "err", err, "outerr", string(outerr))
-			}
+	pending := make(map[string]bool)
+	err := initialSync(ctx, pending)
+	if err != nil {
+		return err
+	}
+	err = recheckExpiring(ctx)
+	if err != nil {
+		return err
+	}
+	var patterns []string
+	for _, src := range sources {
+		patterns = append(patterns, src.keyspacePath()+"*")
+	}
+	defer settle.abort(ctx)
+	defer debounce.abort(ctx)
+	slog.Debug("subscribing", "patterns", patterns)
+	var channels []string
+	for cert, keys := range config.CertKeys {
+		_, db := keyedClient(cert)
+		for _, key := range keys {
+			channels = append(channels, keyspaceChannel(db, key))
 		}
 	}
-	keypath := "__keyspace@0__:" + config.KeyPrefix + "/certificates/" + config.AcmeDirName + "/"
-	pubsub := client.PSubscribe(ctx, keypath+"*")
+	if len(channels) > 0 {
+		slog.Debug("subscribing", "channels", channels)
+	}
+	pubsub, err := subscribeKeyspace(ctx, patterns, channels)
+	if err != nil {
+		return err
+	}
 	defer pubsub.Close()
+	redisErrors.Reset()
+	listenFailures = 0
+	slog.Info("listening for cert changes")
+	state.setSubscribed(true)
+	defer state.setSubscribed(false)
+	sdReady()
+	receiveTimeout := config.SleepTime
+	if config.PingInterval > 0 {
+		receiveTimeout = min(receiveTimeout, config.PingInterval)
+	}
+	lastReceived := clk.Now()
+	var pingSent time.Time
+	// recvErrors counts the consecutive failed receives
+	recvErrors := 0
+	// refetch holds the time of the next -refresh-interval fetch per cert
+	refetch := newRefetchSchedule()
+	// nextPoll is the time of the next sync of all certs with
+	// -poll-subscribe
+	nextPoll := clk.Now().Add(config.Poll)
+	// follow batches the changes arriving during a command run
+	var follow followUp
+	defer follow.flush(ctx)
 	for {
-		msg, err := pubsub.ReceiveMessage(ctx)
+		state.beat()
+		var changed []string
+		if certDirReturned() {
+			slog.Info("certdir available again, reconciling all certs", "certdir", config.CertDir)
+			for _, i := range config.Certs {
+				pending[i] = true
+			}
+		}
+		added, removed := refreshManagedCerts(ctx)
+		for _, i := range added {
+			pending[i] = true
+			refetch.add(i)
+		}
+		for _, i := range removed {
+			delete(pending, i)
+			delete(refetch, i)
+		}
+		if len(pending) > 0 && !diskBlocked() {
+			for i := range pending {
+				didOne, err := handleCert(ctx, i)
+				state.synced(i, didOne, err)
+				if err != nil {
+					if errors.Is(err, errClusterRedirect) {
+						return err
+					}
+					slog.Error("handleCert", "err", err)
+					if isDiskFault(err) {
+						break
+					}
+					continue
+				}
+				delete(pending, i)
+				if didOne {
+					changed = append(changed, i)
+				}
+			}
+		}
+		for _, i := range refetch.due() {
+			didOne, err := handleCert(ctx, i)
+			state.synced(i, didOne, err)
+			if err != nil {
+				if errors.Is(err, errClusterRedirect) {
+					return err
+				}
+				if isDiskFault(err) {
+					pending[i] = true
+				}
+				slog.Error("periodic refresh", "cert", i, "err", err)
+				continue
+			}
+			if didOne {
+				slog.Warn("periodic refresh changed files, a notification was probably missed", "cert", i)
+				changed = append(changed, i)
+			}
+		}
+		if config.Poll > 0 && !clk.Now().Before(nextPoll) {
+			_, err := discoverCerts(ctx)
+			if err != nil {
+				return err
+			}
+			err = initialSync(ctx, pending)
+			if err != nil {
+				return err
+			}
+			nextPoll = clk.Now().Add(config.Poll)
+		}
+		if config.PingInterval > 0 {
+			if !pingSent.IsZero() && clk.Now().Sub(pingSent) > config.PingInterval {
+				return errors.New("no reply to ping, subscription lost")
+			}
+			if pingSent.IsZero() && clk.Now().Sub(lastReceived) >= config.PingInterval {
+				err := pubsub.Ping(ctx)
+				if err != nil {
+					return err
+				}
+				pingSent = clk.Now()
+			}
+		}
+		timeout := receiveTimeout
+		for r, at := range expiring {
+			wait := at.Sub(clk.Now())
+			if wait <= 0 {
+				removeCert(r.cert, r.suf)
+				delete(expiring, r)
+				continue
+			}
+			timeout = min(timeout, wait)
+		}
+		timeout = follow.timeout(timeout)
+		if config.Poll > 0 {
+			timeout = min(timeout, max(nextPoll.Sub(clk.Now()), time.Millisecond))
+		}
+		if wait, ok := refetch.remaining(); ok {
+			timeout = min(timeout, wait)
+		}
+		if wait, ok := settle.remaining(); ok {
+			timeout = min(timeout, wait)
+		}
+		if wait, ok := debounce.remaining(); ok {
+			timeout = min(timeout, wait)
+		}
+		m, err := pubsub.ReceiveTimeout(ctx, timeout)
 		if err != nil {
-			return err
+			if errors.Is(err, errClusterChanged) {
+				return err
+			}
+			var nerr net.Error
+			if !errors.As(err, &nerr) || !nerr.Timeout() {
+				// the pubsub reconnects and resubscribes on the next
+				// receive, so retry in place before giving up
+				recvErrors++
+				if ctx.Err() != nil || recvErrors > config.ReceiveRetries {
+					return err
+				}
+				delay := min(time.Second<<(recvErrors-1), config.SleepTime)
+				slog.Warn("receive failed, recovering subscription", "err", err, "try", recvErrors, "dur", delay)
+				state.setSubscribed(false)
+				select {
+				case <-clk.After(delay):
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+				continue
+			}
+			// a receive does not return early on shutdown, it times out
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			m = nil
+		} else {
+			lastReceived = clk.Now()
+			pingSent = time.Time{}
 		}
-		needExec := false
-		key := strings.TrimPrefix(msg.Channel, keypath)
-		slog.Debug("msg", "key", key, "payload", msg.Payload)
-		for _, i := range config.Certs {
-			if strings.HasPrefix(key, i) {
+		// a message or a clean timeout after failed receives means the
+		// pubsub reconnected and resubscribed, an idle subscription must
+		// not wait for its next event to catch up
+		if recvErrors > 0 {
+			slog.Info("subscription recovered", "tries", recvErrors)
+			recvErrors = 0
+			state.setSubscribed(true)
+			// catch up on the events missed during the gap
+			err = initialSync(ctx, pending)
+			if err != nil {
+				return err
+			}
+			err = recheckExpiring(ctx)
+			if err != nil {
+				return err
+			}
+		}
+		bctx := ctx
+		var span trace.Span
+		msg, ok := m.(*redis.Message)
+		if ok {
+			certs, suf := eventTargets(msg.Channel)
+			if len(certs) == 0 {
+				certs, suf = discoverTarget(msg.Channel, msg.Payload)
+				for _, i := range certs {
+					refetch.add(i)
+				}
+			}
+			slog.Debug("msg", "channel", msg.Channel, "redisKey", channelKey(msg.Channel), "payload", msg.Payload, "certs", certs, "suffix", suf)
+			if len(certs) > 0 {
+				bctx, span = tracer.Start(ctx, "batch", trace.WithAttributes(
+					attribute.String("channel", msg.Channel),
+					attribute.String("event", msg.Payload),
+				))
+			}
+			for _, i := range certs {
+				debounce.touch()
 				switch msg.Payload {
-				case "evicted":
-					fallthrough
-				case "expired":
-					fallthrough
-				case "del":
-					fname := path.Join(config.CertDir, i+path.Ext(key))
-					err := os.Remove(fname)
-					if err != nil {
-						slog.Error("Remove", "err", err)
+				case "evicted", "expired", "del", "move_from":
+					if msg.Payload == "evicted" && !config.DeleteOnEvict {
+						slog.Warn("key evicted by redis, keeping the local file, check maxmemory and maxmemory-policy", "cert", i, "suffix", suf, "file", localPath(i, suf))
+						continue
+					}
+					if msg.Payload == "expired" && config.ExpireGrace > 0 {
+						slog.Info("removal scheduled", "cert", i, "suffix", suf, "grace", config.ExpireGrace)
+						expiring[graceRemoval{i, suf}] = clk.Now().Add(config.ExpireGrace)
+						continue
+					}
+					removeCert(i, suf)
+				case "set", "copy_to", "move_to":
+					if _, ok := expiring[graceRemoval{i, suf}]; ok {
+						slog.Info("removal cancelled", "cert", i, "suffix", suf)
+						delete(expiring, graceRemoval{i, suf})
 					}
-				case "set":
-					didOne, err := handleCert(ctx, i)
+					didOne, err := handleCert(bctx, i)
+					state.synced(i, didOne, err)
 					if err != nil {
-						slog.Error("handleCert", "err", err)
+						if errors.Is(err, errClusterRedirect) {
+							return err
+						}
+						if isDiskFault(err) {
+							pending[i] = true
+						}
+						if errors.Is(err, errDiskBackoff) {
+							slog.Debug("handleCert", "cert", i, "err", err)
+						} else {
+							slog.Error("handleCert", "err", err)
+						}
 						continue
 					}
+					delete(pending, i)
 					if didOne {
-						needExec = true
+						changed = append(changed, i)
 					}
 				default:
 					slog.Warn("unhandled message", "msg", msg)
 				}
 			}
 		}
-		if needExec {
-			if len(config.Cmd) > 0 {
-				slog.Info("exec", "cmd", config.Cmd)
-				cmd := exec.Command("sh", "-c", config.Cmd)
-				outerr, err := cmd.CombinedOutput()
-				if err != nil {
-					slog.Error("exec", "err", err, "outerr", string(outerr))
+		if len(changed) > 0 {
+			switch {
+			case settle.active():
+				settle.hold(changed)
+			case config.Debounce > 0:
+				debounce.hold(changed)
+			case follow.draining:
+				follow.hold(changed)
+			default:
+				certsChanged(bctx, changed)
+				follow.ran()
+			}
+		}
+		if held := settle.due(); len(held) > 0 {
+			certsChanged(bctx, held)
+			follow.ran()
+		}
+		if held := debounce.due(); len(held) > 0 {
+			certsChanged(bctx, held)
+			follow.ran()
+		}
+		if held := follow.done(m != nil); len(held) > 0 {
+			slog.Info("follow-up command for the changes during the last run", "changed", held)
+			certsChanged(bctx, held)
+			follow.ran()
+		}
+		if span != nil {
+			span.End()
+		}
+	}
+}
+
+// graceRemoval is a cert file whose removal was deferred by -expire-grace.
+type graceRemoval struct {
+	cert string
+	suf  string
+}
+
+// expiring holds the removals deferred by -expire-grace with the time they
+// are due. It outlives the subscription, so the removals pending when the
+// connection drops are done after reconnecting.
+var expiring = make(map[graceRemoval]time.Time)
+
+// recheckExpiring cancels the deferred removals whose key exists again, as
+// the event setting it may have been missed while disconnected.
+func recheckExpiring(ctx context.Context) error {
+	for r := range expiring {
+		_, _, _, err := getValue(ctx, r.cert, r.suf)
+		if errors.Is(err, redis.Nil) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		slog.Info("removal cancelled, key set again", "cert", r.cert, "suffix", r.suf)
+		delete(expiring, r)
+	}
+	return nil
+}
+
+// removeCertFile removes the local file of cert with the given suffix after
+// its key was removed from redis.
+func removeCertFile(cert string, suf string) {
+	fname := localPath(cert, suf)
+	finfo, err := os.Lstat(fname)
+	if err == nil && finfo.Mode()&fs.ModeSymlink != 0 && !config.FollowSymlinks {
+		slog.Error("Remove", "err", &fs.PathError{Op: "remove", Path: fname, Err: errSymlink})
+		return
+	}
+	err = os.Remove(fname)
+	if errors.Is(err, fs.ErrNotExist) {
+		// caddy deleted a file we never had or already removed
+		slog.Debug("Remove", "err", err)
+	} else if err != nil {
+		slog.Error("Remove", "err", err)
+	} else {
+		audit(cert, fname, auditDelete, nil, "")
+		emitEvent(changeEvent{Cert: cert, Action: eventRemoved, Files: []string{fname}})
+		if suf == ".crt" {
+			updateBundle()
+			removeExploded(cert, 0)
+		}
+		removeOutputs(cert)
+		removePrimary(cert, suf)
+	}
+}
+
+// initialSync runs handleCert for all watched certs and the command if
+// any of them changed. Certs that could not be written because CertDir is
+// unavailable are added to pending. With -sweep-retries, certs that failed
+// are retried with backoff, those still failing afterwards are added to
+// pending as well instead of failing the sweep. It runs at start and again
+// after every reconnect to catch up on the events missed meanwhile.
+func initialSync(ctx context.Context, pending map[string]bool) (err error) {
+	ctx, span := tracer.Start(ctx, "sweep")
+	defer func() { endSpan(span, err) }()
+	ctx = withPrefetch(ctx, config.Certs)
+	var changed []string
+	failed := make(map[string]error)
+	certs := config.Certs
+	delay := config.SweepRetryDelay
+	for try := 0; ; try++ {
+		for _, i := range certs {
+			didOne, err := handleCert(ctx, i)
+			state.synced(i, didOne, err)
+			delete(failed, i)
+			if err != nil {
+				switch {
+				case errors.Is(err, errClusterRedirect):
+					return err
+				case isDiskFault(err):
+					pending[i] = true
+				case errors.Is(err, errRejected), errors.Is(err, errCollision), errors.Is(err, errKeyNotAllowed),
+					errors.Is(err, errDecode) && !config.StrictDecode:
+					slog.Error("handleCert", "err", err)
+				default:
+					if config.SweepRetries == 0 {
+						return err
+					}
+					slog.Warn("handleCert", "err", err, "try", try)
+					failed[i] = err
 				}
 			}
+			if didOne {
+				changed = append(changed, i)
+			}
+		}
+		if len(failed) == 0 || try >= config.SweepRetries {
+			break
+		}
+		certs = certs[:0:0]
+		for i := range failed {
+			certs = append(certs, i)
+		}
+		slices.Sort(certs)
+		slog.Info("retrying failed certs", "certs", certs, "delay", delay)
+		select {
+		case <-clk.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		delay *= 2
+	}
+	if config.SweepRetries > 0 {
+		slog.Info("initial sync", "ok", len(config.Certs)-len(failed), "failed", len(failed))
+	}
+	if !swept {
+		err = checkRequired()
+		if err != nil && config.FailFast {
+			return err
+		}
+	}
+	initial := !swept
+	swept = true
+	if initial {
+		defer snapshot()
+		updateBundle()
+		settle.start()
+	}
+	if !initial && config.Poll > 0 {
+		slog.Debug("poll", "checked", len(config.Certs), "changed", changed, "failed", len(failed))
+	} else if !initial {
+		slog.Info("reconciliation after reconnect", "checked", len(config.Certs), "changed", changed, "failed", len(failed))
+	}
+	if len(changed) > 0 {
+		if initial && config.NoInitialCmd {
+			slog.Info("initial command suppressed", "changed", changed)
+			state.beat()
+			notifyFifo(changed)
+		} else if settle.active() {
+			settle.hold(changed)
+		} else {
+			certsChanged(ctx, changed)
+		}
+	}
+	// the sweep is done, leave the remaining failures to the listen loop
+	for i, err := range failed {
+		slog.Error("initial sync failed", "cert", i, "err", err)
+		pending[i] = true
+	}
+	return nil
+}
+
+// swept is set once the first initial sync since the start is done.
+var swept bool
+
+// certsChanged is called once for each batch of changed certs.
+func certsChanged(ctx context.Context, changed []string) {
+	updateBundle()
+	uploadSftp(changed)
+	updateOSStore(ctx, changed)
+	if config.CmdAsync {
+		asyncCmds.enqueue(ctx, changed)
+	} else {
+		runCmd(ctx, changed)
+	}
+	state.beat()
+	notifyFifo(changed)
+}
+
+// eventTargets returns the watched certs affected by a keyspace
+// notification on channel, together with the suffix of the affected cert
+// file.
+func eventTargets(channel string) ([]string, string) {
+	for cert, keys := range config.CertKeys {
+		_, db := keyedClient(cert)
+		for suf, key := range keys {
+			if channel == keyspaceChannel(db, key) {
+				return []string{cert}, suf
+			}
+		}
+	}
+	for _, src := range sources {
+		keypath := src.keyspacePath()
+		if !strings.HasPrefix(channel, keypath) {
+			continue
+		}
+		key := strings.TrimPrefix(channel, keypath)
+		cert, file, ok := strings.Cut(key, "/")
+		if !ok || !slices.Contains(config.Certs, cert) {
+			return nil, ""
+		}
+		if _, ok := config.CertKeys[cert]; ok {
+			return nil, ""
+		}
+		suf := strings.TrimPrefix(file, cert)
+		if file != cert+suf || !slices.Contains(certSuffixes, suf) {
+			// lock, metadata and other bookkeeping keys of the cert
+			slog.Debug("ignoring key", "key", key, "redisKey", certPath(src.prefix)+key, "channel", channel)
+			return nil, ""
+		}
+		return []string{cert}, suf
+	}
+	return nil, ""
+}
+
+// fetchValue fetches and decodes the cert file with the given suffix.
+func fetchValue(ctx context.Context, cert string, suf string) ([]byte, time.Time, error) {
+	val, key, c, err := getValue(ctx, cert, suf)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	data, modified, err := framing().unframe(val)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("%w: %s: %w", errDecode, key, err)
+	}
+	data, err = followRefs(ctx, c, key, data)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	slog.Debug("fetched", "cert", cert, "suffix", suf, "redisKey", key, "db", clientDB(c), "size", len(data), "modified", modified)
+	return data, modified, nil
+}
+
+// retryParse re-fetches the cert a bounded number of times while its leaf
+// does not parse. This covers reading a value while it is being rewritten,
+// the next value fetched is usually complete. If the leaf still does not
+// parse after all retries the last value fetched is returned.
+func retryParse(ctx context.Context, cert string, data []byte, modified time.Time) ([]byte, time.Time, error) {
+	_, err := parseLeaf(data)
+	if err == nil {
+		return data, modified, nil
+	}
+	for try := 1; try <= config.ParseRetries; try++ {
+		slog.Warn("leaf does not parse, retrying", "cert", cert, "try", try, "err", err)
+		select {
+		case <-clk.After(config.ParseRetryDelay):
+		case <-ctx.Done():
+			return nil, time.Time{}, ctx.Err()
+		}
+		data, modified, err = fetchValue(ctx, cert, ".crt")
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		_, err = parseLeaf(data)
+		if err == nil {
+			slog.Info("leaf parsed after retry", "cert", cert, "try", try)
+			return data, modified, nil
 		}
 	}
+	slog.Warn("leaf does not parse, giving up", "cert", cert, "err", err)
+	return data, modified, nil
 }
 
-func handleCert(ctx context.Context, cert string) (bool, error) {
-	didOne := false
-	for _, suf := range []string{".key", ".crt"} {
-		var value struct {
-			Value    []byte
-			Modified time.Time
+// certSuffixes are the cert files mirrored for each cert.
+var certSuffixes = []string{".key", ".crt"}
+
+// expectedSuffixes returns the suffixes of the files cert must have in
+// redis: those with an explicit key for certs like the -pki-ca ones, which
+// have no key unless -pki-keys is given, and all certSuffixes otherwise.
+func expectedSuffixes(cert string) []string {
+	keys, ok := config.CertKeys[cert]
+	if !ok {
+		return certSuffixes
+	}
+	var sufs []string
+	for _, suf := range certSuffixes {
+		if _, ok := keys[suf]; ok {
+			sufs = append(sufs, suf)
+		}
+	}
+	return sufs
+}
+
+// localPath returns the local file name for the cert file with the given
+// suffix.
+func localPath(cert string, suf string) string {
+	return path.Join(certDir(cert), localName(cert)+localSuffix(cert, suf))
+}
+
+// upToDate reports whether the local file already holds the given value,
+// judged by its modification time and size, or by its contents for values
+// without a modification time.
+func upToDate(fname string, data []byte, modified time.Time) (bool, error) {
+	finfo, err := os.Stat(fname)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return false, nil
+		}
+		return false, err
+	}
+	size := finfo.Size()
+	if strings.HasSuffix(fname, compressSuffix) {
+		// compare against the decompressed size, a file that does not
+		// decompress is rewritten
+		current, err := readLocal(fname)
+		if err != nil {
+			return false, nil
+		}
+		size = int64(len(current))
+	}
+	if modified.IsZero() {
+		// no modification time stored, compare the contents
+		slog.Debug("no modification time stored, comparing contents", "file", fname)
+		if size != int64(len(data)) {
+			return false, nil
 		}
-		fname := path.Join(config.CertDir, cert+suf)
-		key := config.KeyPrefix + "/certificates/" + config.AcmeDirName + "/" + cert + "/" + cert + suf
-		val, err := client.Get(ctx, key).Result()
+		return sameContents(fname, data)
+	}
+	return finfo.ModTime().Equal(modified) && size == int64(len(data)), nil
+}
+
+// sameContents reports whether fname holds exactly data, after decompressing
+// it.
+func sameContents(fname string, data []byte) (bool, error) {
+	current, err := readLocal(fname)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(current, data), nil
+}
+
+// certFile is one file of a cert as fetched from redis.
+type certFile struct {
+	suffix   string
+	fname    string
+	data     []byte
+	modified time.Time
+}
+
+// stagedFile is a cert file written to a temporary file, waiting to be
+// renamed into place.
+type stagedFile struct {
+	certFile
+	tmpname string
+	action  string
+	// refresh is set for a file that is rewritten unchanged because of
+	// -always-refresh.
+	refresh bool
+}
+
+// refreshed holds the certs written since certwatch started, see
+// -always-refresh.
+var refreshed sync.Map
+
+// needsRefresh reports whether cert has to be written even if the local
+// files look current.
+func needsRefresh(cert string) bool {
+	if !config.AlwaysRefresh {
+		return false
+	}
+	_, ok := refreshed.Load(cert)
+	return !ok
+}
+
+// errRejected marks a cert that was fetched but failed validation and was
+// therefore not installed.
+var errRejected = errors.New("cert rejected")
+
+// fetchCert fetches all files of the cert that are present in redis.
+func fetchCert(ctx context.Context, cert string) ([]certFile, error) {
+	var files []certFile
+	for _, suf := range certSuffixes {
+		data, modified, err := fetchValue(ctx, cert, suf)
 		if err != nil {
 			if errors.Is(err, redis.Nil) {
 				continue
 			}
-			return false, err
+			return nil, err
+		}
+		if suf == ".crt" {
+			data, modified, err = retryParse(ctx, cert, data, modified)
+			if err != nil {
+				return nil, err
+			}
+		}
+		files = append(files, certFile{
+			suffix:   suf,
+			fname:    localPath(cert, suf),
+			data:     data,
+			modified: modified,
+		})
+	}
+	nameIssuance(cert, files)
+	return files, nil
+}
+
+// validateCert checks the fetched files before any of them is installed.
+func validateCert(cert string, files []certFile) error {
+	for _, f := range files {
+		if config.MaxValueSize > 0 && len(f.data) > config.MaxValueSize {
+			return fmt.Errorf("%w: %s%s: %d bytes exceed -max-value-size %d", errRejected, cert, f.suffix, len(f.data), config.MaxValueSize)
+		}
+		err := checkBlocks(f.suffix, f.data)
+		if err != nil {
+			return fmt.Errorf("%w: %s%s: %w", errRejected, cert, f.suffix, err)
+		}
+		if f.suffix == ".crt" && config.VerifyChain {
+			err := verifyChain(f.data)
+			if err != nil {
+				return fmt.Errorf("%w: %s: chain verification: %w", errRejected, cert, err)
+			}
+		}
+		if f.suffix == ".key" {
+			err := checkKeyPolicy(f.data)
+			if err != nil {
+				return fmt.Errorf("%w: %s: key policy: %w", errRejected, cert, err)
+			}
+		}
+	}
+	err := checkKeyMatch(files)
+	if err != nil {
+		return fmt.Errorf("%w: %s: %w", errRejected, cert, err)
+	}
+	return nil
+}
+
+// prepareCert fetches, decrypts and validates the files of the cert and
+// converts them to the configured output format, ready to be compared
+// against and written to the local files.
+func prepareCert(ctx context.Context, cert string) ([]certFile, error) {
+	files, err := fetchCert(ctx, cert)
+	if err != nil {
+		return nil, err
+	}
+	err = decryptKeys(cert, files)
+	if err != nil {
+		return nil, err
+	}
+	err = validateCert(cert, files)
+	if err != nil {
+		return nil, err
+	}
+	for i := range files {
+		err = transformFile(cert, &files[i])
+		if err != nil {
+			return nil, fmt.Errorf("%s%s: %w", cert, files[i].suffix, err)
+		}
+	}
+	return files, nil
+}
+
+// transformFile converts a fetched file to the configured output format.
+func transformFile(cert string, f *certFile) error {
+	if f.suffix == ".crt" && config.FixChain {
+		data, changed, err := fixChain(f.data)
+		if err != nil {
+			return err
+		}
+		if changed {
+			slog.Info("fixed chain order", "cert", cert, "blocks", len(certBlocks(f.data)), "kept", len(certBlocks(data)))
+			f.data = data
+		}
+	}
+	if f.suffix == ".key" && config.KeyFormat == keyFormatPKCS8 {
+		data, err := toPKCS8(f.data)
+		if err != nil {
+			return err
+		}
+		f.data = data
+	}
+	if f.suffix == ".key" && len(config.OutPassphrase) > 0 {
+		data, err := encryptKey(f.data, f.fname, []byte(config.OutPassphrase))
+		if err != nil {
+			return err
+		}
+		f.data = data
+	}
+	var err error
+	if config.LineEnding == lineEndingCRLF {
+		f.data, err = reencodePEM(f.data, true)
+	}
+	return err
+}
+
+// validateStaged runs -stage-cmd against the staged files of cert. Files
+// that did not change are passed with their live path. The files of a
+// compressed cert are passed as uncompressed copies instead.
+func validateStaged(ctx context.Context, cert string, staged []stagedFile) error {
+	if stageCmd == nil {
+		return nil
+	}
+	paths := map[string]string{
+		".key": localPath(cert, ".key"),
+		".crt": localPath(cert, ".crt"),
+	}
+	for _, sf := range staged {
+		paths[sf.suffix] = sf.tmpname
+	}
+	if compressed(cert) {
+		files := make(map[string][]byte)
+		for suf, fname := range paths {
+			data, err := readLocal(fname)
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			files[suf] = data
+		}
+		plain, cleanup, err := plainFiles(cert, files)
+		if err != nil {
+			return err
+		}
+		defer cleanup()
+		paths = plain
+	}
+	err := stageCmd.validate(ctx, cert, paths[".key"], paths[".crt"])
+	if err != nil {
+		return fmt.Errorf("%w: %s: stage-cmd: %w", errRejected, cert, err)
+	}
+	return nil
+}
+
+func handleCert(ctx context.Context, cert string) (didOne bool, err error) {
+	defer certLocks.Lock(cert)()
+	ctx, span := tracer.Start(ctx, "handleCert", trace.WithAttributes(attribute.String("cert", cert)))
+	written := 0
+	defer func() {
+		span.SetAttributes(attribute.Int("bytes", written), attribute.Bool("changed", didOne))
+		endSpan(span, err)
+	}()
+	files, err := prepareCert(ctx, cert)
+	if err != nil {
+		return false, err
+	}
+	// Stage all changed files first and rename them back to back afterwards,
+	// key before cert, to keep the window in which a reader sees a new key
+	// with an old cert or vice versa as short as possible.
+	var staged []stagedFile
+	defer func() {
+		for _, sf := range staged {
+			if len(sf.tmpname) > 0 {
+				os.Remove(sf.tmpname)
+			}
 		}
-		val = strings.TrimPrefix(val, config.ValuePrefix)
-		err = json.Unmarshal([]byte(val), &value)
+	}()
+	err = checkCertDir()
+	if err != nil {
+		if diskBlocked() {
+			return false, errDiskBackoff
+		}
+		diskFault(err)
+		return false, err
+	}
+	refresh := needsRefresh(cert)
+	for _, f := range files {
+		f.fname, err = resolveTarget(f.fname)
 		if err != nil {
 			return false, err
 		}
-		finfo, err := os.Stat(fname)
-		if err == nil && finfo.ModTime() == value.Modified && finfo.Size() == int64(len(value.Value)) {
-			continue
-		} else if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		err = prepareTarget(f.fname)
+		if err != nil {
 			return false, err
 		}
-		f, err := os.OpenFile(fname, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		current, err := upToDate(f.fname, f.data, f.modified)
 		if err != nil {
 			return false, err
 		}
-		n, err := f.Write(value.Value)
-		if n != len(value.Value) {
-			f.Close()
+		if current && config.VerifyOnStart && !swept {
+			current, err = sameContents(f.fname, f.data)
+			if err != nil {
+				return false, err
+			}
+			if !current {
+				slog.Warn("local file differs from redis, rewriting", "cert", cert, "file", f.fname)
+			}
+		}
+		slog.Debug("compared", "cert", cert, "file", f.fname, "size", len(f.data), "modified", f.modified, "current", current, "refresh", refresh)
+		if current && !refresh {
+			continue
+		}
+		if diskBlocked() {
+			return false, errDiskBackoff
+		}
+		action := writeAction(f.fname)
+		if f.suffix == ".crt" && action != auditCreate && !current {
+			diffCert(cert, f.fname, f.data)
+		}
+		ondisk := f.data
+		if compressed(cert) {
+			ondisk, err = gzipData(f.data)
+			if err != nil {
+				return false, err
+			}
+		}
+		tmpname, err := stageFile(f.fname, ondisk, f.modified)
+		if err != nil {
+			if isDiskFault(err) {
+				diskFault(err)
+			}
 			return false, err
 		}
-		err = f.Close()
+		staged = append(staged, stagedFile{certFile: f, tmpname: tmpname, action: action, refresh: current})
+		err = applyTarget(cert, tmpname)
 		if err != nil {
 			return false, err
 		}
-		err = os.Chtimes(fname, value.Modified, value.Modified)
+	}
+	if len(staged) > 0 {
+		diskRecovered()
+		err = validateStaged(ctx, cert, staged)
 		if err != nil {
 			return false, err
 		}
+	}
+	// installed is the fingerprint of the new leaf, if the crt changed
+	var installed string
+	for i := range staged {
+		f := &staged[i]
+		if f.action == auditModify && !f.refresh {
+			keepBackup(f.fname)
+		}
+		err = os.Rename(f.tmpname, f.fname)
+		if err != nil {
+			return didOne, err
+		}
+		f.tmpname = ""
+		if f.suffix == ".key" {
+			err = checkKeyMode(f.fname, keyMode(cert))
+			if err != nil {
+				return didOne, err
+			}
+		}
+		written += len(f.data)
+		applyFileContext(f.fname)
+		var fingerprint string
+		if f.suffix == ".crt" {
+			leaf, chain, err := fingerprints(f.data)
+			if err != nil {
+				slog.Warn("fingerprint", "cert", cert, "err", err)
+			} else {
+				slog.Info("installed", "cert", cert, "fingerprint", leaf, "chainFingerprint", chain)
+				state.setFingerprint(cert, leaf, chain)
+				fingerprint = leaf
+				installed = leaf
+			}
+		}
+		audit(cert, f.fname, f.action, f.data, fingerprint)
 		didOne = true
 	}
+	if didOne {
+		ev := changeEvent{Cert: cert, Action: eventCreated}
+		for _, f := range staged {
+			ev.Files = append(ev.Files, f.fname)
+			if f.action != auditCreate {
+				ev.Action = eventUpdated
+			}
+		}
+		ev.Fingerprint = installed
+		emitEvent(ev)
+	}
+	if nameUsesIssuance {
+		issuances.Store(cert, issuanceFrom(cert, files))
+		if didOne {
+			pruneIssuances(cert)
+		}
+	}
+	notifyChange(cert, files, staged)
+	writeDestinations(cert, files, len(staged) > 0)
+	for _, f := range staged {
+		if f.suffix == ".crt" {
+			checkMetadata(ctx, cert, f.data)
+		}
+	}
+	if didOne {
+		firstSight(ctx, cert)
+	}
+	// staged is in key, crt order, so the key hook runs first. A file
+	// rewritten unchanged by -always-refresh does not run its hook.
+	for _, f := range staged {
+		if f.refresh {
+			continue
+		}
+		runFileHook(ctx, cert, f.suffix, f.fname, f.data)
+	}
+	if refresh {
+		refreshed.Store(cert, true)
+	}
 	return didOne, nil
 }
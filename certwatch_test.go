@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+func TestInitialSyncDecodeErrors(t *testing.T) {
+	useTestConfig(t)
+	oldSwept := swept
+	defer func() { swept = oldSwept }()
+	good, other := newTestVersion(t), newTestVersion(t)
+	values := map[string]string{
+		certKey("good.example.com", ".key"):  storedValue(string(good.key), 1),
+		certKey("good.example.com", ".crt"):  storedValue(string(good.crt), 1),
+		certKey("other.example.com", ".key"): storedValue(string(other.key), 1),
+		certKey("other.example.com", ".crt"): storedValue(string(other.crt), 1),
+		certKey("bad.example.com", ".key"):   "{not json",
+		certKey("bad.example.com", ".crt"):   `{"Value": 42}`,
+	}
+	tests := []struct {
+		name   string
+		strict bool
+		err    error
+		// written are the certs whose files must be written
+		written []string
+	}{
+		{"skip", false, nil, []string{"good.example.com", "other.example.com"}},
+		{"strict", true, errDecode, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.CertDir = t.TempDir()
+			useFakeRedis(t, values)
+			config.Certs = []string{"bad.example.com", "good.example.com", "other.example.com"}
+			config.StrictDecode = tt.strict
+			swept = true
+			err := initialSync(context.Background(), make(map[string]bool))
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("got error %v, want %v", err, tt.err)
+			}
+			for _, cert := range tt.written {
+				for _, suf := range certSuffixes {
+					_, err := os.Stat(localPath(cert, suf))
+					if err != nil {
+						t.Errorf("%s%s not written: %v", cert, suf, err)
+					}
+				}
+			}
+			for _, suf := range certSuffixes {
+				_, err := os.Stat(localPath("bad.example.com", suf))
+				if err == nil {
+					t.Errorf("bad.example.com%s written", suf)
+				}
+			}
+		})
+	}
+}
+
+// waitFor polls cond until it holds or a few seconds passed.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestListenCopy(t *testing.T) {
+	useTestConfig(t)
+	oldSwept := swept
+	defer func() { swept = oldSwept }()
+	swept = false
+	config.SleepTime = 50 * time.Millisecond
+	config.Certs = []string{"www.example.com", "api.example.com"}
+	v := newTestVersion(t)
+	staged := func(suf string) string {
+		return "staging/" + suf
+	}
+	r := useFakeRedis(t, map[string]string{
+		staged(".key"): storedValue(string(v.key), 1),
+		staged(".crt"): storedValue(string(v.crt), 1),
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- listenRedis(ctx) }()
+	defer func() {
+		cancel()
+		<-done
+	}()
+	waitFor(t, "the subscription", func() bool {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		return len(r.subscribers) > 0
+	})
+	c := redis.NewClient(&redis.Options{Addr: client.(*redis.Client).Options().Addr, Protocol: 2, DisableIndentity: true})
+	defer c.Close()
+	tests := []struct {
+		name string
+		cert string
+		// watched tells whether the copy must be mirrored
+		watched bool
+	}{
+		{"watched", "www.example.com", true},
+		{"another watched", "api.example.com", true},
+		{"unwatched", "other.example.com", false},
+	}
+	for _, tt := range tests {
+		for _, suf := range certSuffixes {
+			ok, err := c.Copy(ctx, staged(suf), certKey(tt.cert, suf), 0, false).Result()
+			if err != nil || ok != 1 {
+				t.Fatalf("%s: COPY %s: %d, %v", tt.name, suf, ok, err)
+			}
+		}
+		if !tt.watched {
+			continue
+		}
+		want := map[string][]byte{".key": v.key, ".crt": v.crt}
+		for _, suf := range certSuffixes {
+			waitFor(t, tt.cert+suf, func() bool {
+				data, err := os.ReadFile(localPath(tt.cert, suf))
+				return err == nil && bytes.Equal(data, want[suf])
+			})
+		}
+	}
+	// the unwatched copy has been handled once the subscription is idle
+	time.Sleep(2 * config.SleepTime)
+	for _, suf := range certSuffixes {
+		_, err := os.Stat(localPath("other.example.com", suf))
+		if err == nil {
+			t.Errorf("unwatched cert other.example.com%s written", suf)
+		}
+	}
+}
+
+func TestMaxValueSize(t *testing.T) {
+	useTestConfig(t)
+	const cert = "www.example.com"
+	old, renewed := newTestVersion(t), newTestVersion(t)
+	size := len(renewed.crt)
+	tests := []struct {
+		name  string
+		limit int
+		// installed tells whether renewed must be installed over old
+		installed bool
+	}{
+		{"over the limit", size - 1, false},
+		{"at the limit", size, true},
+		{"no limit", 0, true},
+	}
+	for _, tt := range tests {
+		config.CertDir = t.TempDir()
+		config.MaxValueSize = 0
+		_, err := handleCert(withValues(context.Background(), cert, old, 1), cert)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config.MaxValueSize = tt.limit
+		_, err = handleCert(withValues(context.Background(), cert, renewed, 2), cert)
+		if tt.installed && err != nil || !tt.installed && !errors.Is(err, errRejected) {
+			t.Errorf("%s: got error %v", tt.name, err)
+		}
+		want := old
+		if tt.installed {
+			want = renewed
+		}
+		for suf, data := range map[string][]byte{".key": want.key, ".crt": want.crt} {
+			got, err := os.ReadFile(localPath(cert, suf))
+			if err != nil || !bytes.Equal(got, data) {
+				t.Errorf("%s: %s does not hold the expected version: %v", tt.name, suf, err)
+			}
+		}
+	}
+}
+
+func TestZeroModified(t *testing.T) {
+	useTestConfig(t)
+	const cert = "www.example.com"
+	v, renewed := newTestVersion(t), newTestVersion(t)
+	tests := []struct {
+		name string
+		// stored returns the stored value holding data
+		stored func(data []byte) string
+	}{
+		{"absent", func(data []byte) string {
+			b, _ := json.Marshal(map[string]any{"Value": string(data)})
+			return string(b)
+		}},
+		{"zero", func(data []byte) string {
+			b, _ := json.Marshal(map[string]any{"Value": string(data), "Modified": time.Time{}})
+			return string(b)
+		}},
+	}
+	for _, tt := range tests {
+		config.CertDir = t.TempDir()
+		sync := func(v testVersion) bool {
+			changed, err := handleCert(withStored(context.Background(), cert, tt.stored(v.key), tt.stored(v.crt)), cert)
+			if err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+			return changed
+		}
+		start := time.Now().Add(-time.Minute)
+		if !sync(v) {
+			t.Errorf("%s: first sync changed nothing", tt.name)
+		}
+		for _, suf := range certSuffixes {
+			finfo, err := os.Stat(localPath(cert, suf))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if finfo.ModTime().Before(start) {
+				t.Errorf("%s: %s modified %v, want the current time", tt.name, suf, finfo.ModTime())
+			}
+		}
+		if sync(v) {
+			t.Errorf("%s: unchanged value rewritten", tt.name)
+		}
+		if !sync(renewed) {
+			t.Errorf("%s: changed value not written", tt.name)
+		}
+	}
+}
+
+func TestRecheckExpiring(t *testing.T) {
+	useTestConfig(t)
+	v := newTestVersion(t)
+	useFakeRedis(t, map[string]string{
+		certKey("a.example.com", ".crt"): storedValue(string(v.crt), 1),
+	})
+	t.Cleanup(func() { clear(expiring) })
+	due := time.Now().Add(time.Minute)
+	expiring[graceRemoval{"a.example.com", ".crt"}] = due
+	expiring[graceRemoval{"b.example.com", ".crt"}] = due
+	err := recheckExpiring(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := expiring[graceRemoval{"a.example.com", ".crt"}]; ok {
+		t.Error("removal of a key set again not cancelled")
+	}
+	if _, ok := expiring[graceRemoval{"b.example.com", ".crt"}]; !ok {
+		t.Error("removal of a missing key cancelled")
+	}
+}
+
+func TestAlwaysRefreshSkipsHooks(t *testing.T) {
+	useTestConfig(t)
+	const cert = "www.example.com"
+	defer delete(fileHooks, ".crt")
+	defer refreshed.Delete(cert)
+	out := filepath.Join(t.TempDir(), "out")
+	c, err := parseShellCmd("hook.crt", "echo run >> "+shquote(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileHooks[".crt"] = c
+	v := newTestVersion(t)
+	// values without a modification time are compared by their contents
+	stored := func(data []byte) string {
+		b, _ := json.Marshal(map[string]any{"Value": string(data)})
+		return string(b)
+	}
+	runs := func() int {
+		data, _ := os.ReadFile(out)
+		return bytes.Count(data, []byte("run"))
+	}
+	_, err = handleCert(withStored(context.Background(), cert, stored(v.key), stored(v.crt)), cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if runs() != 1 {
+		t.Fatalf("hook ran %d times for a new cert", runs())
+	}
+	config.AlwaysRefresh = true
+	changed, err := handleCert(withStored(context.Background(), cert, stored(v.key), stored(v.crt)), cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !changed {
+		t.Error("-always-refresh did not rewrite the files")
+	}
+	if runs() != 1 {
+		t.Errorf("hook ran for an unchanged rewrite")
+	}
+}
+
+func TestPollSubscribe(t *testing.T) {
+	useTestConfig(t)
+	oldSwept := swept
+	defer func() { swept = oldSwept }()
+	swept = false
+	config.SleepTime = time.Second
+	config.Poll = 50 * time.Millisecond
+	config.PollSubscribe = true
+	const cert = "www.example.com"
+	config.Certs = []string{cert}
+	r := useFakeRedis(t, map[string]string{})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- listenRedis(ctx) }()
+	defer func() {
+		cancel()
+		<-done
+	}()
+	waitFor(t, "the subscription", func() bool {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		return len(r.subscribers) > 0
+	})
+	// set without a keyspace event, only a poll finds it
+	v := newTestVersion(t)
+	r.set(certKey(cert, ".key"), storedValue(string(v.key), 1))
+	r.set(certKey(cert, ".crt"), storedValue(string(v.crt), 1))
+	waitFor(t, "the polled cert", func() bool {
+		data, err := os.ReadFile(localPath(cert, ".crt"))
+		return err == nil && bytes.Equal(data, v.crt)
+	})
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+)
+
+// Exit codes of -check.
+const (
+	checkInSync    = 0
+	checkOutOfSync = 1
+	checkFailed    = 2
+)
+
+// runCheck compares the local files of all watched certs against redis
+// without writing anything. It prints one line per file to stdout and
+// returns the exit code: checkInSync if all files are current, checkOutOfSync
+// if any are stale or missing, locally or in redis, and checkFailed if the
+// comparison itself failed.
+func runCheck(ctx context.Context) int {
+	var current, stale, missing, failed int
+	for _, cert := range config.Certs {
+		files, err := prepareCert(ctx, cert)
+		if err != nil {
+			fmt.Printf("error\t%s\t%v\n", cert, err)
+			failed++
+			continue
+		}
+		found := make(map[string]bool)
+		for _, f := range files {
+			found[f.suffix] = true
+			_, err := os.Stat(f.fname)
+			if errors.Is(err, fs.ErrNotExist) {
+				fmt.Printf("missing\t%s\tnot written\n", f.fname)
+				missing++
+				continue
+			}
+			ok, err := upToDate(f.fname, f.data, f.modified)
+			switch {
+			case err != nil:
+				fmt.Printf("error\t%s\t%v\n", f.fname, err)
+				failed++
+			case ok:
+				fmt.Printf("ok\t%s\n", f.fname)
+				current++
+			default:
+				fmt.Printf("stale\t%s\tmodified %v\n", f.fname, f.modified)
+				stale++
+			}
+		}
+		for _, suf := range expectedSuffixes(cert) {
+			if !found[suf] {
+				fmt.Printf("missing\t%s\tnot in redis\n", localPath(cert, suf))
+				missing++
+			}
+		}
+	}
+	fmt.Printf("%d ok, %d stale, %d missing, %d errors\n", current, stale, missing, failed)
+	switch {
+	case failed > 0:
+		return checkFailed
+	case stale > 0 || missing > 0:
+		return checkOutOfSync
+	}
+	return checkInSync
+}
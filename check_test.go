@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestExpectedSuffixes(t *testing.T) {
+	useTestConfig(t)
+	defer delete(prefixKeyed, "pki-local-root")
+	defer delete(prefixKeyed, "pki-local-intermediate")
+	config.KeyPrefixes = []string{"caddy"}
+	config.CertKeys = nil
+	config.Certs = nil
+	config.PKICAs = []string{"local"}
+	config.PKIKeys = false
+	resolvePKICerts()
+	config.PKICAs = nil
+	tests := []struct {
+		cert string
+		want []string
+	}{
+		{"example.com", []string{".key", ".crt"}},
+		{"pki-local-root", []string{".crt"}},
+		{"pki-local-intermediate", []string{".crt"}},
+	}
+	for _, tt := range tests {
+		if got := expectedSuffixes(tt.cert); !slices.Equal(got, tt.want) {
+			t.Errorf("expectedSuffixes(%q) = %v, want %v", tt.cert, got, tt.want)
+		}
+	}
+}
+
+func TestRunCheckMissingFile(t *testing.T) {
+	useTestConfig(t)
+	v := newTestVersion(t)
+	values := make(map[string]string)
+	config.Certs = []string{"a.example.com", "b.example.com"}
+	for _, cert := range config.Certs {
+		values[certKey(cert, ".key")] = storedValue(string(v.key), 1)
+		values[certKey(cert, ".crt")] = storedValue(string(v.crt), 1)
+	}
+	useFakeRedis(t, values)
+	ctx := context.Background()
+	_, err := handleCert(ctx, "a.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	code := runCheck(ctx)
+	os.Stdout = stdout
+	w.Close()
+	out, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != checkOutOfSync {
+		t.Errorf("exit code %d, want %d", code, checkOutOfSync)
+	}
+	for _, want := range []string{
+		"ok\t" + localPath("a.example.com", ".crt"),
+		"missing\t" + localPath("b.example.com", ".crt") + "\tnot written",
+		"2 ok, 0 stale, 2 missing, 0 errors",
+	} {
+		if !strings.Contains(string(out), want) {
+			t.Errorf("%q missing in output:\n%s", want, out)
+		}
+	}
+}
@@ -0,0 +1,24 @@
+package main
+
+import "time"
+
+// clock is the time source for decisions based on the current time, such
+// as backoff, grace periods and ping timeouts.
+type clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+// realClock is the clock of the host.
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// clk is the clock used by certwatch.
+var clk clock = realClock{}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+// fakeClock is a clock that only moves when the test advances it.
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	ch := make(chan time.Time, 1)
+	ch <- c.now.Add(d)
+	return ch
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+// useFakeClock replaces clk with a fake clock for the test.
+func useFakeClock(t *testing.T) *fakeClock {
+	c := &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	old := clk
+	clk = c
+	t.Cleanup(func() { clk = old })
+	return c
+}
+
+func TestSettleWindow(t *testing.T) {
+	c := useFakeClock(t)
+	oldSettle := config.InitialSettle
+	config.InitialSettle = 10 * time.Second
+	defer func() { config.InitialSettle = oldSettle }()
+	var w settleWindow
+	w.start()
+	w.hold([]string{"www.example.com"})
+	tests := []struct {
+		advance time.Duration
+		due     []string
+	}{
+		{5 * time.Second, nil},
+		{4 * time.Second, nil},
+		{time.Second, []string{"www.example.com"}},
+		{time.Second, nil},
+	}
+	for i, tt := range tests {
+		c.advance(tt.advance)
+		if got := w.due(); !slices.Equal(got, tt.due) {
+			t.Errorf("step %d: due %v, want %v", i, got, tt.due)
+		}
+	}
+	if w.active() {
+		t.Error("window still open")
+	}
+}
+
+func TestSettleAbortOnShutdown(t *testing.T) {
+	useFakeClock(t)
+	runs := useRecordedCmd(t)
+	config.InitialSettle = 10 * time.Second
+	var w settleWindow
+	w.start()
+	w.hold([]string{"www.example.com"})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	w.abort(ctx)
+	if got := runs(); !slices.Equal(got, []string{"www.example.com"}) {
+		t.Errorf("runs %q, want the initial run on shutdown", got)
+	}
+}
+
+func TestDiskBackoff(t *testing.T) {
+	c := useFakeClock(t)
+	oldSleep := config.SleepTime
+	config.SleepTime = time.Second
+	defer func() {
+		config.SleepTime = oldSleep
+		diskRecovered()
+	}()
+	tests := []struct {
+		// fault records a write failure before advancing
+		fault   bool
+		advance time.Duration
+		blocked bool
+	}{
+		{true, 0, true},
+		{false, 999 * time.Millisecond, true},
+		{false, time.Millisecond, false},
+		{true, time.Second, true},
+		{false, time.Second, false},
+		{true, 3 * time.Second, true},
+		{false, time.Second, false},
+	}
+	for i, tt := range tests {
+		if tt.fault {
+			diskFault(errors.New("read-only file system"))
+		}
+		c.advance(tt.advance)
+		if got := diskBlocked(); got != tt.blocked {
+			t.Errorf("step %d: blocked %v, want %v", i, got, tt.blocked)
+		}
+	}
+}
+
+func TestDedupLog(t *testing.T) {
+	c := useFakeClock(t)
+	oldInterval := config.ErrorLogInterval
+	config.ErrorLogInterval = time.Minute
+	defer func() { config.ErrorLogInterval = oldInterval }()
+	d := &dedupLog{msg: "test"}
+	tests := []struct {
+		advance time.Duration
+		err     string
+		logged  bool
+	}{
+		{0, "down", true},
+		{30 * time.Second, "down", false},
+		{29 * time.Second, "down", false},
+		{time.Second, "down", true},
+		{time.Second, "refused", true},
+		{time.Second, "refused", false},
+	}
+	for i, tt := range tests {
+		c.advance(tt.advance)
+		if got := d.Error(errors.New(tt.err)); got != tt.logged {
+			t.Errorf("step %d: logged %v, want %v", i, got, tt.logged)
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// errClusterChanged is returned by the subscription of a cluster once its
+// masters changed, so the listen loop subscribes again on the new ones.
+var errClusterChanged = errors.New("cluster masters changed")
+
+// clusterAddrs returns the addresses given by -cluster.
+func clusterAddrs() []string {
+	var addrs []string
+	for _, v := range config.ClusterAddrs {
+		for _, addr := range strings.Split(v, ",") {
+			addr = strings.TrimSpace(addr)
+			if len(addr) > 0 {
+				addrs = append(addrs, addr)
+			}
+		}
+	}
+	return addrs
+}
+
+// newClusterClient returns the client for the cluster whose nodes are
+// given by -cluster, taking credentials, pool and TLS settings from opt. A
+// cluster only has database 0.
+func newClusterClient(opt *redis.Options) (*redis.ClusterClient, error) {
+	if len(config.SentinelMaster) > 0 {
+		return nil, errors.New("-cluster and -sentinel-master are mutually exclusive")
+	}
+	if len(config.ReplicaUrl) > 0 {
+		return nil, errors.New("-cluster and -replica-url are mutually exclusive")
+	}
+	if opt.DB != 0 {
+		return nil, fmt.Errorf("-redisurl selects database %d, a cluster only has database 0", opt.DB)
+	}
+	addrs := clusterAddrs()
+	if len(addrs) == 0 {
+		return nil, errors.New("-cluster needs at least one node")
+	}
+	slog.Info("redis cluster", "nodes", addrs)
+	return redis.NewClusterClient(&redis.ClusterOptions{
+		Addrs:           addrs,
+		ClientName:      opt.ClientName,
+		Protocol:        opt.Protocol,
+		Username:        opt.Username,
+		Password:        opt.Password,
+		MaxRetries:      opt.MaxRetries,
+		MinRetryBackoff: opt.MinRetryBackoff,
+		MaxRetryBackoff: opt.MaxRetryBackoff,
+		DialTimeout:     opt.DialTimeout,
+		ReadTimeout:     opt.ReadTimeout,
+		WriteTimeout:    opt.WriteTimeout,
+		PoolFIFO:        opt.PoolFIFO,
+		PoolSize:        opt.PoolSize,
+		PoolTimeout:     opt.PoolTimeout,
+		MinIdleConns:    opt.MinIdleConns,
+		MaxIdleConns:    opt.MaxIdleConns,
+		MaxActiveConns:  opt.MaxActiveConns,
+		ConnMaxIdleTime: opt.ConnMaxIdleTime,
+		ConnMaxLifetime: opt.ConnMaxLifetime,
+		TLSConfig:       opt.TLSConfig,
+	}), nil
+}
+
+// clientDB returns the database c selects, 0 for a cluster.
+func clientDB(c redis.UniversalClient) int {
+	if c, ok := c.(*redis.Client); ok {
+		return c.Options().DB
+	}
+	return 0
+}
+
+// nodeClients returns the clients of the nodes holding the keys of c: the
+// masters of a cluster sorted by address, or c itself. Commands that only
+// see the keys of one node, like SCAN and CONFIG GET, are sent to each.
+func nodeClients(ctx context.Context, c redis.UniversalClient) ([]*redis.Client, error) {
+	cc, ok := c.(*redis.ClusterClient)
+	if !ok {
+		return []*redis.Client{c.(*redis.Client)}, nil
+	}
+	var mu sync.Mutex
+	var nodes []*redis.Client
+	err := cc.ForEachMaster(ctx, func(ctx context.Context, node *redis.Client) error {
+		mu.Lock()
+		defer mu.Unlock()
+		nodes = append(nodes, node)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	slices.SortFunc(nodes, func(a, b *redis.Client) int { return strings.Compare(a.Options().Addr, b.Options().Addr) })
+	return nodes, nil
+}
+
+// nodeAddrs returns the addresses of nodes.
+func nodeAddrs(nodes []*redis.Client) []string {
+	var addrs []string
+	for _, n := range nodes {
+		addrs = append(addrs, n.Options().Addr)
+	}
+	return addrs
+}
+
+// subscription is the keyspace subscription of the listen loop.
+type subscription interface {
+	ReceiveTimeout(ctx context.Context, timeout time.Duration) (interface{}, error)
+	Ping(ctx context.Context, payload ...string) error
+	Close() error
+}
+
+// subscribeKeyspace subscribes to patterns and channels and waits for the
+// subscription to be confirmed. On a cluster, keyspace notifications are
+// only published by the node holding the key, so every master is
+// subscribed to.
+func subscribeKeyspace(ctx context.Context, patterns []string, channels []string) (subscription, error) {
+	nodes, err := nodeClients(ctx, client)
+	if err != nil {
+		return nil, err
+	}
+	var subs []*redis.PubSub
+	for _, node := range nodes {
+		ps := node.PSubscribe(ctx, patterns...)
+		subs = append(subs, ps)
+		_, err = ps.Receive(ctx)
+		if err == nil && len(channels) > 0 {
+			err = ps.Subscribe(ctx, channels...)
+		}
+		if err != nil {
+			for _, ps := range subs {
+				ps.Close()
+			}
+			return nil, err
+		}
+	}
+	cc, ok := client.(*redis.ClusterClient)
+	if !ok {
+		return subs[0], nil
+	}
+	slog.Debug("subscribed to cluster masters", "masters", nodeAddrs(nodes))
+	return newClusterPubSub(ctx, cc, subs, nodeAddrs(nodes)), nil
+}
+
+// clusterPubSub merges the subscriptions on the masters of a cluster.
+// Every subscription is received from by its own goroutine, which hands the
+// messages and errors to ReceiveTimeout.
+type clusterPubSub struct {
+	cluster *redis.ClusterClient
+	subs    []*redis.PubSub
+	// masters are the addresses of the masters subscribed to
+	masters []string
+	msgs    chan received
+	done    chan struct{}
+	once    sync.Once
+}
+
+// received is a message or an error of one of the subscriptions.
+type received struct {
+	msg interface{}
+	err error
+}
+
+// receiveTimeout is the timeout error of clusterPubSub.ReceiveTimeout, a
+// net.Error like the one of a single subscription.
+type receiveTimeout struct{}
+
+func (receiveTimeout) Error() string   { return "receive timeout" }
+func (receiveTimeout) Timeout() bool   { return true }
+func (receiveTimeout) Temporary() bool { return true }
+
+func newClusterPubSub(ctx context.Context, cc *redis.ClusterClient, subs []*redis.PubSub, masters []string) *clusterPubSub {
+	p := &clusterPubSub{cluster: cc, subs: subs, masters: masters, msgs: make(chan received), done: make(chan struct{})}
+	for _, ps := range subs {
+		go func() {
+			for {
+				msg, err := ps.Receive(ctx)
+				select {
+				case p.msgs <- received{msg, err}:
+				case <-p.done:
+					return
+				}
+			}
+		}()
+	}
+	return p
+}
+
+// ReceiveTimeout returns the next message of any master. When it times
+// out, it checks whether the masters of the cluster changed and returns
+// errClusterChanged if so.
+func (p *clusterPubSub) ReceiveTimeout(ctx context.Context, timeout time.Duration) (interface{}, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case r := <-p.msgs:
+		return r.msg, r.err
+	case <-timer.C:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	nodes, err := nodeClients(ctx, p.cluster)
+	if err != nil {
+		return nil, err
+	}
+	if masters := nodeAddrs(nodes); !slices.Equal(masters, p.masters) {
+		return nil, fmt.Errorf("%w: %v, subscribed to %v", errClusterChanged, masters, p.masters)
+	}
+	return nil, receiveTimeout{}
+}
+
+// Ping pings every master.
+func (p *clusterPubSub) Ping(ctx context.Context, payload ...string) error {
+	for _, ps := range p.subs {
+		err := ps.Ping(ctx, payload...)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close closes the subscriptions and stops their goroutines.
+func (p *clusterPubSub) Close() error {
+	var errs []error
+	p.once.Do(func() {
+		close(p.done)
+		for _, ps := range p.subs {
+			errs = append(errs, ps.Close())
+		}
+	})
+	return errors.Join(errs...)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// fakeNode is a redis node that only knows PSUBSCRIBE, enough to test the
+// subscription on several cluster masters. Messages sent to publish are
+// pushed to the subscribed connection.
+type fakeNode struct {
+	ln      net.Listener
+	publish chan string
+}
+
+func newFakeNode(t *testing.T) *fakeNode {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := &fakeNode{ln: ln, publish: make(chan string)}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go n.serve(conn)
+		}
+	}()
+	return n
+}
+
+// bulk encodes s as a RESP bulk string.
+func bulk(s string) string {
+	return "$" + strconv.Itoa(len(s)) + "\r\n" + s + "\r\n"
+}
+
+func (n *fakeNode) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		if strings.ToLower(args[0]) != "psubscribe" {
+			fmt.Fprintf(conn, "-ERR unknown command '%s'\r\n", args[0])
+			continue
+		}
+		pattern := args[1]
+		fmt.Fprintf(conn, "*3\r\n%s%s:1\r\n", bulk("psubscribe"), bulk(pattern))
+		for payload := range n.publish {
+			channel := strings.TrimSuffix(pattern, "*") + "www.example.com/www.example.com.crt"
+			fmt.Fprintf(conn, "*4\r\n%s%s%s%s", bulk("pmessage"), bulk(pattern), bulk(channel), bulk(payload))
+		}
+		return
+	}
+}
+
+// readCommand reads a command sent as a RESP array of bulk strings.
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	count, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "*")))
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, count)
+	for i := range args {
+		_, err = r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		arg, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		args[i] = strings.TrimSuffix(arg, "\r\n")
+	}
+	return args, nil
+}
+
+func TestClusterPubSub(t *testing.T) {
+	ctx := context.Background()
+	pattern := keyspaceChannel(0, "caddy/certificates/acme/") + "*"
+	var nodes []*fakeNode
+	var subs []*redis.PubSub
+	for range 2 {
+		n := newFakeNode(t)
+		nodes = append(nodes, n)
+		c := redis.NewClient(&redis.Options{Addr: n.ln.Addr().String(), Protocol: 2})
+		defer c.Close()
+		ps := c.PSubscribe(ctx, pattern)
+		_, err := ps.Receive(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		subs = append(subs, ps)
+	}
+	p := newClusterPubSub(ctx, nil, subs, nil)
+	for i, n := range nodes {
+		payload := "set" + strconv.Itoa(i)
+		go func() { n.publish <- payload }()
+		m, err := p.ReceiveTimeout(ctx, 5*time.Second)
+		if err != nil {
+			t.Fatalf("node %d: %v", i, err)
+		}
+		msg, ok := m.(*redis.Message)
+		if !ok || msg.Payload != payload {
+			t.Errorf("node %d: got %#v", i, m)
+		}
+	}
+	done := make(chan error)
+	go func() { done <- p.Close() }()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close hangs")
+	}
+	for _, n := range nodes {
+		close(n.publish)
+	}
+}
+
+func TestReceiveTimeoutIsNetError(t *testing.T) {
+	var err error = receiveTimeout{}
+	nerr, ok := err.(net.Error)
+	if !ok || !nerr.Timeout() {
+		t.Error("receiveTimeout is no net.Error timeout")
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// compressSuffix is appended to the names of compressed cert files.
+const compressSuffix = ".gz"
+
+// compressed reports whether the local files of cert are written gzip
+// compressed, as set by its compress entry in the -config file or else by
+// -compress.
+func compressed(cert string) bool {
+	if t, ok := certTargets[cert]; ok && t.compress != nil {
+		return *t.compress
+	}
+	return config.Compress
+}
+
+// anyCompressed reports whether the local files of any cert are written
+// compressed.
+func anyCompressed() bool {
+	if config.Compress {
+		return true
+	}
+	for _, t := range certTargets {
+		if t.compress != nil && *t.compress {
+			return true
+		}
+	}
+	return false
+}
+
+// localSuffix returns the suffix of the local file of cert for the cert
+// file with the given suffix.
+func localSuffix(cert string, suf string) string {
+	if compressed(cert) {
+		return suf + compressSuffix
+	}
+	return suf
+}
+
+// gzipData returns data compressed with gzip. The header carries no name or
+// time, so the same data always compresses to the same bytes.
+func gzipData(data []byte) ([]byte, error) {
+	var b bytes.Buffer
+	zw := gzip.NewWriter(&b)
+	_, err := zw.Write(data)
+	if err != nil {
+		return nil, err
+	}
+	err = zw.Close()
+	if err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// gzipMagic starts every gzip stream. PEM files never start with it.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// readLocal reads a local cert file, decompressing it if it was written
+// with -compress.
+func readLocal(fname string) ([]byte, error) {
+	data, err := os.ReadFile(fname)
+	if err != nil || !bytes.HasPrefix(data, gzipMagic) {
+		return data, err
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(zr)
+}
+
+// plainFiles writes the files of a compressed cert, given by suffix, to a
+// new private directory, for the commands that read them, and returns
+// their paths and a function removing the directory again.
+func plainFiles(cert string, files map[string][]byte) (map[string]string, func(), error) {
+	dir, err := os.MkdirTemp("", "certwatch-")
+	if err != nil {
+		return nil, nil, err
+	}
+	cleanup := func() {
+		err := os.RemoveAll(dir)
+		if err != nil {
+			slog.Warn("remove plain files", "dir", dir, "err", err)
+		}
+	}
+	paths := make(map[string]string)
+	for suf, data := range files {
+		fname := filepath.Join(dir, path.Base(localName(cert))+suf)
+		err = os.WriteFile(fname, data, 0600)
+		if err != nil {
+			cleanup()
+			return nil, nil, err
+		}
+		paths[suf] = fname
+	}
+	return paths, cleanup, nil
+}
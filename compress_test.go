@@ -0,0 +1,37 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileHookGetsPlainFile(t *testing.T) {
+	defer func(c bool) { config.Compress = c }(config.Compress)
+	defer delete(fileHooks, ".crt")
+	config.Compress = true
+	out := filepath.Join(t.TempDir(), "out")
+	c, err := parseShellCmd("hook.crt", "cat {{.Crt}} > "+shquote(out)+"; echo {{.Crt}} >> "+shquote(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileHooks[".crt"] = c
+	runFileHook(context.Background(), "www.example.com", ".crt", "/nonexistent/www.example.com.crt.gz", []byte("plain cert\n"))
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, fname, _ := bytes.Cut(data, []byte("\n"))
+	if string(got) != "plain cert" {
+		t.Errorf("hook read %q", data)
+	}
+	fname = bytes.TrimSpace(fname)
+	if filepath.Base(string(fname)) != "www.example.com.crt" {
+		t.Errorf("hook got path %s", fname)
+	}
+	if _, err := os.Stat(string(fname)); !os.IsNotExist(err) {
+		t.Errorf("plain copy %s not removed: %v", fname, err)
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/user"
+	"path/filepath"
+	"slices"
+	"strconv"
+
+	"gopkg.in/yaml.v3"
+)
+
+// certEntry is a cert in the -config file. All fields but Name are
+// optional, an entry without them is the same as naming the cert on the
+// command line.
+type certEntry struct {
+	// Name is the name of the cert in redis.
+	Name string `yaml:"name"`
+	// Dir is the directory its files are written to instead of CertDir.
+	Dir string `yaml:"dir"`
+	// Mode are the permissions of its files as an octal string like "0640".
+	Mode string `yaml:"mode"`
+	// Owner and Group own its files, by name or numeric id.
+	Owner string `yaml:"owner"`
+	Group string `yaml:"group"`
+	// Cmd is run when it changed, like a -certcmd.
+	Cmd string `yaml:"cmd"`
+	// Reload is done when it changed, instead of a Cmd.
+	Reload *reloadEntry `yaml:"reload"`
+	// Compress writes its files gzip compressed, overriding -compress.
+	Compress *bool `yaml:"compress"`
+}
+
+// configFile is the format of the -config file. It is read as YAML, which
+// includes JSON.
+type configFile struct {
+	Certs []certEntry `yaml:"certs"`
+}
+
+// certTarget is where and how the files of a cert from the -config file are
+// written. A zero mode keeps the default of 0600, and a uid or gid of -1
+// keeps the owner or group of certwatch.
+type certTarget struct {
+	dir  string
+	mode fs.FileMode
+	uid  int
+	gid  int
+	// compress overrides -compress if set.
+	compress *bool
+}
+
+// certTargets holds the targets of the certs from the -config file that set
+// any of them.
+var certTargets = make(map[string]certTarget)
+
+// loadConfigFile adds the certs of the -config file to the watched certs,
+// their commands to -certcmd, their reloads to certReloads and their targets
+// to certTargets.
+func loadConfigFile() error {
+	if len(config.ConfigFile) == 0 {
+		return nil
+	}
+	data, err := os.ReadFile(config.ConfigFile)
+	if err != nil {
+		return err
+	}
+	var cf configFile
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	err = dec.Decode(&cf)
+	if err != nil {
+		return fmt.Errorf("%s: %w", config.ConfigFile, err)
+	}
+	for _, e := range cf.Certs {
+		if len(e.Name) == 0 {
+			return fmt.Errorf("%s: cert entry without a name", config.ConfigFile)
+		}
+		if slices.Contains(config.Certs, e.Name) {
+			return fmt.Errorf("%s: cert %s given more than once", config.ConfigFile, e.Name)
+		}
+		t, err := parseCertTarget(e)
+		if err != nil {
+			return fmt.Errorf("%s: cert %s: %w", config.ConfigFile, e.Name, err)
+		}
+		if t != (certTarget{uid: -1, gid: -1}) {
+			certTargets[e.Name] = t
+		}
+		if len(e.Cmd) > 0 {
+			if _, ok := config.CertCmds[e.Name]; ok {
+				return fmt.Errorf("%s: cert %s has a cmd and a -certcmd", config.ConfigFile, e.Name)
+			}
+			config.CertCmds[e.Name] = e.Cmd
+		}
+		if e.Reload != nil {
+			if _, ok := config.CertCmds[e.Name]; ok {
+				return fmt.Errorf("%s: cert %s has a reload and a cmd", config.ConfigFile, e.Name)
+			}
+			a, err := newReloadAction(*e.Reload)
+			if err != nil {
+				return fmt.Errorf("%s: cert %s: %w", config.ConfigFile, e.Name, err)
+			}
+			certReloads[e.Name] = a
+		}
+		config.Certs = append(config.Certs, e.Name)
+	}
+	return nil
+}
+
+// parseCertTarget parses the target fields of e.
+func parseCertTarget(e certEntry) (certTarget, error) {
+	t := certTarget{uid: -1, gid: -1}
+	if len(e.Dir) > 0 {
+		t.dir = filepath.Clean(e.Dir)
+	}
+	if len(e.Mode) > 0 {
+		mode, err := strconv.ParseUint(e.Mode, 8, 32)
+		if err != nil || mode&^0777 != 0 || mode&0600 != 0600 {
+			return t, fmt.Errorf("invalid mode %q, expected octal permissions readable and writable by the owner like 0640", e.Mode)
+		}
+		t.mode = fs.FileMode(mode)
+	}
+	if len(e.Owner) > 0 {
+		u, err := user.Lookup(e.Owner)
+		if err != nil {
+			u, err = user.LookupId(e.Owner)
+		}
+		if err != nil {
+			return t, fmt.Errorf("owner: %w", err)
+		}
+		t.uid, _ = strconv.Atoi(u.Uid)
+	}
+	if len(e.Group) > 0 {
+		g, err := user.LookupGroup(e.Group)
+		if err != nil {
+			g, err = user.LookupGroupId(e.Group)
+		}
+		if err != nil {
+			return t, fmt.Errorf("group: %w", err)
+		}
+		t.gid, _ = strconv.Atoi(g.Gid)
+	}
+	t.compress = e.Compress
+	return t, nil
+}
+
+// certDir returns the directory the files of cert are written to.
+func certDir(cert string) string {
+	if t, ok := certTargets[cert]; ok && len(t.dir) > 0 {
+		return t.dir
+	}
+	return config.CertDir
+}
+
+// certDirs returns CertDir and the other directories of the -config file.
+func certDirs() []string {
+	dirs := []string{config.CertDir}
+	for _, t := range certTargets {
+		if len(t.dir) > 0 && !slices.Contains(dirs, t.dir) {
+			dirs = append(dirs, t.dir)
+		}
+	}
+	return dirs
+}
+
+// keyMode returns the permissions allowed for the key file of cert.
+func keyMode(cert string) fs.FileMode {
+	if t, ok := certTargets[cert]; ok && t.mode != 0 {
+		return t.mode
+	}
+	return 0600
+}
+
+// applyTarget sets the mode and ownership of the -config file on the staged
+// file of cert, before it is renamed into place.
+func applyTarget(cert string, tmpname string) error {
+	t, ok := certTargets[cert]
+	if !ok {
+		return nil
+	}
+	if t.uid >= 0 || t.gid >= 0 {
+		err := os.Lchown(tmpname, t.uid, t.gid)
+		if err != nil {
+			return err
+		}
+	}
+	if t.mode != 0 {
+		err := os.Chmod(tmpname, t.mode)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
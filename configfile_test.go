@@ -0,0 +1,86 @@
+package main
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestLoadConfigFile(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		{"yaml", `
+certs:
+  - name: mail.example.com
+    dir: /etc/postfix/tls
+    mode: 0640
+    cmd: systemctl reload postfix
+  - name: www.example.com
+    reload:
+      unit: nginx.service
+      restart: true
+  - name: example.org
+`},
+		{"json", `{"certs": [
+  {"name": "mail.example.com", "dir": "/etc/postfix/tls", "mode": "0640", "cmd": "systemctl reload postfix"},
+  {"name": "www.example.com", "reload": {"unit": "nginx.service", "restart": true}},
+  {"name": "example.org"}
+]}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTestConfig(t)
+			oldTargets, oldReloads := certTargets, certReloads
+			t.Cleanup(func() { certTargets, certReloads = oldTargets, oldReloads })
+			certTargets = make(map[string]certTarget)
+			certReloads = make(map[string]reloadAction)
+			config.Certs = nil
+			config.CertCmds = mapFlag{}
+			config.ConfigFile = filepath.Join(t.TempDir(), "certwatch."+tt.name)
+			err := os.WriteFile(config.ConfigFile, []byte(tt.data), 0o600)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = loadConfigFile()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := []string{"mail.example.com", "www.example.com", "example.org"}; !slices.Equal(config.Certs, want) {
+				t.Errorf("certs %v, want %v", config.Certs, want)
+			}
+			if got := certDir("mail.example.com"); got != "/etc/postfix/tls" {
+				t.Errorf("dir %q", got)
+			}
+			if got := keyMode("mail.example.com"); got != fs.FileMode(0o640) {
+				t.Errorf("mode %v", got)
+			}
+			if got := config.CertCmds["mail.example.com"]; got != "systemctl reload postfix" {
+				t.Errorf("cmd %q", got)
+			}
+			if _, ok := certReloads["www.example.com"]; !ok {
+				t.Error("reload missing")
+			}
+			if _, ok := certTargets["example.org"]; ok {
+				t.Error("target for a cert without one")
+			}
+		})
+	}
+}
+
+func TestLoadConfigFileUnknownField(t *testing.T) {
+	useTestConfig(t)
+	config.Certs = nil
+	config.CertCmds = mapFlag{}
+	config.ConfigFile = filepath.Join(t.TempDir(), "certwatch.yaml")
+	err := os.WriteFile(config.ConfigFile, []byte("certs:\n  - name: www.example.com\n    directory: /etc/nginx/tls\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := loadConfigFile(); err == nil {
+		t.Error("unknown field accepted")
+	}
+}
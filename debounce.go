@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+	"time"
+)
+
+// debounceWindow holds back the command for -debounce after a change,
+// restarting the wait with every further event for a watched cert, so the
+// separate events for the .key and the .crt of a renewal cause a single
+// run. The wait never extends past -debounce-max after the first held
+// change, so a steady stream of events cannot hold back the command
+// forever. It is only used by the listen loop.
+type debounceWindow struct {
+	until   time.Time
+	started time.Time
+	changed []string
+}
+
+var debounce debounceWindow
+
+// shutdownCmdTimeout bounds the run of a command held back when a shutdown
+// ends the listen loop.
+const shutdownCmdTimeout = 30 * time.Second
+
+// runHeld runs the command for changes held back when the listen loop ends.
+// Their files are written already, so on shutdown the command still runs,
+// for at most shutdownCmdTimeout, instead of leaving the services with the
+// old certs.
+func runHeld(ctx context.Context, what string, changed []string) {
+	if ctx.Err() != nil {
+		slog.Warn(what+" run on shutdown", "changed", changed, "timeout", shutdownCmdTimeout)
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(context.WithoutCancel(ctx), shutdownCmdTimeout)
+		defer cancel()
+		// with -cmd-async the run is only queued, it must be done before
+		// the timeout is cancelled
+		defer asyncCmds.drain()
+	}
+	certsChanged(ctx, changed)
+}
+
+// active reports whether changes are held back.
+func (w *debounceWindow) active() bool {
+	return !w.until.IsZero()
+}
+
+// hold adds changed to the changes held back and restarts the wait.
+func (w *debounceWindow) hold(changed []string) {
+	for _, cert := range changed {
+		if !slices.Contains(w.changed, cert) {
+			w.changed = append(w.changed, cert)
+		}
+	}
+	if !w.active() {
+		w.started = clk.Now()
+	}
+	w.restart()
+}
+
+// touch restarts the wait for an event that changed nothing, such as a
+// deletion, if changes are held back.
+func (w *debounceWindow) touch() {
+	if w.active() {
+		w.restart()
+	}
+}
+
+// restart restarts the wait for -debounce, capped at -debounce-max after
+// the first held change.
+func (w *debounceWindow) restart() {
+	w.until = clk.Now().Add(config.Debounce)
+	if config.DebounceMax > 0 {
+		if limit := w.started.Add(config.DebounceMax); w.until.After(limit) {
+			w.until = limit
+		}
+	}
+}
+
+// remaining returns the time left until the changes are due, false if none
+// are held back.
+func (w *debounceWindow) remaining() (time.Duration, bool) {
+	if !w.active() {
+		return 0, false
+	}
+	return max(w.until.Sub(clk.Now()), time.Millisecond), true
+}
+
+// due returns the changes held back once no event arrived for -debounce, to
+// run the command for.
+func (w *debounceWindow) due() []string {
+	if !w.active() || clk.Now().Before(w.until) {
+		return nil
+	}
+	changed := w.changed
+	w.until = time.Time{}
+	w.changed = nil
+	slog.Debug("debounce done", "changed", changed)
+	return changed
+}
+
+// abort runs the command for the changes held back when the listen loop
+// ends, also on shutdown.
+func (w *debounceWindow) abort(ctx context.Context) {
+	if !w.active() {
+		return
+	}
+	changed := w.changed
+	w.until = time.Time{}
+	w.changed = nil
+	runHeld(ctx, "debounced command", changed)
+}
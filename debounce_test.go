@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useRecordedCmd makes -cmd append the changed certs of every run as a line
+// to a file and returns a func reading the lines back.
+func useRecordedCmd(t *testing.T) func() []string {
+	useTestConfig(t)
+	out := filepath.Join(t.TempDir(), "runs")
+	c, err := parseShellCmd("cmd", `echo "$CERTWATCH_CHANGED" >>`+shquote(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := reloadCmd
+	reloadCmd = c
+	t.Cleanup(func() { reloadCmd = old })
+	return func() []string {
+		data, err := os.ReadFile(out)
+		if err != nil && !os.IsNotExist(err) {
+			t.Fatal(err)
+		}
+		return strings.Split(strings.TrimSpace(string(data)), "\n")
+	}
+}
+
+func TestDebounceAbortOnShutdown(t *testing.T) {
+	useFakeClock(t)
+	runs := useRecordedCmd(t)
+	var w debounceWindow
+	w.hold([]string{"www.example.com", "api.example.com"})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	w.abort(ctx)
+	if got := runs(); !slices.Equal(got, []string{"www.example.com api.example.com"}) {
+		t.Errorf("runs %q, want the held changes run on shutdown", got)
+	}
+	if w.active() {
+		t.Error("still active after abort")
+	}
+}
+
+func TestDebounceAbortOnShutdownAsync(t *testing.T) {
+	useFakeClock(t)
+	runs := useRecordedCmd(t)
+	config.CmdAsync = true
+	var w debounceWindow
+	w.hold([]string{"www.example.com"})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	w.abort(ctx)
+	if got := runs(); !slices.Equal(got, []string{"www.example.com"}) {
+		t.Errorf("runs %q, want the held changes run on shutdown", got)
+	}
+}
+
+func TestDebounceMax(t *testing.T) {
+	c := useFakeClock(t)
+	oldDebounce, oldMax := config.Debounce, config.DebounceMax
+	config.Debounce, config.DebounceMax = 2*time.Second, 5*time.Second
+	defer func() { config.Debounce, config.DebounceMax = oldDebounce, oldMax }()
+	var w debounceWindow
+	w.hold([]string{"www.example.com"})
+	for range 3 {
+		c.advance(time.Second)
+		if held := w.due(); held != nil {
+			t.Fatalf("due after %v: %v", c.now.Sub(w.started), held)
+		}
+		w.touch()
+	}
+	w.hold([]string{"api.example.com"})
+	if wait, _ := w.remaining(); wait != 2*time.Second {
+		t.Errorf("remaining before the limit: %v", wait)
+	}
+	c.advance(time.Second)
+	w.touch()
+	if wait, _ := w.remaining(); wait != time.Second {
+		t.Errorf("remaining capped by -debounce-max: %v", wait)
+	}
+	c.advance(time.Second)
+	held := w.due()
+	if !slices.Equal(held, []string{"www.example.com", "api.example.com"}) {
+		t.Errorf("held %v", held)
+	}
+	if w.active() {
+		t.Error("still active after due")
+	}
+}
+
+func TestDebounceNoMax(t *testing.T) {
+	c := useFakeClock(t)
+	oldDebounce, oldMax := config.Debounce, config.DebounceMax
+	config.Debounce, config.DebounceMax = 2*time.Second, 0
+	defer func() { config.Debounce, config.DebounceMax = oldDebounce, oldMax }()
+	var w debounceWindow
+	w.hold([]string{"www.example.com"})
+	for range 10 {
+		c.advance(time.Second)
+		if held := w.due(); held != nil {
+			t.Fatalf("due while events keep arriving: %v", held)
+		}
+		w.touch()
+	}
+	c.advance(2 * time.Second)
+	if held := w.due(); len(held) != 1 {
+		t.Errorf("held %v", held)
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Value formats accepted by -value-format.
+const (
+	valueFormatJSON           = "json"            // JSON object with value and modification time
+	valueFormatRaw            = "raw"             // the file contents, without any wrapping
+	valueFormatLengthPrefixed = "length-prefixed" // the file contents after a 4 byte length
+)
+
+// valueFraming unwraps a value as stored in redis into the file contents
+// and their modification time, which is zero if the framing carries none.
+// An error means that the value is not framed as expected. Support for
+// another producer is added by implementing it and adding it to
+// valueFramings under the name to select it by with -value-format.
+type valueFraming interface {
+	unframe(val string) ([]byte, time.Time, error)
+}
+
+// valueFramings are the framings selectable by -value-format.
+var valueFramings = map[string]valueFraming{
+	valueFormatJSON:           prefixJSONFraming{},
+	valueFormatRaw:            rawFraming{},
+	valueFormatLengthPrefixed: lengthPrefixedFraming{},
+}
+
+// framing returns the framing selected by -value-format.
+func framing() valueFraming {
+	return valueFramings[config.ValueFormat]
+}
+
+// prefixJSONFraming is the framing of caddy-storage-redis: -valueprefix
+// followed by a JSON object decoded by decodeValue.
+type prefixJSONFraming struct{}
+
+func (prefixJSONFraming) unframe(val string) ([]byte, time.Time, error) {
+	return decodeValue(strings.TrimPrefix(val, config.ValuePrefix))
+}
+
+// rawFraming takes the value as the file contents.
+type rawFraming struct{}
+
+func (rawFraming) unframe(val string) ([]byte, time.Time, error) {
+	// Go strings hold arbitrary bytes
+	return []byte(val), time.Time{}, nil
+}
+
+// lengthPrefixSize is the size of the header of a length-prefixed value.
+const lengthPrefixSize = 4
+
+// lengthPrefixedFraming expects the file contents after their length as a
+// 4 byte big endian unsigned integer, with nothing following them.
+type lengthPrefixedFraming struct{}
+
+func (lengthPrefixedFraming) unframe(val string) ([]byte, time.Time, error) {
+	if len(val) < lengthPrefixSize {
+		return nil, time.Time{}, fmt.Errorf("length-prefixed value of %d bytes is shorter than its %d byte length", len(val), lengthPrefixSize)
+	}
+	n := binary.BigEndian.Uint32([]byte(val[:lengthPrefixSize]))
+	data := val[lengthPrefixSize:]
+	if int64(n) != int64(len(data)) {
+		return nil, time.Time{}, fmt.Errorf("length prefix %d does not match the %d bytes following it", n, len(data))
+	}
+	return []byte(data), time.Time{}, nil
+}
+
+// Value encodings accepted by -value-encoding.
+const (
+	encodingAuto   = "auto"   // detect one of the encodings below
+	encodingBytes  = "bytes"  // Go []byte, i.e. a base64 JSON string
+	encodingBase64 = "base64" // base64 of the base64 text, i.e. double encoded
+	encodingPEM    = "pem"    // the PEM text as a plain JSON string
+)
+
+var valueEncodings = []string{encodingAuto, encodingBytes, encodingBase64, encodingPEM}
+
+// errDecode marks a stored value that could not be decoded.
+var errDecode = errors.New("cannot decode value")
+
+var pemStart = []byte("-----BEGIN ")
+
+// lookupField returns the JSON field name of obj, preferring an exact match
+// but accepting a case-insensitive one like encoding/json does.
+func lookupField(obj map[string]json.RawMessage, name string) (json.RawMessage, bool) {
+	if v, ok := obj[name]; ok {
+		return v, true
+	}
+	for k, v := range obj {
+		if strings.EqualFold(k, name) {
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+// decodeValue decodes the JSON value stored in redis, returning the file
+// contents and the modification time. The names of the JSON fields holding
+// them are set by -value-field and -modified-field and default to the
+// Value and Modified fields written by caddy-storage-redis. A missing, null
+// or zero modification time, including the Unix epoch, is returned as the
+// zero time.
+func decodeValue(val string) ([]byte, time.Time, error) {
+	var obj map[string]json.RawMessage
+	err := json.Unmarshal([]byte(val), &obj)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	rawValue, ok := lookupField(obj, config.ValueField)
+	if !ok {
+		return nil, time.Time{}, fmt.Errorf("value field %q not found in JSON", config.ValueField)
+	}
+	rawModified, hasModified := lookupField(obj, config.ModifiedField)
+	var value string
+	err = json.Unmarshal(rawValue, &value)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("value field %q: %w", config.ValueField, err)
+	}
+	var modified time.Time
+	if hasModified {
+		err = json.Unmarshal(rawModified, &modified)
+		if err != nil {
+			return nil, time.Time{}, fmt.Errorf("modified field %q: %w", config.ModifiedField, err)
+		}
+	}
+	if modified.Unix() == 0 {
+		modified = time.Time{}
+	}
+	data, err := decodeValueField(value, config.ValueEncoding)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	return data, modified, nil
+}
+
+// detected reports whether -value-encoding auto accepts data as decoded:
+// PEM, or a -value-ref reference followed after decoding.
+func detected(data []byte) bool {
+	return bytes.HasPrefix(data, pemStart) || len(config.ValueRef) > 0 && bytes.HasPrefix(data, []byte(config.ValueRef))
+}
+
+func decodeValueField(s string, encoding string) ([]byte, error) {
+	switch encoding {
+	case encodingPEM:
+		return []byte(s), nil
+	case encodingBytes:
+		return base64.StdEncoding.DecodeString(s)
+	case encodingBase64:
+		once, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return nil, err
+		}
+		return base64.StdEncoding.DecodeString(string(once))
+	case encodingAuto:
+		if detected([]byte(s)) {
+			return []byte(s), nil
+		}
+		once, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return nil, fmt.Errorf("value is neither PEM nor base64: %w", err)
+		}
+		if detected(once) {
+			return once, nil
+		}
+		twice, err := base64.StdEncoding.DecodeString(string(once))
+		if err == nil && detected(twice) {
+			return twice, nil
+		}
+		return nil, errors.New("cannot detect value encoding, decoded value is not PEM; set -value-encoding explicitly")
+	default:
+		return nil, fmt.Errorf("unknown value encoding %q", encoding)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// dedupLog logs repeated identical errors only once, followed by a periodic
+// summary of how many repetitions were suppressed while the error persists.
+type dedupLog struct {
+	msg string
+
+	mu         sync.Mutex
+	last       string
+	suppressed int
+	logged     time.Time
+}
+
+// Error logs err unless it is identical to the previous error and the
+// summary interval has not yet passed. It reports whether err was logged.
+func (d *dedupLog) Error(err error, args ...any) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	text := err.Error()
+	now := clk.Now()
+	if text != d.last {
+		if d.suppressed > 0 {
+			slog.Error(d.msg, "err", d.last, "suppressed", d.suppressed)
+		}
+		d.last = text
+		d.suppressed = 0
+		d.logged = now
+		slog.Error(d.msg, append([]any{"err", err}, args...)...)
+		return true
+	}
+	if now.Sub(d.logged) < config.ErrorLogInterval {
+		d.suppressed++
+		return false
+	}
+	slog.Error(d.msg+" still failing", append([]any{"err", err, "suppressed", d.suppressed}, args...)...)
+	d.suppressed = 0
+	d.logged = now
+	return true
+}
+
+// Reset forgets the previous error after the operation succeeded.
+func (d *dedupLog) Reset() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.last) == 0 {
+		return
+	}
+	slog.Info(d.msg+" recovered", "lastErr", d.last, "suppressed", d.suppressed)
+	d.last = ""
+	d.suppressed = 0
+}
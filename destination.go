@@ -0,0 +1,56 @@
+package main
+
+// destination is a place the synced certs are written to. The files below
+// -certdir are the default destination and always come first: handleCert
+// installs the key and cert files there and detects changes against them,
+// the destinations then follow what was installed. Errors are handled by
+// each destination, a destination must not block the caller for long.
+type destination interface {
+	// write is called after every sync of cert with all its fetched files,
+	// changed tells whether any of them was written.
+	write(cert string, files []certFile, changed bool)
+	// remove is called once the file of cert with suffix suf was removed
+	// from redis.
+	remove(cert string, suf string)
+}
+
+// destinations are the destinations in use, set up by setupDestinations.
+var destinations = []destination{fileDestination{}}
+
+// setupDestinations adds the destinations configured besides the local
+// files.
+func setupDestinations() {
+	if len(config.VaultAddr) > 0 {
+		destinations = append(destinations, newVaultDestination())
+	}
+}
+
+// writeDestinations hands the synced files of cert to every destination.
+func writeDestinations(cert string, files []certFile, changed bool) {
+	for _, d := range destinations {
+		d.write(cert, files, changed)
+	}
+}
+
+// removeCert removes the file of cert with suffix suf from every
+// destination after its key was removed from redis.
+func removeCert(cert string, suf string) {
+	for _, d := range destinations {
+		d.remove(cert, suf)
+	}
+}
+
+// fileDestination is the destination below -certdir. Besides the key and
+// cert files it maintains the files derived from them: the -primary copies,
+// the -explode-chain files and the -out-combined and -out-p12 outputs.
+type fileDestination struct{}
+
+func (fileDestination) write(cert string, files []certFile, changed bool) {
+	updatePrimary(cert, files)
+	explodeChain(cert, files)
+	writeOutputs(cert, files, changed)
+}
+
+func (fileDestination) remove(cert string, suf string) {
+	removeCertFile(cert, suf)
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"path"
+	"slices"
+	"strings"
+)
+
+// checkDiscover validates the -discover patterns.
+func checkDiscover() error {
+	for _, pattern := range config.Discover {
+		_, err := path.Match(pattern, "")
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addCertArgs adds the cert names given on the command line to the watched
+// certs, and those containing glob characters to the -discover patterns. A
+// pattern like *.example.com still matches a cert of that literal name.
+func addCertArgs(args []string) {
+	for _, arg := range args {
+		if strings.ContainsAny(arg, `*?[\`) {
+			config.Discover = append(config.Discover, arg)
+		} else {
+			config.Certs = append(config.Certs, arg)
+		}
+	}
+}
+
+// discoverable reports whether cert matches one of the -discover patterns
+// and -name-regex.
+func discoverable(cert string) bool {
+	if len(cert) == 0 || !nameWatched(cert) {
+		return false
+	}
+	return slices.ContainsFunc(config.Discover, func(pattern string) bool {
+		ok, _ := path.Match(pattern, cert)
+		return ok
+	})
+}
+
+// keyCert returns the cert a file key below the certificates of a key prefix
+// belongs to, the part of the key after certPath. Caddy stores the files of
+// a cert as <cert>/<cert>.crt and <cert>/<cert>.key.
+func keyCert(rel string) (string, string, bool) {
+	cert, file, ok := strings.Cut(rel, "/")
+	if !ok {
+		return "", "", false
+	}
+	for _, suf := range certSuffixes {
+		if file == cert+suf {
+			return cert, suf, true
+		}
+	}
+	return "", "", false
+}
+
+// scanCerts returns the sorted names of the certs below all key prefixes
+// that match -discover and are not watched yet.
+func scanCerts(ctx context.Context) ([]string, error) {
+	watched := watchedCerts()
+	var found []string
+	for _, src := range sources {
+		prefix := certPath(src.prefix)
+		nodes, err := nodeClients(ctx, src.client)
+		if err != nil {
+			return nil, err
+		}
+		for _, node := range nodes {
+			iter := node.Scan(ctx, 0, prefix+"*", 1000).Iterator()
+			for iter.Next(ctx) {
+				cert, _, ok := keyCert(strings.TrimPrefix(iter.Val(), prefix))
+				if !ok || !discoverable(cert) || slices.Contains(watched, cert) || slices.Contains(found, cert) {
+					continue
+				}
+				if checkKey(iter.Val()) != nil {
+					continue
+				}
+				found = append(found, cert)
+			}
+			err := iter.Err()
+			if err != nil {
+				return nil, clusterRedirect(err)
+			}
+		}
+	}
+	slices.Sort(found)
+	return found, nil
+}
+
+// addDiscovered adds cert to the watched certs, unless its name is no valid
+// host name or -max-certs are watched already. Discovered certs stay watched
+// like those given on the command line.
+func addDiscovered(cert string) bool {
+	if !validCertName(cert) {
+		slog.Warn("ignoring discovered cert with invalid name", "cert", cert)
+		return false
+	}
+	certsMu.Lock()
+	defer certsMu.Unlock()
+	if config.MaxCerts > 0 && len(config.Certs) >= config.MaxCerts {
+		slog.Warn("too many certs, not watching discovered cert", "cert", cert, "max", config.MaxCerts)
+		return false
+	}
+	config.Certs = append(config.Certs, cert)
+	if len(config.CertsFromKey) > 0 {
+		staticCerts = append(staticCerts, cert)
+	}
+	state.watch(cert)
+	slog.Info("discovered cert", "cert", cert)
+	return true
+}
+
+// discoverCerts scans the key prefixes for certs matching -discover and
+// watches them. It returns the certs added.
+func discoverCerts(ctx context.Context) ([]string, error) {
+	if len(config.Discover) == 0 {
+		return nil, nil
+	}
+	found, err := scanCerts(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var added []string
+	for _, cert := range found {
+		if addDiscovered(cert) {
+			added = append(added, cert)
+		}
+	}
+	return added, nil
+}
+
+// discoverTarget watches the cert a keyspace notification on channel is
+// about if it is not watched yet but matches -discover and the event wrote
+// one of its files. It returns the cert and the suffix of the file like
+// eventTargets.
+func discoverTarget(channel string, event string) ([]string, string) {
+	if len(config.Discover) == 0 || !slices.Contains([]string{"set", "copy_to", "move_to"}, event) {
+		return nil, ""
+	}
+	for _, src := range sources {
+		rel, ok := strings.CutPrefix(channel, src.keyspacePath())
+		if !ok {
+			continue
+		}
+		cert, suf, ok := keyCert(rel)
+		if !ok || !discoverable(cert) || slices.Contains(watchedCerts(), cert) {
+			return nil, ""
+		}
+		if !addDiscovered(cert) {
+			return nil, ""
+		}
+		return []string{cert}, suf
+	}
+	return nil, ""
+}
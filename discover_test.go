@@ -0,0 +1,30 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestAddCertArgs(t *testing.T) {
+	useTestConfig(t)
+	config.Certs = nil
+	config.Discover = nil
+	addCertArgs([]string{"www.example.org", "*.example.com", "api-?.example.net", "mail.example.org"})
+	if want := []string{"www.example.org", "mail.example.org"}; !slices.Equal(config.Certs, want) {
+		t.Errorf("certs %v, want %v", config.Certs, want)
+	}
+	if want := []string{"*.example.com", "api-?.example.net"}; !slices.Equal(config.Discover, want) {
+		t.Errorf("patterns %v, want %v", config.Discover, want)
+	}
+	for cert, want := range map[string]bool{
+		"www.example.com":   true,
+		"*.example.com":     true,
+		"api-1.example.net": true,
+		"example.com":       false,
+		"www.example.org":   false,
+	} {
+		if got := discoverable(cert); got != want {
+			t.Errorf("discoverable(%q) = %v, want %v", cert, got, want)
+		}
+	}
+}
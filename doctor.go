@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// notifyClasses are the notify-keyspace-events classes certwatch relies on:
+// string commands for set, generic commands for del and expiry and
+// eviction events.
+const notifyClasses = "$gxe"
+
+// doctor collects the results of the -doctor checks.
+type doctor struct {
+	failed int
+}
+
+func (d *doctor) pass(check string, detail string) {
+	fmt.Printf("pass\t%s\t%s\n", check, detail)
+}
+
+func (d *doctor) warn(check string, detail string, hint string) {
+	fmt.Printf("warn\t%s\t%s\n\thint: %s\n", check, detail, hint)
+}
+
+func (d *doctor) fail(check string, detail string, hint string) {
+	fmt.Printf("FAIL\t%s\t%s\n\thint: %s\n", check, detail, hint)
+	d.failed++
+}
+
+// runDoctor checks the configuration for the common causes of certwatch
+// silently doing nothing. It prints a report with remediation hints to
+// stdout and returns checkInSync if all checks passed and checkFailed
+// otherwise.
+func runDoctor(ctx context.Context) int {
+	var d doctor
+	err := client.Ping(ctx).Err()
+	if err != nil {
+		d.fail("redis", err.Error(), "check -redisurl, the server address and the credentials")
+		fmt.Printf("%d checks failed\n", d.failed)
+		return checkFailed
+	}
+	d.pass("redis", "reachable")
+	d.checkNotifications(ctx)
+	d.checkSources(ctx)
+	d.checkCerts(ctx)
+	d.checkCertDir()
+	d.checkCmds()
+	if d.failed > 0 {
+		fmt.Printf("%d checks failed\n", d.failed)
+		return checkFailed
+	}
+	fmt.Println("all checks passed")
+	return checkInSync
+}
+
+// checkNotifications checks that the keyspace notifications certwatch
+// subscribes to are enabled.
+func (d *doctor) checkNotifications(ctx context.Context) {
+	nodes, err := nodeClients(ctx, client)
+	if err != nil {
+		d.fail("notifications", err.Error(), "check that the -cluster nodes are reachable")
+		return
+	}
+	for _, node := range nodes {
+		check := "notifications"
+		if len(nodes) > 1 {
+			check += " " + node.Options().Addr
+		}
+		d.checkNodeNotifications(ctx, check, node)
+	}
+}
+
+// checkNodeNotifications checks the keyspace notifications of one node.
+func (d *doctor) checkNodeNotifications(ctx context.Context, check string, node *redis.Client) {
+	res, err := node.ConfigGet(ctx, "notify-keyspace-events").Result()
+	if err != nil {
+		d.warn(check, err.Error(), "CONFIG GET is not permitted, make sure notify-keyspace-events contains K"+notifyClasses)
+		return
+	}
+	flags := res["notify-keyspace-events"]
+	if !strings.Contains(flags, "K") {
+		d.fail(check, fmt.Sprintf("notify-keyspace-events is %q, keyspace events are disabled", flags), "run CONFIG SET notify-keyspace-events K"+notifyClasses)
+		return
+	}
+	var missing string
+	if !strings.Contains(flags, "A") {
+		for _, c := range notifyClasses {
+			if !strings.ContainsRune(flags, c) {
+				missing += string(c)
+			}
+		}
+	}
+	if len(missing) > 0 {
+		d.fail(check, fmt.Sprintf("notify-keyspace-events is %q, missing %q", flags, missing), "run CONFIG SET notify-keyspace-events "+flags+missing)
+		return
+	}
+	d.pass(check, fmt.Sprintf("notify-keyspace-events is %q", flags))
+}
+
+// checkSources checks that every key prefix holds at least one certificate
+// key below -acmedir.
+func (d *doctor) checkSources(ctx context.Context) {
+	for _, src := range sources {
+		check := "prefix " + src.prefix
+		match := certPath(src.prefix) + "*"
+		keys, err := scanSample(ctx, src.client, match)
+		switch {
+		case err != nil:
+			d.fail(check, err.Error(), "check that the database given for the prefix exists")
+		case len(keys) == 0:
+			d.fail(check, "no key matches "+match, "check -keyprefix and -acmedir against the keys written by caddy")
+		default:
+			d.pass(check, "found "+keys[0])
+		}
+	}
+}
+
+// scanSample returns the keys matching match found by the first SCAN of
+// each node of c.
+func scanSample(ctx context.Context, c redis.UniversalClient, match string) ([]string, error) {
+	nodes, err := nodeClients(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	for _, node := range nodes {
+		found, _, err := node.Scan(ctx, 0, match, 1000).Result()
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, found...)
+	}
+	return keys, nil
+}
+
+// checkCerts checks that all files of the watched certs exist in redis.
+func (d *doctor) checkCerts(ctx context.Context) {
+	for _, cert := range config.Certs {
+		check := "cert " + cert
+		var absent []string
+		var failed error
+		for _, suf := range expectedSuffixes(cert) {
+			_, _, _, err := getValue(ctx, cert, suf)
+			if errors.Is(err, redis.Nil) {
+				absent = append(absent, suf)
+			} else if err != nil {
+				failed = err
+			}
+		}
+		switch {
+		case failed != nil:
+			d.fail(check, failed.Error(), "check the connection to redis")
+		case len(absent) > 0:
+			d.fail(check, "no key for "+strings.Join(absent, ", "), "check the spelling of -cert and that caddy manages this cert")
+		default:
+			d.pass(check, "found")
+		}
+	}
+}
+
+// checkCertDir checks that files can be created in -certdir.
+func (d *doctor) checkCertDir() {
+	const check = "certdir"
+	dir := config.CertDir
+	_, err := os.Stat(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		d.pass(check, dir+" does not exist and will be created")
+		return
+	}
+	f, err := os.CreateTemp(dir, ".certwatch-doctor.*")
+	if err != nil {
+		d.fail(check, err.Error(), "make -certdir writable for the user running certwatch")
+		return
+	}
+	f.Close()
+	os.Remove(f.Name())
+	d.pass(check, dir+" is writable")
+}
+
+// checkCmds checks that the programs run by -pre-cmd, -cmd, -stage-cmd,
+// -service-reload-cmd, -new-cert-cmd, the file hooks and -certcmd can be
+// found.
+// Commands starting with a template action or a variable assignment are
+// skipped.
+func (d *doctor) checkCmds() {
+	d.checkCmd("pre-cmd", config.PreCmd)
+	d.checkCmd("cmd", config.Cmd)
+	d.checkCmd("stage-cmd", config.StageCmd)
+	d.checkCmd("service-reload-cmd", config.ServiceReloadCmd)
+	d.checkCmd("new-cert-cmd", config.NewCertCmd)
+	d.checkCmd("hook-key", config.HookKey)
+	d.checkCmd("hook-crt", config.HookCrt)
+	var certs []string
+	for cert := range config.CertCmds {
+		certs = append(certs, cert)
+	}
+	slices.Sort(certs)
+	for _, cert := range certs {
+		d.checkCmd("certcmd "+cert, config.CertCmds[cert])
+	}
+}
+
+func (d *doctor) checkCmd(check string, text string) {
+	fields := strings.Fields(text)
+	if len(fields) == 0 || strings.Contains(fields[0], "{{") || strings.Contains(fields[0], "=") {
+		return
+	}
+	_, err := exec.LookPath(fields[0])
+	if err != nil {
+		d.fail(check, err.Error(), "use the full path of the program or fix PATH")
+		return
+	}
+	d.pass(check, fields[0]+" found")
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// writeEnvFile writes the -env-file for a batch of changed certs, in a
+// form that can be sourced by sh.
+func writeEnvFile(changed []string) {
+	if len(config.EnvFile) == 0 {
+		return
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "CHANGED_CERTS=%s\n", shquote(strings.Join(changed, ",")))
+	fmt.Fprintf(&b, "CERTDIR=%s\n", shquote(config.CertDir))
+	err := writeFileAtomic(config.EnvFile, []byte(b.String()), time.Now())
+	if err != nil {
+		slog.Error("env file", "file", config.EnvFile, "err", err)
+	}
+}
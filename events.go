@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// Actions of -events-json events.
+const (
+	eventCreated = "created"
+	eventUpdated = "updated"
+	eventRemoved = "removed"
+)
+
+// changeEvent is one line of the -events-json stream.
+type changeEvent struct {
+	Cert        string    `json:"cert"`
+	Action      string    `json:"action"`
+	Time        time.Time `json:"time"`
+	Fingerprint string    `json:"fingerprint,omitempty"`
+	Files       []string  `json:"files"`
+}
+
+var eventsMu sync.Mutex
+
+// emitEvent writes ev as a JSON line to stdout if -events-json is set.
+// Stdout is unbuffered, so every event is visible to the reader at once.
+func emitEvent(ev changeEvent) {
+	if !config.EventsJSON {
+		return
+	}
+	ev.Time = clk.Now().UTC()
+	line, err := json.Marshal(ev)
+	if err != nil {
+		slog.Error("events", "err", err)
+		return
+	}
+	eventsMu.Lock()
+	defer eventsMu.Unlock()
+	_, err = os.Stdout.Write(append(line, '\n'))
+	if err != nil {
+		slog.Error("events", "err", err)
+	}
+}
@@ -0,0 +1,577 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"sync"
+	"text/template"
+	"text/template/parse"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// exitNotFound is the exit status of sh for a command that does not exist.
+const exitNotFound = 127
+
+// cmdData is passed to a templated command. Key and Crt are only set for
+// -stage-cmd and the file hooks and hold the paths of the files, Service is
+// only set for -service-reload-cmd.
+type cmdData struct {
+	Changed []string
+	CertDir string
+	Time    time.Time
+	Key     string
+	Crt     string
+	Service string
+}
+
+var cmdFuncs = template.FuncMap{
+	"shquote":   shquote,
+	"join":      strings.Join,
+	"autoquote": autoquote,
+}
+
+// shellCmd is a command line run by sh. Commands containing template actions
+// are rendered with cmdData before each run, others are run verbatim.
+type shellCmd struct {
+	text string
+	tmpl *template.Template
+	// reload is set for the reload commands, whose output is checked with
+	// -cmd-result-json.
+	reload bool
+}
+
+var (
+	// reloadCmd is the parsed -cmd, nil if none was given.
+	reloadCmd *shellCmd
+	// certCmds are the parsed -certcmd commands by cert name.
+	certCmds = make(map[string]*shellCmd)
+	// stageCmd is the parsed -stage-cmd, nil if none was given.
+	stageCmd *shellCmd
+	// serviceCmd is the parsed -service-reload-cmd, nil if none was given.
+	serviceCmd *shellCmd
+	// preCmd is the parsed -pre-cmd, nil if none was given.
+	preCmd *shellCmd
+	// newCertCmd is the parsed -new-cert-cmd, nil if none was given.
+	newCertCmd *shellCmd
+	// fileHooks are the parsed -hook-key and -hook-crt commands by suffix.
+	fileHooks = make(map[string]*shellCmd)
+)
+
+// parseShellCmd parses a command line, returning nil for an empty one. The
+// output of every action of a template is shell quoted, as the values come
+// from cert names in redis and must never be run as shell code.
+func parseShellCmd(name string, text string) (*shellCmd, error) {
+	if len(text) == 0 {
+		return nil, nil
+	}
+	c := &shellCmd{text: text}
+	if !strings.Contains(text, "{{") {
+		return c, nil
+	}
+	t, err := template.New(name).Funcs(cmdFuncs).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	quoteActions(t.Tree, t.Tree.Root)
+	c.tmpl = t
+	return c, nil
+}
+
+// quoteActions appends autoquote to the pipeline of every action below node
+// that prints its value, unless it ends in shquote or autoquote already.
+func quoteActions(tree *parse.Tree, node parse.Node) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, c := range n.Nodes {
+			quoteActions(tree, c)
+		}
+	case *parse.IfNode:
+		quoteActions(tree, n.List)
+		quoteActions(tree, n.ElseList)
+	case *parse.RangeNode:
+		quoteActions(tree, n.List)
+		quoteActions(tree, n.ElseList)
+	case *parse.WithNode:
+		quoteActions(tree, n.List)
+		quoteActions(tree, n.ElseList)
+	case *parse.ActionNode:
+		pipe := n.Pipe
+		if len(pipe.Decl) > 0 || pipe.IsAssign {
+			return
+		}
+		last := pipe.Cmds[len(pipe.Cmds)-1]
+		if id, ok := last.Args[0].(*parse.IdentifierNode); ok && (id.Ident == "shquote" || id.Ident == "autoquote") {
+			return
+		}
+		quote := parse.NewIdentifier("autoquote").SetTree(tree).SetPos(n.Pos)
+		pipe.Cmds = append(pipe.Cmds, &parse.CommandNode{NodeType: parse.NodeCommand, Pos: n.Pos, Args: []parse.Node{quote}})
+	}
+}
+
+// autoquote quotes v for sh, every string of a slice as a word of its own
+// and anything else as the single word it prints as.
+func autoquote(v any) string {
+	switch v := v.(type) {
+	case string:
+		return shquote(v)
+	case []string:
+		words := make([]string, len(v))
+		for i, s := range v {
+			words[i] = shquote(s)
+		}
+		return strings.Join(words, " ")
+	}
+	return shquote(fmt.Sprint(v))
+}
+
+// parseCmds parses -pre-cmd, -cmd, -stage-cmd, -service-reload-cmd,
+// -new-cert-cmd, the file hooks and all -certcmd commands.
+func parseCmds() error {
+	var err error
+	preCmd, err = parseShellCmd("pre-cmd", config.PreCmd)
+	if err != nil {
+		return err
+	}
+	reloadCmd, err = parseShellCmd("cmd", config.Cmd)
+	if err != nil {
+		return err
+	}
+	stageCmd, err = parseShellCmd("stage-cmd", config.StageCmd)
+	if err != nil {
+		return err
+	}
+	serviceCmd, err = parseShellCmd("service-reload-cmd", config.ServiceReloadCmd)
+	if err != nil {
+		return err
+	}
+	newCertCmd, err = parseShellCmd("new-cert-cmd", config.NewCertCmd)
+	if err != nil {
+		return err
+	}
+	for suf, text := range map[string]string{".key": config.HookKey, ".crt": config.HookCrt} {
+		c, err := parseShellCmd("hook"+suf, text)
+		if err != nil {
+			return err
+		}
+		if c != nil {
+			fileHooks[suf] = c
+		}
+	}
+	for cert, text := range config.CertCmds {
+		c, err := parseShellCmd(cert, text)
+		if err != nil {
+			return err
+		}
+		certCmds[cert] = c
+	}
+	for _, c := range certCmds {
+		c.reload = true
+	}
+	for _, c := range []*shellCmd{reloadCmd, serviceCmd} {
+		if c != nil {
+			c.reload = true
+		}
+	}
+	return nil
+}
+
+// shquote quotes s for use as a single word in sh.
+func shquote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// expand renders the command line with the given data.
+func (c *shellCmd) expand(data cmdData) (string, error) {
+	if c.tmpl == nil {
+		return c.text, nil
+	}
+	var b strings.Builder
+	err := c.tmpl.Execute(&b, data)
+	if err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// validate runs the command as -stage-cmd for the staged key and crt files
+// of cert. A failure of the command is returned together with its output.
+func (c *shellCmd) validate(ctx context.Context, cert string, key string, crt string) error {
+	cmdline, err := c.expand(cmdData{
+		Changed: []string{cert},
+		CertDir: config.CertDir,
+		Time:    time.Now(),
+		Key:     key,
+		Crt:     crt,
+	})
+	if err != nil {
+		return err
+	}
+	slog.Debug("exec stage cmd", "cert", cert, "cmd", cmdline)
+	out, err := exec.CommandContext(ctx, "sh", "-c", cmdline).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%w: %s", err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+// run runs the command for the given changed certs. Standard output and
+// standard error are captured separately and logged under their own keys.
+// A failure is logged and returned.
+func (c *shellCmd) run(ctx context.Context, changed []string) error {
+	return c.runWith(ctx, cmdData{
+		Changed: changed,
+		CertDir: config.CertDir,
+		Time:    time.Now(),
+	})
+}
+
+// runWith runs the command rendered with data.
+func (c *shellCmd) runWith(ctx context.Context, data cmdData) error {
+	changed := data.Changed
+	_, span := tracer.Start(ctx, "exec", trace.WithAttributes(attribute.StringSlice("changed", changed)))
+	var err error
+	defer func() { endSpan(span, err) }()
+	cmdline, err := c.expand(data)
+	if err != nil {
+		slog.Error("expand cmd", "cmd", c.text, "err", err)
+		return err
+	}
+	slog.Info("exec", "cmd", cmdline)
+	var stdout, stderr bytes.Buffer
+	args := append(slices.Clone(priorityArgs), "sh", "-c", cmdline)
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Env = append(os.Environ(), "CERTWATCH_CHANGED="+strings.Join(changed, " "))
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	start := time.Now()
+	err = cmd.Run()
+	duration := time.Since(start)
+	exitCode := -1
+	if cmd.ProcessState != nil {
+		exitCode = cmd.ProcessState.ExitCode()
+	}
+	span.SetAttributes(attribute.Int("exitCode", exitCode))
+	if err != nil {
+		if cmdNotFound(err) {
+			slog.Error("reload command not found, certs were updated on disk", "cmd", cmdline, "changed", changed, "exitCode", exitCode, "duration", duration, "err", err, "stderr", stderr.String())
+		} else {
+			slog.Error("exec failed", "changed", changed, "exitCode", exitCode, "duration", duration, "err", err, "stdout", stdout.String(), "stderr", stderr.String())
+		}
+		return err
+	}
+	if c.reload && config.CmdResultJSON {
+		err = checkCmdResult(stdout.Bytes())
+		if err != nil {
+			slog.Error("reload command reported failure", "changed", changed, "exitCode", exitCode, "duration", duration, "err", err, "stdout", stdout.String(), "stderr", stderr.String())
+			return err
+		}
+	}
+	slog.Info("exec completed", "changed", changed, "exitCode", exitCode, "duration", duration)
+	if stdout.Len() > 0 || stderr.Len() > 0 {
+		slog.Debug("exec", "stdout", stdout.String(), "stderr", stderr.String())
+	}
+	return nil
+}
+
+// runPreCmd runs -pre-cmd once at startup, before anything is read from or
+// written to CertDir. Its output is logged like that of the reload command,
+// a failure is returned together with its standard error.
+func runPreCmd(ctx context.Context) error {
+	if preCmd == nil {
+		return nil
+	}
+	cmdline, err := preCmd.expand(cmdData{CertDir: config.CertDir, Time: time.Now()})
+	if err != nil {
+		return err
+	}
+	slog.Info("exec pre cmd", "cmd", cmdline)
+	var stdout, stderr bytes.Buffer
+	args := append(slices.Clone(priorityArgs), "sh", "-c", cmdline)
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	start := time.Now()
+	err = cmd.Run()
+	duration := time.Since(start)
+	if err != nil {
+		slog.Error("pre cmd failed", "duration", duration, "err", err, "stdout", stdout.String(), "stderr", stderr.String())
+		return fmt.Errorf("%w: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	slog.Info("pre cmd completed", "duration", duration)
+	if stdout.Len() > 0 || stderr.Len() > 0 {
+		slog.Debug("pre cmd", "stdout", stdout.String(), "stderr", stderr.String())
+	}
+	return nil
+}
+
+// errCmdResult is returned for a reload command that exited successfully but
+// reported a failure in its JSON result.
+var errCmdResult = errors.New("reload command result")
+
+// checkCmdResult checks the standard output of a reload command with
+// -cmd-result-json. It must be a JSON object whose -cmd-result-field, a
+// dotted path into nested objects, is true. Anything else is a failure,
+// described by the -cmd-result-error field if the result has one.
+func checkCmdResult(out []byte) error {
+	var obj map[string]json.RawMessage
+	err := json.Unmarshal(bytes.TrimSpace(out), &obj)
+	if err != nil {
+		return fmt.Errorf("%w: output is no JSON object: %w", errCmdResult, err)
+	}
+	path := strings.Split(config.CmdResultField, ".")
+	for _, name := range path[:len(path)-1] {
+		raw, ok := lookupField(obj, name)
+		var next map[string]json.RawMessage
+		if !ok || json.Unmarshal(raw, &next) != nil {
+			return fmt.Errorf("%w: field %q not found", errCmdResult, config.CmdResultField)
+		}
+		obj = next
+	}
+	raw, ok := lookupField(obj, path[len(path)-1])
+	if !ok {
+		return fmt.Errorf("%w: field %q not found", errCmdResult, config.CmdResultField)
+	}
+	var success bool
+	if json.Unmarshal(raw, &success) == nil && success {
+		return nil
+	}
+	msg := string(raw)
+	if raw, ok := lookupField(obj, config.CmdResultError); ok {
+		var s string
+		if json.Unmarshal(raw, &s) != nil {
+			s = string(raw)
+		}
+		msg += ": " + s
+	}
+	return fmt.Errorf("%w: %s is %s", errCmdResult, config.CmdResultField, msg)
+}
+
+// Reload modes accepted by -cmd-mode.
+const (
+	cmdModeOneshot = "oneshot" // run -cmd and wait for it to exit
+	cmdModeSignal  = "signal"  // signal the process in -cmd-pidfile
+	cmdModeSystemd = "systemd" // reload the systemd unit -cmd-unit
+	cmdModeWebhook = "webhook" // post the changed certs to -cmd-webhook
+)
+
+// checkCmdMode checks -cmd-mode and the flags it depends on and sets
+// cmdReload for the built-in modes.
+func checkCmdMode() error {
+	var e reloadEntry
+	switch config.CmdMode {
+	case cmdModeOneshot:
+		return nil
+	case cmdModeSignal:
+		if len(config.CmdPidfile) == 0 {
+			return errors.New("-cmd-mode signal needs -cmd-pidfile")
+		}
+		e = reloadEntry{Pidfile: config.CmdPidfile, Signal: config.CmdSignal}
+	case cmdModeSystemd:
+		if len(config.CmdUnit) == 0 {
+			return errors.New("-cmd-mode systemd needs -cmd-unit")
+		}
+		e = reloadEntry{Unit: config.CmdUnit, Restart: config.CmdUnitRestart}
+	case cmdModeWebhook:
+		if len(config.CmdWebhook) == 0 {
+			return errors.New("-cmd-mode webhook needs -cmd-webhook")
+		}
+		e = reloadEntry{Webhook: config.CmdWebhook}
+	default:
+		return fmt.Errorf("unknown mode %q", config.CmdMode)
+	}
+	if len(config.Cmd) > 0 {
+		return fmt.Errorf("-cmd-mode %s replaces -cmd, give only one of them", config.CmdMode)
+	}
+	a, err := newReloadAction(e)
+	if err != nil {
+		return err
+	}
+	cmdReload = &a
+	return nil
+}
+
+// runFileHook runs the hook for the suffix of a cert file that was just
+// written, with {{.Key}} or {{.Crt}} set to its path, or to the path of an
+// uncompressed copy of data if the cert is compressed.
+func runFileHook(ctx context.Context, cert string, suf string, fname string, plain []byte) {
+	c, ok := fileHooks[suf]
+	if !ok {
+		return
+	}
+	if compressed(cert) {
+		paths, cleanup, err := plainFiles(cert, map[string][]byte{suf: plain})
+		if err != nil {
+			slog.Error("runFileHook", "cert", cert, "err", err)
+			state.hookFailed(err)
+			return
+		}
+		defer cleanup()
+		fname = paths[suf]
+	}
+	data := cmdData{
+		Changed: []string{cert},
+		CertDir: config.CertDir,
+		Time:    time.Now(),
+	}
+	if suf == ".key" {
+		data.Key = fname
+	} else {
+		data.Crt = fname
+	}
+	err := c.runWith(ctx, data)
+	if err != nil {
+		state.hookFailed(err)
+	}
+}
+
+// runCmd writes the -env-file and runs the configured command, or the
+// built-in reload of -cmd-mode, after certificates have been changed,
+// followed by the per cert commands and reloads of the changed certs and the
+// reloads of the services owning them, and then checks the served certs
+// given by -verify-serve. The reload error is recorded once for the whole
+// run, so a later success does not hide an earlier failure. Failures of the
+// -certcmd and -service-reload-cmd hooks are recorded separately.
+func runCmd(ctx context.Context, changed []string) {
+	writeEnvFile(changed)
+	var errs []error
+	if cmdReload != nil {
+		errs = append(errs, cmdReload.run(ctx, changed))
+	} else if reloadCmd != nil {
+		errs = append(errs, reloadCmd.run(ctx, changed))
+	}
+	hookErrs := []error{runCertCmds(ctx, changed)}
+	errs = append(errs, runCertReloads(ctx, changed))
+	hookErrs = append(hookErrs, runServiceCmds(ctx, changed))
+	state.setCmdError(errors.Join(errs...))
+	if err := errors.Join(hookErrs...); err != nil {
+		state.hookFailed(err)
+	}
+	verifyServed(ctx, changed)
+}
+
+// cmdQueue runs the commands of -cmd-async in the background, one batch at
+// a time. Changes arriving while a batch runs are merged into the next one,
+// batches still queued on shutdown are dropped.
+type cmdQueue struct {
+	mu      sync.Mutex
+	pending []string
+	// ctx is the context of the last enqueue, the next batch runs with it
+	ctx     context.Context
+	running bool
+	wg      sync.WaitGroup
+}
+
+var asyncCmds cmdQueue
+
+// enqueue adds changed to the next batch and starts a runner if none is
+// active.
+func (q *cmdQueue) enqueue(ctx context.Context, changed []string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, cert := range changed {
+		if !slices.Contains(q.pending, cert) {
+			q.pending = append(q.pending, cert)
+		}
+	}
+	q.ctx = ctx
+	if q.running {
+		slog.Debug("cmd queued", "pending", q.pending)
+		return
+	}
+	q.running = true
+	q.wg.Add(1)
+	go q.loop()
+}
+
+func (q *cmdQueue) loop() {
+	defer q.wg.Done()
+	for {
+		q.mu.Lock()
+		batch, ctx := q.pending, q.ctx
+		q.pending = nil
+		if len(batch) == 0 {
+			q.running = false
+			q.ctx = nil
+			q.mu.Unlock()
+			return
+		}
+		q.mu.Unlock()
+		if ctx.Err() != nil {
+			slog.Warn("queued command dropped by shutdown", "changed", batch)
+			continue
+		}
+		runCmd(ctx, batch)
+	}
+}
+
+// drain waits until the running batch is done and the queued ones are
+// dropped or run.
+func (q *cmdQueue) drain() {
+	q.wg.Wait()
+}
+
+// runCertCmds runs the -certcmd commands of the changed certs with at most
+// -cmd-concurrency of them in parallel. Commands start in the order of
+// changed, the others wait in that order for a free slot. Commands still
+// waiting when ctx is cancelled are dropped. The failures are returned
+// joined.
+func runCertCmds(ctx context.Context, changed []string) error {
+	limit := max(config.CmdConcurrency, 1)
+	sem := make(chan struct{}, limit)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var errs []error
+	for _, cert := range changed {
+		c, ok := certCmds[cert]
+		if !ok {
+			continue
+		}
+		select {
+		case sem <- struct{}{}:
+		default:
+			slog.Info("cert command queued", "cert", cert, "limit", limit)
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				slog.Warn("cert command cancelled", "cert", cert, "err", ctx.Err())
+				continue
+			}
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			err := c.run(ctx, []string{cert})
+			mu.Lock()
+			errs = append(errs, err)
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// cmdNotFound reports whether err means that the command, or the shell
+// running it, could not be found.
+func cmdNotFound(err error) bool {
+	if errors.Is(err, exec.ErrNotFound) || errors.Is(err, fs.ErrNotExist) {
+		return true
+	}
+	var exitErr *exec.ExitError
+	return errors.As(err, &exitErr) && exitErr.ExitCode() == exitNotFound
+}
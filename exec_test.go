@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestExpandQuotes(t *testing.T) {
+	evil := []string{"a.example.com", "$(touch /tmp/pwned)", "b'; rm -rf /; '"}
+	tests := []struct {
+		tmpl string
+		want string
+	}{
+		{"echo {{.Changed}}", "a.example.com\n$(touch /tmp/pwned)\nb'; rm -rf /; '"},
+		{"echo {{range .Changed}}svc-{{.}} {{end}}", "svc-a.example.com\nsvc-$(touch /tmp/pwned)\nsvc-b'; rm -rf /; '"},
+		{"echo {{join .Changed \",\"}}", "a.example.com,$(touch /tmp/pwned),b'; rm -rf /; '"},
+		{"echo {{range .Changed}}{{shquote (print \"x-\" .)}} {{end}}", "x-a.example.com\nx-$(touch /tmp/pwned)\nx-b'; rm -rf /; '"},
+		{"echo {{$n := len .Changed}}{{$n}}", "3"},
+		{"echo {{if .Changed}}{{index .Changed 1}}{{end}}", "$(touch /tmp/pwned)"},
+	}
+	for _, tt := range tests {
+		c, err := parseShellCmd("test", tt.tmpl)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.tmpl, err)
+		}
+		cmdline, err := c.expand(cmdData{Changed: evil})
+		if err != nil {
+			t.Fatalf("%s: %v", tt.tmpl, err)
+		}
+		// print every argument of echo on its own line
+		out, err := exec.Command("sh", "-c", strings.Replace(cmdline, "echo", "printf '%s\\n'", 1)).Output()
+		if err != nil {
+			t.Fatalf("%s: %s: %v", tt.tmpl, cmdline, err)
+		}
+		if got := strings.TrimSuffix(string(out), "\n"); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.tmpl, got, tt.want)
+		}
+	}
+}
+
+func TestValidCertName(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"example.com", true},
+		{"*.example.com", true},
+		{"mail-1.example.org", true},
+		{"localhost", true},
+		{"", false},
+		{"*.", false},
+		{"*", false},
+		{"a..b", false},
+		{"-a.example.com", false},
+		{"a-.example.com", false},
+		{"a.*.example.com", false},
+		{"$(id).example.com", false},
+		{"a b", false},
+		{"a;b", false},
+		{strings.Repeat("a", 64) + ".com", false},
+	}
+	for _, tt := range tests {
+		if got := validCertName(tt.name); got != tt.want {
+			t.Errorf("validCertName(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRunLogsNotFound(t *testing.T) {
+	var buf bytes.Buffer
+	old := slog.Default()
+	defer slog.SetDefault(old)
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&buf, nil)))
+	c, err := parseShellCmd("cmd", "certwatch-no-such-command")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.run(context.Background(), []string{"www.example.com"})
+	if !cmdNotFound(err) {
+		t.Fatalf("got %v, want a not found error", err)
+	}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var rec map[string]any
+		err := json.Unmarshal([]byte(line), &rec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rec["level"] != "ERROR" {
+			continue
+		}
+		if rec["exitCode"] != float64(exitNotFound) || rec["duration"] == nil {
+			t.Errorf("not found logged without exit code or duration: %s", line)
+		}
+		return
+	}
+	t.Errorf("not found not logged: %s", buf.String())
+}
+
+func TestCmdQueueShutdown(t *testing.T) {
+	runs := useRecordedCmd(t)
+	config.CmdAsync = true
+	// the first run blocks until release exists
+	release := filepath.Join(t.TempDir(), "release")
+	c, err := parseShellCmd("cmd", reloadCmd.text+"; while [ ! -e "+shquote(release)+" ]; do sleep 0.01; done")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloadCmd = c
+	var q cmdQueue
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	q.enqueue(ctx, []string{"a.example.com"})
+	waitFor(t, "the first run", func() bool { return runs()[0] != "" })
+	q.enqueue(ctx, []string{"b.example.com"})
+	cancel()
+	err = os.WriteFile(release, nil, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.drain()
+	if got := runs(); !slices.Equal(got, []string{"a.example.com"}) {
+		t.Errorf("runs %q, want the queued run dropped on shutdown", got)
+	}
+}
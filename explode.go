@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/pem"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+)
+
+// explodedPath returns the file name of the n-th certificate of the chain of
+// cert with -explode-chain: <name>.0.pem for the leaf, <name>.1.pem for the
+// first intermediate and so on, in the order of the .crt.
+func explodedPath(cert string, n int) string {
+	return path.Join(certDir(cert), localName(cert)+"."+strconv.Itoa(n)+".pem")
+}
+
+// explodedFiles returns the numbered chain files of cert present locally,
+// by their number.
+func explodedFiles(cert string) (map[int]string, error) {
+	dir := filepath.Dir(explodedPath(cert, 0))
+	re := regexp.MustCompile(`^` + regexp.QuoteMeta(path.Base(localName(cert))) + `\.([0-9]+)\.pem$`)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	files := make(map[int]string)
+	for _, e := range entries {
+		m := re.FindStringSubmatch(e.Name())
+		if m == nil || !e.Type().IsRegular() {
+			continue
+		}
+		n, err := strconv.Atoi(m[1])
+		if err != nil {
+			continue
+		}
+		files[n] = filepath.Join(dir, e.Name())
+	}
+	return files, nil
+}
+
+// explodeChain writes every certificate of the chain of cert to its own
+// numbered file if -explode-chain is set. Files that are current are left
+// alone, and files numbered beyond the end of the chain, left from a longer
+// chain, are removed. Errors are logged, the cert files are installed
+// already.
+func explodeChain(cert string, files []certFile) {
+	if !config.ExplodeChain {
+		return
+	}
+	for _, f := range files {
+		if f.suffix != ".crt" {
+			continue
+		}
+		ders := certBlocks(f.data)
+		if len(ders) == 0 {
+			slog.Warn("explode chain: no CERTIFICATE block found", "cert", cert)
+			return
+		}
+		for n, der := range ders {
+			fname := explodedPath(cert, n)
+			data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+			if config.LineEnding == lineEndingCRLF {
+				data, _ = reencodePEM(data, true)
+			}
+			current, err := sameContents(fname, data)
+			if err == nil && current {
+				continue
+			}
+			err = writeFileAtomic(fname, data, f.modified)
+			if err != nil {
+				slog.Error("explode chain", "cert", cert, "file", fname, "err", err)
+				return
+			}
+			slog.Debug("explode chain", "cert", cert, "file", fname)
+		}
+		removeExploded(cert, len(ders))
+	}
+}
+
+// removeExploded removes the numbered chain files of cert numbered from or
+// higher, all of them for 0.
+func removeExploded(cert string, from int) {
+	if !config.ExplodeChain {
+		return
+	}
+	files, err := explodedFiles(cert)
+	if err != nil {
+		slog.Error("explode chain", "cert", cert, "err", err)
+		return
+	}
+	for n, fname := range files {
+		if n < from {
+			continue
+		}
+		err = os.Remove(fname)
+		if err != nil {
+			slog.Error("explode chain", "cert", cert, "file", fname, "err", err)
+			continue
+		}
+		slog.Info("removed chain file", "cert", cert, "file", fname)
+	}
+}
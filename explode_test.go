@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestExplodeChain(t *testing.T) {
+	useTestConfig(t)
+	config.ExplodeChain = true
+	const cert = "www.example.com"
+	// chain returns a chain of n certificates, made distinct by renewal
+	chain := func(n int, renewal int) [][]byte {
+		var ders [][]byte
+		for i := range n {
+			ders = append(ders, []byte(fmt.Sprintf("renewal %d cert %d", renewal, i)))
+		}
+		return ders
+	}
+	tests := []struct {
+		name   string
+		length int
+	}{
+		{"leaf and intermediates", 3},
+		{"shrunk to the leaf", 1},
+		{"grown", 4},
+		{"same length", 4},
+		{"shrunk", 2},
+	}
+	for renewal, tt := range tests {
+		ders := chain(tt.length, renewal)
+		explodeChain(cert, []certFile{{suffix: ".crt", data: pemChain(ders...), modified: time.Now()}})
+		files, err := explodedFiles(cert)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []int
+		for n := range files {
+			got = append(got, n)
+		}
+		slices.Sort(got)
+		if len(got) != tt.length || len(got) > 0 && got[len(got)-1] != tt.length-1 {
+			t.Errorf("%s: files %v, want 0 to %d", tt.name, got, tt.length-1)
+			continue
+		}
+		for n, der := range ders {
+			data, err := os.ReadFile(explodedPath(cert, n))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(data, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})) {
+				t.Errorf("%s: file %d does not hold certificate %d", tt.name, n, n)
+			}
+		}
+	}
+	removeExploded(cert, 0)
+	files, err := explodedFiles(cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) > 0 {
+		t.Errorf("files left after removal: %v", files)
+	}
+}
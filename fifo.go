@@ -0,0 +1,53 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"log/slog"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// ensureFifo creates the named pipe at fname unless it already exists.
+func ensureFifo(fname string) error {
+	finfo, err := os.Stat(fname)
+	if err == nil {
+		if finfo.Mode()&fs.ModeNamedPipe == 0 {
+			return &fs.PathError{Op: "ensureFifo", Path: fname, Err: errors.New("not a named pipe")}
+		}
+		return nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	slog.Info("creating fifo", "fifo", fname)
+	return mkfifo(fname, 0600)
+}
+
+// notifyFifo writes the changed cert names, one per line, to the notify
+// fifo. The fifo is opened non-blocking so a missing reader never stalls the
+// listen loop, the notification is dropped instead.
+func notifyFifo(changed []string) {
+	if len(config.NotifyFifo) == 0 {
+		return
+	}
+	f, err := openFifo(config.NotifyFifo)
+	if err != nil {
+		if errors.Is(err, syscall.ENXIO) {
+			slog.Debug("notify fifo has no reader", "fifo", config.NotifyFifo)
+			return
+		}
+		slog.Error("notify fifo", "err", err)
+		return
+	}
+	defer f.Close()
+	_, err = f.WriteString(strings.Join(changed, "\n") + "\n")
+	if err != nil {
+		if errors.Is(err, syscall.EPIPE) {
+			slog.Debug("notify fifo reader went away", "fifo", config.NotifyFifo)
+			return
+		}
+		slog.Error("notify fifo", "err", err)
+	}
+}
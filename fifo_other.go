@@ -0,0 +1,18 @@
+//go:build !unix
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+var errNoFifo = errors.New("named pipes are not supported on this platform")
+
+func mkfifo(fname string, mode uint32) error {
+	return &os.PathError{Op: "mkfifo", Path: fname, Err: errNoFifo}
+}
+
+func openFifo(fname string) (*os.File, error) {
+	return nil, &os.PathError{Op: "open", Path: fname, Err: errNoFifo}
+}
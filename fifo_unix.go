@@ -0,0 +1,21 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+func mkfifo(fname string, mode uint32) error {
+	err := syscall.Mkfifo(fname, mode)
+	if err != nil {
+		return &os.PathError{Op: "mkfifo", Path: fname, Err: err}
+	}
+	return nil
+}
+
+// openFifo opens the fifo for writing without blocking for a reader.
+func openFifo(fname string) (*os.File, error) {
+	return os.OpenFile(fname, os.O_WRONLY|syscall.O_NONBLOCK, 0)
+}
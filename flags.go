@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// stringsFlag is a flag.Value that collects the values of a repeated flag.
+type stringsFlag []string
+
+func (s *stringsFlag) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringsFlag) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
+// certSpecFlag parses -cert name=<local>,keypath=<rediskey>,crtpath=<rediskey>
+// into config.Certs and config.CertKeys, and
+// -cert name=<local>,issuer=<issuer>[,domain=<domain>] into config.Certs and
+// config.IssuerCerts.
+type certSpecFlag struct{}
+
+func (certSpecFlag) String() string {
+	return ""
+}
+
+func (certSpecFlag) Set(v string) error {
+	var name string
+	var ic issuerCert
+	keys := make(map[string]string)
+	for _, field := range strings.Split(v, ",") {
+		k, val, ok := strings.Cut(field, "=")
+		if !ok || len(val) == 0 {
+			return fmt.Errorf("invalid cert spec field %q", field)
+		}
+		switch k {
+		case "name":
+			name = val
+		case "keypath":
+			keys[".key"] = val
+		case "crtpath":
+			keys[".crt"] = val
+		case "issuer":
+			ic.Issuer = val
+		case "domain":
+			ic.Domain = val
+		default:
+			return fmt.Errorf("unknown cert spec field %q", k)
+		}
+	}
+	if len(name) == 0 {
+		return errors.New("cert spec needs a name")
+	}
+	if len(ic.Issuer) > 0 {
+		if len(keys) > 0 {
+			return errors.New("cert spec cannot have both issuer and keypath or crtpath")
+		}
+		if len(ic.Domain) == 0 {
+			ic.Domain = name
+		}
+		if config.IssuerCerts == nil {
+			config.IssuerCerts = make(map[string]issuerCert)
+		}
+		config.Certs = append(config.Certs, name)
+		config.IssuerCerts[name] = ic
+		return nil
+	}
+	if len(keys) == 0 {
+		return errors.New("cert spec needs keypath, crtpath or issuer")
+	}
+	if config.CertKeys == nil {
+		config.CertKeys = make(map[string]map[string]string)
+	}
+	config.Certs = append(config.Certs, name)
+	config.CertKeys[name] = keys
+	return nil
+}
+
+// mapFlag is a flag.Value collecting repeated key=value pairs.
+type mapFlag map[string]string
+
+func (m mapFlag) String() string {
+	var pairs []string
+	for k, v := range m {
+		pairs = append(pairs, k+"="+v)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (m mapFlag) Set(v string) error {
+	k, val, ok := strings.Cut(v, "=")
+	if !ok || len(k) == 0 {
+		return fmt.Errorf("expected key=value, got %q", v)
+	}
+	m[k] = val
+	return nil
+}
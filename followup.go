@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"time"
+)
+
+// drainTimeout is the receive timeout while draining the events that
+// queued up during a command run. A receive timing out means the queue is
+// empty.
+const drainTimeout = 50 * time.Millisecond
+
+// maxDrain is the longest draining goes on. Once it passed, the follow-up
+// run starts even though events keep arriving, so a steady stream of events
+// does not put it off indefinitely.
+const maxDrain = 5 * time.Second
+
+// followUp batches the changes of all events that arrived while a
+// synchronous command ran into a single follow-up run, instead of one run
+// per event. It is only used by the listen loop. With -cmd-async the
+// command queue batches the changes itself, and during -initial-settle the
+// settle window holds them back first.
+type followUp struct {
+	draining bool
+	// since is when draining started
+	since   time.Time
+	changed []string
+}
+
+// ran starts draining after a synchronous command run.
+func (f *followUp) ran() {
+	if !config.CmdAsync {
+		if !f.draining {
+			f.since = clk.Now()
+		}
+		f.draining = true
+	}
+}
+
+// timeout caps the receive timeout while draining.
+func (f *followUp) timeout(timeout time.Duration) time.Duration {
+	if f.draining {
+		return min(timeout, drainTimeout)
+	}
+	return timeout
+}
+
+// hold adds changed to the follow-up run.
+func (f *followUp) hold(changed []string) {
+	for _, cert := range changed {
+		if !slices.Contains(f.changed, cert) {
+			f.changed = append(f.changed, cert)
+		}
+	}
+}
+
+// done ends draining once a receive came back empty or maxDrain passed and
+// returns the changes to run the follow-up command for, if any.
+func (f *followUp) done(received bool) []string {
+	if !f.draining || received && clk.Now().Sub(f.since) < maxDrain {
+		return nil
+	}
+	changed := f.changed
+	f.draining = false
+	f.changed = nil
+	return changed
+}
+
+// flush runs the pending follow-up command when the listen loop ends before
+// draining is done, also on shutdown.
+func (f *followUp) flush(ctx context.Context) {
+	changed := f.changed
+	f.draining = false
+	f.changed = nil
+	if len(changed) == 0 {
+		return
+	}
+	runHeld(ctx, "follow-up command", changed)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+func TestFollowUpMaxDrain(t *testing.T) {
+	c := useFakeClock(t)
+	var f followUp
+	f.ran()
+	for i := 0; clk.Now().Sub(f.since) < maxDrain; i++ {
+		f.hold([]string{"www.example.com"})
+		if held := f.done(true); held != nil {
+			t.Fatalf("event %d: follow-up run after %v", i, clk.Now().Sub(f.since))
+		}
+		c.advance(time.Second)
+	}
+	held := f.done(true)
+	if !slices.Equal(held, []string{"www.example.com"}) {
+		t.Errorf("after %v: got %v, want the held changes", maxDrain, held)
+	}
+	if f.draining {
+		t.Error("still draining after the follow-up run")
+	}
+}
+
+func TestFollowUpEmptyReceive(t *testing.T) {
+	useFakeClock(t)
+	var f followUp
+	f.ran()
+	f.hold([]string{"a.example.com", "b.example.com", "a.example.com"})
+	if held := f.done(true); held != nil {
+		t.Errorf("follow-up run while events arrive: %v", held)
+	}
+	held := f.done(false)
+	if !slices.Equal(held, []string{"a.example.com", "b.example.com"}) {
+		t.Errorf("got %v", held)
+	}
+}
+
+func TestFollowUpFlushOnShutdown(t *testing.T) {
+	useFakeClock(t)
+	runs := useRecordedCmd(t)
+	var f followUp
+	f.ran()
+	f.hold([]string{"www.example.com"})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	f.flush(ctx)
+	if got := runs(); !slices.Equal(got, []string{"www.example.com"}) {
+		t.Errorf("runs %q, want the follow-up run on shutdown", got)
+	}
+}
+
+func TestFollowUpBurstDuringRun(t *testing.T) {
+	runs := useRecordedCmd(t)
+	oldSwept := swept
+	defer func() { swept = oldSwept }()
+	swept = false
+	config.SleepTime = time.Second
+	config.Debounce = 0
+	config.Certs = []string{"a.example.com", "b.example.com", "c.example.com"}
+	// the first run blocks until release exists, the later ones find it
+	release := filepath.Join(t.TempDir(), "release")
+	cmd, err := parseShellCmd("cmd", reloadCmd.text+"; while [ ! -e "+shquote(release)+" ]; do sleep 0.01; done")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloadCmd = cmd
+	r := useFakeRedis(t, map[string]string{})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- listenRedis(ctx) }()
+	defer func() {
+		os.WriteFile(release, nil, 0o644)
+		cancel()
+		<-done
+	}()
+	waitFor(t, "the subscription", func() bool {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		return len(r.subscribers) > 0
+	})
+	v := newTestVersion(t)
+	c := redis.NewClient(&redis.Options{Addr: client.(*redis.Client).Options().Addr, Protocol: 2, DisableIndentity: true})
+	defer c.Close()
+	// the keys are stored without an event, so every cert changes with the
+	// event for its .crt
+	for _, cert := range config.Certs {
+		r.set(certKey(cert, ".key"), storedValue(string(v.key), 1))
+	}
+	set := func(cert string) {
+		t.Helper()
+		err := c.Set(ctx, certKey(cert, ".crt"), storedValue(string(v.crt), 1), 0).Err()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	set("a.example.com")
+	waitFor(t, "the first run", func() bool { return len(runs()) == 1 && runs()[0] != "" })
+	// a burst of changes while the command still runs
+	set("b.example.com")
+	set("c.example.com")
+	set("b.example.com")
+	err = os.WriteFile(release, nil, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the follow-up run", func() bool { return len(runs()) >= 2 })
+	// a further run would follow within the drain timeout
+	time.Sleep(4 * drainTimeout)
+	want := []string{"a.example.com", "b.example.com c.example.com"}
+	if got := runs(); !slices.Equal(got, want) {
+		t.Errorf("runs %q, want %q", got, want)
+	}
+}
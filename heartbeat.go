@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"os"
+	"time"
+)
+
+// startHeartbeat touches -heartbeat-file every -heartbeat-interval as long
+// as the keyspace subscription is up and the listen loop keeps reporting
+// that it is alive, so an external watchdog watching its modification time
+// can restart a wedged process. The returned function stops the heartbeat
+// and removes the file, so the watchdog can tell a shutdown from a hang.
+func startHeartbeat(ctx context.Context) func() {
+	if len(config.HeartbeatFile) == 0 || config.HeartbeatInterval <= 0 {
+		return func() {}
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	// the listen loop beats at least once per receive timeout
+	stale := 2 * max(config.HeartbeatInterval, config.SleepTime)
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(config.HeartbeatInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+			if !state.report().Subscribed || clk.Now().Sub(state.lastAlive()) >= stale {
+				slog.Debug("heartbeat skipped", "file", config.HeartbeatFile, "lastAlive", state.lastAlive())
+				continue
+			}
+			err := touch(config.HeartbeatFile)
+			if err != nil {
+				slog.Warn("heartbeat", "file", config.HeartbeatFile, "err", err)
+			}
+		}
+	}()
+	return func() {
+		cancel()
+		<-done
+		err := os.Remove(config.HeartbeatFile)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			slog.Warn("heartbeat", "file", config.HeartbeatFile, "err", err)
+		}
+	}
+}
+
+// touch sets the modification time of fname to now, creating it if needed.
+func touch(fname string) error {
+	now := clk.Now()
+	err := os.Chtimes(fname, now, now)
+	if errors.Is(err, fs.ErrNotExist) {
+		return os.WriteFile(fname, nil, 0644)
+	}
+	return err
+}
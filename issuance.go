@@ -0,0 +1,219 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// issuance identifies one issuance of a cert for the {{.Serial}} and
+// {{.NotBefore}} fields of -name-template.
+type issuance struct {
+	// Serial is the serial number of the leaf in lower case hex.
+	Serial string
+	// NotBefore is the start of validity of the leaf as 20060102T150405Z.
+	NotBefore string
+}
+
+// notBeforeLayout is the format of issuance.NotBefore.
+const notBeforeLayout = "20060102T150405Z"
+
+// Placeholders rendered for the issuance fields to find the files of all
+// issuances of a cert.
+const (
+	serialPlaceholder    = "\ue000"
+	notBeforePlaceholder = "\ue001"
+)
+
+// nameUsesIssuance is set if -name-template refers to the issuance fields.
+var nameUsesIssuance bool
+
+// issuances holds the issuance of the installed leaf of each cert.
+var issuances sync.Map
+
+// issued returns the issuance of the installed leaf of cert, the zero value
+// if none is known.
+func issued(cert string) issuance {
+	iss, _ := issuances.Load(cert)
+	v, _ := iss.(issuance)
+	return v
+}
+
+// leafIssuance returns the issuance of the leaf in the PEM data.
+func leafIssuance(data []byte) (issuance, error) {
+	leaf, err := parseLeaf(data)
+	if err != nil {
+		return issuance{}, err
+	}
+	return issuance{
+		Serial:    leaf.SerialNumber.Text(16),
+		NotBefore: leaf.NotBefore.UTC().Format(notBeforeLayout),
+	}, nil
+}
+
+// issuanceFrom returns the issuance of the cert file among files, or the one
+// installed if there is none or it does not parse.
+func issuanceFrom(cert string, files []certFile) issuance {
+	for _, f := range files {
+		if f.suffix != ".crt" {
+			continue
+		}
+		iss, err := leafIssuance(f.data)
+		if err != nil {
+			slog.Warn("issuance for the file name", "cert", cert, "err", err)
+			break
+		}
+		return iss
+	}
+	return issued(cert)
+}
+
+// nameIssuance sets the local file names of the fetched files from the
+// issuance of their leaf.
+func nameIssuance(cert string, files []certFile) {
+	if !nameUsesIssuance {
+		return
+	}
+	iss := issuanceFrom(cert, files)
+	for i := range files {
+		files[i].fname = path.Join(certDir(cert), renderName(nameData{Name: cert, issuance: iss})+localSuffix(cert, files[i].suffix))
+	}
+}
+
+// checkIssuanceTemplate sets nameUsesIssuance from the parsed template. The
+// issuance fields are only allowed in the last path element, the files of
+// older issuances could not be found otherwise.
+func checkIssuanceTemplate() error {
+	name := renderName(nameData{Name: "example.com", issuance: issuance{Serial: serialPlaceholder, NotBefore: notBeforePlaceholder}})
+	nameUsesIssuance = strings.Contains(name, serialPlaceholder) || strings.Contains(name, notBeforePlaceholder)
+	dir := path.Dir(name)
+	if strings.Contains(dir, serialPlaceholder) || strings.Contains(dir, notBeforePlaceholder) {
+		return errors.New("{{.Serial}} and {{.NotBefore}} must be used in the file name, not in a directory")
+	}
+	if !nameUsesIssuance && config.KeepIssuances > 0 {
+		return errors.New("-keep-issuances needs {{.Serial}} or {{.NotBefore}} in -name-template")
+	}
+	return nil
+}
+
+// issuancePattern returns the directory of the files of cert with the given
+// suffix and a regexp matching the base names of all its issuances.
+func issuancePattern(cert string, suf string) (string, *regexp.Regexp) {
+	name := path.Join(certDir(cert), renderName(nameData{Name: cert, issuance: issuance{Serial: serialPlaceholder, NotBefore: notBeforePlaceholder}})+localSuffix(cert, suf))
+	expr := regexp.QuoteMeta(path.Base(name))
+	expr = strings.ReplaceAll(expr, serialPlaceholder, "[0-9a-f]+")
+	expr = strings.ReplaceAll(expr, notBeforePlaceholder, "[0-9]{8}T[0-9]{6}Z")
+	return path.Dir(name), regexp.MustCompile("^" + expr + "$")
+}
+
+// issuanceFiles returns the local files of all issuances of cert with the
+// given suffix, newest first by modification time.
+func issuanceFiles(cert string, suf string) ([]string, error) {
+	dir, re := issuancePattern(cert, suf)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var fnames []string
+	mtimes := make(map[string]time.Time)
+	for _, e := range entries {
+		if !e.Type().IsRegular() || !re.MatchString(e.Name()) {
+			continue
+		}
+		finfo, err := e.Info()
+		if err != nil {
+			continue
+		}
+		fname := filepath.Join(dir, e.Name())
+		fnames = append(fnames, fname)
+		mtimes[fname] = finfo.ModTime()
+	}
+	slices.SortFunc(fnames, func(a, b string) int {
+		return mtimes[b].Compare(mtimes[a])
+	})
+	return fnames, nil
+}
+
+// loadIssuances finds the installed issuance of every watched cert at
+// startup, the newest of its cert files, so the local file names are known
+// before the first sync.
+func loadIssuances() error {
+	if !nameUsesIssuance {
+		return nil
+	}
+	for _, cert := range watchedCerts() {
+		fnames, err := issuanceFiles(cert, ".crt")
+		if err != nil {
+			return err
+		}
+		if len(fnames) == 0 {
+			continue
+		}
+		data, err := readLocal(fnames[0])
+		if err != nil {
+			return err
+		}
+		iss, err := leafIssuance(data)
+		if err != nil {
+			slog.Warn("issuance of installed cert", "cert", cert, "file", fnames[0], "err", err)
+			continue
+		}
+		issuances.Store(cert, iss)
+		slog.Debug("installed issuance", "cert", cert, "serial", iss.Serial, "notBefore", iss.NotBefore)
+	}
+	return nil
+}
+
+// isIssuanceFile reports whether fname is a file of any issuance of cert.
+func isIssuanceFile(cert string, fname string) bool {
+	if !nameUsesIssuance {
+		return false
+	}
+	for _, suf := range certSuffixes {
+		dir, re := issuancePattern(cert, suf)
+		if filepath.Clean(dir) == filepath.Dir(fname) && re.MatchString(filepath.Base(fname)) {
+			return true
+		}
+	}
+	return false
+}
+
+// pruneIssuances removes the files of older issuances of cert beyond
+// -keep-issuances. The files of the installed issuance are always kept.
+func pruneIssuances(cert string) {
+	if !nameUsesIssuance || config.KeepIssuances <= 0 {
+		return
+	}
+	for _, suf := range certSuffixes {
+		fnames, err := issuanceFiles(cert, suf)
+		if err != nil {
+			slog.Error("pruneIssuances", "cert", cert, "err", err)
+			continue
+		}
+		current := filepath.Clean(localPath(cert, suf))
+		fnames = slices.DeleteFunc(fnames, func(fname string) bool { return fname == current })
+		if len(fnames) < config.KeepIssuances {
+			continue
+		}
+		for _, fname := range fnames[config.KeepIssuances-1:] {
+			err = os.Remove(fname)
+			if err != nil {
+				slog.Error("pruneIssuances", "cert", cert, "err", err)
+				continue
+			}
+			slog.Info("removed old issuance", "cert", cert, "file", fname)
+			audit(cert, fname, auditDelete, nil, "")
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+)
+
+// Log formats accepted by -logformat.
+const (
+	logFormatText    = "text"
+	logFormatJournal = "journal"
+)
+
+// journalPriority maps a slog level to a syslog priority as understood by
+// the systemd journal.
+func journalPriority(level slog.Level) int {
+	switch {
+	case level >= slog.LevelError:
+		return 3 // err
+	case level >= slog.LevelWarn:
+		return 4 // warning
+	case level >= slog.LevelInfo:
+		return 6 // info
+	}
+	return 7 // debug
+}
+
+// journalHandler writes text log lines prefixed with the <N> priority
+// markers of sd-daemon(3), which the journal strips and uses as the
+// priority of the line.
+type journalHandler struct {
+	mu  *sync.Mutex
+	buf *bytes.Buffer
+	h   slog.Handler
+	w   io.Writer
+}
+
+// newJournalHandler returns a handler writing to w. The time is left out as
+// the journal records its own.
+func newJournalHandler(w io.Writer, opts *slog.HandlerOptions) *journalHandler {
+	buf := new(bytes.Buffer)
+	o := *opts
+	o.ReplaceAttr = func(groups []string, a slog.Attr) slog.Attr {
+		if len(groups) == 0 && a.Key == slog.TimeKey {
+			return slog.Attr{}
+		}
+		return a
+	}
+	return &journalHandler{
+		mu:  new(sync.Mutex),
+		buf: buf,
+		h:   slog.NewTextHandler(buf, &o),
+		w:   w,
+	}
+}
+
+func (j *journalHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return j.h.Enabled(ctx, level)
+}
+
+func (j *journalHandler) Handle(ctx context.Context, r slog.Record) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.buf.Reset()
+	fmt.Fprintf(j.buf, "<%d>", journalPriority(r.Level))
+	err := j.h.Handle(ctx, r)
+	if err != nil {
+		return err
+	}
+	_, err = j.w.Write(j.buf.Bytes())
+	return err
+}
+
+func (j *journalHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &journalHandler{mu: j.mu, buf: j.buf, h: j.h.WithAttrs(attrs), w: j.w}
+}
+
+func (j *journalHandler) WithGroup(name string) slog.Handler {
+	return &journalHandler{mu: j.mu, buf: j.buf, h: j.h.WithGroup(name), w: j.w}
+}
+
+// newLogHandler returns the handler for -logformat. The journal format is
+// only used if stderr is connected to the journal, as indicated by
+// JOURNAL_STREAM, and falls back to text otherwise.
+func newLogHandler(format string, opts *slog.HandlerOptions) slog.Handler {
+	if format == logFormatJournal && len(os.Getenv("JOURNAL_STREAM")) > 0 {
+		return newJournalHandler(os.Stderr, opts)
+	}
+	return slog.NewTextHandler(os.Stderr, opts)
+}
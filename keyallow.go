@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strings"
+)
+
+// errKeyNotAllowed is returned instead of reading a key that matches none of
+// the -key-allow patterns.
+var errKeyNotAllowed = errors.New("key not allowed by -key-allow")
+
+// keyAllow holds the compiled -key-allow patterns, empty if all keys may be
+// read.
+var keyAllow []*regexp.Regexp
+
+// globRegexp translates a glob in the syntax of the redis KEYS command into
+// an anchored regexp. A * matches any string including slashes, ? any single
+// character, [...] a character class, and \ escapes the next character.
+func globRegexp(glob string) (*regexp.Regexp, error) {
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		case '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated [ in %q", glob)
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "^") {
+				class = "^" + regexp.QuoteMeta(class[1:])
+			} else {
+				class = regexp.QuoteMeta(class)
+			}
+			b.WriteString("[" + class + "]")
+			i += end + 1
+		case '\\':
+			if i+1 < len(glob) {
+				i++
+			}
+			b.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	return regexp.Compile(b.String())
+}
+
+// parseKeyAllow compiles -key-allow.
+func parseKeyAllow() error {
+	for _, glob := range config.KeyAllow {
+		re, err := globRegexp(glob)
+		if err != nil {
+			return err
+		}
+		keyAllow = append(keyAllow, re)
+	}
+	return nil
+}
+
+// checkKey returns errKeyNotAllowed for a key that matches none of the
+// -key-allow patterns, and logs it.
+func checkKey(key string) error {
+	if len(keyAllow) == 0 {
+		return nil
+	}
+	for _, re := range keyAllow {
+		if re.MatchString(key) {
+			return nil
+		}
+	}
+	slog.Error("refusing to read key not matching -key-allow", "redisKey", key, "allow", config.KeyAllow)
+	return fmt.Errorf("%w: %s", errKeyNotAllowed, key)
+}
+
+// checkSubscriptions checks the keys certwatch subscribes to against
+// -key-allow before subscribing: the explicit keys of -cert and, for every
+// key prefix, the pattern below which its certs are stored.
+func checkSubscriptions() error {
+	for _, src := range sources {
+		err := checkKey(certPath(src.prefix) + "*")
+		if err != nil {
+			return err
+		}
+	}
+	for _, keys := range config.CertKeys {
+		for _, key := range keys {
+			err := checkKey(key)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// errWrongPassphrase is returned for an encrypted private key that does not
+// decrypt with -key-passphrase.
+var errWrongPassphrase = errors.New("wrong passphrase")
+
+// decryptKeys decrypts the private key of the cert files with
+// -key-passphrase before it is validated and written. A key that does not
+// decrypt rejects the cert, so nothing of it is written.
+func decryptKeys(cert string, files []certFile) error {
+	if len(config.KeyPassphrase) == 0 {
+		return nil
+	}
+	for i := range files {
+		f := &files[i]
+		if f.suffix != ".key" {
+			continue
+		}
+		data, err := decryptKey(f.data, []byte(config.KeyPassphrase))
+		if err != nil {
+			return fmt.Errorf("%w: %s%s: %w", errRejected, cert, f.suffix, err)
+		}
+		f.data = data
+	}
+	return nil
+}
+
+// decryptKey decrypts the encrypted PEM blocks in data, both PKCS#8
+// ENCRYPTED PRIVATE KEY blocks and legacy PKCS#1 and SEC 1 blocks encrypted
+// per RFC 1423. Data without encrypted blocks is returned unchanged.
+func decryptKey(data []byte, passphrase []byte) ([]byte, error) {
+	var out bytes.Buffer
+	encrypted := false
+	rest := data
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		switch {
+		case block.Type == "ENCRYPTED PRIVATE KEY":
+			der, err := decryptPKCS8(block.Bytes, passphrase)
+			if err != nil {
+				return nil, err
+			}
+			block = &pem.Block{Type: "PRIVATE KEY", Bytes: der}
+			encrypted = true
+		case x509.IsEncryptedPEMBlock(block):
+			// deprecated as insecure, but still found in the wild
+			der, err := x509.DecryptPEMBlock(block, passphrase)
+			if errors.Is(err, x509.IncorrectPasswordError) {
+				return nil, errWrongPassphrase
+			}
+			if err != nil {
+				return nil, err
+			}
+			block = &pem.Block{Type: block.Type, Bytes: der}
+			encrypted = true
+		}
+		err := pem.Encode(&out, block)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if !encrypted {
+		return data, nil
+	}
+	return out.Bytes(), nil
+}
+
+var (
+	oidPBES2          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidHMACWithSHA1   = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	oidHMACWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidHMACWithSHA384 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 10}
+	oidHMACWithSHA512 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 11}
+	oidAES128CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES192CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	oidAES256CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+	oidDESEDE3CBC     = asn1.ObjectIdentifier{1, 2, 840, 113549, 3, 7}
+)
+
+// encryptedPrivateKeyInfo is the PKCS#8 EncryptedPrivateKeyInfo.
+type encryptedPrivateKeyInfo struct {
+	Algo pkix.AlgorithmIdentifier
+	Data []byte
+}
+
+// pbes2Params are the PBES2 parameters of RFC 8018.
+type pbes2Params struct {
+	KDF    pkix.AlgorithmIdentifier
+	Scheme pkix.AlgorithmIdentifier
+}
+
+// pbkdf2Params are the PBKDF2 parameters of RFC 8018.
+type pbkdf2Params struct {
+	Salt       []byte
+	Iterations int
+	KeyLength  int                      `asn1:"optional"`
+	PRF        pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+// keyEncryptIterations is the PBKDF2 iteration count for -out-passphrase.
+const keyEncryptIterations = 100000
+
+// pbes2Cipher returns the block cipher for the encryption scheme of the
+// PBES2 parameters, keyed with the passphrase.
+func pbes2Cipher(params pbes2Params, passphrase []byte) (cipher.Block, []byte, error) {
+	if !params.KDF.Algorithm.Equal(oidPBKDF2) {
+		return nil, nil, fmt.Errorf("unsupported key derivation %v", params.KDF.Algorithm)
+	}
+	var kdf pbkdf2Params
+	_, err := asn1.Unmarshal(params.KDF.Parameters.FullBytes, &kdf)
+	if err != nil {
+		return nil, nil, err
+	}
+	var h func() hash.Hash
+	switch {
+	case len(kdf.PRF.Algorithm) == 0, kdf.PRF.Algorithm.Equal(oidHMACWithSHA1):
+		h = sha1.New
+	case kdf.PRF.Algorithm.Equal(oidHMACWithSHA256):
+		h = sha256.New
+	case kdf.PRF.Algorithm.Equal(oidHMACWithSHA384):
+		h = sha512.New384
+	case kdf.PRF.Algorithm.Equal(oidHMACWithSHA512):
+		h = sha512.New
+	default:
+		return nil, nil, fmt.Errorf("unsupported pseudorandom function %v", kdf.PRF.Algorithm)
+	}
+	var keyLen int
+	var newCipher func([]byte) (cipher.Block, error)
+	switch {
+	case params.Scheme.Algorithm.Equal(oidAES128CBC):
+		keyLen, newCipher = 16, aes.NewCipher
+	case params.Scheme.Algorithm.Equal(oidAES192CBC):
+		keyLen, newCipher = 24, aes.NewCipher
+	case params.Scheme.Algorithm.Equal(oidAES256CBC):
+		keyLen, newCipher = 32, aes.NewCipher
+	case params.Scheme.Algorithm.Equal(oidDESEDE3CBC):
+		keyLen, newCipher = 24, des.NewTripleDESCipher
+	default:
+		return nil, nil, fmt.Errorf("unsupported encryption scheme %v", params.Scheme.Algorithm)
+	}
+	var iv []byte
+	_, err = asn1.Unmarshal(params.Scheme.Parameters.FullBytes, &iv)
+	if err != nil {
+		return nil, nil, err
+	}
+	block, err := newCipher(pbkdf2.Key(passphrase, kdf.Salt, kdf.Iterations, keyLen, h))
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(iv) != block.BlockSize() {
+		return nil, nil, errors.New("invalid IV length")
+	}
+	return block, iv, nil
+}
+
+// decryptPKCS8 decrypts a PBES2 encrypted PKCS#8 private key and returns
+// the unencrypted PKCS#8 DER.
+func decryptPKCS8(der []byte, passphrase []byte) ([]byte, error) {
+	var info encryptedPrivateKeyInfo
+	_, err := asn1.Unmarshal(der, &info)
+	if err != nil {
+		return nil, err
+	}
+	if !info.Algo.Algorithm.Equal(oidPBES2) {
+		return nil, fmt.Errorf("unsupported key encryption %v, only PBES2 is supported", info.Algo.Algorithm)
+	}
+	var params pbes2Params
+	_, err = asn1.Unmarshal(info.Algo.Parameters.FullBytes, &params)
+	if err != nil {
+		return nil, err
+	}
+	block, iv, err := pbes2Cipher(params, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	bs := block.BlockSize()
+	if len(info.Data) == 0 || len(info.Data)%bs != 0 {
+		return nil, errors.New("invalid encrypted key length")
+	}
+	plain := make([]byte, len(info.Data))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plain, info.Data)
+	// a wrong passphrase shows as broken padding or a key that does not
+	// parse
+	pad := int(plain[len(plain)-1])
+	if pad == 0 || pad > bs || !bytes.Equal(plain[len(plain)-pad:], bytes.Repeat([]byte{byte(pad)}, pad)) {
+		return nil, errWrongPassphrase
+	}
+	plain = plain[:len(plain)-pad]
+	_, err = x509.ParsePKCS8PrivateKey(plain)
+	if err != nil {
+		return nil, errWrongPassphrase
+	}
+	return plain, nil
+}
+
+// encryptPKCS8 encrypts PKCS#8 DER with PBES2, using PBKDF2 with
+// HMAC-SHA256 and AES-256-CBC.
+func encryptPKCS8(der []byte, passphrase []byte) ([]byte, error) {
+	salt := make([]byte, 16)
+	iv := make([]byte, aes.BlockSize)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return nil, err
+	}
+	_, err = rand.Read(iv)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(pbkdf2.Key(passphrase, salt, keyEncryptIterations, 32, sha256.New))
+	if err != nil {
+		return nil, err
+	}
+	pad := aes.BlockSize - len(der)%aes.BlockSize
+	data := append(bytes.Clone(der), bytes.Repeat([]byte{byte(pad)}, pad)...)
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(data, data)
+	kdf, err := asn1.Marshal(pbkdf2Params{
+		Salt:       salt,
+		Iterations: keyEncryptIterations,
+		KeyLength:  32,
+		PRF:        pkix.AlgorithmIdentifier{Algorithm: oidHMACWithSHA256, Parameters: asn1.NullRawValue},
+	})
+	if err != nil {
+		return nil, err
+	}
+	ivParam, err := asn1.Marshal(iv)
+	if err != nil {
+		return nil, err
+	}
+	params, err := asn1.Marshal(pbes2Params{
+		KDF:    pkix.AlgorithmIdentifier{Algorithm: oidPBKDF2, Parameters: asn1.RawValue{FullBytes: kdf}},
+		Scheme: pkix.AlgorithmIdentifier{Algorithm: oidAES256CBC, Parameters: asn1.RawValue{FullBytes: ivParam}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(encryptedPrivateKeyInfo{
+		Algo: pkix.AlgorithmIdentifier{Algorithm: oidPBES2, Parameters: asn1.RawValue{FullBytes: params}},
+		Data: data,
+	})
+}
+
+// encryptKey encrypts the private key in data with passphrase as an
+// ENCRYPTED PRIVATE KEY block. Since every encryption uses a new salt, the
+// current contents of fname are kept if they already hold the same key
+// encrypted with the same passphrase, so an unchanged key is not rewritten.
+func encryptKey(data []byte, fname string, passphrase []byte) ([]byte, error) {
+	key, err := parsePrivateKey(data)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	current, err := readLocal(fname)
+	if err == nil {
+		block, _ := pem.Decode(current)
+		if block != nil && block.Type == "ENCRYPTED PRIVATE KEY" {
+			plain, err := decryptPKCS8(block.Bytes, passphrase)
+			if err == nil && bytes.Equal(plain, der) {
+				return current, nil
+			}
+		}
+	}
+	enc, err := encryptPKCS8(der, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "ENCRYPTED PRIVATE KEY", Bytes: enc}), nil
+}
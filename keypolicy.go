@@ -0,0 +1,117 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// parsePrivateKey parses the first private key block of the PEM data.
+func parsePrivateKey(data []byte) (crypto.PrivateKey, error) {
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return nil, errors.New("no PRIVATE KEY block found")
+		}
+		switch block.Type {
+		case "PRIVATE KEY":
+			return x509.ParsePKCS8PrivateKey(block.Bytes)
+		case "RSA PRIVATE KEY":
+			return x509.ParsePKCS1PrivateKey(block.Bytes)
+		case "EC PRIVATE KEY":
+			return x509.ParseECPrivateKey(block.Bytes)
+		}
+	}
+}
+
+// Private key formats accepted by -key-format.
+const (
+	keyFormatStored = "stored" // as stored in redis
+	keyFormatPKCS8  = "pkcs8"  // unencrypted PKCS#8
+)
+
+// toPKCS8 re-encodes the private key in data as an unencrypted PKCS#8
+// PRIVATE KEY block. Keys already in PKCS#8 are returned unchanged.
+func toPKCS8(data []byte) ([]byte, error) {
+	block, _ := pem.Decode(data)
+	if block != nil && block.Type == "PRIVATE KEY" {
+		return data, nil
+	}
+	key, err := parsePrivateKey(data)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("unsupported key type %T: %w", key, err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+// allowedCurves returns the curve names of -allowed-curves, nil if any
+// curve is allowed.
+func allowedCurves() []string {
+	var curves []string
+	for _, v := range config.AllowedCurves {
+		for _, c := range strings.Split(v, ",") {
+			if c = strings.TrimSpace(c); len(c) > 0 {
+				curves = append(curves, c)
+			}
+		}
+	}
+	return curves
+}
+
+// knownCurves are the curve names -allowed-curves accepts, as reported for
+// the keys checked.
+var knownCurves = []string{"P-224", "P-256", "P-384", "P-521", "Ed25519"}
+
+// checkAllowedCurves rejects unknown names in -allowed-curves, which would
+// otherwise silently reject every EC and Ed25519 key.
+func checkAllowedCurves() error {
+	for _, c := range allowedCurves() {
+		if !slices.Contains(knownCurves, c) {
+			return fmt.Errorf("unknown curve %q, expected one of %s", c, strings.Join(knownCurves, ","))
+		}
+	}
+	return nil
+}
+
+// checkKeyPolicy checks the private key in the PEM data against
+// -min-rsa-bits and -allowed-curves.
+func checkKeyPolicy(data []byte) error {
+	curves := allowedCurves()
+	if config.MinRSABits == 0 && len(curves) == 0 {
+		return nil
+	}
+	key, err := parsePrivateKey(data)
+	if err != nil {
+		return err
+	}
+	var curve string
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		if bits := k.N.BitLen(); bits < config.MinRSABits {
+			return fmt.Errorf("RSA key has %d bits, at least %d required", bits, config.MinRSABits)
+		}
+		return nil
+	case *ecdsa.PrivateKey:
+		curve = k.Curve.Params().Name
+	case ed25519.PrivateKey:
+		curve = "Ed25519"
+	default:
+		return fmt.Errorf("unsupported key type %T", key)
+	}
+	if len(curves) > 0 && !slices.Contains(curves, curve) {
+		return fmt.Errorf("curve %s not in %s", curve, strings.Join(curves, ","))
+	}
+	return nil
+}
@@ -0,0 +1,23 @@
+package main
+
+import "testing"
+
+func TestCheckAllowedCurves(t *testing.T) {
+	useTestConfig(t)
+	tests := []struct {
+		curves stringsFlag
+		ok     bool
+	}{
+		{nil, true},
+		{stringsFlag{"P-256, P-384", "Ed25519"}, true},
+		{stringsFlag{"P-256,p384"}, false},
+		{stringsFlag{"secp256r1"}, false},
+	}
+	for _, tt := range tests {
+		config.AllowedCurves = tt.curves
+		err := checkAllowedCurves()
+		if (err == nil) != tt.ok {
+			t.Errorf("%v: got %v", tt.curves, err)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// kvStore is a key-value store cert changes are published to.
+type kvStore interface {
+	Put(ctx context.Context, key string, value string) error
+}
+
+// kvTimeout bounds a single write to the key-value store.
+const kvTimeout = 10 * time.Second
+
+// kvQueueSize is the number of changes waiting to be published before
+// further ones are dropped.
+const kvQueueSize = 100
+
+// kvPut is a single write to the key-value store.
+type kvPut struct {
+	key   string
+	value string
+}
+
+// newKVStore returns the store for a -kv-url of the form consul://host:port
+// or etcd://host:port, https is used with consul+https and etcd+https.
+func newKVStore(rawURL string) (kvStore, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	backend, scheme, ok := strings.Cut(u.Scheme, "+")
+	if !ok {
+		scheme = "http"
+	}
+	base := scheme + "://" + u.Host
+	switch backend {
+	case "consul":
+		return consulStore{base: base, token: config.KVToken}, nil
+	case "etcd":
+		return etcdStore{base: base}, nil
+	}
+	return nil, fmt.Errorf("unsupported key-value store %q, want consul or etcd", u.Scheme)
+}
+
+// consulStore writes to the Consul KV HTTP API.
+type consulStore struct {
+	base  string
+	token string
+}
+
+func (s consulStore) Put(ctx context.Context, key string, value string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, s.base+"/v1/kv/"+key, strings.NewReader(value))
+	if err != nil {
+		return err
+	}
+	if len(s.token) > 0 {
+		req.Header.Set("X-Consul-Token", s.token)
+	}
+	return doKV(req)
+}
+
+// etcdStore writes to the JSON gateway of the etcd v3 API.
+type etcdStore struct {
+	base string
+}
+
+func (s etcdStore) Put(ctx context.Context, key string, value string) error {
+	body, err := json.Marshal(map[string]string{
+		"key":   base64.StdEncoding.EncodeToString([]byte(key)),
+		"value": base64.StdEncoding.EncodeToString([]byte(value)),
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.base+"/v3/kv/put", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return doKV(req)
+}
+
+func doKV(req *http.Request) error {
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s %s: %s: %s", req.Method, req.URL, resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// publishKV registers a change callback that publishes the fingerprint and
+// modification time of every changed cert below -kv-prefix. The writes are
+// done by a single background worker so a slow or failing store never holds
+// up syncing.
+func publishKV(store kvStore) {
+	queue := make(chan kvPut, kvQueueSize)
+	go func() {
+		for p := range queue {
+			ctx, cancel := context.WithTimeout(context.Background(), kvTimeout)
+			err := store.Put(ctx, p.key, p.value)
+			cancel()
+			state.targetResult("kv", err)
+			if err != nil {
+				slog.Error("kv put", "key", p.key, "err", err)
+			}
+		}
+	}()
+	onChange(func(c certChange) {
+		if !c.KeyChanged && !c.CrtChanged {
+			return
+		}
+		prefix := strings.Trim(config.KVPrefix, "/") + "/" + c.Name + "/"
+		var puts []kvPut
+		if c.Crt != nil {
+			leaf, _, err := fingerprints(c.Crt)
+			if err == nil {
+				puts = append(puts, kvPut{prefix + "fingerprint", leaf})
+			}
+		}
+		puts = append(puts, kvPut{prefix + "modified", c.Modified.UTC().Format(time.RFC3339Nano)})
+		for _, p := range puts {
+			select {
+			case queue <- p:
+			default:
+				slog.Warn("kv queue full, dropping", "key", p.key)
+			}
+		}
+	})
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testVersion is one version of the key and cert of a cert.
+type testVersion struct {
+	key []byte
+	crt []byte
+}
+
+func newTestVersion(t testing.TB) testVersion {
+	key, chain := testChain(t, func() crypto.Signer {
+		k, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		return k
+	})
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testVersion{
+		key: pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}),
+		crt: pemChain(chain...),
+	}
+}
+
+// useTestConfig sets up config to sync the caddy-storage-redis values of
+// certs into a temporary -certdir.
+func useTestConfig(t testing.TB) {
+	oldConfig := config
+	t.Cleanup(func() { config = oldConfig })
+	config.CertDir = t.TempDir()
+	config.ValueFormat = valueFormatJSON
+	config.ValueField = "Value"
+	config.ModifiedField = "Modified"
+	config.ValueEncoding = encodingPEM
+	config.AcmeDirName = "acme"
+}
+
+// withValues returns a context holding v as the prefetched values of cert,
+// so handleCert does not need redis.
+func withValues(ctx context.Context, cert string, v testVersion, hours int) context.Context {
+	return withStored(ctx, cert, storedValue(string(v.key), hours), storedValue(string(v.crt), hours))
+}
+
+// withStored returns a context holding key and crt as the prefetched
+// stored values of cert.
+func withStored(ctx context.Context, cert string, key string, crt string) context.Context {
+	pf := &prefetch{values: map[string]prefetchedValue{
+		cert + ".key": {val: key, key: cert + ".key"},
+		cert + ".crt": {val: crt, key: cert + ".crt"},
+	}}
+	return context.WithValue(ctx, prefetchKey{}, pf)
+}
+
+func TestHandleCertConcurrent(t *testing.T) {
+	useTestConfig(t)
+	const cert = "www.example.com"
+	var versions []testVersion
+	for range 4 {
+		versions = append(versions, newTestVersion(t))
+	}
+	tests := []struct {
+		name       string
+		goroutines int
+		rounds     int
+	}{
+		{"two", 2, 20},
+		{"many", 16, 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stop := make(chan struct{})
+			corrupt := make(chan string, 1)
+			var readers sync.WaitGroup
+			readers.Add(1)
+			go func() {
+				defer readers.Done()
+				for {
+					select {
+					case <-stop:
+						return
+					default:
+					}
+					for _, suf := range certSuffixes {
+						data, err := os.ReadFile(localPath(cert, suf))
+						if err != nil {
+							continue
+						}
+						if !slices.ContainsFunc(versions, func(v testVersion) bool {
+							return bytes.Equal(data, v.key) || bytes.Equal(data, v.crt)
+						}) {
+							select {
+							case corrupt <- suf:
+							default:
+							}
+						}
+					}
+				}
+			}()
+			var wg sync.WaitGroup
+			for g := range tt.goroutines {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for r := range tt.rounds {
+						i := (g + r) % len(versions)
+						_, err := handleCert(withValues(context.Background(), cert, versions[i], g*tt.rounds+r), cert)
+						if err != nil {
+							t.Error(err)
+							return
+						}
+					}
+				}()
+			}
+			wg.Wait()
+			close(stop)
+			readers.Wait()
+			select {
+			case suf := <-corrupt:
+				t.Errorf("read a corrupted %s file", suf)
+			default:
+			}
+			_, err := tls.LoadX509KeyPair(localPath(cert, ".crt"), localPath(cert, ".key"))
+			if err != nil {
+				t.Errorf("key and cert do not match after the last run: %v", err)
+			}
+			leftover, _ := filepath.Glob(filepath.Join(config.CertDir, ".*.tmp"))
+			if len(leftover) > 0 {
+				t.Errorf("temporary files left: %v", leftover)
+			}
+		})
+	}
+}
+
+func TestKeyedMutex(t *testing.T) {
+	tests := []struct {
+		name string
+		keys []string
+		// want is the most goroutines holding a lock at the same time
+		want int
+	}{
+		{"same key", []string{"a", "a", "a", "a"}, 1},
+		{"different keys", []string{"a", "b", "c", "d"}, 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var k keyedMutex
+			var mu sync.Mutex
+			holding, most := 0, 0
+			var entered, wg sync.WaitGroup
+			entered.Add(len(tt.keys))
+			release := make(chan struct{})
+			for _, key := range tt.keys {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					unlock := k.Lock(key)
+					mu.Lock()
+					holding++
+					most = max(most, holding)
+					mu.Unlock()
+					entered.Done()
+					if tt.want > 1 {
+						<-release
+					} else {
+						time.Sleep(time.Millisecond)
+					}
+					mu.Lock()
+					holding--
+					mu.Unlock()
+					unlock()
+				}()
+			}
+			entered.Wait()
+			close(release)
+			wg.Wait()
+			if most != tt.want {
+				t.Errorf("%d goroutines held a lock at once, want %d", most, tt.want)
+			}
+			if len(k.locks) > 0 {
+				t.Errorf("locks left: %v", k.locks)
+			}
+		})
+	}
+}
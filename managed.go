@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// certsMu guards config.Certs once -certs-from-key changes it at
+	// runtime. The listen loop is the only writer, other goroutines read it
+	// with watchedCerts.
+	certsMu sync.RWMutex
+	// staticCerts are the certs given on the command line, watched
+	// regardless of -certs-from-key.
+	staticCerts []string
+	// managedCerts are the certs last read from -certs-from-key.
+	managedCerts []string
+	// nextCertsRead is when -certs-from-key is read next.
+	nextCertsRead time.Time
+
+	certsKeyErrors = &dedupLog{msg: "certs from key"}
+)
+
+// watchedCerts returns the watched certs, for goroutines other than the
+// listen loop.
+func watchedCerts() []string {
+	certsMu.RLock()
+	defer certsMu.RUnlock()
+	return config.Certs
+}
+
+// readCertsKey returns the sorted cert names held by -certs-from-key, a set
+// or a list. A missing key holds no names. Names not matching -name-regex
+// are dropped.
+func readCertsKey(ctx context.Context) ([]string, error) {
+	err := checkKey(config.CertsFromKey)
+	if err != nil {
+		return nil, err
+	}
+	typ, err := readClient.Type(ctx, config.CertsFromKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	switch typ {
+	case "none":
+		return nil, nil
+	case "set":
+		names, err = readClient.SMembers(ctx, config.CertsFromKey).Result()
+	case "list":
+		names, err = readClient.LRange(ctx, config.CertsFromKey, 0, -1).Result()
+	default:
+		return nil, fmt.Errorf("%s is a %s, expected a set or a list", config.CertsFromKey, typ)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var certs []string
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if len(name) == 0 || strings.Contains(name, "/") || !nameWatched(name) || slices.Contains(certs, name) {
+			continue
+		}
+		if !validCertName(name) {
+			slog.Warn("ignoring invalid cert name", "key", config.CertsFromKey, "cert", name)
+			continue
+		}
+		certs = append(certs, name)
+	}
+	slices.Sort(certs)
+	return certs, nil
+}
+
+// loadManagedCerts adds the certs of -certs-from-key to the watched certs
+// at startup.
+func loadManagedCerts(ctx context.Context) error {
+	if len(config.CertsFromKey) == 0 {
+		return nil
+	}
+	staticCerts = slices.Clone(config.Certs)
+	names, err := readCertsKey(ctx)
+	if err != nil {
+		return err
+	}
+	if len(names) == 0 {
+		slog.Warn("no cert names in key, watching only the certs given on the command line", "key", config.CertsFromKey)
+	}
+	added, _ := setManagedCerts(names)
+	slog.Info("certs from key", "key", config.CertsFromKey, "certs", len(names), "added", added)
+	nextCertsRead = clk.Now().Add(config.CertsFromKeyInterval)
+	return nil
+}
+
+// setManagedCerts makes names the managed certs and returns the certs that
+// are watched now and those no longer watched. At most -max-certs certs
+// are watched, the managed ones beyond the limit are ignored.
+func setManagedCerts(names []string) (added []string, removed []string) {
+	certs := slices.Clone(staticCerts)
+	for _, name := range names {
+		if slices.Contains(certs, name) {
+			continue
+		}
+		if config.MaxCerts > 0 && len(certs) >= config.MaxCerts {
+			slog.Warn("too many certs, ignoring the rest of the key", "key", config.CertsFromKey, "max", config.MaxCerts)
+			break
+		}
+		certs = append(certs, name)
+	}
+	for _, cert := range certs {
+		if !slices.Contains(config.Certs, cert) {
+			added = append(added, cert)
+		}
+	}
+	for _, cert := range config.Certs {
+		if !slices.Contains(certs, cert) {
+			removed = append(removed, cert)
+		}
+	}
+	managedCerts = names
+	certsMu.Lock()
+	config.Certs = certs
+	certsMu.Unlock()
+	return added, removed
+}
+
+// refreshManagedCerts re-reads -certs-from-key once its interval has passed
+// and applies the changes to the watch set. Newly watched certs are
+// returned to be synced, certs no longer watched are dropped from the
+// status and their files handled like orphans by -orphan-action. Nothing
+// needs to be subscribed, the keyspace subscription of the key prefixes
+// covers every cert name. A failed read keeps the current set.
+func refreshManagedCerts(ctx context.Context) (added []string, removed []string) {
+	if len(config.CertsFromKey) == 0 || clk.Now().Before(nextCertsRead) {
+		return nil, nil
+	}
+	nextCertsRead = clk.Now().Add(config.CertsFromKeyInterval)
+	names, err := readCertsKey(ctx)
+	if err != nil {
+		certsKeyErrors.Error(err, "key", config.CertsFromKey)
+		return nil, nil
+	}
+	certsKeyErrors.Reset()
+	if slices.Equal(names, managedCerts) {
+		return nil, nil
+	}
+	added, removed = setManagedCerts(names)
+	if len(added) == 0 && len(removed) == 0 {
+		return nil, nil
+	}
+	slog.Info("watch set changed", "key", config.CertsFromKey, "added", added, "removed", removed, "watching", len(config.Certs))
+	state.watch(added...)
+	state.unwatch(removed...)
+	for _, cert := range removed {
+		pruneCert(cert)
+	}
+	if len(removed) > 0 {
+		updateBundle()
+	}
+	return added, removed
+}
+
+// pruneCert handles the files of a cert no longer watched per
+// -orphan-action.
+func pruneCert(cert string) {
+	if healthCerts != nil {
+		healthCerts.remove(cert)
+	}
+	for _, suf := range certSuffixes {
+		fname := localPath(cert, suf)
+		if _, err := os.Stat(fname); err != nil {
+			continue
+		}
+		switch config.OrphanAction {
+		case orphanWarn:
+			slog.Warn("cert no longer watched, keeping its file", "cert", cert, "file", fname)
+		case orphanRemove:
+			removeCert(cert, suf)
+		}
+	}
+}
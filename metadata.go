@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"math/big"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// certMetadata is the part of the .json metadata Caddy stores next to a
+// cert that is cross-checked by -check-metadata.
+type certMetadata struct {
+	SANs       []string        `json:"sans"`
+	IssuerData json.RawMessage `json:"issuer_data"`
+}
+
+// findSerial returns the first value of a field named serial or
+// serial_number anywhere in the JSON data, as issuers record it in their
+// issuer data.
+func findSerial(data json.RawMessage) (string, bool) {
+	var v any
+	if json.Unmarshal(data, &v) != nil {
+		return "", false
+	}
+	var walk func(v any) (string, bool)
+	walk = func(v any) (string, bool) {
+		switch v := v.(type) {
+		case map[string]any:
+			for k, e := range v {
+				k = strings.ToLower(k)
+				if s, ok := e.(string); ok && (k == "serial" || k == "serial_number") {
+					return s, true
+				}
+			}
+			for _, e := range v {
+				if s, ok := walk(e); ok {
+					return s, true
+				}
+			}
+		case []any:
+			for _, e := range v {
+				if s, ok := walk(e); ok {
+					return s, true
+				}
+			}
+		}
+		return "", false
+	}
+	return walk(v)
+}
+
+// serialMatches reports whether the serial s recorded in metadata is n. It
+// may be given in hex, optionally with colons or an 0x prefix, or in
+// decimal.
+func serialMatches(s string, n *big.Int) bool {
+	s = strings.ReplaceAll(strings.TrimPrefix(strings.ToLower(s), "0x"), ":", "")
+	for _, base := range []int{16, 10} {
+		v, ok := new(big.Int).SetString(s, base)
+		if ok && v.Cmp(n) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// checkMetadata compares the leaf just written for cert against the
+// serial and names recorded in its .json metadata, for -check-metadata. A
+// mismatch means the cert and the metadata come from different issuances,
+// such as a partial update of the keys of the cert, and is logged as a
+// warning.
+func checkMetadata(ctx context.Context, cert string, crt []byte) {
+	if !config.CheckMetadata {
+		return
+	}
+	leaf, err := parseLeaf(crt)
+	if err != nil {
+		slog.Warn("check metadata", "cert", cert, "err", err)
+		return
+	}
+	data, _, err := fetchValue(ctx, cert, ".json")
+	if errors.Is(err, redis.Nil) {
+		slog.Debug("check metadata, no metadata", "cert", cert)
+		return
+	}
+	if err != nil {
+		slog.Warn("check metadata", "cert", cert, "err", err)
+		return
+	}
+	var meta certMetadata
+	err = json.Unmarshal(data, &meta)
+	if err != nil {
+		slog.Warn("check metadata", "cert", cert, "err", err)
+		return
+	}
+	if s, ok := findSerial(meta.IssuerData); ok {
+		if !serialMatches(s, leaf.SerialNumber) {
+			slog.Warn("cert and metadata disagree on serial, they may come from different issuances", "cert", cert, "crt", leaf.SerialNumber.Text(16), "metadata", s)
+		}
+	}
+	if len(meta.SANs) > 0 {
+		added, removed := diffNames(meta.SANs, certNames(leaf))
+		if len(added) > 0 || len(removed) > 0 {
+			slog.Warn("cert and metadata disagree on names, they may come from different issuances", "cert", cert, "onlyCrt", added, "onlyMetadata", removed)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// labelEscaper escapes a label value of the Prometheus text format.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// metricsWriter writes metrics in the Prometheus text exposition format.
+type metricsWriter struct {
+	b bytes.Buffer
+}
+
+// family starts a metric family with its help text and type.
+func (m *metricsWriter) family(name string, typ string, help string) {
+	fmt.Fprintf(&m.b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// sample writes a sample of name, with a single label if label is not empty.
+func (m *metricsWriter) sample(name string, label string, value string, v float64) {
+	if len(label) > 0 {
+		fmt.Fprintf(&m.b, "%s{%s=\"%s\"} %g\n", name, label, labelEscaper.Replace(value), v)
+		return
+	}
+	fmt.Fprintf(&m.b, "%s %g\n", name, v)
+}
+
+// timestamp returns t as seconds since the epoch, 0 for none.
+func timestamp(t *time.Time) float64 {
+	if t == nil || t.IsZero() {
+		return 0
+	}
+	return float64(t.UnixNano()) / float64(time.Second)
+}
+
+// boolValue returns 1 for true and 0 for false.
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// metricsHandler serves the watch state as Prometheus metrics. Like /certs,
+// it is protected by -health-token.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	if !authorized(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	rep := state.report()
+	var m metricsWriter
+	m.family("certwatch_subscribed", "gauge", "Whether the keyspace subscription to redis is established.")
+	m.sample("certwatch_subscribed", "", "", boolValue(rep.Subscribed))
+	m.family("certwatch_healthy", "gauge", "Whether /healthz reports healthy.")
+	m.sample("certwatch_healthy", "", "", boolValue(rep.healthy()))
+	m.family("certwatch_reconnects_total", "counter", "Reconnect attempts to redis.")
+	m.sample("certwatch_reconnects_total", "", "", float64(rep.Reconnects))
+	m.family("certwatch_cmd_failures_total", "counter", "Failed runs of the reload commands.")
+	m.sample("certwatch_cmd_failures_total", "", "", float64(rep.CmdFailures))
+	m.family("certwatch_hook_failures_total", "counter", "Failed runs of the hooks.")
+	m.sample("certwatch_hook_failures_total", "", "", float64(rep.HookFailures))
+	m.family("certwatch_cert_last_sync_timestamp_seconds", "gauge", "Time of the last successful sync of the cert, 0 if none.")
+	for _, cs := range rep.Certs {
+		m.sample("certwatch_cert_last_sync_timestamp_seconds", "cert", cs.Name, timestamp(cs.LastSync))
+	}
+	m.family("certwatch_cert_last_change_timestamp_seconds", "gauge", "Time the files of the cert were last changed, 0 if not since the start.")
+	for _, cs := range rep.Certs {
+		m.sample("certwatch_cert_last_change_timestamp_seconds", "cert", cs.Name, timestamp(cs.LastChange))
+	}
+	m.family("certwatch_cert_syncs_total", "counter", "Successful syncs of the cert.")
+	for _, cs := range rep.Certs {
+		m.sample("certwatch_cert_syncs_total", "cert", cs.Name, float64(cs.Syncs))
+	}
+	m.family("certwatch_cert_sync_errors_total", "counter", "Failed syncs of the cert.")
+	for _, cs := range rep.Certs {
+		m.sample("certwatch_cert_sync_errors_total", "cert", cs.Name, float64(cs.SyncErrors))
+	}
+	m.family("certwatch_cert_not_after_timestamp_seconds", "gauge", "Expiry of the installed leaf of the cert, missing if it cannot be read.")
+	for _, cs := range rep.Certs {
+		d := readCertDetails(cs)
+		if len(d.Error) == 0 {
+			m.sample("certwatch_cert_not_after_timestamp_seconds", "cert", cs.Name, timestamp(d.NotAfter))
+		}
+	}
+	m.family("certwatch_target_failures", "gauge", "Consecutive failed writes to the destination.")
+	for _, ts := range rep.Targets {
+		m.sample("certwatch_target_failures", "target", ts.Name, float64(ts.Failures))
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, err := w.Write(m.b.Bytes())
+	if err != nil {
+		slog.Error("metrics", "err", err)
+	}
+}
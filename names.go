@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strings"
+	"text/template"
+	"unicode"
+)
+
+// nameRegex is the compiled -name-regex, nil if all names are watched.
+var nameRegex *regexp.Regexp
+
+// filterNames compiles -name-regex and drops the certs not matching it.
+func filterNames() error {
+	if len(config.NameRegex) == 0 {
+		return nil
+	}
+	re, err := regexp.Compile(config.NameRegex)
+	if err != nil {
+		return err
+	}
+	nameRegex = re
+	var certs []string
+	for _, cert := range config.Certs {
+		if nameWatched(cert) {
+			certs = append(certs, cert)
+		} else {
+			slog.Debug("cert does not match name regex", "cert", cert)
+			delete(config.CertKeys, cert)
+		}
+	}
+	slog.Info("name regex", "regex", re.String(), "matched", len(certs), "of", len(config.Certs))
+	config.Certs = certs
+	return nil
+}
+
+// validCertName reports whether cert is a host name, optionally a wildcard
+// starting with "*.". Names read from redis must be valid, as they end up in
+// file names and commands.
+func validCertName(cert string) bool {
+	name := strings.TrimPrefix(cert, "*.")
+	if len(name) == 0 || len(name) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(name, ".") {
+		if len(label) == 0 || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, r := range label {
+			if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// nameWatched reports whether cert matches -name-regex.
+func nameWatched(cert string) bool {
+	return nameRegex == nil || nameRegex.MatchString(cert)
+}
+
+// nameTmpl is the parsed -name-template, nil for the default name.
+var nameTmpl *template.Template
+
+// nameData is passed to -name-template. The issuance fields are empty until
+// the cert was fetched or found installed.
+type nameData struct {
+	Name string
+	issuance
+}
+
+var nameFuncs = template.FuncMap{
+	"sanitize": sanitizeName,
+	"replace":  strings.ReplaceAll,
+	"lower":    strings.ToLower,
+}
+
+// sanitizeName is the rule for file names of -sanitize-names: a "*" becomes
+// "wildcard_", as in the keys caddy writes, and path separators, colons,
+// white space and control characters become "_".
+func sanitizeName(name string) string {
+	name = strings.ReplaceAll(name, "*", "wildcard_")
+	return strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r == ':' || unicode.IsSpace(r) || unicode.IsControl(r) {
+			return '_'
+		}
+		return r
+	}, name)
+}
+
+// parseNameTemplate parses -name-template.
+func parseNameTemplate() error {
+	if len(config.NameTemplate) > 0 {
+		t, err := template.New("name").Funcs(nameFuncs).Option("missingkey=error").Parse(config.NameTemplate)
+		if err != nil {
+			return err
+		}
+		nameTmpl = t
+	}
+	return checkIssuanceTemplate()
+}
+
+// localName returns the base of the local file names of cert, for the
+// installed issuance. The name in redis is not affected.
+func localName(cert string) string {
+	return renderName(nameData{Name: cert, issuance: issued(cert)})
+}
+
+// defaultName returns the file name of cert without -name-template: the
+// cert name itself, sanitized with -sanitize-names.
+func defaultName(cert string) string {
+	if config.SanitizeNames {
+		return sanitizeName(cert)
+	}
+	return cert
+}
+
+// renderName applies -name-template to data.
+func renderName(data nameData) string {
+	if nameTmpl == nil {
+		return defaultName(data.Name)
+	}
+	var b strings.Builder
+	err := nameTmpl.Execute(&b, data)
+	if err != nil || len(b.String()) == 0 {
+		slog.Error("name template, using default name", "cert", data.Name, "err", err)
+		return defaultName(data.Name)
+	}
+	return b.String()
+}
+
+// checkNameCollisions fails if different certs are written to the same
+// local file, as -sanitize-names or -name-template may map several names to
+// one.
+func checkNameCollisions() error {
+	seen := make(map[string]string)
+	for _, cert := range config.Certs {
+		fname := localPath(cert, ".crt")
+		if other, ok := seen[fname]; ok && other != cert {
+			return fmt.Errorf("certs %s and %s are both written to %s", other, cert, fname)
+		}
+		seen[fname] = cert
+	}
+	return nil
+}
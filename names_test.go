@@ -0,0 +1,28 @@
+package main
+
+import "testing"
+
+func TestDefaultName(t *testing.T) {
+	useTestConfig(t)
+	if got := localName("*.example.com"); got != "*.example.com" {
+		t.Errorf("default: got %q", got)
+	}
+	config.SanitizeNames = true
+	if got := localName("*.example.com"); got != "wildcard_.example.com" {
+		t.Errorf("-sanitize-names: got %q", got)
+	}
+}
+
+func TestCheckNameCollisions(t *testing.T) {
+	useTestConfig(t)
+	config.Certs = []string{"*.example.com", "wildcard_.example.com", "www.example.com"}
+	err := checkNameCollisions()
+	if err != nil {
+		t.Errorf("default: %v", err)
+	}
+	config.SanitizeNames = true
+	err = checkNameCollisions()
+	if err == nil {
+		t.Error("-sanitize-names: collision not detected")
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Actions for orphaned cert files accepted by -orphan-action.
+const (
+	orphanKeep   = "keep"   // leave them alone
+	orphanWarn   = "warn"   // log each of them
+	orphanRemove = "remove" // delete them
+)
+
+// findOrphans returns the files below CertDir named like cert files that
+// belong to none of the watched certs. Only files ending in one of the
+// certSuffixes are considered, so backups, temporary files and anything else
+// kept in CertDir are never reported. The files certwatch writes besides
+// the cert files, the -bundle, the -primary copies and the -out-combined and
+// -out-p12 outputs, are never orphans either.
+func findOrphans() ([]string, error) {
+	certs := watchedCerts()
+	known := make(map[string]bool)
+	add := func(fname string) {
+		abs, err := filepath.Abs(fname)
+		if err == nil {
+			known[abs] = true
+		}
+	}
+	for _, cert := range certs {
+		for _, suf := range certSuffixes {
+			add(localPath(cert, suf))
+		}
+		add(combinedPath(cert))
+		add(p12Path(cert))
+	}
+	if len(config.Bundle) > 0 {
+		add(config.Bundle)
+	}
+	if len(config.Primary) > 0 {
+		for _, suf := range certSuffixes {
+			add(primaryPath(suf))
+		}
+	}
+	var orphans []string
+	err := filepath.WalkDir(config.CertDir, func(fname string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() || strings.HasPrefix(d.Name(), ".") {
+			return nil
+		}
+		ext := filepath.Ext(strings.TrimSuffix(fname, compressSuffix))
+		if !slices.Contains(certSuffixes, ext) {
+			return nil
+		}
+		abs, err := filepath.Abs(fname)
+		if err != nil || known[abs] {
+			return err
+		}
+		if slices.ContainsFunc(certs, func(cert string) bool { return isIssuanceFile(cert, fname) }) {
+			return nil
+		}
+		orphans = append(orphans, fname)
+		return nil
+	})
+	return orphans, err
+}
+
+// handleOrphans applies -orphan-action to the cert files in CertDir left
+// behind by certs no longer watched.
+func handleOrphans() error {
+	if config.OrphanAction == orphanKeep {
+		return nil
+	}
+	orphans, err := findOrphans()
+	if err != nil {
+		return err
+	}
+	for _, fname := range orphans {
+		if config.OrphanAction == orphanWarn {
+			slog.Warn("orphaned cert file, not part of any watched cert", "file", fname)
+			continue
+		}
+		err = os.Remove(fname)
+		if err != nil {
+			return err
+		}
+		slog.Info("removed orphaned cert file", "file", fname)
+	}
+	return nil
+}
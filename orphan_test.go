@@ -0,0 +1,54 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestFindOrphans(t *testing.T) {
+	useTestConfig(t)
+	config.Certs = []string{"www.example.com"}
+	config.Bundle = filepath.Join(config.CertDir, "bundle.crt")
+	config.Primary = "www.example.com"
+	config.PrimaryCrt, config.PrimaryKey = "cert.crt", "cert.key"
+	tests := []struct {
+		name   string
+		fname  string
+		orphan bool
+	}{
+		{"watched key", localPath("www.example.com", ".key"), false},
+		{"watched crt", localPath("www.example.com", ".crt"), false},
+		{"bundle", config.Bundle, false},
+		{"primary key", primaryPath(".key"), false},
+		{"primary crt", primaryPath(".crt"), false},
+		{"combined", combinedPath("www.example.com"), false},
+		{"keystore", p12Path("www.example.com"), false},
+		{"backup", localPath("www.example.com", ".crt") + ".bak", false},
+		{"unwatched key", localPath("old.example.com", ".key"), true},
+		{"unwatched crt", localPath("old.example.com", ".crt"), true},
+	}
+	var want []string
+	for _, tt := range tests {
+		err := os.MkdirAll(filepath.Dir(tt.fname), 0700)
+		if err == nil {
+			err = os.WriteFile(tt.fname, []byte(tt.name), 0600)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.orphan {
+			want = append(want, tt.fname)
+		}
+	}
+	got, err := findOrphans()
+	if err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(got)
+	slices.Sort(want)
+	if !slices.Equal(got, want) {
+		t.Errorf("orphans %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+)
+
+// errOSStoreUnsupported is returned by installOSStore on platforms without
+// a supported certificate store.
+var errOSStoreUnsupported = errors.New("no supported OS certificate store on this platform")
+
+// runStoreCmd runs a certificate store tool, returning its output with an
+// error.
+func runStoreCmd(ctx context.Context, name string, args ...string) error {
+	out, err := exec.CommandContext(ctx, name, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %w: %s", name, err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+// updateOSStore installs the changed certs into the OS certificate store.
+func updateOSStore(ctx context.Context, changed []string) {
+	if !config.OSStore {
+		return
+	}
+	for _, cert := range changed {
+		crt := localPath(cert, ".crt")
+		if _, err := os.Stat(crt); err != nil {
+			continue
+		}
+		key := localPath(cert, ".key")
+		if _, err := os.Stat(key); err != nil {
+			key = ""
+		}
+		err := installOSStore(ctx, key, crt)
+		if err != nil {
+			slog.Error("os store", "cert", cert, "err", err)
+			continue
+		}
+		slog.Info("installed into os store", "cert", cert, "location", config.OSStoreLocation)
+	}
+}
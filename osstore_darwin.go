@@ -0,0 +1,24 @@
+//go:build darwin
+
+package main
+
+import "context"
+
+// osStoreSupported tells whether installOSStore is implemented.
+const osStoreSupported = true
+
+// installOSStore imports the cert, and its key if given, into the keychain
+// named by -os-store-location, the default keychain if empty.
+func installOSStore(ctx context.Context, key string, crt string) error {
+	var keychain []string
+	if len(config.OSStoreLocation) > 0 {
+		keychain = []string{"-k", config.OSStoreLocation}
+	}
+	if len(key) > 0 {
+		err := runStoreCmd(ctx, "security", append([]string{"import", key, "-t", "priv", "-f", "openssl"}, keychain...)...)
+		if err != nil {
+			return err
+		}
+	}
+	return runStoreCmd(ctx, "security", append([]string{"import", crt, "-t", "cert", "-f", "pemseq"}, keychain...)...)
+}
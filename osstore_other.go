@@ -0,0 +1,13 @@
+//go:build !darwin && !windows
+
+package main
+
+import "context"
+
+// osStoreSupported tells whether installOSStore is implemented.
+const osStoreSupported = false
+
+// installOSStore fails as there is no supported certificate store.
+func installOSStore(ctx context.Context, key string, crt string) error {
+	return errOSStoreUnsupported
+}
@@ -0,0 +1,19 @@
+//go:build windows
+
+package main
+
+import "context"
+
+// osStoreSupported tells whether installOSStore is implemented.
+const osStoreSupported = true
+
+// installOSStore adds the cert to the store of the current user named by
+// -os-store-location, My if empty. certutil cannot pair a PEM key with the
+// cert, so the key is not imported.
+func installOSStore(ctx context.Context, key string, crt string) error {
+	store := config.OSStoreLocation
+	if len(store) == 0 {
+		store = "My"
+	}
+	return runStoreCmd(ctx, "certutil", "-user", "-f", "-addstore", store, crt)
+}
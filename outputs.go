@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"time"
+)
+
+// errKeyMismatch is returned for a key that does not belong to the leaf of
+// the cert fetched with it.
+var errKeyMismatch = errors.New("private key does not match the cert")
+
+// checkKeyMatch checks that the key and the cert among files form a pair,
+// with -check-key-match or when they are combined into -out-combined or
+// -out-p12. A cert with only one of the files in redis is not checked.
+func checkKeyMatch(files []certFile) error {
+	if !config.CheckKeyMatch && !config.OutCombined && !config.OutP12 {
+		return nil
+	}
+	var key, crt []byte
+	for _, f := range files {
+		switch f.suffix {
+		case ".key":
+			key = f.data
+		case ".crt":
+			crt = f.data
+		}
+	}
+	if key == nil || crt == nil {
+		return nil
+	}
+	_, err := tls.X509KeyPair(crt, key)
+	if err != nil {
+		return errors.Join(errKeyMismatch, err)
+	}
+	return nil
+}
+
+// combinedPath returns the file name of the -out-combined file of cert.
+func combinedPath(cert string) string {
+	return path.Join(certDir(cert), localName(cert)+".pem")
+}
+
+// p12Path returns the file name of the -out-p12 keystore of cert.
+func p12Path(cert string) string {
+	return path.Join(certDir(cert), localName(cert)+".p12")
+}
+
+// writeOutput writes data to fname atomically with the mode and ownership
+// of the files of cert. Both outputs hold the private key, so they are
+// checked like the key file and removed if the resulting mode is insecure.
+func writeOutput(cert string, fname string, data []byte, modified time.Time) error {
+	tmpname, err := stageFile(fname, data, modified)
+	if err != nil {
+		return err
+	}
+	err = applyTarget(cert, tmpname)
+	if err == nil {
+		err = os.Rename(tmpname, fname)
+	}
+	if err != nil {
+		os.Remove(tmpname)
+		return err
+	}
+	return checkKeyMode(fname, keyMode(cert))
+}
+
+// writeOutputs writes the -out-combined and -out-p12 files of cert from its
+// fetched files, once both the key and the cert are present. The keystore is
+// only rewritten if a file changed or it is missing, as every encoding uses
+// new salts. Errors are logged, the key and cert files are installed already.
+func writeOutputs(cert string, files []certFile, changed bool) {
+	if !config.OutCombined && !config.OutP12 {
+		return
+	}
+	var key, crt certFile
+	for _, f := range files {
+		switch f.suffix {
+		case ".key":
+			key = f
+		case ".crt":
+			crt = f
+		}
+	}
+	if key.data == nil || crt.data == nil {
+		return
+	}
+	modified := crt.modified
+	if key.modified.After(modified) {
+		modified = key.modified
+	}
+	if config.OutCombined {
+		var b bytes.Buffer
+		for _, data := range [][]byte{key.data, crt.data} {
+			b.Write(data)
+			if len(data) > 0 && data[len(data)-1] != '\n' {
+				b.WriteByte('\n')
+			}
+		}
+		fname := combinedPath(cert)
+		current, err := sameContents(fname, b.Bytes())
+		if err != nil || !current {
+			err = writeOutput(cert, fname, b.Bytes(), modified)
+			if err != nil {
+				slog.Error("combined output", "cert", cert, "file", fname, "err", err)
+			} else {
+				slog.Debug("combined output", "cert", cert, "file", fname)
+			}
+		}
+	}
+	if config.OutP12 {
+		fname := p12Path(cert)
+		_, err := os.Stat(fname)
+		if changed || errors.Is(err, fs.ErrNotExist) {
+			err = writeP12(cert, fname, key.data, crt.data, modified)
+			if err != nil {
+				slog.Error("p12 output", "cert", cert, "file", fname, "err", err)
+			} else {
+				slog.Debug("p12 output", "cert", cert, "file", fname)
+			}
+		}
+	}
+}
+
+// writeP12 writes the PKCS#12 keystore of cert to fname. A key encrypted
+// with -out-passphrase is decrypted first.
+func writeP12(cert string, fname string, keyData []byte, crtData []byte, modified time.Time) error {
+	if len(config.OutPassphrase) > 0 {
+		var err error
+		keyData, err = decryptKey(keyData, []byte(config.OutPassphrase))
+		if err != nil {
+			return err
+		}
+	}
+	key, err := parsePrivateKey(keyData)
+	if err != nil {
+		return err
+	}
+	chain := certBlocks(crtData)
+	if len(chain) == 0 {
+		return errors.New("no CERTIFICATE block found")
+	}
+	data, err := encodePKCS12(cert, key, chain, config.P12Passphrase)
+	if err != nil {
+		return err
+	}
+	return writeOutput(cert, fname, data, modified)
+}
+
+// removeOutputs removes the -out-combined and -out-p12 files of cert after
+// one of its files was removed.
+func removeOutputs(cert string) {
+	var fnames []string
+	if config.OutCombined {
+		fnames = append(fnames, combinedPath(cert))
+	}
+	if config.OutP12 {
+		fnames = append(fnames, p12Path(cert))
+	}
+	for _, fname := range fnames {
+		err := os.Remove(fname)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			slog.Error("remove output", "cert", cert, "file", fname, "err", err)
+		}
+	}
+}
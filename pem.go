@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// certBlocks returns the DER bytes of all CERTIFICATE blocks in data, leaf
+// first.
+func certBlocks(data []byte) [][]byte {
+	var ders [][]byte
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return ders
+		}
+		if block.Type == "CERTIFICATE" {
+			ders = append(ders, block.Bytes)
+		}
+	}
+}
+
+// fingerprints returns the hex encoded SHA-256 fingerprints of the leaf
+// certificate and of the full chain, computed over the concatenated DER of
+// all certificates in the chain.
+func fingerprints(data []byte) (string, string, error) {
+	ders := certBlocks(data)
+	if len(ders) == 0 {
+		return "", "", errors.New("no CERTIFICATE block found")
+	}
+	leaf := sha256.Sum256(ders[0])
+	h := sha256.New()
+	for _, der := range ders {
+		h.Write(der)
+	}
+	return hex.EncodeToString(leaf[:]), hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// checkBlocks checks the structure of a fetched cert file: a .crt must hold
+// at least one and at most -max-chain-certs CERTIFICATE blocks, a .key
+// exactly one private key block. This catches swapped or corrupted values
+// before anything is written.
+func checkBlocks(suf string, data []byte) error {
+	var certs, keys int
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		switch {
+		case block.Type == "CERTIFICATE":
+			certs++
+		case strings.HasSuffix(block.Type, "PRIVATE KEY"):
+			keys++
+		}
+	}
+	switch suf {
+	case ".crt":
+		if certs == 0 {
+			if keys > 0 {
+				return errors.New("no CERTIFICATE block found, but a private key, are .key and .crt swapped?")
+			}
+			return errors.New("no CERTIFICATE block found")
+		}
+		if config.MaxChainCerts > 0 && certs > config.MaxChainCerts {
+			return fmt.Errorf("%d CERTIFICATE blocks exceed -max-chain-certs %d", certs, config.MaxChainCerts)
+		}
+	case ".key":
+		if keys == 0 && certs > 0 {
+			return errors.New("no private key block found, but a certificate, are .key and .crt swapped?")
+		}
+		if keys != 1 {
+			return fmt.Errorf("%d private key blocks found, want exactly one", keys)
+		}
+	}
+	return nil
+}
+
+// parseLeaf parses the first certificate in the PEM data.
+func parseLeaf(data []byte) (*x509.Certificate, error) {
+	ders := certBlocks(data)
+	if len(ders) == 0 {
+		return nil, errors.New("no CERTIFICATE block found")
+	}
+	return x509.ParseCertificate(ders[0])
+}
+
+// Line endings accepted by -line-ending.
+const (
+	lineEndingLF   = "lf"
+	lineEndingCRLF = "crlf"
+)
+
+// reencodePEM decodes all PEM blocks in data and encodes them again, with
+// CRLF line endings if crlf is set. Anything outside the PEM blocks is lost.
+func reencodePEM(data []byte, crlf bool) ([]byte, error) {
+	var out []byte
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		out = append(out, pem.EncodeToMemory(block)...)
+	}
+	if len(out) == 0 {
+		return nil, errors.New("no PEM block found")
+	}
+	if crlf {
+		out = bytes.ReplaceAll(out, []byte("\n"), []byte("\r\n"))
+	}
+	return out, nil
+}
+
+// fixChain orders the certificates in the PEM data from the leaf up
+// through the intermediates and drops self-signed roots. Certificates that
+// are not part of the chain are kept at the end. It reports whether
+// anything changed, the data is returned unmodified otherwise. A lone
+// self-signed certificate, like the CA of -pki-ca, is its own leaf.
+func fixChain(data []byte) ([]byte, bool, error) {
+	ders := certBlocks(data)
+	if len(ders) == 0 {
+		return nil, false, errors.New("no CERTIFICATE block found")
+	}
+	certs := make([]*x509.Certificate, len(ders))
+	for i, der := range ders {
+		c, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, false, err
+		}
+		certs[i] = c
+	}
+	selfSigned := func(c *x509.Certificate) bool {
+		return bytes.Equal(c.RawIssuer, c.RawSubject) && c.CheckSignatureFrom(c) == nil
+	}
+	issues := func(issuer *x509.Certificate, c *x509.Certificate) bool {
+		return issuer != c && bytes.Equal(c.RawIssuer, issuer.RawSubject) && c.CheckSignatureFrom(issuer) == nil
+	}
+	// the leaf is the certificate not issuing any other, preferring the
+	// first one
+	var leaf *x509.Certificate
+	for _, c := range certs {
+		if selfSigned(c) {
+			continue
+		}
+		if !slices.ContainsFunc(certs, func(o *x509.Certificate) bool { return issues(c, o) }) {
+			leaf = c
+			break
+		}
+	}
+	if leaf == nil && len(certs) == 1 {
+		return data, false, nil
+	}
+	if leaf == nil {
+		return nil, false, errors.New("no leaf certificate found")
+	}
+	chain := []*x509.Certificate{leaf}
+	used := map[*x509.Certificate]bool{leaf: true}
+	for cur := leaf; ; {
+		i := slices.IndexFunc(certs, func(c *x509.Certificate) bool { return !used[c] && issues(c, cur) })
+		if i < 0 {
+			break
+		}
+		cur = certs[i]
+		used[cur] = true
+		if selfSigned(cur) {
+			break
+		}
+		chain = append(chain, cur)
+	}
+	for _, c := range certs {
+		if !used[c] && !selfSigned(c) {
+			chain = append(chain, c)
+		}
+	}
+	changed := len(chain) != len(certs)
+	for i, c := range chain {
+		changed = changed || c != certs[i]
+	}
+	if !changed {
+		return data, false, nil
+	}
+	var out []byte
+	for _, c := range chain {
+		out = append(out, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.Raw})...)
+	}
+	return out, true, nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/pem"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// pemChain encodes ders as PEM CERTIFICATE blocks.
+func pemChain(ders ...[]byte) []byte {
+	var out []byte
+	for _, der := range ders {
+		out = append(out, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	return out
+}
+
+func TestFixChain(t *testing.T) {
+	_, chain := testChain(t, func() crypto.Signer {
+		k, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		return k
+	})
+	leaf, root := chain[0], chain[1]
+	tests := []struct {
+		name    string
+		in      [][]byte
+		want    [][]byte
+		changed bool
+		err     bool
+	}{
+		{"leaf", [][]byte{leaf}, [][]byte{leaf}, false, false},
+		{"lone root", [][]byte{root}, [][]byte{root}, false, false},
+		{"root dropped", [][]byte{leaf, root}, [][]byte{leaf}, true, false},
+		{"reordered", [][]byte{root, leaf}, [][]byte{leaf}, true, false},
+		{"two roots", [][]byte{root, root}, nil, false, true},
+	}
+	for _, tt := range tests {
+		got, changed, err := fixChain(pemChain(tt.in...))
+		if (err != nil) != tt.err {
+			t.Errorf("%s: err %v", tt.name, err)
+			continue
+		}
+		if tt.err {
+			continue
+		}
+		if changed != tt.changed {
+			t.Errorf("%s: changed %v, want %v", tt.name, changed, tt.changed)
+		}
+		if !bytes.Equal(got, pemChain(tt.want...)) {
+			t.Errorf("%s: got %d certs, want %d", tt.name, len(certBlocks(got)), len(tt.want))
+		}
+	}
+}
+
+func TestCheckBlocks(t *testing.T) {
+	oldMax := config.MaxChainCerts
+	config.MaxChainCerts = 3
+	defer func() { config.MaxChainCerts = oldMax }()
+	v := newTestVersion(t)
+	crt := certBlocks(v.crt)
+	tests := []struct {
+		name string
+		suf  string
+		data []byte
+		// err is a substring of the error, empty for none
+		err string
+	}{
+		{"crt", ".crt", v.crt, ""},
+		{"key", ".key", v.key, ""},
+		{"swapped crt", ".crt", v.key, "swapped"},
+		{"swapped key", ".key", v.crt, "swapped"},
+		{"empty crt", ".crt", nil, "no CERTIFICATE block"},
+		{"empty key", ".key", nil, "0 private key blocks"},
+		{"garbage crt", ".crt", []byte("not pem"), "no CERTIFICATE block"},
+		{"two keys", ".key", append(slices.Clone(v.key), v.key...), "2 private key blocks"},
+		{"longest chain", ".crt", pemChain(crt[0], crt[1], crt[1]), ""},
+		{"chain too long", ".crt", pemChain(crt[0], crt[1], crt[1], crt[1]), "exceed -max-chain-certs"},
+	}
+	for _, tt := range tests {
+		err := checkBlocks(tt.suf, tt.data)
+		switch {
+		case len(tt.err) == 0 && err != nil:
+			t.Errorf("%s: %v", tt.name, err)
+		case len(tt.err) > 0 && (err == nil || !strings.Contains(err.Error(), tt.err)):
+			t.Errorf("%s: got error %v, want %q", tt.name, err, tt.err)
+		}
+	}
+}
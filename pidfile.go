@@ -0,0 +1,59 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// writePidfile writes the pid of this process to fname. An existing
+// pidfile of a process that is still running makes it fail unless force is
+// set, a stale one is replaced.
+func writePidfile(fname string, force bool) error {
+	data, err := os.ReadFile(fname)
+	if err == nil {
+		pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+		if err == nil && pid != os.Getpid() && processAlive(pid) {
+			if !force {
+				return fmt.Errorf("%s: certwatch already running with pid %d", fname, pid)
+			}
+			slog.Warn("taking over pidfile", "pidfile", fname, "pid", pid)
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return writeFileAtomic(fname, []byte(strconv.Itoa(os.Getpid())+"\n"), time.Now())
+}
+
+// readPidfile returns the pid held by fname.
+func readPidfile(fname string) (int, error) {
+	data, err := os.ReadFile(fname)
+	if err != nil {
+		return 0, err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || pid <= 0 {
+		return 0, fmt.Errorf("%s: invalid pid %q", fname, strings.TrimSpace(string(data)))
+	}
+	return pid, nil
+}
+
+// removePidfile removes fname if it still holds the pid of this process.
+func removePidfile(fname string) {
+	data, err := os.ReadFile(fname)
+	if err != nil {
+		return
+	}
+	if strings.TrimSpace(string(data)) != strconv.Itoa(os.Getpid()) {
+		return
+	}
+	err = os.Remove(fname)
+	if err != nil {
+		slog.Warn("removePidfile", "err", err)
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"unicode/utf16"
+)
+
+var (
+	oidData            = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidShroudedKeyBag  = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 2}
+	oidCertBag         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 3}
+	oidX509Certificate = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 22, 1}
+	oidFriendlyName    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 20}
+	oidLocalKeyID      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 21}
+	oidSHA256          = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+)
+
+const (
+	// pfxVersion is the version of the PFX structure.
+	pfxVersion = 3
+	// pkcs12MacIterations is the iteration count of the MAC key derivation.
+	pkcs12MacIterations = 10000
+)
+
+// pfxPDU is the PFX of RFC 7292.
+type pfxPDU struct {
+	Version  int
+	AuthSafe contentInfo
+	MacData  macData
+}
+
+// contentInfo is the PKCS#7 ContentInfo, only used with the data type.
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"tag:0,explicit,optional"`
+}
+
+// macData is the integrity protection of a PFX.
+type macData struct {
+	Mac        digestInfo
+	MacSalt    []byte
+	Iterations int
+}
+
+// digestInfo is the PKCS#1 DigestInfo.
+type digestInfo struct {
+	Algorithm pkix.AlgorithmIdentifier
+	Digest    []byte
+}
+
+// safeBag is a SafeBag of RFC 7292.
+type safeBag struct {
+	ID         asn1.ObjectIdentifier
+	Value      asn1.RawValue     `asn1:"tag:0,explicit"`
+	Attributes []pkcs12Attribute `asn1:"set,optional"`
+}
+
+// pkcs12Attribute is a PKCS12Attribute with a single value.
+type pkcs12Attribute struct {
+	ID    asn1.ObjectIdentifier
+	Value asn1.RawValue `asn1:"set"`
+}
+
+// certBag is a CertBag holding an X.509 certificate.
+type certBag struct {
+	ID   asn1.ObjectIdentifier
+	Data []byte `asn1:"tag:0,explicit"`
+}
+
+// explicit wraps DER in a context specific [0] tag.
+func explicit(der []byte) asn1.RawValue {
+	return asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: der}
+}
+
+// dataContent returns a ContentInfo of the data type holding der.
+func dataContent(der []byte) (contentInfo, error) {
+	octets, err := asn1.Marshal(der)
+	if err != nil {
+		return contentInfo{}, err
+	}
+	return contentInfo{ContentType: oidData, Content: explicit(octets)}, nil
+}
+
+// bmpString encodes s as a null terminated BMPString without the tag, as
+// used for the PKCS#12 MAC passphrase.
+func bmpString(s string) []byte {
+	var b []byte
+	for _, r := range utf16.Encode([]rune(s)) {
+		b = append(b, byte(r>>8), byte(r))
+	}
+	return append(b, 0, 0)
+}
+
+// bagAttributes returns the friendlyName and localKeyId attributes that tie
+// the key to its cert and name the entry, which Java uses as the alias.
+func bagAttributes(name string, keyID []byte) ([]pkcs12Attribute, error) {
+	bmp := bmpString(name)
+	friendly, err := asn1.Marshal(asn1.RawValue{Class: asn1.ClassUniversal, Tag: 30, Bytes: bmp[:len(bmp)-2]})
+	if err != nil {
+		return nil, err
+	}
+	id, err := asn1.Marshal(keyID)
+	if err != nil {
+		return nil, err
+	}
+	set := func(der []byte) asn1.RawValue {
+		return asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true, Bytes: der}
+	}
+	return []pkcs12Attribute{
+		{ID: oidFriendlyName, Value: set(friendly)},
+		{ID: oidLocalKeyID, Value: set(id)},
+	}, nil
+}
+
+// pkcs12KDF derives size bytes of key material of the given purpose from the
+// passphrase as specified by RFC 7292 appendix B.2, with SHA-256.
+func pkcs12KDF(salt []byte, password []byte, iterations int, id byte, size int) []byte {
+	const v = sha256.BlockSize
+	fill := func(in []byte) []byte {
+		if len(in) == 0 {
+			return nil
+		}
+		out := make([]byte, v*((len(in)+v-1)/v))
+		for i := range out {
+			out[i] = in[i%len(in)]
+		}
+		return out
+	}
+	d := make([]byte, v)
+	for i := range d {
+		d[i] = id
+	}
+	in := append(fill(salt), fill(password)...)
+	var key []byte
+	for len(key) < size {
+		hh := sha256.New()
+		hh.Write(d)
+		hh.Write(in)
+		a := hh.Sum(nil)
+		for range iterations - 1 {
+			hh.Reset()
+			hh.Write(a)
+			a = hh.Sum(a[:0])
+		}
+		key = append(key, a...)
+		b := fill(a)
+		for j := 0; j < len(in); j += v {
+			carry := 1
+			for k := v - 1; k >= 0; k-- {
+				sum := int(in[j+k]) + int(b[k]) + carry
+				in[j+k] = byte(sum)
+				carry = sum >> 8
+			}
+		}
+	}
+	return key[:size]
+}
+
+// encodePKCS12 returns a PKCS#12 keystore holding key and the chain, leaf
+// first, under name. The key is encrypted with PBES2 using AES-256-CBC and
+// PBKDF2 with HMAC-SHA256, the file is protected with an HMAC-SHA256 MAC, as
+// written by OpenSSL 3 and read by Java 8u301 and later. The certs are not
+// encrypted.
+func encodePKCS12(name string, key any, chain [][]byte, passphrase string) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	shrouded, err := encryptPKCS8(der, []byte(passphrase))
+	if err != nil {
+		return nil, err
+	}
+	keyID := sha1.Sum(chain[0])
+	attrs, err := bagAttributes(name, keyID[:])
+	if err != nil {
+		return nil, err
+	}
+	var certBags []safeBag
+	for i, c := range chain {
+		bag, err := asn1.Marshal(certBag{ID: oidX509Certificate, Data: c})
+		if err != nil {
+			return nil, err
+		}
+		sb := safeBag{ID: oidCertBag, Value: explicit(bag)}
+		if i == 0 {
+			sb.Attributes = attrs
+		}
+		certBags = append(certBags, sb)
+	}
+	certsDER, err := asn1.Marshal(certBags)
+	if err != nil {
+		return nil, err
+	}
+	keyDER, err := asn1.Marshal([]safeBag{{ID: oidShroudedKeyBag, Value: explicit(shrouded), Attributes: attrs}})
+	if err != nil {
+		return nil, err
+	}
+	var safes []contentInfo
+	for _, d := range [][]byte{certsDER, keyDER} {
+		ci, err := dataContent(d)
+		if err != nil {
+			return nil, err
+		}
+		safes = append(safes, ci)
+	}
+	authSafe, err := asn1.Marshal(safes)
+	if err != nil {
+		return nil, err
+	}
+	salt := make([]byte, 16)
+	_, err = rand.Read(salt)
+	if err != nil {
+		return nil, err
+	}
+	macKey := pkcs12KDF(salt, bmpString(passphrase), pkcs12MacIterations, 3, sha256.Size)
+	mac := hmac.New(sha256.New, macKey)
+	mac.Write(authSafe)
+	ci, err := dataContent(authSafe)
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(pfxPDU{
+		Version:  pfxVersion,
+		AuthSafe: ci,
+		MacData: macData{
+			Mac: digestInfo{
+				Algorithm: pkix.AlgorithmIdentifier{Algorithm: oidSHA256, Parameters: asn1.NullRawValue},
+				Digest:    mac.Sum(nil),
+			},
+			MacSalt:    salt,
+			Iterations: pkcs12MacIterations,
+		},
+	})
+}
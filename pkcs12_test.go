@@ -0,0 +1,122 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"math/big"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// The expected keys were generated with OpenSSL 3, e.g.
+// openssl kdf -keylen 32 -kdfopt digest:SHA256 -kdfopt hexpass:<BMPString>
+// -kdfopt hexsalt:0102030405060708 -kdfopt iter:2048 -kdfopt id:3 PKCS12KDF
+func TestPKCS12KDF(t *testing.T) {
+	salt, _ := hex.DecodeString("0102030405060708")
+	tests := []struct {
+		id         byte
+		iterations int
+		size       int
+		want       string
+	}{
+		{1, 2048, 32, "4f7075f15c384a1a7a76d6399764beabde936e35ce6285ef09fcffc12507f3c3"},
+		{3, 2048, 32, "f5482fd03f702689b4e96cbbea867c6b16e5bda934929f2ecaf4da9e1c67be8f"},
+		{3, 1, 80, "fe5b6acfa2cf33773d5a0b95a18b28b6d5162a8239bf1636c02d4a791d34ef4bd7651605d9786d2c4e992bdd0d020059fa3241f83e0a1c06032aaf895c4639dd71bd68d6953da689a9089e3f18a72b5c"},
+	}
+	for _, tt := range tests {
+		got := hex.EncodeToString(pkcs12KDF(salt, bmpString("secret"), tt.iterations, tt.id, tt.size))
+		if got != tt.want {
+			t.Errorf("id %d, %d iterations: got %s, want %s", tt.id, tt.iterations, got, tt.want)
+		}
+	}
+}
+
+// testChain returns a leaf signed by a CA, both with keys of the given
+// kind, as DER leaf first.
+func testChain(t testing.TB, newKey func() crypto.Signer) (crypto.Signer, [][]byte) {
+	caKey, key := newKey(), newKey()
+	ca := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, ca, ca, caKey.Public(), caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, _ = x509.ParseCertificate(caDER)
+	leaf := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "example.com"},
+		DNSNames:     []string{"example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	leafDER, err := x509.CreateCertificate(rand.Reader, leaf, ca, key.Public(), caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, [][]byte{leafDER, caDER}
+}
+
+func TestEncodePKCS12(t *testing.T) {
+	keys := map[string]func() crypto.Signer{
+		"ecdsa": func() crypto.Signer {
+			k, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			return k
+		},
+		"rsa": func() crypto.Signer {
+			k, _ := rsa.GenerateKey(rand.Reader, 2048)
+			return k
+		},
+	}
+	for name, newKey := range keys {
+		key, chain := testChain(t, newKey)
+		data, err := encodePKCS12("example.com", key, chain, "pass word")
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		gotKey, leaf, cas, err := pkcs12.DecodeChain(data, "pass word")
+		if err != nil {
+			t.Fatalf("%s: decode: %v", name, err)
+		}
+		if !key.Public().(interface{ Equal(crypto.PublicKey) bool }).Equal(gotKey.(crypto.Signer).Public()) {
+			t.Errorf("%s: key differs", name)
+		}
+		if string(leaf.Raw) != string(chain[0]) || len(cas) != 1 || string(cas[0].Raw) != string(chain[1]) {
+			t.Errorf("%s: chain differs", name)
+		}
+		_, _, _, err = pkcs12.DecodeChain(data, "wrong")
+		if err == nil {
+			t.Errorf("%s: decoded with a wrong passphrase", name)
+		}
+		openssl, err := exec.LookPath("openssl")
+		if err != nil {
+			continue
+		}
+		fname := filepath.Join(t.TempDir(), "test.p12")
+		err = os.WriteFile(fname, data, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := exec.Command(openssl, "pkcs12", "-info", "-noout", "-in", fname, "-passin", "pass:pass word").CombinedOutput()
+		if err != nil {
+			t.Errorf("%s: openssl: %v: %s", name, err, out)
+		}
+	}
+}
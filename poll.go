@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+)
+
+// pollRedis syncs all watched certs every -poll instead of listening for
+// keyspace notifications, for servers that do not allow enabling them. A
+// sweep that fails returns its error, to be retried like a lost
+// subscription.
+func pollRedis(ctx context.Context) error {
+	defer settle.abort(ctx)
+	defer state.setSubscribed(false)
+	for {
+		state.beat()
+		refreshManagedCerts(ctx)
+		_, err := discoverCerts(ctx)
+		if err != nil {
+			return err
+		}
+		pending := make(map[string]bool)
+		err = initialSync(ctx, pending)
+		if err != nil {
+			return err
+		}
+		if len(pending) > 0 {
+			slog.Warn("poll", "failed", len(pending))
+		}
+		redisErrors.Reset()
+		listenFailures = 0
+		state.setSubscribed(true)
+		sdReady()
+		select {
+		case <-clk.After(config.Poll):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if held := settle.due(); len(held) > 0 {
+			certsChanged(ctx, held)
+		}
+	}
+}
+
+// syncOnce syncs all watched certs once for -oneshot, runs the command for
+// the changed ones, waits for the -sftp uploads and returns the exit
+// status: 0 if every cert is in sync and every command and target write
+// succeeded, 1 otherwise.
+func syncOnce(ctx context.Context) int {
+	pending := make(map[string]bool)
+	err := initialSync(ctx, pending)
+	settle.abort(ctx)
+	asyncCmds.drain()
+	drainSftp()
+	if err != nil {
+		slog.Error("oneshot sync failed", "err", err)
+		return 1
+	}
+	r := state.report()
+	var failedTargets []string
+	for _, ts := range r.Targets {
+		if len(ts.LastError) > 0 {
+			failedTargets = append(failedTargets, ts.Name)
+		}
+	}
+	if len(pending) > 0 || len(r.CmdError) > 0 || len(r.LastHookError) > 0 || len(r.Missing) > 0 || len(failedTargets) > 0 {
+		slog.Error("oneshot sync incomplete", "failed", len(pending), "cmdError", r.CmdError, "hookError", r.LastHookError, "missing", r.Missing, "failedTargets", failedTargets)
+		return 1
+	}
+	slog.Info("oneshot sync done", "certs", len(watchedCerts()))
+	return 0
+}
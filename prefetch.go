@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// prefetchedValue is the result of getValue for one cert file.
+type prefetchedValue struct {
+	val    string
+	key    string
+	client redis.UniversalClient
+	err    error
+}
+
+// prefetch holds the values of the initial sweep, read with one pipeline
+// per client instead of one round trip per key.
+type prefetch struct {
+	mu     sync.Mutex
+	values map[string]prefetchedValue
+}
+
+type prefetchKey struct{}
+
+// prefetchFrom returns the prefetched values attached to ctx, if any.
+func prefetchFrom(ctx context.Context) *prefetch {
+	pf, _ := ctx.Value(prefetchKey{}).(*prefetch)
+	return pf
+}
+
+// take returns and forgets the prefetched value of the cert file, so that
+// retries read the current value from redis.
+func (pf *prefetch) take(cert string, suf string) (prefetchedValue, bool) {
+	pf.mu.Lock()
+	defer pf.mu.Unlock()
+	v, ok := pf.values[cert+suf]
+	delete(pf.values, cert+suf)
+	return v, ok
+}
+
+// withPrefetch reads all files of certs with pipelined GETs and attaches
+// the results to the returned context.
+func withPrefetch(ctx context.Context, certs []string) context.Context {
+	start := time.Now()
+	pipes := make(map[redis.UniversalClient]redis.Pipeliner)
+	cmds := make(map[redis.UniversalClient]map[string]*redis.StringCmd)
+	queue := func(c redis.UniversalClient, key string) (string, error) {
+		if _, ok := pipes[c]; !ok {
+			pipes[c] = c.Pipeline()
+			cmds[c] = make(map[string]*redis.StringCmd)
+		}
+		if _, ok := cmds[c][key]; !ok {
+			cmds[c][key] = pipes[c].Get(ctx, key)
+		}
+		return "", redis.Nil
+	}
+	for _, cert := range certs {
+		for _, suf := range certSuffixes {
+			getValueWith(cert, suf, queue)
+		}
+	}
+	// replies with errors, including redis.Nil, are reported per command,
+	// a failure to talk to the server at all only by Exec
+	failed := make(map[redis.UniversalClient]error)
+	for c, pipe := range pipes {
+		_, err := pipe.Exec(ctx)
+		var rerr redis.Error
+		if err != nil && !errors.As(err, &rerr) {
+			failed[c] = err
+		}
+	}
+	read := func(c redis.UniversalClient, key string) (string, error) {
+		if err, ok := failed[c]; ok {
+			return "", err
+		}
+		return cmds[c][key].Result()
+	}
+	pf := &prefetch{values: make(map[string]prefetchedValue)}
+	for _, cert := range certs {
+		for _, suf := range certSuffixes {
+			var v prefetchedValue
+			v.val, v.key, v.client, v.err = getValueWith(cert, suf, read)
+			pf.values[cert+suf] = v
+		}
+	}
+	slog.Debug("prefetched", "certs", len(certs), "pipelines", len(pipes), "duration", time.Since(start))
+	return context.WithValue(ctx, prefetchKey{}, pf)
+}
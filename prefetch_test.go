@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// prefetchValues returns the values of n certs named cert<i>.example.com.
+func prefetchValues(tb testing.TB, n int) ([]string, map[string]string) {
+	v := newTestVersion(tb)
+	var certs []string
+	values := make(map[string]string)
+	for i := range n {
+		cert := fmt.Sprintf("cert%d.example.com", i)
+		certs = append(certs, cert)
+		values[certKey(cert, ".key")] = storedValue(string(v.key), 1)
+		values[certKey(cert, ".crt")] = storedValue(string(v.crt), 1)
+	}
+	return certs, values
+}
+
+// sweep reads all files of certs with getValue, pipelined if prefetch is
+// set.
+func sweep(tb testing.TB, certs []string, prefetch bool) {
+	ctx := context.Background()
+	if prefetch {
+		ctx = withPrefetch(ctx, certs)
+	}
+	for _, cert := range certs {
+		for _, suf := range certSuffixes {
+			_, _, _, err := getValue(ctx, cert, suf)
+			if err != nil {
+				tb.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestPrefetchRoundTrips(t *testing.T) {
+	useTestConfig(t)
+	tests := []struct {
+		certs    int
+		prefetch bool
+		want     int
+	}{
+		{1, false, 2},
+		{1, true, 1},
+		{200, false, 400},
+		{200, true, 1},
+	}
+	for _, tt := range tests {
+		certs, values := prefetchValues(t, tt.certs)
+		r := useFakeRedis(t, values)
+		sweep(t, certs, tt.prefetch)
+		if got := r.trips(); got != tt.want {
+			t.Errorf("%d certs, prefetch %v: %d round trips, want %d", tt.certs, tt.prefetch, got, tt.want)
+		}
+	}
+}
+
+// BenchmarkSweep reads 200 certs from a server 5ms away, with one GET per
+// file and pipelined.
+func BenchmarkSweep(b *testing.B) {
+	useTestConfig(b)
+	certs, values := prefetchValues(b, 200)
+	for _, prefetch := range []bool{false, true} {
+		b.Run(fmt.Sprintf("prefetch=%v", prefetch), func(b *testing.B) {
+			r := useFakeRedis(b, values)
+			r.mu.Lock()
+			r.latency = 5 * time.Millisecond
+			r.mu.Unlock()
+			for range b.N {
+				sweep(b, certs, prefetch)
+			}
+			b.ReportMetric(float64(r.trips())/float64(b.N), "roundtrips/op")
+		})
+	}
+}
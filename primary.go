@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+)
+
+// primaryPath returns the fixed file name the file of -primary with the
+// given suffix is also written to.
+func primaryPath(suf string) string {
+	name := config.PrimaryCrt
+	if suf == ".key" {
+		name = config.PrimaryKey
+	}
+	if filepath.IsAbs(name) {
+		return name
+	}
+	return filepath.Join(config.CertDir, name)
+}
+
+// updatePrimary writes the files of cert under their fixed names if cert is
+// the -primary cert and they are not up to date. Errors are logged, the per
+// cert files are installed already.
+func updatePrimary(cert string, files []certFile) {
+	if cert != config.Primary {
+		return
+	}
+	for _, f := range files {
+		fname := primaryPath(f.suffix)
+		current, err := upToDate(fname, f.data, f.modified)
+		if err == nil && current {
+			continue
+		}
+		err = writeFileAtomic(fname, f.data, f.modified)
+		if err == nil && f.suffix == ".key" {
+			err = checkKeyMode(fname, 0600)
+		}
+		if err != nil {
+			slog.Error("primary", "cert", cert, "file", fname, "err", err)
+			continue
+		}
+		slog.Info("primary updated", "cert", cert, "file", fname)
+	}
+}
+
+// removePrimary removes the fixed name file of a removed file of -primary.
+func removePrimary(cert string, suf string) {
+	if cert != config.Primary {
+		return
+	}
+	fname := primaryPath(suf)
+	err := os.Remove(fname)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		slog.Error("primary", "cert", cert, "file", fname, "err", err)
+		return
+	}
+	slog.Info("primary removed", "cert", cert, "file", fname)
+}
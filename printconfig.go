@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"maps"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// redactURL hides the userinfo and the query values of a URL, either may
+// carry credentials.
+func redactURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil {
+		return "<unparsable>"
+	}
+	if u.User != nil {
+		u.User = url.User("xxxxx")
+	}
+	if len(u.RawQuery) > 0 {
+		q := u.Query()
+		for k := range q {
+			q[k] = []string{"xxxxx"}
+		}
+		u.RawQuery = q.Encode()
+	}
+	return u.String()
+}
+
+// redactAddr hides the userinfo of a host:port address, or of a URL if it
+// is one.
+func redactAddr(s string) string {
+	if strings.Contains(s, "://") {
+		return redactURL(s)
+	}
+	if i := strings.LastIndex(s, "@"); i >= 0 {
+		return "xxxxx" + s[i:]
+	}
+	return s
+}
+
+// redactAddrs returns a copy of addrs with each address redacted.
+func redactAddrs(addrs stringsFlag) stringsFlag {
+	var r stringsFlag
+	for _, v := range addrs {
+		var parts []string
+		for _, addr := range strings.Split(v, ",") {
+			parts = append(parts, redactAddr(addr))
+		}
+		r = append(r, strings.Join(parts, ","))
+	}
+	return r
+}
+
+// cmdURL matches the URLs in a command line.
+var cmdURL = regexp.MustCompile(`[a-zA-Z][a-zA-Z0-9+.-]*://[^\s'"]+`)
+
+// redactCmd hides the credentials of the URLs in the command line s.
+func redactCmd(s string) string {
+	return cmdURL.ReplaceAllStringFunc(s, redactURL)
+}
+
+// redacted returns a copy of the config with secrets hidden.
+func (c Config) redacted() Config {
+	c.RedisUrl = redactURL(c.RedisUrl)
+	if len(c.ReplicaUrl) > 0 {
+		c.ReplicaUrl = redactURL(c.ReplicaUrl)
+	}
+	c.SentinelAddrs = redactAddrs(c.SentinelAddrs)
+	c.ClusterAddrs = redactAddrs(c.ClusterAddrs)
+	if len(c.VaultAddr) > 0 {
+		c.VaultAddr = redactURL(c.VaultAddr)
+	}
+	if len(c.CmdWebhook) > 0 {
+		c.CmdWebhook = redactURL(c.CmdWebhook)
+	}
+	if len(c.KVURL) > 0 {
+		c.KVURL = redactURL(c.KVURL)
+	}
+	c.Cmd = redactCmd(c.Cmd)
+	c.PreCmd = redactCmd(c.PreCmd)
+	c.NewCertCmd = redactCmd(c.NewCertCmd)
+	c.StageCmd = redactCmd(c.StageCmd)
+	c.ServiceReloadCmd = redactCmd(c.ServiceReloadCmd)
+	// the commands of the certs in the -config file end up in CertCmds,
+	// which is shared with config and must not be changed in place
+	c.CertCmds = maps.Clone(c.CertCmds)
+	for cert, cmd := range c.CertCmds {
+		c.CertCmds[cert] = redactCmd(cmd)
+	}
+	if len(c.HealthToken) > 0 {
+		c.HealthToken = "xxxxx"
+	}
+	if len(c.KVToken) > 0 {
+		c.KVToken = "xxxxx"
+	}
+	if len(c.KeyPassphrase) > 0 {
+		c.KeyPassphrase = "xxxxx"
+	}
+	if len(c.OutPassphrase) > 0 {
+		c.OutPassphrase = "xxxxx"
+	}
+	if len(c.VaultToken) > 0 {
+		c.VaultToken = "xxxxx"
+	}
+	if len(c.CmdWebhookToken) > 0 {
+		c.CmdWebhookToken = "xxxxx"
+	}
+	if len(c.P12Passphrase) > 0 {
+		c.P12Passphrase = "xxxxx"
+	}
+	if len(c.SentinelPassword) > 0 {
+		c.SentinelPassword = "xxxxx"
+	}
+	if len(c.SmtpPassword) > 0 {
+		c.SmtpPassword = "xxxxx"
+	}
+	return c
+}
+
+// printConfig writes the effective config to stdout as JSON.
+func printConfig() error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(config.redacted())
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// priorityArgs prefix the commands run by runWith to apply -cmd-nice and
+// -cmd-ionice, empty if neither is given.
+var priorityArgs []string
+
+// parsePriority checks -cmd-nice and -cmd-ionice and sets priorityArgs.
+// The priorities are applied by the nice and ionice tools so they cover the
+// whole command run by sh, including its children.
+func parsePriority() error {
+	if config.CmdNice < 0 || config.CmdNice > 19 {
+		return fmt.Errorf("nice increment %d out of range 0-19", config.CmdNice)
+	}
+	if len(config.CmdIONice) > 0 {
+		if runtime.GOOS != "linux" {
+			return errors.New("ionice is only supported on linux")
+		}
+		class, level, hasLevel := strings.Cut(config.CmdIONice, ":")
+		switch {
+		case class == "idle" && !hasLevel:
+			priorityArgs = append(priorityArgs, "ionice", "-c", "3")
+		case class == "best-effort":
+			priorityArgs = append(priorityArgs, "ionice", "-c", "2")
+			if hasLevel {
+				n, err := strconv.Atoi(level)
+				if err != nil || n < 0 || n > 7 {
+					return fmt.Errorf("best-effort level %q out of range 0-7", level)
+				}
+				priorityArgs = append(priorityArgs, "-n", level)
+			}
+		default:
+			return fmt.Errorf("unknown I/O scheduling class %q", config.CmdIONice)
+		}
+	}
+	if config.CmdNice > 0 {
+		if runtime.GOOS == "windows" {
+			return errors.New("nice is not supported on windows")
+		}
+		priorityArgs = append(priorityArgs, "nice", "-n", strconv.Itoa(config.CmdNice))
+	}
+	return nil
+}
@@ -0,0 +1,25 @@
+//go:build !unix
+
+package main
+
+import "errors"
+
+// processAlive reports whether a process with the given pid exists. Without
+// a way to check, every process is assumed to be alive.
+func processAlive(pid int) bool {
+	return true
+}
+
+// errSignalUnsupported is returned for -cmd-mode signal on platforms
+// without signals.
+var errSignalUnsupported = errors.New("signals are not supported on this platform")
+
+// checkSignal checks that the named signal can be sent.
+func checkSignal(name string) error {
+	return errSignalUnsupported
+}
+
+// signalProcess sends the named signal to the process with the given pid.
+func signalProcess(pid int, name string) error {
+	return errSignalUnsupported
+}
@@ -0,0 +1,52 @@
+//go:build unix
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"syscall"
+)
+
+// processAlive reports whether a process with the given pid exists.
+func processAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
+
+// reloadSignals are the signals -cmd-signal accepts, by name.
+var reloadSignals = map[string]syscall.Signal{
+	"HUP":   syscall.SIGHUP,
+	"INT":   syscall.SIGINT,
+	"QUIT":  syscall.SIGQUIT,
+	"TERM":  syscall.SIGTERM,
+	"USR1":  syscall.SIGUSR1,
+	"USR2":  syscall.SIGUSR2,
+	"WINCH": syscall.SIGWINCH,
+}
+
+// lookupSignal returns the signal of the given name, with or without the
+// SIG prefix.
+func lookupSignal(name string) (syscall.Signal, error) {
+	sig, ok := reloadSignals[strings.TrimPrefix(strings.ToUpper(name), "SIG")]
+	if !ok {
+		return 0, fmt.Errorf("unknown signal %q", name)
+	}
+	return sig, nil
+}
+
+// checkSignal checks that the named signal can be sent.
+func checkSignal(name string) error {
+	_, err := lookupSignal(name)
+	return err
+}
+
+// signalProcess sends the named signal to the process with the given pid.
+func signalProcess(pid int, name string) error {
+	sig, err := lookupSignal(name)
+	if err != nil {
+		return err
+	}
+	return syscall.Kill(pid, sig)
+}
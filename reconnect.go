@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// reconnectSummaryInterval is how often reconnect activity is summarised in
+// the log.
+const reconnectSummaryInterval = 10 * time.Minute
+
+// reconnectLimiter is a token bucket bounding the rate of connection
+// attempts to redis, independent of the sleep after an error.
+type reconnectLimiter struct {
+	rate   float64 // tokens per second
+	burst  float64
+	tokens float64
+	last   time.Time
+
+	// attempts since the last summary
+	attempts    int
+	summaryTime time.Time
+}
+
+func newReconnectLimiter(perMinute float64, burst int) *reconnectLimiter {
+	now := clk.Now()
+	return &reconnectLimiter{
+		rate:        perMinute / 60,
+		burst:       float64(burst),
+		tokens:      float64(burst),
+		last:        now,
+		summaryTime: now,
+	}
+}
+
+// wait blocks until a connection attempt is allowed or ctx is done.
+func (l *reconnectLimiter) wait(ctx context.Context) error {
+	if l.rate <= 0 {
+		return nil
+	}
+	now := clk.Now()
+	l.tokens = min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	if l.tokens < 1 {
+		d := time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+		slog.Warn("reconnect throttled", "dur", d)
+		select {
+		case <-clk.After(d):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		l.tokens = 1
+		l.last = clk.Now()
+	}
+	l.tokens--
+	return nil
+}
+
+// reconnected records a reconnect attempt and logs a summary at most every
+// reconnectSummaryInterval.
+func (l *reconnectLimiter) reconnected() {
+	total := state.reconnected()
+	l.attempts++
+	if clk.Now().Sub(l.summaryTime) >= reconnectSummaryInterval {
+		slog.Info("reconnect summary", "attempts", l.attempts, "since", l.summaryTime, "total", total)
+		l.attempts = 0
+		l.summaryTime = clk.Now()
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// fakeRedis is a redis server that only knows the commands certwatch syncs
+// with, holding its values in memory.
+type fakeRedis struct {
+	mu     sync.Mutex
+	values map[string]string
+	// latency delays every reply sent, roundTrips counts those holding
+	// values read
+	latency     time.Duration
+	roundTrips  int
+	subscribers []*fakeSubscriber
+}
+
+// useFakeRedis starts a fakeRedis holding values and points client,
+// readClient and a source with prefix caddy at it.
+func useFakeRedis(t testing.TB, values map[string]string) *fakeRedis {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	r := &fakeRedis{values: values}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go r.serve(conn)
+		}
+	}()
+	oldClient, oldReadClient, oldSources := client, readClient, sources
+	t.Cleanup(func() { client, readClient, sources = oldClient, oldReadClient, oldSources })
+	c := redis.NewClient(&redis.Options{Addr: ln.Addr().String(), Protocol: 2, DisableIndentity: true})
+	t.Cleanup(func() { c.Close() })
+	client, readClient = c, c
+	sources = []keySource{{prefix: "caddy", db: -1, client: c}}
+	return r
+}
+
+// certKey returns the redis key of the file of cert with suffix suf below
+// the source of useFakeRedis.
+func certKey(cert string, suf string) string {
+	return certPath("caddy") + cert + "/" + cert + suf
+}
+
+// set stores value at key.
+func (r *fakeRedis) set(key string, value string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.values[key] = value
+}
+
+// trips returns the number of round trips that read values.
+func (r *fakeRedis) trips() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.roundTrips
+}
+
+func (r *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	reads := false
+	for {
+		args, err := readCommand(br)
+		if err != nil {
+			return
+		}
+		r.mu.Lock()
+		r.reply(w, args)
+		reads = reads || strings.EqualFold(args[0], "get")
+		if br.Buffered() == 0 {
+			if reads {
+				r.roundTrips++
+			}
+			reads = false
+			latency := r.latency
+			r.mu.Unlock()
+			time.Sleep(latency)
+			r.mu.Lock()
+			err = w.Flush()
+		}
+		r.mu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// fakeSubscriber is a connection subscribed to patterns.
+type fakeSubscriber struct {
+	w        *bufio.Writer
+	patterns []string
+}
+
+// publish sends the keyspace notification of event on key to the
+// subscribers whose pattern matches. Called with mu held.
+func (r *fakeRedis) publish(key string, event string) {
+	channel := keyspaceChannel(0, key)
+	for _, sub := range r.subscribers {
+		for _, pattern := range sub.patterns {
+			if strings.HasPrefix(channel, strings.TrimSuffix(pattern, "*")) {
+				fmt.Fprintf(sub.w, "*4\r\n%s%s%s%s", bulk("pmessage"), bulk(pattern), bulk(channel), bulk(event))
+				sub.w.Flush()
+			}
+		}
+	}
+}
+
+// reply writes the reply to the command args. Called with mu held.
+func (r *fakeRedis) reply(w *bufio.Writer, args []string) {
+	switch strings.ToLower(args[0]) {
+	case "ping":
+		w.WriteString("+PONG\r\n")
+	case "get":
+		v, ok := r.values[args[1]]
+		if !ok {
+			w.WriteString("$-1\r\n")
+			return
+		}
+		w.WriteString(bulk(v))
+	case "set":
+		r.values[args[1]] = args[2]
+		w.WriteString("+OK\r\n")
+		r.publish(args[1], "set")
+	case "copy":
+		v, ok := r.values[args[1]]
+		_, exists := r.values[args[2]]
+		if !ok || exists {
+			w.WriteString(":0\r\n")
+			return
+		}
+		r.values[args[2]] = v
+		w.WriteString(":1\r\n")
+		r.publish(args[2], "copy_to")
+	case "psubscribe":
+		sub := &fakeSubscriber{w: w, patterns: args[1:]}
+		r.subscribers = append(r.subscribers, sub)
+		for i, pattern := range sub.patterns {
+			fmt.Fprintf(w, "*3\r\n%s%s:%d\r\n", bulk("psubscribe"), bulk(pattern), i+1)
+		}
+	default:
+		fmt.Fprintf(w, "-ERR unknown command '%s'\r\n", args[0])
+	}
+}
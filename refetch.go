@@ -0,0 +1,69 @@
+package main
+
+import (
+	"math/rand/v2"
+	"slices"
+	"time"
+)
+
+// refetchSchedule holds when each cert is due for its -refresh-interval
+// fetch. It is only used by the listen loop.
+type refetchSchedule map[string]time.Time
+
+// newRefetchSchedule spreads the first fetch of every cert evenly over one
+// interval, so the certs are not all fetched at once. It returns nil
+// without -refresh-interval.
+func newRefetchSchedule() refetchSchedule {
+	if config.RefreshInterval <= 0 {
+		return nil
+	}
+	now := clk.Now()
+	s := make(refetchSchedule)
+	for _, cert := range config.Certs {
+		s[cert] = now.Add(rand.N(config.RefreshInterval))
+	}
+	return s
+}
+
+// add schedules the first fetch of a newly watched cert one interval out.
+func (s refetchSchedule) add(cert string) {
+	if s != nil {
+		s[cert] = clk.Now().Add(s.next())
+	}
+}
+
+// next returns the interval until the following fetch, jittered by up to a
+// tenth of -refresh-interval.
+func (s refetchSchedule) next() time.Duration {
+	return config.RefreshInterval + rand.N(config.RefreshInterval/10+1)
+}
+
+// due returns the certs whose fetch is due, in name order, and schedules
+// their next one.
+func (s refetchSchedule) due() []string {
+	now := clk.Now()
+	var certs []string
+	for cert, at := range s {
+		if !now.Before(at) {
+			certs = append(certs, cert)
+			s[cert] = now.Add(s.next())
+		}
+	}
+	slices.Sort(certs)
+	return certs
+}
+
+// remaining returns the time until the next fetch is due, false if there is
+// no schedule.
+func (s refetchSchedule) remaining() (time.Duration, bool) {
+	if len(s) == 0 {
+		return 0, false
+	}
+	var first time.Time
+	for _, at := range s {
+		if first.IsZero() || at.Before(first) {
+			first = at
+		}
+	}
+	return max(first.Sub(clk.Now()), time.Millisecond), true
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// reloadTimeout bounds a single built-in reload, including the wait for a
+// systemd job to finish.
+const reloadTimeout = time.Minute
+
+// reloadAction is a built-in reload, done without spawning a shell. Exactly
+// one of pidfile, unit and webhook is set. Actions are comparable, so certs
+// sharing an action are reloaded together.
+type reloadAction struct {
+	// pidfile holds the pid of the process sent signal.
+	pidfile string
+	signal  string
+	// unit is the systemd unit reloaded, or restarted if restart is set.
+	unit    string
+	restart bool
+	// webhook is the URL sent a POST request with the changed certs.
+	webhook string
+}
+
+// reloadEntry is the reload of a cert in the -config file.
+type reloadEntry struct {
+	Pidfile string `yaml:"pidfile"`
+	Signal  string `yaml:"signal"`
+	Unit    string `yaml:"unit"`
+	Restart bool   `yaml:"restart"`
+	Webhook string `yaml:"webhook"`
+}
+
+// webhookBody is the JSON body posted to a reload webhook.
+type webhookBody struct {
+	Changed []string  `json:"changed"`
+	CertDir string    `json:"cert_dir"`
+	Time    time.Time `json:"time"`
+}
+
+var (
+	// cmdReload is the reload of -cmd-mode signal, systemd or webhook, nil
+	// for oneshot.
+	cmdReload *reloadAction
+	// certReloads are the reloads of the certs in the -config file by cert
+	// name.
+	certReloads = make(map[string]reloadAction)
+)
+
+// newReloadAction checks and returns the reload described by e.
+func newReloadAction(e reloadEntry) (reloadAction, error) {
+	a := reloadAction{pidfile: e.Pidfile, signal: e.Signal, unit: e.Unit, restart: e.Restart, webhook: e.Webhook}
+	n := 0
+	for _, s := range []string{a.pidfile, a.unit, a.webhook} {
+		if len(s) > 0 {
+			n++
+		}
+	}
+	if n != 1 {
+		return a, errors.New("a reload needs exactly one of pidfile, unit and webhook")
+	}
+	if len(a.signal) > 0 && len(a.pidfile) == 0 {
+		return a, errors.New("signal needs a pidfile")
+	}
+	if a.restart && len(a.unit) == 0 {
+		return a, errors.New("restart needs a unit")
+	}
+	switch {
+	case len(a.pidfile) > 0:
+		if len(a.signal) == 0 {
+			a.signal = "HUP"
+		}
+		return a, checkSignal(a.signal)
+	case len(a.unit) > 0:
+		return a, checkSystemd()
+	}
+	u, err := url.Parse(a.webhook)
+	if err != nil {
+		return a, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return a, fmt.Errorf("webhook %q is no http or https URL", a.webhook)
+	}
+	return a, nil
+}
+
+// String describes the action for the log, without the query of a webhook
+// that may hold a secret.
+func (a reloadAction) String() string {
+	switch {
+	case len(a.pidfile) > 0:
+		return "signal " + a.signal + " " + a.pidfile
+	case len(a.unit) > 0 && a.restart:
+		return "restart " + a.unit
+	case len(a.unit) > 0:
+		return "reload " + a.unit
+	}
+	u, err := url.Parse(a.webhook)
+	if err != nil {
+		return "webhook"
+	}
+	u.RawQuery = ""
+	u.User = nil
+	return "webhook " + u.String()
+}
+
+// run does the reload for the changed certs. A failure is logged and
+// returned.
+func (a reloadAction) run(ctx context.Context, changed []string) error {
+	ctx, span := tracer.Start(ctx, "reload", trace.WithAttributes(attribute.StringSlice("changed", changed), attribute.String("action", a.String())))
+	var err error
+	defer func() { endSpan(span, err) }()
+	ctx, cancel := context.WithTimeout(ctx, reloadTimeout)
+	defer cancel()
+	start := time.Now()
+	switch {
+	case len(a.pidfile) > 0:
+		err = a.signalPid()
+	case len(a.unit) > 0:
+		err = systemdUnitAction(ctx, a.unit, a.restart)
+	default:
+		err = a.post(ctx, changed)
+	}
+	if err != nil {
+		slog.Error("reload failed, certs were updated on disk", "changed", changed, "action", a.String(), "err", err)
+		return err
+	}
+	slog.Info("reload completed", "changed", changed, "action", a.String(), "duration", time.Since(start))
+	return nil
+}
+
+// signalPid sends the signal to the process in the pidfile. The pidfile is
+// read for every reload, so a restarted process is found again.
+func (a reloadAction) signalPid() error {
+	pid, err := readPidfile(a.pidfile)
+	if err != nil {
+		return err
+	}
+	if !processAlive(pid) {
+		return fmt.Errorf("%s: no process with pid %d", a.pidfile, pid)
+	}
+	err = signalProcess(pid, a.signal)
+	if err != nil {
+		return err
+	}
+	slog.Debug("reload signal sent", "signal", a.signal, "pid", pid)
+	return nil
+}
+
+// post sends the changed certs to the webhook, with -cmd-webhook-token as
+// bearer token if set. Any status but 2xx is a failure.
+func (a reloadAction) post(ctx context.Context, changed []string) error {
+	data, err := json.Marshal(webhookBody{Changed: changed, CertDir: config.CertDir, Time: time.Now()})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.webhook, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(config.CmdWebhookToken) > 0 {
+		req.Header.Set("Authorization", "Bearer "+config.CmdWebhookToken)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// runCertReloads does the reloads of the changed certs from the -config
+// file, once for every action in the order the actions first appear in
+// changed, with the changed certs sharing it. The failures are returned
+// joined.
+func runCertReloads(ctx context.Context, changed []string) error {
+	var actions []reloadAction
+	owned := make(map[reloadAction][]string)
+	for _, cert := range changed {
+		a, ok := certReloads[cert]
+		if !ok {
+			continue
+		}
+		if !slices.Contains(actions, a) {
+			actions = append(actions, a)
+		}
+		owned[a] = append(owned[a], cert)
+	}
+	var errs []error
+	for _, a := range actions {
+		errs = append(errs, a.run(ctx, owned[a]))
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// webhookRecorder is a test webhook answering with status and recording
+// the requests it received.
+type webhookRecorder struct {
+	mu     sync.Mutex
+	status int
+	bodies []webhookBody
+	auth   []string
+}
+
+func (wr *webhookRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var b webhookBody
+	json.NewDecoder(r.Body).Decode(&b)
+	wr.mu.Lock()
+	wr.bodies = append(wr.bodies, b)
+	wr.auth = append(wr.auth, r.Header.Get("Authorization"))
+	status := wr.status
+	wr.mu.Unlock()
+	if status/100 != 2 {
+		http.Error(w, "reload refused", status)
+		return
+	}
+	w.WriteHeader(status)
+}
+
+func TestNewReloadAction(t *testing.T) {
+	tests := []struct {
+		e       reloadEntry
+		wantErr bool
+	}{
+		{reloadEntry{Unit: "nginx.service"}, false},
+		{reloadEntry{Unit: "nginx.service", Restart: true}, false},
+		{reloadEntry{Webhook: "https://example.com/reload"}, false},
+		{reloadEntry{}, true},
+		{reloadEntry{Unit: "nginx.service", Webhook: "https://example.com"}, true},
+		{reloadEntry{Webhook: "ftp://example.com"}, true},
+		{reloadEntry{Unit: "nginx.service", Signal: "HUP"}, true},
+		{reloadEntry{Webhook: "https://example.com", Restart: true}, true},
+	}
+	for _, tt := range tests {
+		_, err := newReloadAction(tt.e)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%+v: got %v, want error %v", tt.e, err, tt.wantErr)
+		}
+	}
+}
+
+func TestWebhookPost(t *testing.T) {
+	wr := &webhookRecorder{}
+	srv := httptest.NewServer(wr)
+	defer srv.Close()
+	config.CertDir = "/etc/certs"
+	config.CmdWebhookToken = "token"
+	defer func() { config.CmdWebhookToken = "" }()
+	a, err := newReloadAction(reloadEntry{Webhook: srv.URL + "/reload?key=secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := a.String(); strings.Contains(s, "secret") {
+		t.Errorf("String leaks the query: %s", s)
+	}
+	tests := []struct {
+		status  int
+		wantErr bool
+	}{
+		{http.StatusOK, false},
+		{http.StatusNoContent, false},
+		{http.StatusForbidden, true},
+		{http.StatusInternalServerError, true},
+	}
+	for _, tt := range tests {
+		wr.status = tt.status
+		err := a.post(context.Background(), []string{"a.example.com", "b.example.com"})
+		if (err != nil) != tt.wantErr {
+			t.Errorf("status %d: got %v, want error %v", tt.status, err, tt.wantErr)
+		}
+		if err != nil && !strings.Contains(err.Error(), "reload refused") {
+			t.Errorf("status %d: error %v does not hold the response", tt.status, err)
+		}
+	}
+	for i, b := range wr.bodies {
+		if !slices.Equal(b.Changed, []string{"a.example.com", "b.example.com"}) || b.CertDir != "/etc/certs" || b.Time.IsZero() {
+			t.Errorf("request %d: body %+v", i, b)
+		}
+		if wr.auth[i] != "Bearer token" {
+			t.Errorf("request %d: authorization %q", i, wr.auth[i])
+		}
+	}
+}
+
+func TestRunCertReloads(t *testing.T) {
+	web, api := &webhookRecorder{status: http.StatusOK}, &webhookRecorder{status: http.StatusOK}
+	webSrv, apiSrv := httptest.NewServer(web), httptest.NewServer(api)
+	defer webSrv.Close()
+	defer apiSrv.Close()
+	webAction, _ := newReloadAction(reloadEntry{Webhook: webSrv.URL})
+	apiAction, _ := newReloadAction(reloadEntry{Webhook: apiSrv.URL})
+	certReloads = map[string]reloadAction{
+		"www.example.com":    webAction,
+		"static.example.com": webAction,
+		"api.example.com":    apiAction,
+	}
+	defer func() { certReloads = make(map[string]reloadAction) }()
+	runCertReloads(context.Background(), []string{"www.example.com", "api.example.com", "other.example.com", "static.example.com"})
+	if len(web.bodies) != 1 || !slices.Equal(web.bodies[0].Changed, []string{"www.example.com", "static.example.com"}) {
+		t.Errorf("shared action: %+v", web.bodies)
+	}
+	if len(api.bodies) != 1 || !slices.Equal(api.bodies[0].Changed, []string{"api.example.com"}) {
+		t.Errorf("own action: %+v", api.bodies)
+	}
+}
+
+func TestRunCmdKeepsError(t *testing.T) {
+	failing, ok := &webhookRecorder{status: http.StatusInternalServerError}, &webhookRecorder{status: http.StatusOK}
+	failingSrv, okSrv := httptest.NewServer(failing), httptest.NewServer(ok)
+	defer failingSrv.Close()
+	defer okSrv.Close()
+	failAction, _ := newReloadAction(reloadEntry{Webhook: failingSrv.URL})
+	okAction, _ := newReloadAction(reloadEntry{Webhook: okSrv.URL})
+	cmdReload = &failAction
+	certReloads = map[string]reloadAction{"www.example.com": okAction}
+	defer func() {
+		cmdReload = nil
+		certReloads = make(map[string]reloadAction)
+		state.setCmdError(nil)
+	}()
+	runCmd(context.Background(), []string{"www.example.com"})
+	if len(ok.bodies) != 1 {
+		t.Fatalf("cert reload not run: %+v", ok.bodies)
+	}
+	state.mu.Lock()
+	cmdError := state.cmdError
+	state.mu.Unlock()
+	if !strings.Contains(cmdError, "500") {
+		t.Errorf("failed cmdReload cleared by a later success, error %q", cmdError)
+	}
+}
+
+func TestRunCmdHookError(t *testing.T) {
+	ok := &webhookRecorder{status: http.StatusOK}
+	okSrv := httptest.NewServer(ok)
+	defer okSrv.Close()
+	okAction, _ := newReloadAction(reloadEntry{Webhook: okSrv.URL})
+	failing, err := parseShellCmd("certcmd", "false")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmdReload = &okAction
+	certCmds["www.example.com"] = failing
+	defer func() {
+		cmdReload = nil
+		delete(certCmds, "www.example.com")
+		state = watchState{certs: make(map[string]*certStatus), targets: make(map[string]*targetStatus)}
+	}()
+	runCmd(context.Background(), []string{"www.example.com"})
+	r := state.report()
+	if len(r.CmdError) > 0 || !r.healthy() {
+		t.Errorf("failing -certcmd recorded as reload error %q", r.CmdError)
+	}
+	if len(r.LastHookError) == 0 || r.HookFailures != 1 {
+		t.Errorf("failing -certcmd not recorded as hook error: %q, %d failures", r.LastHookError, r.HookFailures)
+	}
+}
@@ -0,0 +1,59 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestSignalPid(t *testing.T) {
+	dir := t.TempDir()
+	cmd := exec.Command("sleep", "60")
+	err := cmd.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Process.Kill()
+	done := exec.Command("true")
+	err = done.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pidfile := func(name string, pid int) string {
+		fname := filepath.Join(dir, name)
+		os.WriteFile(fname, []byte(strconv.Itoa(pid)+"\n"), 0600)
+		return fname
+	}
+	tests := []struct {
+		pidfile string
+		wantErr string
+	}{
+		{filepath.Join(dir, "absent.pid"), "no such file"},
+		{pidfile("exited.pid", done.Process.Pid), "no process"},
+		{pidfile("sleep.pid", cmd.Process.Pid), ""},
+	}
+	for _, tt := range tests {
+		a, err := newReloadAction(reloadEntry{Pidfile: tt.pidfile, Signal: "TERM"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = a.signalPid()
+		switch {
+		case len(tt.wantErr) == 0 && err != nil:
+			t.Errorf("%s: %v", tt.pidfile, err)
+		case len(tt.wantErr) > 0 && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+			t.Errorf("%s: got %v, want %q", tt.pidfile, err, tt.wantErr)
+		}
+	}
+	err = cmd.Wait()
+	status, ok := cmd.ProcessState.Sys().(syscall.WaitStatus)
+	if !ok || !status.Signaled() || status.Signal() != syscall.SIGTERM {
+		t.Errorf("sleep not terminated by the signal: %v", err)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+)
+
+// errRequiredAbsent is returned for required certs that are not present
+// after the initial sync.
+var errRequiredAbsent = errors.New("required certs absent")
+
+// requiredCerts returns the certs given by -required, or all certs given on
+// the command line and by -cert with -require-all. Certs added by
+// -certs-from-key are not required, and the list returned is a copy that
+// later changes of the watched certs do not touch.
+func requiredCerts() []string {
+	if config.RequireAll {
+		certsMu.RLock()
+		defer certsMu.RUnlock()
+		if len(config.CertsFromKey) > 0 {
+			return slices.Clone(staticCerts)
+		}
+		return slices.Clone(config.Certs)
+	}
+	return config.Required
+}
+
+// checkRequired marks the required certs without an installed cert file as
+// missing after the initial sync, failing the health check until they are
+// written. Certs that are not required just wait for their first set.
+func checkRequired() error {
+	var missing []string
+	for _, cert := range requiredCerts() {
+		_, err := os.Stat(localPath(cert, ".crt"))
+		if err == nil {
+			continue
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			slog.Warn("checkRequired", "cert", cert, "err", err)
+		}
+		missing = append(missing, cert)
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	state.setMissing(missing)
+	slog.Error("required certs absent after the initial sync, check that they are provisioned in redis", "certs", missing, "count", len(missing))
+	return fmt.Errorf("%w: %s", errRequiredAbsent, strings.Join(missing, ", "))
+}
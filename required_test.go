@@ -0,0 +1,34 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestRequiredCerts(t *testing.T) {
+	oldCerts, oldStatic, oldKey, oldAll := config.Certs, staticCerts, config.CertsFromKey, config.RequireAll
+	defer func() {
+		config.Certs, staticCerts, config.CertsFromKey, config.RequireAll = oldCerts, oldStatic, oldKey, oldAll
+	}()
+	config.RequireAll = true
+	config.CertsFromKey = "certs"
+	staticCerts = []string{"www.example.com"}
+	config.Certs = []string{"www.example.com", "managed.example.com"}
+	got := requiredCerts()
+	if !slices.Equal(got, []string{"www.example.com"}) {
+		t.Errorf("with -certs-from-key: %v", got)
+	}
+	got[0] = "changed"
+	if staticCerts[0] != "www.example.com" {
+		t.Error("requiredCerts returned staticCerts itself")
+	}
+	config.CertsFromKey = ""
+	got = requiredCerts()
+	if !slices.Equal(got, config.Certs) {
+		t.Errorf("without -certs-from-key: %v", got)
+	}
+	got[0] = "changed"
+	if config.Certs[0] != "www.example.com" {
+		t.Error("requiredCerts returned config.Certs itself")
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// sdNotify sends a state notification to systemd. It is a no-op when not
+// run by systemd with a notify socket.
+func sdNotify(msg string) {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if len(addr) == 0 {
+		return
+	}
+	if addr[0] == '@' {
+		addr = "\x00" + addr[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		slog.Warn("sd_notify", "err", err)
+		return
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(msg))
+	if err != nil {
+		slog.Warn("sd_notify", "err", err)
+	}
+}
+
+var readyOnce sync.Once
+
+// sdReady tells systemd that the initial sync is complete.
+func sdReady() {
+	readyOnce.Do(func() {
+		sdNotify("READY=1")
+	})
+}
+
+// sdWatchdogInterval returns the watchdog interval requested by systemd, 0 if
+// the watchdog is not enabled for this process.
+func sdWatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	pid := os.Getenv("WATCHDOG_PID")
+	if len(pid) > 0 && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// sdWatchdog sends watchdog keepalives at half the requested interval as long
+// as the listen loop keeps reporting that it is alive, so a wedged loop gets
+// the process restarted.
+func sdWatchdog() {
+	interval := sdWatchdogInterval()
+	if interval == 0 {
+		return
+	}
+	slog.Debug("systemd watchdog", "interval", interval)
+	go func() {
+		for range time.Tick(interval / 2) {
+			if clk.Now().Sub(state.lastAlive()) < interval {
+				sdNotify("WATCHDOG=1")
+			}
+		}
+	}()
+}
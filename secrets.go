@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// secretFile is a flag holding a secret together with its -*-file variant,
+// which keeps the secret out of the process list.
+type secretFile struct {
+	flag  string
+	value *string
+	file  string
+}
+
+// secretFiles returns the secrets that can be read from a file.
+func secretFiles() []secretFile {
+	return []secretFile{
+		{"key-passphrase", &config.KeyPassphrase, config.KeyPassphraseFile},
+		{"p12-passphrase", &config.P12Passphrase, config.P12PassphraseFile},
+		{"cmd-webhook-token", &config.CmdWebhookToken, config.CmdWebhookTokenFile},
+		{"sentinel-password", &config.SentinelPassword, config.SentinelPasswordFile},
+		{"smtp-password", &config.SmtpPassword, config.SmtpPasswordFile},
+	}
+}
+
+// loadSecretFiles reads every given -*-file flag into its secret, without
+// the trailing line break. Giving both flags of a secret is an error.
+func loadSecretFiles() error {
+	for _, s := range secretFiles() {
+		if len(s.file) == 0 {
+			continue
+		}
+		if len(*s.value) > 0 {
+			return fmt.Errorf("-%s and -%s-file are mutually exclusive", s.flag, s.flag)
+		}
+		data, err := os.ReadFile(s.file)
+		if err != nil {
+			return err
+		}
+		*s.value = strings.TrimRight(string(data), "\r\n")
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// seen records the certs mirrored so far, persisted in the seen file so that
+// -new-cert-cmd fires only once per cert, across restarts.
+var seen struct {
+	sync.Mutex
+	certs map[string]bool
+}
+
+// trackSeen reports whether first sight of certs is tracked.
+func trackSeen() bool {
+	return len(config.NewCertCmd) > 0 || len(config.SeenFile) > 0
+}
+
+// seenFile returns the name of the file the seen certs are kept in.
+func seenFile() string {
+	if len(config.SeenFile) > 0 {
+		return config.SeenFile
+	}
+	return filepath.Join(config.CertDir, ".certwatch-seen")
+}
+
+// loadSeen reads the seen file. Without one, the certs already present in
+// CertDir are recorded as seen, so that starting to track does not fire
+// -new-cert-cmd for every cert mirrored before.
+func loadSeen() error {
+	if !trackSeen() {
+		return nil
+	}
+	seen.certs = make(map[string]bool)
+	data, err := os.ReadFile(seenFile())
+	if err == nil {
+		for _, cert := range strings.Fields(string(data)) {
+			seen.certs[cert] = true
+		}
+		slog.Info("seen certs", "file", seenFile(), "count", len(seen.certs))
+		return nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	for _, cert := range config.Certs {
+		_, err := os.Stat(localPath(cert, ".crt"))
+		if err == nil {
+			seen.certs[cert] = true
+		}
+	}
+	slog.Info("no seen file, recording existing certs as seen", "file", seenFile(), "count", len(seen.certs))
+	return saveSeen()
+}
+
+// saveSeen writes the seen certs, one per line. The caller must hold the
+// lock unless no other goroutine is running yet.
+func saveSeen() error {
+	certs := make([]string, 0, len(seen.certs))
+	for cert := range seen.certs {
+		certs = append(certs, cert)
+	}
+	slices.Sort(certs)
+	var b bytes.Buffer
+	for _, cert := range certs {
+		b.WriteString(cert)
+		b.WriteByte('\n')
+	}
+	return writeFileAtomic(seenFile(), b.Bytes(), clk.Now())
+}
+
+// firstSight records that cert has been mirrored. The first time a cert is
+// seen this is logged and -new-cert-cmd is run for it.
+func firstSight(ctx context.Context, cert string) {
+	if !trackSeen() {
+		return
+	}
+	seen.Lock()
+	if seen.certs[cert] {
+		seen.Unlock()
+		return
+	}
+	seen.certs[cert] = true
+	err := saveSeen()
+	seen.Unlock()
+	if err != nil {
+		slog.Error("saveSeen", "file", seenFile(), "err", err)
+	}
+	slog.Info("NEW CERT mirrored for the first time", "cert", cert)
+	if newCertCmd != nil {
+		err := newCertCmd.run(ctx, []string{cert})
+		if err != nil {
+			state.hookFailed(err)
+		}
+	}
+}
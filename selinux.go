@@ -0,0 +1,26 @@
+package main
+
+import (
+	"log/slog"
+	"os/exec"
+)
+
+// applyFileContext fixes up the SELinux context of a written file, either by
+// running restorecon or by setting the configured label with chcon. Failures
+// are logged and otherwise ignored, a wrong label does not make the written
+// file any less current.
+func applyFileContext(fname string) {
+	var cmd *exec.Cmd
+	switch {
+	case len(config.FileContext) > 0:
+		cmd = exec.Command("chcon", config.FileContext, fname)
+	case config.Restorecon:
+		cmd = exec.Command("restorecon", fname)
+	default:
+		return
+	}
+	outerr, err := cmd.CombinedOutput()
+	if err != nil {
+		slog.Warn("file context", "file", fname, "cmd", cmd.String(), "err", err, "outerr", string(outerr))
+	}
+}
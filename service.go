@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"regexp"
+	"slices"
+	"time"
+)
+
+// serviceRegex is the compiled -service-from-name, nil if none was given.
+var serviceRegex *regexp.Regexp
+
+// parseServiceRegex compiles -service-from-name.
+func parseServiceRegex() error {
+	if len(config.ServiceFromName) == 0 {
+		return nil
+	}
+	re, err := regexp.Compile(config.ServiceFromName)
+	if err != nil {
+		return err
+	}
+	serviceRegex = re
+	return nil
+}
+
+// serviceOf returns the service owning cert, the first group of
+// -service-from-name or else its whole match. It returns false for certs
+// the regexp does not match.
+func serviceOf(cert string) (string, bool) {
+	m := serviceRegex.FindStringSubmatch(cert)
+	if m == nil {
+		return "", false
+	}
+	if len(m) > 1 {
+		return m[1], len(m[1]) > 0
+	}
+	return m[0], len(m[0]) > 0
+}
+
+// runServiceCmds runs -service-reload-cmd once for every service owning one
+// of the changed certs, in the order the services first appear in changed.
+// {{.Changed}} holds the changed certs of the service. The failures are
+// returned joined.
+func runServiceCmds(ctx context.Context, changed []string) error {
+	if serviceCmd == nil || serviceRegex == nil {
+		return nil
+	}
+	var services []string
+	owned := make(map[string][]string)
+	for _, cert := range changed {
+		svc, ok := serviceOf(cert)
+		if !ok {
+			slog.Debug("cert has no service", "cert", cert, "regex", serviceRegex.String())
+			continue
+		}
+		if !slices.Contains(services, svc) {
+			services = append(services, svc)
+		}
+		owned[svc] = append(owned[svc], cert)
+	}
+	var errs []error
+	for _, svc := range services {
+		errs = append(errs, serviceCmd.runWith(ctx, cmdData{
+			Changed: owned[svc],
+			CertDir: config.CertDir,
+			Time:    time.Now(),
+			Service: svc,
+		}))
+	}
+	return errors.Join(errs...)
+}
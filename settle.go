@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+	"time"
+)
+
+// settleWindow holds back the command after the initial sync for
+// -initial-settle, batching the changes of the sync with those arriving
+// during the window into a single run. It is only used by the listen loop.
+type settleWindow struct {
+	until   time.Time
+	changed []string
+}
+
+var settle settleWindow
+
+// start opens the window after the initial sync.
+func (w *settleWindow) start() {
+	if config.InitialSettle <= 0 {
+		return
+	}
+	w.until = clk.Now().Add(config.InitialSettle)
+	slog.Info("initial settle", "dur", config.InitialSettle)
+}
+
+// active reports whether the window is open.
+func (w *settleWindow) active() bool {
+	return !w.until.IsZero()
+}
+
+// hold adds changed to the changes held back.
+func (w *settleWindow) hold(changed []string) {
+	for _, cert := range changed {
+		if !slices.Contains(w.changed, cert) {
+			w.changed = append(w.changed, cert)
+		}
+	}
+}
+
+// remaining returns the time left until the window closes, false if it is
+// not open.
+func (w *settleWindow) remaining() (time.Duration, bool) {
+	if !w.active() {
+		return 0, false
+	}
+	return max(w.until.Sub(clk.Now()), time.Millisecond), true
+}
+
+// due closes the window once its time is up and returns the changes held
+// back, to run the command for.
+func (w *settleWindow) due() []string {
+	if !w.active() || clk.Now().Before(w.until) {
+		return nil
+	}
+	changed := w.changed
+	w.until = time.Time{}
+	w.changed = nil
+	slog.Info("initial settle done", "changed", changed)
+	return changed
+}
+
+// abort closes the window when the listen loop ends and runs the command for
+// the changes held back right away, also on shutdown.
+func (w *settleWindow) abort(ctx context.Context) {
+	if !w.active() {
+		return
+	}
+	changed := w.changed
+	w.until = time.Time{}
+	w.changed = nil
+	if len(changed) == 0 {
+		return
+	}
+	runHeld(ctx, "initial command", changed)
+}
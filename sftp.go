@@ -0,0 +1,355 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sftpTarget is a remote directory changed certs are uploaded to with the
+// OpenSSH sftp client.
+type sftpTarget struct {
+	dest string // [user@]host
+	dir  string
+	// delay is waited after the local files were written before uploading,
+	// -sftp-delay unless given for the target.
+	delay time.Duration
+	// timeout bounds a single upload, -sftp-timeout unless given for the
+	// target, 0 for no limit.
+	timeout time.Duration
+	// compress uploads the files gzip compressed as .crt.gz and .key.gz,
+	// -compress unless given for the target.
+	compress bool
+}
+
+// sftpTargets are the parsed -sftp targets.
+var sftpTargets []sftpTarget
+
+// parseSftpTarget parses a -sftp value of the form
+// [user@]host:dir[,delay=<duration>][,timeout=<duration>][,compress[=<bool>]].
+// The options override -sftp-delay, -sftp-timeout and -compress for the
+// target.
+func parseSftpTarget(v string) (sftpTarget, error) {
+	spec, opts, _ := strings.Cut(v, ",")
+	dest, dir, ok := strings.Cut(spec, ":")
+	if !ok || len(dest) == 0 || len(dir) == 0 {
+		return sftpTarget{}, fmt.Errorf("invalid sftp target %q, want [user@]host:dir[,delay=<duration>][,timeout=<duration>][,compress[=<bool>]]", v)
+	}
+	t := sftpTarget{dest: dest, dir: dir, delay: config.SftpDelay, timeout: config.SftpTimeout, compress: config.Compress}
+	if len(opts) == 0 {
+		return t, nil
+	}
+	for _, opt := range strings.Split(opts, ",") {
+		name, val, hasVal := strings.Cut(opt, "=")
+		if name == "compress" {
+			t.compress = true
+			if hasVal {
+				b, err := strconv.ParseBool(val)
+				if err != nil {
+					return sftpTarget{}, fmt.Errorf("invalid compress in sftp target %q: %q", v, opt)
+				}
+				t.compress = b
+			}
+			continue
+		}
+		d, err := time.ParseDuration(val)
+		if err != nil || d < 0 {
+			return sftpTarget{}, fmt.Errorf("invalid duration in sftp target %q: %q", v, opt)
+		}
+		switch name {
+		case "delay":
+			t.delay = d
+		case "timeout":
+			t.timeout = d
+		default:
+			return sftpTarget{}, fmt.Errorf("unknown option %q in sftp target %q", name, v)
+		}
+	}
+	return t, nil
+}
+
+// parseSftpTargets parses all -sftp values.
+func parseSftpTargets() error {
+	for _, v := range config.Sftp {
+		t, err := parseSftpTarget(v)
+		if err != nil {
+			return err
+		}
+		sftpTargets = append(sftpTargets, t)
+	}
+	return nil
+}
+
+// sftpQuote quotes s as a single argument of an sftp batch command.
+func sftpQuote(s string) string {
+	return `"` + strings.ReplaceAll(s, `"`, `\"`) + `"`
+}
+
+// script returns the sftp batch commands uploading the local files of the
+// changed certs. Every file is put under a temporary name and then renamed
+// over the remote file, which the OpenSSH client does atomically if the
+// server supports the posix-rename extension. Files whose local compression
+// differs from that of the target are converted to a copy in tmpdir, which
+// is uploaded instead.
+func (t sftpTarget) script(changed []string, tmpdir string) ([]byte, error) {
+	var b bytes.Buffer
+	for _, cert := range changed {
+		for _, suf := range certSuffixes {
+			local := localPath(cert, suf)
+			finfo, err := os.Stat(local)
+			if err != nil {
+				continue
+			}
+			name := localName(cert) + suf
+			if t.compress {
+				name += compressSuffix
+			}
+			if t.compress != compressed(cert) {
+				local, err = convertedCopy(local, finfo, t.compress, tmpdir)
+				if err != nil {
+					return nil, err
+				}
+			}
+			remote := path.Join(t.dir, name)
+			tmp := path.Join(t.dir, "."+name+".tmp")
+			fmt.Fprintf(&b, "put -p %s %s\n", sftpQuote(local), sftpQuote(tmp))
+			fmt.Fprintf(&b, "rename %s %s\n", sftpQuote(tmp), sftpQuote(remote))
+		}
+	}
+	return b.Bytes(), nil
+}
+
+// convertedCopy writes the contents of the local file fname to a new file
+// in dir, compressed or decompressed as given, with the modification time
+// of fname so that put -p keeps it.
+func convertedCopy(fname string, finfo fs.FileInfo, compress bool, dir string) (string, error) {
+	data, err := readLocal(fname)
+	if err != nil {
+		return "", err
+	}
+	if compress {
+		data, err = gzipData(data)
+		if err != nil {
+			return "", err
+		}
+	}
+	f, err := os.CreateTemp(dir, "upload-")
+	if err != nil {
+		return "", err
+	}
+	_, err = f.Write(data)
+	err = errors.Join(err, f.Close())
+	if err != nil {
+		return "", err
+	}
+	return f.Name(), os.Chtimes(f.Name(), finfo.ModTime(), finfo.ModTime())
+}
+
+// upload runs one sftp session uploading the changed certs, bounded by the
+// timeout of the target.
+func (t sftpTarget) upload(ctx context.Context, changed []string) error {
+	if t.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, t.timeout)
+		defer cancel()
+	}
+	args := []string{"-b", "-", "-o", "BatchMode=yes"}
+	if len(config.SftpKey) > 0 {
+		args = append(args, "-i", config.SftpKey)
+	}
+	args = append(args, t.dest)
+	tmpdir, err := os.MkdirTemp("", "certwatch-sftp-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpdir)
+	script, err := t.script(changed, tmpdir)
+	if err != nil {
+		return err
+	}
+	cmd := exec.CommandContext(ctx, "sftp", args...)
+	cmd.Stdin = bytes.NewReader(script)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%w: %s", err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+// uploadRetry uploads the changed certs to t after the delay of the target,
+// retrying -sftp-retries times with a doubling delay.
+func (t sftpTarget) uploadRetry(ctx context.Context, changed []string) error {
+	if t.delay > 0 {
+		select {
+		case <-clk.After(t.delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	delay := config.SftpRetryDelay
+	for try := 0; ; try++ {
+		err := t.upload(ctx, changed)
+		if err == nil || try >= config.SftpRetries {
+			return err
+		}
+		slog.Warn("sftp upload", "dest", t.dest, "dir", t.dir, "err", err, "try", try)
+		select {
+		case <-clk.After(delay):
+		case <-ctx.Done():
+			return errors.Join(err, ctx.Err())
+		}
+		delay *= 2
+	}
+}
+
+// name identifies the target in logs and the status.
+func (t sftpTarget) name() string {
+	return "sftp " + t.dest + ":" + t.dir
+}
+
+// sftpWorker uploads the changed certs to one -sftp target in the
+// background, so that a slow or unreachable host holds up neither the other
+// targets nor the listen loop. Certs changed while an upload is running are
+// collected and uploaded together afterwards, and the certs of a failed
+// upload are kept and retried every -sleep until they get through.
+type sftpWorker struct {
+	t       sftpTarget
+	mu      sync.Mutex
+	pending map[string]bool
+	wake    chan struct{}
+	errs    *dedupLog
+	// idle is signalled whenever an upload finished, for drain
+	idle *sync.Cond
+	// busy is set while an upload runs, failed after a failed one until
+	// more certs are queued, and stopped once the worker returned.
+	busy    bool
+	failed  bool
+	stopped bool
+}
+
+// sftpWorkers are the workers of the -sftp targets, see startSftp.
+var sftpWorkers []*sftpWorker
+
+// startSftp starts a worker for every -sftp target.
+func startSftp(ctx context.Context) {
+	for _, t := range sftpTargets {
+		w := &sftpWorker{
+			t:       t,
+			pending: make(map[string]bool),
+			wake:    make(chan struct{}, 1),
+			errs:    &dedupLog{msg: "sftp upload failed"},
+		}
+		w.idle = sync.NewCond(&w.mu)
+		sftpWorkers = append(sftpWorkers, w)
+		go w.run(ctx)
+	}
+}
+
+// add queues certs for the next upload.
+func (w *sftpWorker) add(certs []string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, cert := range certs {
+		w.pending[cert] = true
+	}
+	w.failed = false
+}
+
+// take returns and clears the queued certs, sorted.
+func (w *sftpWorker) take() []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var certs []string
+	for cert := range w.pending {
+		certs = append(certs, cert)
+	}
+	slices.Sort(certs)
+	clear(w.pending)
+	w.busy = len(certs) > 0
+	return certs
+}
+
+// finish records the end of an upload, or of the worker if stopped is set.
+func (w *sftpWorker) finish(failed bool, stopped bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.busy = false
+	w.failed = failed
+	w.stopped = w.stopped || stopped
+	w.idle.Broadcast()
+}
+
+// drain waits until the queued certs were uploaded, or their upload failed
+// once all retries were used.
+func (w *sftpWorker) drain() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for !w.stopped && (w.busy || len(w.pending) > 0 && !w.failed) {
+		w.idle.Wait()
+	}
+}
+
+// drainSftp waits for the uploads queued to all -sftp targets, for
+// -oneshot.
+func drainSftp() {
+	for _, w := range sftpWorkers {
+		w.drain()
+	}
+}
+
+func (w *sftpWorker) run(ctx context.Context) {
+	defer w.finish(false, true)
+	var retry <-chan time.Time
+	for {
+		select {
+		case <-w.wake:
+		case <-retry:
+		case <-ctx.Done():
+			return
+		}
+		retry = nil
+		certs := w.take()
+		if len(certs) == 0 {
+			continue
+		}
+		start := time.Now()
+		err := w.t.uploadRetry(ctx, certs)
+		if ctx.Err() != nil {
+			return
+		}
+		state.targetResult(w.t.name(), err)
+		if err != nil {
+			w.errs.Error(err, "dest", w.t.dest, "dir", w.t.dir, "changed", certs, "retry", config.SleepTime)
+			w.add(certs)
+			w.finish(true, false)
+			retry = clk.After(config.SleepTime)
+			continue
+		}
+		w.finish(false, false)
+		w.errs.Reset()
+		slog.Info("sftp upload completed", "dest", w.t.dest, "dir", w.t.dir, "changed", certs, "duration", time.Since(start))
+	}
+}
+
+// uploadSftp queues the changed certs for upload to all -sftp targets and
+// returns right away, the uploads run in the workers of the targets.
+func uploadSftp(changed []string) {
+	for _, w := range sftpWorkers {
+		w.add(changed)
+		select {
+		case w.wake <- struct{}{}:
+		default:
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeSftp puts an sftp script on PATH that fails for the host "bad" and
+// succeeds for every other.
+func fakeSftp(t *testing.T) {
+	dir := t.TempDir()
+	script := "#!/bin/sh\nfor a; do host=$a; done\ncat >/dev/null\n[ \"$host\" != bad ] || { echo unreachable >&2; exit 1; }\n"
+	err := os.WriteFile(filepath.Join(dir, "sftp"), []byte(script), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func TestSftpFailingTarget(t *testing.T) {
+	fakeSftp(t)
+	oldConfig, oldTargets, oldWorkers := config, sftpTargets, sftpWorkers
+	t.Cleanup(func() { config, sftpTargets, sftpWorkers = oldConfig, oldTargets, oldWorkers })
+	t.Cleanup(func() {
+		state = watchState{certs: make(map[string]*certStatus), targets: make(map[string]*targetStatus)}
+	})
+	config.SftpRetries = 1
+	config.SftpRetryDelay = time.Millisecond
+	config.SleepTime = time.Hour
+	sftpTargets = []sftpTarget{{dest: "bad", dir: "/certs"}, {dest: "good", dir: "/certs"}}
+	sftpWorkers = nil
+	state = watchState{certs: make(map[string]*certStatus), targets: make(map[string]*targetStatus)}
+	ctx, cancel := context.WithCancel(context.Background())
+	startSftp(ctx)
+	// stop the workers before the globals they read are restored
+	t.Cleanup(func() {
+		cancel()
+		for _, w := range sftpWorkers {
+			w.mu.Lock()
+			for !w.stopped {
+				w.idle.Wait()
+			}
+			w.mu.Unlock()
+		}
+	})
+	for _, changed := range [][]string{{"a.example.com"}, {"b.example.com"}} {
+		uploadSftp(changed)
+		drainSftp()
+		targets := make(map[string]targetStatus)
+		for _, ts := range state.report().Targets {
+			targets[ts.Name] = ts
+		}
+		bad, good := targets["sftp bad:/certs"], targets["sftp good:/certs"]
+		if len(bad.LastError) == 0 || bad.Failures == 0 {
+			t.Errorf("%v: failing target not reported: %+v", changed, bad)
+		}
+		if len(good.LastError) > 0 || good.LastSuccess == nil {
+			t.Errorf("%v: good target held up by the failing one: %+v", changed, good)
+		}
+	}
+	if got := sftpWorkers[0].take(); len(got) != 2 {
+		t.Errorf("failed certs not kept for retry: %v", got)
+	}
+}
+
+func TestParseSftpTargetCompress(t *testing.T) {
+	defer func(c bool) { config.Compress = c }(config.Compress)
+	tests := []struct {
+		v        string
+		global   bool
+		compress bool
+		wantErr  bool
+	}{
+		{"web1:/certs", false, false, false},
+		{"web1:/certs", true, true, false},
+		{"web1:/certs,compress", false, true, false},
+		{"web1:/certs,delay=1s,compress=true", false, true, false},
+		{"web1:/certs,compress=false", true, false, false},
+		{"web1:/certs,compress=maybe", false, false, true},
+	}
+	for _, tt := range tests {
+		config.Compress = tt.global
+		target, err := parseSftpTarget(tt.v)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: got %v, want error %v", tt.v, err, tt.wantErr)
+			continue
+		}
+		if err == nil && target.compress != tt.compress {
+			t.Errorf("%s with -compress=%v: compress %v", tt.v, tt.global, target.compress)
+		}
+	}
+}
+
+func TestSftpScriptCompress(t *testing.T) {
+	oldDir, oldCompress := config.CertDir, config.Compress
+	defer func() {
+		config.CertDir, config.Compress = oldDir, oldCompress
+		certTargets = make(map[string]certTarget)
+	}()
+	config.CertDir = t.TempDir()
+	config.Compress = false
+	yes := true
+	certTargets = map[string]certTarget{"gz.example.com": {uid: -1, gid: -1, compress: &yes}}
+	modified := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, cert := range []string{"plain.example.com", "gz.example.com"} {
+		for _, suf := range certSuffixes {
+			data := []byte(cert + suf)
+			if compressed(cert) {
+				data, _ = gzipData(data)
+			}
+			fname := localPath(cert, suf)
+			err := os.WriteFile(fname, data, 0600)
+			if err != nil {
+				t.Fatal(err)
+			}
+			os.Chtimes(fname, modified, modified)
+		}
+	}
+	for _, compress := range []bool{false, true} {
+		target := sftpTarget{dest: "web1", dir: "/certs", compress: compress}
+		script, err := target.script([]string{"plain.example.com", "gz.example.com"}, t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Split(strings.TrimSpace(string(script)), "\n")
+		if len(lines) != 8 {
+			t.Fatalf("compress %v: script %q", compress, script)
+		}
+		for i := 0; i < len(lines); i += 2 {
+			put := strings.Fields(lines[i])
+			rename := strings.Fields(lines[i+1])
+			local, remote := strings.Trim(put[2], `"`), strings.Trim(rename[2], `"`)
+			if strings.HasSuffix(remote, compressSuffix) != compress {
+				t.Errorf("compress %v: remote %s", compress, remote)
+			}
+			data, err := os.ReadFile(local)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bytes.HasPrefix(data, gzipMagic) != compress {
+				t.Errorf("compress %v: %s uploaded as %s has the wrong compression", compress, local, remote)
+			}
+			plain, _ := readLocal(local)
+			if want := strings.TrimSuffix(strings.TrimPrefix(remote, "/certs/"), compressSuffix); string(plain) != want {
+				t.Errorf("compress %v: %s holds %q, want %q", compress, local, plain, want)
+			}
+			finfo, _ := os.Stat(local)
+			if !finfo.ModTime().Equal(modified) {
+				t.Errorf("compress %v: %s modified %v", compress, local, finfo.ModTime())
+			}
+		}
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// statusSignals returns the signals that trigger a status dump to the log.
+func statusSignals() []os.Signal {
+	return nil
+}
+
+// snapshotSignals returns the signals that trigger a -snapshot.
+func snapshotSignals() []os.Signal {
+	return nil
+}
@@ -0,0 +1,18 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// statusSignals returns the signals that trigger a status dump to the log.
+func statusSignals() []os.Signal {
+	return []os.Signal{syscall.SIGUSR1}
+}
+
+// snapshotSignals returns the signals that trigger a -snapshot.
+func snapshotSignals() []os.Signal {
+	return []os.Signal{syscall.SIGUSR2}
+}
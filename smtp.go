@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/smtp"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// alertCheckInterval is how often the failure conditions are evaluated for
+// -smtp-addr.
+const alertCheckInterval = time.Minute
+
+// smtpTimeout bounds a single attempt to send an alert mail.
+const smtpTimeout = 30 * time.Second
+
+// alerter tracks the failure conditions for the alert mails. Conditions are
+// named by what failed, such as "redis" or "cert example.com", so that an
+// ongoing condition is mailed once and not again every time it is seen.
+type alerter struct {
+	// since is when each current condition was first seen
+	since map[string]time.Time
+	// detail is the latest description of each current condition
+	detail map[string]string
+	// mailed is when each condition was last included in a mail
+	mailed map[string]time.Time
+}
+
+// alertConditions returns the failure conditions in r, together with the
+// certs whose installed leaf expires within -smtp-expiry.
+func alertConditions(r statusReport) map[string]string {
+	conds := make(map[string]string)
+	if !r.Subscribed {
+		conds["redis"] = "not subscribed to redis, cert changes are not being received"
+	}
+	if len(r.DiskError) > 0 {
+		conds["disk"] = "certdir not writable: " + r.DiskError
+	}
+	if len(r.CmdError) > 0 {
+		conds["cmd"] = "reload command failing: " + r.CmdError
+	}
+	for _, ts := range r.Targets {
+		if len(ts.LastError) > 0 {
+			conds["target "+ts.Name] = "writes failing: " + ts.LastError
+		}
+	}
+	for _, cs := range r.Certs {
+		if len(cs.LastError) > 0 {
+			conds["cert "+cs.Name] = "sync failing: " + cs.LastError
+		}
+		if cs.Missing {
+			conds["missing "+cs.Name] = "required cert absent, it was not found after the initial sync"
+		}
+		if config.SmtpExpiry <= 0 {
+			continue
+		}
+		d := readCertDetails(cs)
+		if len(d.Error) == 0 && d.NotAfter.Sub(clk.Now()) < config.SmtpExpiry {
+			conds["expiry "+cs.Name] = "installed cert expires " + d.NotAfter.UTC().Format(time.RFC3339)
+		}
+	}
+	return conds
+}
+
+// update records the current conditions and returns the conditions that
+// persisted for -smtp-after and are due for a mail, and the mailed
+// conditions that are gone.
+func (a *alerter) update(conds map[string]string) (failing []string, resolved []string) {
+	now := clk.Now()
+	for name := range a.since {
+		if _, ok := conds[name]; !ok {
+			delete(a.since, name)
+			delete(a.detail, name)
+			if _, ok := a.mailed[name]; ok {
+				resolved = append(resolved, name)
+			}
+		}
+	}
+	for name, detail := range conds {
+		if _, ok := a.since[name]; !ok {
+			a.since[name] = now
+		}
+		a.detail[name] = detail
+		if now.Sub(a.since[name]) < config.SmtpAfter {
+			continue
+		}
+		last, ok := a.mailed[name]
+		if ok && (config.SmtpRepeat <= 0 || now.Sub(last) < config.SmtpRepeat) {
+			continue
+		}
+		failing = append(failing, name)
+	}
+	slices.Sort(failing)
+	slices.Sort(resolved)
+	return failing, resolved
+}
+
+// message builds the alert mail for the due and resolved conditions.
+func (a *alerter) message(host string, failing []string, resolved []string) (string, string) {
+	subject := fmt.Sprintf("certwatch on %s: %d failing", host, len(failing))
+	if len(failing) == 0 {
+		subject = fmt.Sprintf("certwatch on %s: resolved", host)
+	}
+	var b strings.Builder
+	for _, name := range failing {
+		fmt.Fprintf(&b, "FAILING %s since %s: %s\n", name, a.since[name].UTC().Format(time.RFC3339), a.detail[name])
+	}
+	for _, name := range resolved {
+		fmt.Fprintf(&b, "resolved %s\n", name)
+	}
+	if len(a.detail) > len(failing) {
+		var current []string
+		for name := range a.detail {
+			current = append(current, name)
+		}
+		slices.Sort(current)
+		fmt.Fprintf(&b, "\nall current conditions: %s\n", strings.Join(current, ", "))
+	}
+	return subject, b.String()
+}
+
+var smtpErrors = &dedupLog{msg: "alert mail not sent"}
+
+// startAlerts evaluates the failure conditions every alertCheckInterval and
+// mails those persisting for -smtp-after to -smtp-to, at most once per
+// -smtp-repeat for the same condition, and once more when they are resolved.
+// It runs in its own goroutine, so a slow or unreachable mail server never
+// delays syncing. Failures to send are logged and retried at the next check.
+func startAlerts(ctx context.Context) {
+	if len(config.SmtpAddr) == 0 {
+		return
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	a := &alerter{
+		since:  make(map[string]time.Time),
+		detail: make(map[string]string),
+		mailed: make(map[string]time.Time),
+	}
+	slog.Info("alert mails", "smtp", config.SmtpAddr, "to", config.SmtpTo, "after", config.SmtpAfter)
+	go func() {
+		ticker := time.NewTicker(alertCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+			failing, resolved := a.update(alertConditions(state.report()))
+			if len(failing) == 0 && len(resolved) == 0 {
+				continue
+			}
+			subject, body := a.message(host, failing, resolved)
+			err := sendMail(subject, body)
+			if err != nil {
+				smtpErrors.Error(err, "smtp", config.SmtpAddr, "failing", failing)
+				continue
+			}
+			smtpErrors.Reset()
+			slog.Info("alert mail sent", "to", config.SmtpTo, "failing", failing, "resolved", resolved)
+			now := clk.Now()
+			for _, name := range failing {
+				a.mailed[name] = now
+			}
+			for _, name := range resolved {
+				delete(a.mailed, name)
+			}
+		}
+	}()
+}
+
+// sendMail sends a plain text mail through -smtp-addr, using STARTTLS if the
+// server offers it and authenticating if -smtp-user is set.
+func sendMail(subject string, body string) error {
+	conn, err := net.DialTimeout("tcp", config.SmtpAddr, smtpTimeout)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(smtpTimeout))
+	host, _, _ := net.SplitHostPort(config.SmtpAddr)
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		err = c.StartTLS(&tls.Config{ServerName: host})
+		if err != nil {
+			return err
+		}
+	}
+	if len(config.SmtpUser) > 0 {
+		err = c.Auth(smtp.PlainAuth("", config.SmtpUser, config.SmtpPassword, host))
+		if err != nil {
+			return err
+		}
+	}
+	err = c.Mail(config.SmtpFrom)
+	if err != nil {
+		return err
+	}
+	for _, to := range config.SmtpTo {
+		err = c.Rcpt(to)
+		if err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n",
+		config.SmtpFrom, strings.Join(config.SmtpTo, ", "), subject, time.Now().Format(time.RFC1123Z))
+	fmt.Fprint(w, strings.ReplaceAll(body, "\n", "\r\n"))
+	err = w.Close()
+	if err != nil {
+		return err
+	}
+	return c.Quit()
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// manifestEntry describes one file of a snapshot.
+type manifestEntry struct {
+	Cert     string    `json:"cert"`
+	File     string    `json:"file"`
+	Size     int       `json:"size"`
+	SHA256   string    `json:"sha256"`
+	Modified time.Time `json:"modified"`
+}
+
+// snapshotManifest is stored as manifest.json in a snapshot.
+type snapshotManifest struct {
+	Time  time.Time       `json:"time"`
+	Files []manifestEntry `json:"files"`
+}
+
+var snapshotMu sync.Mutex
+
+// writeSnapshot writes the local files of all watched certs together with
+// a manifest to the -snapshot tar.gz archive, replacing it atomically.
+func writeSnapshot() error {
+	snapshotMu.Lock()
+	defer snapshotMu.Unlock()
+	f, err := os.CreateTemp(filepath.Dir(config.Snapshot), "."+filepath.Base(config.Snapshot)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmpname := f.Name()
+	defer os.Remove(tmpname)
+	defer f.Close()
+	err = f.Chmod(0600)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(f)
+	tw := tar.NewWriter(zw)
+	manifest := snapshotManifest{Time: clk.Now().UTC()}
+	for _, cert := range watchedCerts() {
+		for _, suf := range certSuffixes {
+			fname := localPath(cert, suf)
+			data, err := os.ReadFile(fname)
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			finfo, err := os.Stat(fname)
+			if err != nil {
+				return err
+			}
+			name := filepath.Base(fname)
+			err = tw.WriteHeader(&tar.Header{
+				Name:    name,
+				Mode:    0600,
+				Size:    int64(len(data)),
+				ModTime: finfo.ModTime(),
+			})
+			if err != nil {
+				return err
+			}
+			_, err = tw.Write(data)
+			if err != nil {
+				return err
+			}
+			sum := sha256.Sum256(data)
+			manifest.Files = append(manifest.Files, manifestEntry{
+				Cert:     cert,
+				File:     name,
+				Size:     len(data),
+				SHA256:   hex.EncodeToString(sum[:]),
+				Modified: finfo.ModTime(),
+			})
+		}
+	}
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = tw.WriteHeader(&tar.Header{
+		Name:    "manifest.json",
+		Mode:    0600,
+		Size:    int64(len(data)),
+		ModTime: manifest.Time,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = tw.Write(data)
+	if err != nil {
+		return err
+	}
+	err = tw.Close()
+	if err != nil {
+		return err
+	}
+	err = zw.Close()
+	if err != nil {
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmpname, config.Snapshot)
+	if err != nil {
+		return err
+	}
+	slog.Info("snapshot written", "file", config.Snapshot, "files", len(manifest.Files))
+	return nil
+}
+
+// snapshot writes a -snapshot, logging failures.
+func snapshot() {
+	if len(config.Snapshot) == 0 {
+		return
+	}
+	err := writeSnapshot()
+	if err != nil {
+		slog.Error("snapshot", "file", config.Snapshot, "err", err)
+	}
+}
+
+// handleSnapshotSignals writes a snapshot whenever one of the
+// snapshotSignals is received.
+func handleSnapshotSignals() {
+	sigs := snapshotSignals()
+	if len(config.Snapshot) == 0 || len(sigs) == 0 {
+		return
+	}
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, sigs...)
+	go func() {
+		for range ch {
+			snapshot()
+		}
+	}()
+}
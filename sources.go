@@ -0,0 +1,516 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// keySource is a key prefix certs are read from, together with the
+// database holding it.
+type keySource struct {
+	prefix string
+	// db is the database index given as prefix@db, -1 if none was given.
+	db     int
+	client redis.UniversalClient
+}
+
+// sources are the parsed -keyprefix values in command line order.
+var sources []keySource
+
+// parseSource parses a -keyprefix value of the form prefix or prefix@db.
+func parseSource(v string) (keySource, error) {
+	prefix, dbs, ok := strings.Cut(v, "@")
+	if !ok {
+		return keySource{prefix: v, db: -1}, nil
+	}
+	db, err := strconv.Atoi(dbs)
+	if err != nil || db < 0 {
+		return keySource{}, fmt.Errorf("invalid database index in key prefix %q", v)
+	}
+	return keySource{prefix: prefix, db: db}, nil
+}
+
+// applyPoolOptions applies the pool flags to opt. Zero flags keep the value
+// from the URL, or the go-redis default.
+func applyPoolOptions(opt *redis.Options) {
+	if config.PoolSize > 0 {
+		opt.PoolSize = config.PoolSize
+	}
+	if config.MinIdleConns > 0 {
+		opt.MinIdleConns = config.MinIdleConns
+	}
+	if config.MaxIdleConns > 0 {
+		opt.MaxIdleConns = config.MaxIdleConns
+	}
+	if config.MaxActiveConns > 0 {
+		opt.MaxActiveConns = config.MaxActiveConns
+	}
+}
+
+// tlsVersions are the versions accepted by -redis-tls-min-version.
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// applyTLSOptions applies -redis-tls-min-version, -redis-tls-ciphers, the
+// CA and client cert files and -redis-tls-insecure to the TLS config of opt.
+// Unknown versions and cipher suites are errors, as are the flags for a
+// connection without TLS.
+func applyTLSOptions(opt *redis.Options) error {
+	if len(config.RedisTLSMinVersion) == 0 && len(config.RedisTLSCiphers) == 0 && len(config.RedisTLSCA) == 0 &&
+		len(config.RedisTLSCert) == 0 && len(config.RedisTLSKey) == 0 && !config.RedisTLSInsecure {
+		return nil
+	}
+	if opt.TLSConfig == nil {
+		return errors.New("TLS options given for a connection without TLS, use a rediss:// URL")
+	}
+	if len(config.RedisTLSMinVersion) > 0 {
+		v, ok := tlsVersions[config.RedisTLSMinVersion]
+		if !ok {
+			return fmt.Errorf("unknown TLS version %q, use 1.2 or 1.3", config.RedisTLSMinVersion)
+		}
+		opt.TLSConfig.MinVersion = v
+	}
+	suites := make(map[string]uint16)
+	for _, cs := range tls.CipherSuites() {
+		suites[cs.Name] = cs.ID
+	}
+	for _, v := range config.RedisTLSCiphers {
+		for _, name := range strings.Split(v, ",") {
+			name = strings.TrimSpace(name)
+			id, ok := suites[name]
+			if !ok {
+				return fmt.Errorf("unknown or insecure cipher suite %q", name)
+			}
+			opt.TLSConfig.CipherSuites = append(opt.TLSConfig.CipherSuites, id)
+		}
+	}
+	if len(config.RedisTLSCA) > 0 {
+		data, err := os.ReadFile(config.RedisTLSCA)
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return fmt.Errorf("no certificates found in %s", config.RedisTLSCA)
+		}
+		opt.TLSConfig.RootCAs = pool
+	}
+	if len(config.RedisTLSCert) > 0 || len(config.RedisTLSKey) > 0 {
+		if len(config.RedisTLSCert) == 0 || len(config.RedisTLSKey) == 0 {
+			return errors.New("-redis-tls-cert and -redis-tls-key must be given together")
+		}
+		cert, err := tls.LoadX509KeyPair(config.RedisTLSCert, config.RedisTLSKey)
+		if err != nil {
+			return err
+		}
+		opt.TLSConfig.Certificates = []tls.Certificate{cert}
+	}
+	if config.RedisTLSInsecure {
+		slog.Warn("not verifying the certificate of the redis server", "addr", opt.Addr)
+		opt.TLSConfig.InsecureSkipVerify = true
+	}
+	return nil
+}
+
+// newClient returns the client for opt, parsed from -redisurl. With
+// -sentinel-master it is a failover client that asks the -sentinel servers
+// for the current master and follows failovers, taking credentials,
+// database, pool and TLS settings from opt. The client stays a
+// *redis.Client, so the subscription and every read go to the master.
+func newClient(opt *redis.Options) (redis.UniversalClient, error) {
+	if len(config.ClusterAddrs) > 0 {
+		return newClusterClient(opt)
+	}
+	if len(config.SentinelMaster) == 0 {
+		if len(config.SentinelAddrs) > 0 {
+			return nil, errors.New("-sentinel needs -sentinel-master")
+		}
+		return redis.NewClient(opt), nil
+	}
+	var addrs []string
+	for _, v := range config.SentinelAddrs {
+		for _, addr := range strings.Split(v, ",") {
+			addr = strings.TrimSpace(addr)
+			if len(addr) > 0 {
+				addrs = append(addrs, addr)
+			}
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, errors.New("-sentinel-master needs at least one -sentinel")
+	}
+	slog.Info("redis sentinel", "master", config.SentinelMaster, "sentinels", addrs)
+	return redis.NewFailoverClient(&redis.FailoverOptions{
+		MasterName:       config.SentinelMaster,
+		SentinelAddrs:    addrs,
+		SentinelPassword: config.SentinelPassword,
+		ClientName:       opt.ClientName,
+		Protocol:         opt.Protocol,
+		Username:         opt.Username,
+		Password:         opt.Password,
+		DB:               opt.DB,
+		MaxRetries:       opt.MaxRetries,
+		MinRetryBackoff:  opt.MinRetryBackoff,
+		MaxRetryBackoff:  opt.MaxRetryBackoff,
+		DialTimeout:      opt.DialTimeout,
+		ReadTimeout:      opt.ReadTimeout,
+		WriteTimeout:     opt.WriteTimeout,
+		PoolFIFO:         opt.PoolFIFO,
+		PoolSize:         opt.PoolSize,
+		PoolTimeout:      opt.PoolTimeout,
+		MinIdleConns:     opt.MinIdleConns,
+		MaxIdleConns:     opt.MaxIdleConns,
+		MaxActiveConns:   opt.MaxActiveConns,
+		ConnMaxIdleTime:  opt.ConnMaxIdleTime,
+		ConnMaxLifetime:  opt.ConnMaxLifetime,
+		TLSConfig:        opt.TLSConfig,
+	}), nil
+}
+
+// setupSources parses the key prefixes and connects a client to every
+// database given explicitly. Sources without a database use readClient.
+// ropt are the options of the replica, nil if values are read from the
+// primary.
+func setupSources(ropt *redis.Options) error {
+	clients := make(map[int]redis.UniversalClient)
+	for _, v := range config.KeyPrefixes {
+		src, err := parseSource(v)
+		if err != nil {
+			return err
+		}
+		src.client = readClient
+		if src.db >= 0 {
+			if len(config.ClusterAddrs) > 0 {
+				return fmt.Errorf("-keyprefix %s: a cluster only has database 0", v)
+			}
+			c, ok := clients[src.db]
+			if !ok {
+				opt := *readClient.(*redis.Client).Options()
+				if ropt != nil {
+					opt = *ropt
+				}
+				opt.DB = src.db
+				c = redis.NewClient(&opt)
+				clients[src.db] = c
+			}
+			src.client = c
+		}
+		slog.Info("key source", "prefix", src.prefix, "db", clientDB(src.client))
+		sources = append(sources, src)
+	}
+	return nil
+}
+
+// keyspaceDB returns the database whose keyspace notifications cover src,
+// the database of -redisurl unless one was given as prefix@db.
+func (src keySource) keyspaceDB() int {
+	if src.db >= 0 {
+		return src.db
+	}
+	return urlDB()
+}
+
+// urlDB returns the database selected by -redisurl, 0 if it names none.
+func urlDB() int {
+	return clientDB(client)
+}
+
+// keyspaceChannel returns the keyspace notification channel for key in the
+// given database.
+func keyspaceChannel(db int, key string) string {
+	return fmt.Sprintf("__keyspace@%d__:%s", db, key)
+}
+
+// channelKey returns the redis key a keyspace notification channel is
+// about.
+func channelKey(channel string) string {
+	_, key, _ := strings.Cut(channel, "__:")
+	return key
+}
+
+// certPath returns the redis key prefix below which the certificates for
+// the given key prefix are stored.
+func certPath(prefix string) string {
+	return prefix + "/certificates/" + config.AcmeDirName + "/"
+}
+
+// keyspacePath returns the keyspace notification channel prefix for the
+// certificates stored below the source.
+func (src keySource) keyspacePath() string {
+	return keyspaceChannel(src.keyspaceDB(), certPath(src.prefix))
+}
+
+// errClusterRedirect is returned for a MOVED or ASK reply. It means that
+// certwatch talks to a node of a Redis Cluster without -cluster, and is
+// treated as a fatal configuration error instead of being retried.
+var errClusterRedirect = errors.New("redis cluster redirect, -redisurl points at a node of a Redis Cluster: give its nodes with -cluster instead")
+
+// clusterRedirect wraps MOVED and ASK replies in errClusterRedirect and
+// returns other errors unchanged.
+func clusterRedirect(err error) error {
+	var rerr redis.Error
+	if !errors.As(err, &rerr) {
+		return err
+	}
+	msg := rerr.Error()
+	if strings.HasPrefix(msg, "MOVED ") || strings.HasPrefix(msg, "ASK ") {
+		return fmt.Errorf("%w: %w", errClusterRedirect, err)
+	}
+	return err
+}
+
+// getter reads a single key.
+type getter func(c redis.UniversalClient, key string) (string, error)
+
+// getValue fetches the value for the cert file with the given suffix,
+// returning it together with its key and the client it was read from. When
+// several key prefixes hold different values for it, -collisions decides
+// which one is used. Values prefetched for the initial sweep are used once
+// instead of reading them again.
+func getValue(ctx context.Context, cert string, suf string) (string, string, redis.UniversalClient, error) {
+	if pf := prefetchFrom(ctx); pf != nil {
+		if v, ok := pf.take(cert, suf); ok {
+			return v.val, v.key, v.client, v.err
+		}
+	}
+	return getValueWith(cert, suf, func(c redis.UniversalClient, key string) (string, error) {
+		return c.Get(ctx, key).Result()
+	})
+}
+
+// getValueWith implements getValue, reading keys with get.
+func getValueWith(cert string, suf string, get getter) (string, string, redis.UniversalClient, error) {
+	if keys, ok := config.CertKeys[cert]; ok {
+		key, ok := keys[suf]
+		if !ok {
+			return "", "", nil, redis.Nil
+		}
+		err := checkKey(key)
+		if err != nil {
+			return "", "", nil, err
+		}
+		c, _ := keyedClient(cert)
+		val, err := get(c, key)
+		return val, key, c, clusterRedirect(err)
+	}
+	var found []candidate
+	for _, src := range sources {
+		key := certPath(src.prefix) + cert + "/" + cert + suf
+		err := checkKey(key)
+		if err != nil {
+			return "", "", nil, err
+		}
+		v, err := get(src.client, key)
+		if err != nil {
+			if errors.Is(err, redis.Nil) {
+				continue
+			}
+			return "", "", nil, clusterRedirect(err)
+		}
+		found = append(found, candidate{val: v, key: key, client: src.client, prefix: src.prefix})
+	}
+	if len(found) == 0 {
+		return "", "", nil, redis.Nil
+	}
+	if len(found) == 1 {
+		return found[0].val, found[0].key, found[0].client, nil
+	}
+	c, err := resolveCollision(cert, suf, found, get)
+	if err != nil {
+		return "", "", nil, err
+	}
+	return c.val, c.key, c.client, nil
+}
+
+// candidate is a value for a cert file found under one of the key prefixes.
+type candidate struct {
+	val    string
+	key    string
+	client redis.UniversalClient
+	prefix string
+	// files holds the values of all files of the cert found under prefix,
+	// by suffix.
+	files map[string]string
+	// modified is the latest modification time of files.
+	modified time.Time
+}
+
+// Resolutions of cert collisions accepted by -collisions.
+const (
+	collisionsFirst  = "first"  // the first key prefix given wins
+	collisionsNewest = "newest" // the value modified last wins
+)
+
+// errCollision is returned for a cert found with different values under
+// several key prefixes if -strict-collisions is set.
+var errCollision = errors.New("cert collision")
+
+// resolveCollision picks one of the values found for the suf file of a
+// cert according to -collisions, or fails with -strict-collisions. The
+// choice is made for the prefix as a whole, comparing all files of the cert
+// under it, so the key and the cert always come from the same prefix.
+// Prefixes holding all files of the cert are preferred over those missing
+// some. Identical copies are not collisions.
+func resolveCollision(cert string, suf string, found []candidate, get getter) (candidate, error) {
+	for i := range found {
+		c := &found[i]
+		c.files = map[string]string{suf: c.val}
+		for _, other := range certSuffixes {
+			if other == suf {
+				continue
+			}
+			v, err := get(c.client, certPath(c.prefix)+cert+"/"+cert+other)
+			if err != nil {
+				if errors.Is(err, redis.Nil) {
+					continue
+				}
+				return candidate{}, clusterRedirect(err)
+			}
+			c.files[other] = v
+		}
+		for _, v := range c.files {
+			_, modified, _ := framing().unframe(v)
+			if modified.After(c.modified) {
+				c.modified = modified
+			}
+		}
+	}
+	differ := slices.ContainsFunc(found[1:], func(c candidate) bool { return !maps.Equal(c.files, found[0].files) })
+	if !differ {
+		return found[0], nil
+	}
+	var conflicts []string
+	for _, c := range found {
+		conflicts = append(conflicts, fmt.Sprintf("%s (db %d, modified %s)", c.key, clientDB(c.client), c.modified.Format(time.RFC3339)))
+	}
+	if config.StrictCollisions {
+		return candidate{}, fmt.Errorf("%w: %s: %s", errCollision, cert, strings.Join(conflicts, ", "))
+	}
+	eligible := found
+	complete := slices.DeleteFunc(slices.Clone(found), func(c candidate) bool { return len(c.files) < len(certSuffixes) })
+	if len(complete) > 0 {
+		eligible = complete
+	}
+	pick := 0
+	if config.Collisions == collisionsNewest {
+		for i := range eligible {
+			if eligible[i].modified.After(eligible[pick].modified) {
+				pick = i
+			}
+		}
+	}
+	slog.Warn("cert collision", "cert", cert, "resolution", config.Collisions, "using", eligible[pick].key, "conflicts", conflicts)
+	return eligible[pick], nil
+}
+
+// maxRefDepth limits how many -value-ref references are followed for a
+// single value.
+const maxRefDepth = 8
+
+// errRefDepth is returned for a chain of references that is too long, most
+// likely a cycle.
+var errRefDepth = errors.New("too many references")
+
+// followRefs follows the references in data read from key. A value starting
+// with -value-ref names another key, whose raw contents replace it.
+func followRefs(ctx context.Context, c redis.UniversalClient, key string, data []byte) ([]byte, error) {
+	if len(config.ValueRef) == 0 {
+		return data, nil
+	}
+	for range maxRefDepth {
+		ref, ok := bytes.CutPrefix(data, []byte(config.ValueRef))
+		if !ok {
+			return data, nil
+		}
+		next := string(ref)
+		slog.Debug("following reference", "key", key, "ref", next)
+		err := checkKey(next)
+		if err != nil {
+			return nil, err
+		}
+		val, err := c.Get(ctx, next).Bytes()
+		if err != nil {
+			return nil, fmt.Errorf("reference %s from %s: %w", next, key, clusterRedirect(err))
+		}
+		key, data = next, val
+	}
+	return nil, fmt.Errorf("%w, stopped at %s after %d", errRefDepth, key, maxRefDepth)
+}
+
+// issuerCert is a cert stored by Caddy below another issuer than -acmedir,
+// such as the certs of its internal CA used as fallback.
+type issuerCert struct {
+	Issuer string
+	Domain string
+}
+
+// prefixKeyed are the explicitly keyed certs whose keys are below the first
+// key prefix, those of -cert specs naming an issuer and of -pki-ca. They
+// are read from the database of that prefix.
+var prefixKeyed = make(map[string]bool)
+
+// keyedClient returns the client the explicit keys of cert are read with,
+// together with the database of their keyspace notifications.
+func keyedClient(cert string) (redis.UniversalClient, int) {
+	if prefixKeyed[cert] && len(sources) > 0 {
+		return sources[0].client, sources[0].keyspaceDB()
+	}
+	return readClient, urlDB()
+}
+
+// resolveIssuerCerts turns the -cert specs naming an issuer into explicit
+// keys below the first key prefix.
+func resolveIssuerCerts() {
+	for name, ic := range config.IssuerCerts {
+		src, _ := parseSource(config.KeyPrefixes[0])
+		dir := src.prefix + "/certificates/" + ic.Issuer + "/" + ic.Domain + "/" + ic.Domain
+		if config.CertKeys == nil {
+			config.CertKeys = make(map[string]map[string]string)
+		}
+		config.CertKeys[name] = map[string]string{
+			".key": dir + ".key",
+			".crt": dir + ".crt",
+		}
+		prefixKeyed[name] = true
+		slog.Debug("issuer cert", "cert", name, "key", dir+".crt")
+	}
+}
+
+// resolvePKICerts adds the root and intermediate certs of the CAs of the
+// Caddy PKI app named by -pki-ca as explicitly keyed certs below the first
+// key prefix. The private keys are only mirrored with -pki-keys.
+func resolvePKICerts() {
+	src, _ := parseSource(config.KeyPrefixes[0])
+	for _, id := range config.PKICAs {
+		for _, which := range []string{"root", "intermediate"} {
+			name := "pki-" + id + "-" + which
+			dir := src.prefix + "/pki/authorities/" + id + "/" + which
+			keys := map[string]string{".crt": dir + ".crt"}
+			if config.PKIKeys {
+				keys[".key"] = dir + ".key"
+			}
+			if config.CertKeys == nil {
+				config.CertKeys = make(map[string]map[string]string)
+			}
+			config.CertKeys[name] = keys
+			prefixKeyed[name] = true
+			config.Certs = append(config.Certs, name)
+			slog.Debug("pki cert", "cert", name, "key", dir+".crt")
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// storedValue returns the caddy-storage-redis value holding data, modified
+// hours after a fixed time.
+func storedValue(data string, hours int) string {
+	v, _ := json.Marshal(map[string]any{
+		"Value":    data,
+		"Modified": time.Date(2024, 1, 1, hours, 0, 0, 0, time.UTC),
+	})
+	return string(v)
+}
+
+func TestResolveCollision(t *testing.T) {
+	oldConfig, oldSources := config, sources
+	defer func() { config, sources = oldConfig, oldSources }()
+	config.ValueFormat = valueFormatJSON
+	config.ValueField = "Value"
+	config.ModifiedField = "Modified"
+	config.ValueEncoding = encodingPEM
+	config.AcmeDirName = "acme"
+	ca, cb := redis.NewClient(&redis.Options{DB: 1}), redis.NewClient(&redis.Options{DB: 2})
+	sources = []keySource{{prefix: "a", client: ca}, {prefix: "b", client: cb}}
+	key := func(prefix string, suf string) string {
+		return certPath(prefix) + "www.example.com/www.example.com" + suf
+	}
+	tests := []struct {
+		name       string
+		values     map[string]string
+		collisions string
+		strict     bool
+		// want is the prefix the .key and the .crt must come from, empty
+		// for an error
+		want string
+	}{
+		{"identical", map[string]string{
+			key("a", ".key"): storedValue("key", 1), key("a", ".crt"): storedValue("crt", 1),
+			key("b", ".key"): storedValue("key", 1), key("b", ".crt"): storedValue("crt", 1),
+		}, collisionsNewest, false, "a"},
+		{"first", map[string]string{
+			key("a", ".key"): storedValue("key a", 1), key("a", ".crt"): storedValue("crt a", 1),
+			key("b", ".key"): storedValue("key b", 2), key("b", ".crt"): storedValue("crt b", 2),
+		}, collisionsFirst, false, "a"},
+		{"newest file decides for the prefix", map[string]string{
+			key("a", ".key"): storedValue("key a", 2), key("a", ".crt"): storedValue("crt a", 1),
+			key("b", ".key"): storedValue("key b", 1), key("b", ".crt"): storedValue("crt b", 3),
+		}, collisionsNewest, false, "b"},
+		{"complete prefix preferred", map[string]string{
+			key("a", ".key"): storedValue("key a", 1), key("a", ".crt"): storedValue("crt a", 1),
+			key("b", ".crt"): storedValue("crt b", 3),
+		}, collisionsNewest, false, "a"},
+		{"strict", map[string]string{
+			key("a", ".key"): storedValue("key a", 1), key("a", ".crt"): storedValue("crt a", 1),
+			key("b", ".key"): storedValue("key b", 2), key("b", ".crt"): storedValue("crt b", 2),
+		}, collisionsNewest, true, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.Collisions = tt.collisions
+			config.StrictCollisions = tt.strict
+			get := func(c redis.UniversalClient, key string) (string, error) {
+				v, ok := tt.values[key]
+				if !ok {
+					return "", redis.Nil
+				}
+				return v, nil
+			}
+			for _, suf := range certSuffixes {
+				_, k, _, err := getValueWith("www.example.com", suf, get)
+				if len(tt.want) == 0 {
+					if !errors.Is(err, errCollision) {
+						t.Errorf("%s: got %v, want a collision", suf, err)
+					}
+					continue
+				}
+				if err != nil {
+					t.Fatalf("%s: %v", suf, err)
+				}
+				if k != key(tt.want, suf) {
+					t.Errorf("%s: got %s, want %s", suf, k, key(tt.want, suf))
+				}
+			}
+		})
+	}
+}
+
+// redisReply is an error reply of a redis server.
+type redisReply string
+
+func (r redisReply) Error() string { return string(r) }
+func (redisReply) RedisError()     {}
+
+func TestClusterRedirect(t *testing.T) {
+	tests := []struct {
+		err      error
+		redirect bool
+	}{
+		{redisReply("MOVED 3999 127.0.0.1:6381"), true},
+		{redisReply("ASK 3999 127.0.0.1:6381"), true},
+		{redisReply("ERR unknown command"), false},
+		{redisReply("MOVEDX"), false},
+		{redis.Nil, false},
+		{errors.New("MOVED 3999 127.0.0.1:6381"), false},
+	}
+	for _, tt := range tests {
+		err := clusterRedirect(tt.err)
+		if errors.Is(err, errClusterRedirect) != tt.redirect {
+			t.Errorf("%v: got %v, want redirect %v", tt.err, err, tt.redirect)
+		}
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%v: wrapped error lost", tt.err)
+		}
+	}
+}
+
+func TestIssuerCertDB(t *testing.T) {
+	oldConfig, oldSources, oldClient, oldReadClient := config, sources, client, readClient
+	defer func() { config, sources, client, readClient = oldConfig, oldSources, oldClient, oldReadClient }()
+	config.KeyPrefixes = stringsFlag{"caddy@3"}
+	config.CertKeys = nil
+	config.IssuerCerts = map[string]issuerCert{"internal": {Issuer: "local", Domain: "example.com"}}
+	defer delete(prefixKeyed, "internal")
+	resolveIssuerCerts()
+	client = redis.NewClient(&redis.Options{DB: 0})
+	readClient = client
+	src := redis.NewClient(&redis.Options{DB: 3})
+	sources = []keySource{{prefix: "caddy", db: 3, client: src}}
+	c, db := keyedClient("internal")
+	if c != src || db != 3 {
+		t.Errorf("got client of db %d, keyspace db %d, want 3", clientDB(c), db)
+	}
+	key := "caddy/certificates/local/example.com/example.com.crt"
+	certs, suf := eventTargets(keyspaceChannel(3, key))
+	if len(certs) != 1 || certs[0] != "internal" || suf != ".crt" {
+		t.Errorf("event in db 3: got %v %q", certs, suf)
+	}
+	certs, _ = eventTargets(keyspaceChannel(0, key))
+	if len(certs) != 0 {
+		t.Errorf("event in db 0: got %v", certs)
+	}
+}
+
+func TestValueRefAutoEncoding(t *testing.T) {
+	useTestConfig(t)
+	config.ValueEncoding = encodingAuto
+	config.ValueRef = "ref:"
+	const cert = "www.example.com"
+	v := newTestVersion(t)
+	useFakeRedis(t, map[string]string{
+		certKey(cert, ".crt"):  storedValue("ref:raw/"+cert+".crt", 1),
+		certKey(cert, ".key"):  storedValue(base64.StdEncoding.EncodeToString([]byte("ref:raw/"+cert+".key")), 1),
+		"raw/" + cert + ".crt": string(v.crt),
+		"raw/" + cert + ".key": string(v.key),
+	})
+	for suf, want := range map[string][]byte{".crt": v.crt, ".key": v.key} {
+		data, _, err := fetchValue(context.Background(), cert, suf)
+		if err != nil {
+			t.Fatalf("%s: %v", suf, err)
+		}
+		if !bytes.Equal(data, want) {
+			t.Errorf("%s: got %q", suf, data)
+		}
+	}
+}
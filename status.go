@@ -0,0 +1,342 @@
+package main
+
+import (
+	"cmp"
+	"crypto/tls"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"slices"
+	"sync"
+	"time"
+)
+
+// certStatus records the synchronisation history of a single watched cert.
+type certStatus struct {
+	Name       string     `json:"name"`
+	LastSync   *time.Time `json:"last_sync,omitempty"`
+	LastChange *time.Time `json:"last_change,omitempty"`
+	LastError  string     `json:"last_error,omitempty"`
+	Syncs      int        `json:"syncs"`
+	SyncErrors int        `json:"sync_errors"`
+	// Missing is set for a required cert absent after the initial sync.
+	Missing bool `json:"missing,omitempty"`
+
+	Fingerprint      string `json:"fingerprint,omitempty"`
+	ChainFingerprint string `json:"chain_fingerprint,omitempty"`
+}
+
+// targetStatus records the outcome of the writes to a destination besides
+// CertDir, such as an -sftp host or Vault.
+type targetStatus struct {
+	Name        string     `json:"name"`
+	LastSuccess *time.Time `json:"last_success,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+	Failures    int        `json:"failures"`
+}
+
+// statusReport is a point in time copy of the watch state.
+type statusReport struct {
+	Subscribed      bool           `json:"subscribed"`
+	SubscribedSince *time.Time     `json:"subscribed_since,omitempty"`
+	DiskError       string         `json:"disk_error,omitempty"`
+	CmdError        string         `json:"cmd_error,omitempty"`
+	CmdFailures     int            `json:"cmd_failures"`
+	LastHookError   string         `json:"last_hook_error,omitempty"`
+	HookFailures    int            `json:"hook_failures"`
+	Missing         []string       `json:"missing,omitempty"`
+	Reconnects      int            `json:"reconnects"`
+	Certs           []certStatus   `json:"certs"`
+	Targets         []targetStatus `json:"targets,omitempty"`
+}
+
+// watchState tracks what certwatch is currently watching. It is updated by
+// the listen loop and read by the diagnostics handlers.
+type watchState struct {
+	mu              sync.Mutex
+	subscribed      bool
+	subscribedSince time.Time
+	diskError       string
+	cmdError        string
+	cmdFailures     int
+	lastHookError   string
+	hookFailures    int
+	reconnects      int
+	alive           time.Time
+	certs           map[string]*certStatus
+	targets         map[string]*targetStatus
+}
+
+var state = watchState{
+	certs:   make(map[string]*certStatus),
+	targets: make(map[string]*targetStatus),
+}
+
+func (s *watchState) cert(name string) *certStatus {
+	cs, ok := s.certs[name]
+	if !ok {
+		cs = &certStatus{Name: name}
+		s.certs[name] = cs
+	}
+	return cs
+}
+
+// watch adds cert names to the watched set.
+func (s *watchState) watch(names ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, name := range names {
+		s.cert(name)
+	}
+}
+
+// unwatch removes cert names from the watched set.
+func (s *watchState) unwatch(names ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, name := range names {
+		delete(s.certs, name)
+	}
+}
+
+// synced records the outcome of a handleCert run.
+func (s *watchState) synced(name string, changed bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cs := s.cert(name)
+	if err != nil {
+		cs.LastError = err.Error()
+		cs.SyncErrors++
+		return
+	}
+	now := clk.Now()
+	cs.Syncs++
+	cs.LastSync = &now
+	cs.LastError = ""
+	if changed {
+		cs.LastChange = &now
+		cs.Missing = false
+	}
+}
+
+// setMissing marks the named certs as required but absent.
+func (s *watchState) setMissing(names []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, name := range names {
+		s.cert(name).Missing = true
+	}
+}
+
+// setFingerprint records the SHA-256 fingerprints of the installed cert.
+func (s *watchState) setFingerprint(name string, leaf string, chain string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cs := s.cert(name)
+	cs.Fingerprint = leaf
+	cs.ChainFingerprint = chain
+}
+
+// targetResult records the outcome of a write to the named target, nil for
+// success. Failures are counted until the next success.
+func (s *watchState) targetResult(name string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ts, ok := s.targets[name]
+	if !ok {
+		ts = &targetStatus{Name: name}
+		s.targets[name] = ts
+	}
+	if err != nil {
+		ts.LastError = err.Error()
+		ts.Failures++
+		return
+	}
+	now := clk.Now()
+	ts.LastSuccess = &now
+	ts.LastError = ""
+	ts.Failures = 0
+}
+
+// setSubscribed records whether the keyspace subscription is established.
+func (s *watchState) setSubscribed(subscribed bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.subscribed = subscribed
+	if subscribed {
+		s.subscribedSince = clk.Now()
+	} else {
+		s.subscribedSince = time.Time{}
+	}
+}
+
+// setDiskError records a write failure of CertDir, nil clears it.
+func (s *watchState) setDiskError(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		s.diskError = err.Error()
+	} else {
+		s.diskError = ""
+	}
+}
+
+// setCmdError records a failure of the reload command, nil clears it.
+func (s *watchState) setCmdError(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		s.cmdError = err.Error()
+		s.cmdFailures++
+	} else {
+		s.cmdError = ""
+	}
+}
+
+// hookFailed records a failure of a hook: a -certcmd, -service-reload-cmd,
+// -hook-key, -hook-crt or -new-cert-cmd command. Unlike a failing reload
+// command it does not make certwatch unhealthy.
+func (s *watchState) hookFailed(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastHookError = err.Error()
+	s.hookFailures++
+}
+
+// healthy reports whether certwatch is able to keep the certs in sync.
+func (r statusReport) healthy() bool {
+	return len(r.DiskError) == 0 && len(r.CmdError) == 0 && len(r.Missing) == 0
+}
+
+// reconnected counts a reconnect attempt to redis and returns the total.
+func (s *watchState) reconnected() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reconnects++
+	return s.reconnects
+}
+
+// beat records that the main loop is alive and not wedged.
+func (s *watchState) beat() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.alive = clk.Now()
+}
+
+// lastAlive returns the time of the last beat of the main loop.
+func (s *watchState) lastAlive() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.alive
+}
+
+// report returns a copy of the current state with certs sorted by name.
+func (s *watchState) report() statusReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r := statusReport{
+		Subscribed:    s.subscribed,
+		DiskError:     s.diskError,
+		CmdError:      s.cmdError,
+		CmdFailures:   s.cmdFailures,
+		LastHookError: s.lastHookError,
+		HookFailures:  s.hookFailures,
+		Reconnects:    s.reconnects,
+		Certs:         make([]certStatus, 0, len(s.certs)),
+	}
+	if !s.subscribedSince.IsZero() {
+		since := s.subscribedSince
+		r.SubscribedSince = &since
+	}
+	for _, cs := range s.certs {
+		r.Certs = append(r.Certs, *cs)
+		if cs.Missing {
+			r.Missing = append(r.Missing, cs.Name)
+		}
+	}
+	slices.SortFunc(r.Certs, func(a, b certStatus) int {
+		return cmp.Compare(a.Name, b.Name)
+	})
+	slices.Sort(r.Missing)
+	for _, ts := range s.targets {
+		r.Targets = append(r.Targets, *ts)
+	}
+	slices.SortFunc(r.Targets, func(a, b targetStatus) int {
+		return cmp.Compare(a.Name, b.Name)
+	})
+	return r
+}
+
+// logStatus dumps the current state to the log.
+func logStatus() {
+	r := state.report()
+	slog.Info("status", "subscribed", r.Subscribed, "since", r.SubscribedSince, "diskError", r.DiskError, "cmdError", r.CmdError, "lastHookError", r.LastHookError, "missing", r.Missing, "certs", len(r.Certs))
+	for _, cs := range r.Certs {
+		slog.Info("status", "cert", cs.Name, "lastSync", cs.LastSync, "lastChange", cs.LastChange, "lastError", cs.LastError, "fingerprint", cs.Fingerprint)
+	}
+	for _, ts := range r.Targets {
+		slog.Info("status", "target", ts.Name, "lastSuccess", ts.LastSuccess, "lastError", ts.LastError, "failures", ts.Failures)
+	}
+}
+
+// handleStatusSignals logs the current state whenever one of the status
+// signals is received.
+func handleStatusSignals() {
+	sigs := statusSignals()
+	if len(sigs) == 0 {
+		return
+	}
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, sigs...)
+	go func() {
+		for range ch {
+			logStatus()
+		}
+	}()
+}
+
+func statusHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(state.report())
+	if err != nil {
+		slog.Error("status", "err", err)
+	}
+}
+
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	if !state.report().healthy() {
+		http.Error(w, "unhealthy", http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
+
+// serveHealth runs the diagnostics HTTP server on addr. With -health-tls it
+// serves HTTPS with the watched certs, chosen by SNI.
+func serveHealth(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", statusHandler)
+	mux.HandleFunc("/healthz", healthzHandler)
+	mux.HandleFunc("/certs", certsHandler)
+	mux.HandleFunc("/metrics", metricsHandler)
+	srv := &http.Server{Addr: addr, Handler: mux}
+	if config.HealthTLS {
+		healthCerts = newCertStore()
+		srv.TLSConfig = &tls.Config{GetCertificate: healthCerts.GetCertificate}
+	}
+	go func() {
+		slog.Info("health listener", "addr", addr, "tls", config.HealthTLS)
+		var err error
+		if config.HealthTLS {
+			err = srv.ListenAndServeTLS("", "")
+		} else {
+			err = srv.ListenAndServe()
+		}
+		if err != nil {
+			slog.Error("ListenAndServe", "err", err)
+			os.Exit(1)
+		}
+	}()
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestReportOmitsUnsetTimes(t *testing.T) {
+	s := watchState{certs: make(map[string]*certStatus), targets: make(map[string]*targetStatus)}
+	s.synced("www.example.com", false, errors.New("sync failed"))
+	s.targetResult("sftp host", errors.New("upload failed"))
+	data, err := json.Marshal(s.report())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, field := range []string{"subscribed_since", "last_sync", "last_change", "last_success"} {
+		if strings.Contains(string(data), field) {
+			t.Errorf("%s in %s", field, data)
+		}
+	}
+	s.synced("www.example.com", true, nil)
+	s.targetResult("sftp host", nil)
+	data, err = json.Marshal(s.report())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, field := range []string{"last_sync", "last_change", "last_success"} {
+		if !strings.Contains(string(data), field) {
+			t.Errorf("%s missing in %s", field, data)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+)
+
+// statusBlob is the JSON published to -status-key.
+type statusBlob struct {
+	Host      string    `json:"host"`
+	Healthy   bool      `json:"healthy"`
+	Published time.Time `json:"published"`
+	statusReport
+}
+
+var statusKeyErrors = &dedupLog{msg: "status key"}
+
+// statusKeyName returns -status-key with {host} replaced.
+func statusKeyName(host string) string {
+	return strings.ReplaceAll(config.StatusKey, "{host}", host)
+}
+
+// publishStatus periodically sets -status-key to the current status, with
+// a TTL of three intervals so the key expires when the instance dies.
+// Failures are logged and otherwise ignored, they never affect the sync.
+func publishStatus(ctx context.Context) {
+	if len(config.StatusKey) == 0 || config.StatusInterval <= 0 {
+		return
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		slog.Warn("status key", "err", err)
+		host = "unknown"
+	}
+	key := statusKeyName(host)
+	slog.Info("publishing status", "key", key, "interval", config.StatusInterval)
+	go func() {
+		ticker := time.NewTicker(config.StatusInterval)
+		defer ticker.Stop()
+		for {
+			r := state.report()
+			data, err := json.Marshal(statusBlob{
+				Host:         host,
+				Healthy:      r.healthy(),
+				Published:    clk.Now().UTC(),
+				statusReport: r,
+			})
+			if err == nil {
+				wctx, cancel := context.WithTimeout(ctx, config.StatusInterval)
+				err = client.Set(wctx, key, data, 3*config.StatusInterval).Err()
+				cancel()
+			}
+			if err != nil && ctx.Err() == nil {
+				statusKeyErrors.Error(err, "key", key)
+			} else if err == nil {
+				statusKeyErrors.Reset()
+			}
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
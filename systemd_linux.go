@@ -0,0 +1,44 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/coreos/go-systemd/v22/dbus"
+)
+
+// systemdUnitAction reloads or restarts unit through the system bus, like
+// systemctl does, and waits for the job to finish. A job that finished with
+// any result but done is returned as an error.
+func systemdUnitAction(ctx context.Context, unit string, restart bool) error {
+	conn, err := dbus.NewSystemConnectionContext(ctx)
+	if err != nil {
+		return fmt.Errorf("system bus: %w", err)
+	}
+	defer conn.Close()
+	method, start := "ReloadUnit", conn.ReloadUnitContext
+	if restart {
+		method, start = "RestartUnit", conn.RestartUnitContext
+	}
+	done := make(chan string, 1)
+	_, err = start(ctx, unit, "replace", done)
+	if err != nil {
+		return fmt.Errorf("%s %s: %w", method, unit, err)
+	}
+	select {
+	case result := <-done:
+		if result != "done" {
+			return fmt.Errorf("%s %s: job %s", method, unit, result)
+		}
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("%s %s: waiting for job: %w", method, unit, ctx.Err())
+	}
+}
+
+// checkSystemd checks that units can be reloaded on this platform.
+func checkSystemd() error {
+	return nil
+}
@@ -0,0 +1,131 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// fakeSystemd serves the job methods of the systemd manager on a test bus
+// and finishes every job with result. The methods run on the goroutines of
+// the bus, mu guards result and calls.
+type fakeSystemd struct {
+	conn   *dbus.Conn
+	mu     sync.Mutex
+	result string
+	calls  []string
+}
+
+func (f *fakeSystemd) job(method string, name string) (dbus.ObjectPath, *dbus.Error) {
+	f.mu.Lock()
+	f.calls = append(f.calls, method+" "+name)
+	id, result := uint32(len(f.calls)), f.result
+	f.mu.Unlock()
+	job := dbus.ObjectPath("/org/freedesktop/systemd1/job/" + strconv.Itoa(int(id)))
+	if name == "missing.service" {
+		return "", dbus.NewError("org.freedesktop.systemd1.NoSuchUnit", []any{"Unit missing.service not found."})
+	}
+	go f.conn.Emit("/org/freedesktop/systemd1", "org.freedesktop.systemd1.Manager.JobRemoved", id, job, name, result)
+	return job, nil
+}
+
+func (f *fakeSystemd) ReloadUnit(name string, mode string) (dbus.ObjectPath, *dbus.Error) {
+	return f.job("ReloadUnit", name)
+}
+
+func (f *fakeSystemd) RestartUnit(name string, mode string) (dbus.ObjectPath, *dbus.Error) {
+	return f.job("RestartUnit", name)
+}
+
+// testBus starts a private dbus-daemon and makes it the system bus.
+func testBus(t *testing.T) string {
+	daemon, err := exec.LookPath("dbus-daemon")
+	if err != nil {
+		t.Skip("no dbus-daemon")
+	}
+	addr := "unix:path=" + filepath.Join(t.TempDir(), "bus")
+	cmd := exec.Command(daemon, "--session", "--nofork", "--address="+addr, "--print-address=1")
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cmd.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+	line, err := bufio.NewReader(out).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("DBUS_SYSTEM_BUS_ADDRESS", strings.TrimSpace(line))
+	return strings.TrimSpace(line)
+}
+
+func TestSystemdUnitAction(t *testing.T) {
+	addr := testBus(t)
+	conn, err := dbus.Dial(addr)
+	if err == nil {
+		err = conn.Auth(nil)
+	}
+	if err == nil {
+		err = conn.Hello()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	f := &fakeSystemd{conn: conn}
+	err = conn.Export(f, "/org/freedesktop/systemd1", "org.freedesktop.systemd1.Manager")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = conn.RequestName("org.freedesktop.systemd1", dbus.NameFlagDoNotQueue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		unit    string
+		restart bool
+		result  string
+		wantErr string
+	}{
+		{"nginx.service", false, "done", ""},
+		{"nginx.service", true, "done", ""},
+		{"nginx.service", false, "failed", "ReloadUnit nginx.service: job failed"},
+		{"missing.service", false, "done", "Unit missing.service not found."},
+	}
+	for _, tt := range tests {
+		f.mu.Lock()
+		f.result = tt.result
+		f.mu.Unlock()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		err := systemdUnitAction(ctx, tt.unit, tt.restart)
+		cancel()
+		switch {
+		case len(tt.wantErr) == 0 && err != nil:
+			t.Errorf("%s restart=%v: %v", tt.unit, tt.restart, err)
+		case len(tt.wantErr) > 0 && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+			t.Errorf("%s restart=%v: got %v, want %q", tt.unit, tt.restart, err, tt.wantErr)
+		}
+	}
+	want := []string{"ReloadUnit nginx.service", "RestartUnit nginx.service", "ReloadUnit nginx.service", "ReloadUnit missing.service"}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if strings.Join(f.calls, ",") != strings.Join(want, ",") {
+		t.Errorf("calls %v, want %v", f.calls, want)
+	}
+}
@@ -0,0 +1,22 @@
+//go:build !linux
+
+package main
+
+import (
+	"context"
+	"errors"
+)
+
+// errSystemdUnsupported is returned for systemd reloads on platforms
+// without systemd.
+var errSystemdUnsupported = errors.New("systemd units can only be reloaded on linux")
+
+// checkSystemd checks that units can be reloaded on this platform.
+func checkSystemd() error {
+	return errSystemdUnsupported
+}
+
+// systemdUnitAction reloads or restarts unit through the system bus.
+func systemdUnitAction(ctx context.Context, unit string, restart bool) error {
+	return errSystemdUnsupported
+}
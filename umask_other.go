@@ -0,0 +1,8 @@
+//go:build !unix
+
+package main
+
+// setUmask is a no-op on platforms without a process umask.
+func setUmask(mask int) int {
+	return 0
+}
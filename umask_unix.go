@@ -0,0 +1,10 @@
+//go:build unix
+
+package main
+
+import "syscall"
+
+// setUmask sets the process umask and returns the previous value.
+func setUmask(mask int) int {
+	return syscall.Umask(mask)
+}
@@ -0,0 +1,81 @@
+//go:build unix
+
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestModesUnderPermissiveUmask(t *testing.T) {
+	old := setUmask(0)
+	defer setUmask(old)
+	dir := t.TempDir()
+	fname := filepath.Join(dir, "sub", "www.example.com.key")
+	err := prepareTarget(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = writeFileAtomic(fname, []byte("key"), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path string
+		want fs.FileMode
+	}{
+		{filepath.Dir(fname), 0700},
+		{fname, 0600},
+	}
+	for _, tt := range tests {
+		finfo, err := os.Stat(tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if finfo.Mode().Perm() != tt.want {
+			t.Errorf("%s: mode %v, want %v", tt.path, finfo.Mode().Perm(), tt.want)
+		}
+	}
+}
+
+func TestCheckKeyMode(t *testing.T) {
+	old := setUmask(0)
+	defer setUmask(old)
+	tests := []struct {
+		mode    fs.FileMode
+		allowed fs.FileMode
+		ok      bool
+	}{
+		{0600, 0600, true},
+		{0400, 0600, true},
+		{0640, 0600, false},
+		{0644, 0600, false},
+		{0640, 0640, true},
+		{0644, 0640, false},
+	}
+	for _, tt := range tests {
+		fname := filepath.Join(t.TempDir(), "www.example.com.key")
+		err := os.WriteFile(fname, []byte("key"), tt.mode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = checkKeyMode(fname, tt.allowed)
+		_, statErr := os.Stat(fname)
+		if tt.ok {
+			if err != nil || statErr != nil {
+				t.Errorf("mode %v allowed %v: %v, file: %v", tt.mode, tt.allowed, err, statErr)
+			}
+			continue
+		}
+		if !errors.Is(err, errInsecureKey) {
+			t.Errorf("mode %v allowed %v: got %v, want errInsecureKey", tt.mode, tt.allowed, err)
+		}
+		if !errors.Is(statErr, fs.ErrNotExist) {
+			t.Errorf("mode %v allowed %v: insecure key not removed", tt.mode, tt.allowed)
+		}
+	}
+}
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// vaultTimeout bounds a single request to Vault.
+const vaultTimeout = 10 * time.Second
+
+// vaultSecret is the data of the secret version written for a cert.
+type vaultSecret struct {
+	Crt         string `json:"crt,omitempty"`
+	Key         string `json:"key,omitempty"`
+	Fingerprint string `json:"fingerprint,omitempty"`
+	Modified    string `json:"modified"`
+}
+
+// errVaultDenied is returned for a request Vault refused with 403, most
+// likely because the token expired or was revoked.
+var errVaultDenied = errors.New("permission denied")
+
+// vaultClient writes secrets to a KV version 2 secrets engine. It logs in
+// with AppRole if -vault-role-id is set and otherwise uses the token given,
+// renewing renewable tokens before they expire.
+type vaultClient struct {
+	addr string
+	mu   sync.Mutex
+	// token is the current client token, empty before the first login
+	token string
+	// ttl and issued describe the lease of token, a zero ttl never expires
+	ttl       time.Duration
+	issued    time.Time
+	renewable bool
+}
+
+// vaultToken returns the static token from -vault-token, -vault-token-file or
+// the VAULT_TOKEN environment variable, in that order.
+func vaultToken() (string, error) {
+	if len(config.VaultToken) > 0 {
+		return config.VaultToken, nil
+	}
+	if len(config.VaultTokenFile) > 0 {
+		data, err := os.ReadFile(config.VaultTokenFile)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(data)), nil
+	}
+	return os.Getenv("VAULT_TOKEN"), nil
+}
+
+// do sends a request to Vault and decodes the JSON reply into out, if not
+// nil.
+func (v *vaultClient) do(ctx context.Context, method string, path string, token string, in any, out any) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(v.addr, "/")+"/v1/"+path, body)
+	if err != nil {
+		return err
+	}
+	if len(token) > 0 {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	if len(config.VaultNamespace) > 0 {
+		req.Header.Set("X-Vault-Namespace", config.VaultNamespace)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		err = fmt.Errorf("%s %s: %s: %s", method, req.URL.Path, resp.Status, bytes.TrimSpace(msg))
+		switch resp.StatusCode {
+		case http.StatusForbidden:
+			err = fmt.Errorf("%w: %w", errVaultDenied, err)
+		case http.StatusNotFound:
+			err = fmt.Errorf("%w: %w", errVaultNotFound, err)
+		}
+		return err
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// vaultAuth is the auth part of a Vault reply.
+type vaultAuth struct {
+	Auth struct {
+		ClientToken   string `json:"client_token"`
+		LeaseDuration int    `json:"lease_duration"`
+		Renewable     bool   `json:"renewable"`
+	} `json:"auth"`
+}
+
+// login obtains a token, by AppRole login or by looking up the static
+// token. Called with mu held.
+func (v *vaultClient) login(ctx context.Context) error {
+	if len(config.VaultRoleID) > 0 {
+		secretID, err := os.ReadFile(config.VaultSecretIDFile)
+		if err != nil {
+			return err
+		}
+		var reply vaultAuth
+		err = v.do(ctx, http.MethodPost, "auth/approle/login", "", map[string]string{
+			"role_id":   config.VaultRoleID,
+			"secret_id": strings.TrimSpace(string(secretID)),
+		}, &reply)
+		if err != nil {
+			return fmt.Errorf("approle login: %w", err)
+		}
+		v.token = reply.Auth.ClientToken
+		v.ttl = time.Duration(reply.Auth.LeaseDuration) * time.Second
+		v.renewable = reply.Auth.Renewable
+		v.issued = clk.Now()
+		slog.Info("vault login", "method", "approle", "ttl", v.ttl)
+		return nil
+	}
+	token, err := vaultToken()
+	if err != nil {
+		return err
+	}
+	if len(token) == 0 {
+		return errors.New("no vault token, use -vault-token, -vault-token-file, VAULT_TOKEN or -vault-role-id")
+	}
+	var reply struct {
+		Data struct {
+			TTL       int  `json:"ttl"`
+			Renewable bool `json:"renewable"`
+		} `json:"data"`
+	}
+	err = v.do(ctx, http.MethodGet, "auth/token/lookup-self", token, nil, &reply)
+	if err != nil {
+		return fmt.Errorf("token lookup: %w", err)
+	}
+	v.token = token
+	v.ttl = time.Duration(reply.Data.TTL) * time.Second
+	v.renewable = reply.Data.Renewable
+	v.issued = clk.Now()
+	slog.Info("vault login", "method", "token", "ttl", v.ttl, "renewable", v.renewable)
+	return nil
+}
+
+// ensureToken returns a valid token, logging in first if there is none and
+// renewing it once two thirds of its lease have passed. A token that can no
+// longer be renewed is replaced by logging in again.
+func (v *vaultClient) ensureToken(ctx context.Context) (string, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if len(v.token) == 0 {
+		err := v.login(ctx)
+		if err != nil {
+			return "", err
+		}
+	}
+	if v.ttl == 0 || clk.Now().Sub(v.issued) < 2*v.ttl/3 {
+		return v.token, nil
+	}
+	if v.renewable {
+		var reply vaultAuth
+		err := v.do(ctx, http.MethodPost, "auth/token/renew-self", v.token, map[string]string{}, &reply)
+		if err == nil {
+			v.ttl = time.Duration(reply.Auth.LeaseDuration) * time.Second
+			v.issued = clk.Now()
+			slog.Debug("vault token renewed", "ttl", v.ttl)
+			return v.token, nil
+		}
+		slog.Warn("vault token renewal", "err", err)
+	}
+	err := v.login(ctx)
+	if err != nil {
+		return "", err
+	}
+	return v.token, nil
+}
+
+// forget drops the current token, so the next request logs in again.
+func (v *vaultClient) forget() {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.token = ""
+}
+
+// secretPath returns the API path of the secret of cert.
+func secretPath(cert string) string {
+	return strings.Trim(config.VaultMount, "/") + "/data/" + strings.Trim(config.VaultPath, "/") + "/" + cert
+}
+
+// errVaultNotFound is returned for a secret that does not exist yet.
+var errVaultNotFound = errors.New("not found")
+
+// write writes a new version of the secret of cert, unless the current
+// version holds the same data already, and reports whether it did. A refused
+// request is retried once with a fresh token.
+func (v *vaultClient) write(ctx context.Context, cert string, secret vaultSecret) (bool, error) {
+	for try := 0; ; try++ {
+		token, err := v.ensureToken(ctx)
+		if err != nil {
+			return false, err
+		}
+		var current struct {
+			Data struct {
+				Data vaultSecret `json:"data"`
+			} `json:"data"`
+		}
+		err = v.do(ctx, http.MethodGet, secretPath(cert), token, nil, &current)
+		if err == nil && current.Data.Data == secret {
+			return false, nil
+		}
+		if err == nil || errors.Is(err, errVaultNotFound) {
+			err = v.do(ctx, http.MethodPost, secretPath(cert), token, map[string]any{"data": secret}, nil)
+		}
+		if errors.Is(err, errVaultDenied) && try == 0 {
+			v.forget()
+			continue
+		}
+		return err == nil, err
+	}
+}
+
+// delete deletes the latest version of the secret of cert and reports
+// whether there was one. The versions written before are kept and can be
+// restored with vault kv undelete. A refused request is retried once with a
+// fresh token.
+func (v *vaultClient) delete(ctx context.Context, cert string) (bool, error) {
+	for try := 0; ; try++ {
+		token, err := v.ensureToken(ctx)
+		if err != nil {
+			return false, err
+		}
+		err = v.do(ctx, http.MethodDelete, secretPath(cert), token, nil, nil)
+		if errors.Is(err, errVaultNotFound) {
+			return false, nil
+		}
+		if errors.Is(err, errVaultDenied) && try == 0 {
+			v.forget()
+			continue
+		}
+		return err == nil, err
+	}
+}
+
+// vaultQueue holds the latest secret of every cert not yet written to Vault.
+// Newer changes of a cert replace older ones waiting, so a backlog never
+// grows beyond one secret per cert and the latest version always wins.
+type vaultQueue struct {
+	mu      sync.Mutex
+	pending map[string]vaultSecret
+	wake    chan struct{}
+}
+
+// push queues the secret of cert and wakes the writer.
+func (q *vaultQueue) push(cert string, secret vaultSecret) {
+	q.mu.Lock()
+	q.pending[cert] = secret
+	q.mu.Unlock()
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// retry queues the secret of cert again after a failed write, unless a newer
+// one is waiting already.
+func (q *vaultQueue) retry(cert string, secret vaultSecret) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if _, ok := q.pending[cert]; !ok {
+		q.pending[cert] = secret
+	}
+}
+
+// take returns and clears the waiting secrets.
+func (q *vaultQueue) take() map[string]vaultSecret {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	pending := q.pending
+	q.pending = make(map[string]vaultSecret)
+	return pending
+}
+
+var vaultErrors = &dedupLog{msg: "vault write"}
+
+// vaultDestination writes the files of every cert as a secret to
+// -vault-addr. A new version is written for every change and for the first
+// sync of every cert, so Vault catches up on changes made while certwatch
+// was not running. Once the key and the cert of a cert are both removed from
+// redis, its secret is deleted. The writes are done by a background worker,
+// failed writes are retried every -sleep, so an unavailable Vault never
+// holds up syncing.
+type vaultDestination struct {
+	queue *vaultQueue
+	// synced holds the certs written at least once
+	synced sync.Map
+	mu     sync.Mutex
+	// current is the latest secret queued for every cert, the base for
+	// removing a single file
+	current map[string]vaultSecret
+}
+
+// removed reports whether secret is the one queued for a cert whose files
+// are all removed, which deletes its secret.
+func (s vaultSecret) removed() bool {
+	return len(s.Crt) == 0 && len(s.Key) == 0
+}
+
+func newVaultDestination() *vaultDestination {
+	v := &vaultClient{addr: config.VaultAddr}
+	q := &vaultQueue{pending: make(map[string]vaultSecret), wake: make(chan struct{}, 1)}
+	go func() {
+		for {
+			select {
+			case <-q.wake:
+			case <-clk.After(config.SleepTime):
+			}
+			for cert, secret := range q.take() {
+				ctx, cancel := context.WithTimeout(context.Background(), vaultTimeout)
+				var done bool
+				var err error
+				if secret.removed() {
+					done, err = v.delete(ctx, cert)
+				} else {
+					done, err = v.write(ctx, cert, secret)
+				}
+				cancel()
+				state.targetResult("vault", err)
+				if err != nil {
+					vaultErrors.Error(err, "cert", cert, "path", secretPath(cert))
+					q.retry(cert, secret)
+					continue
+				}
+				vaultErrors.Reset()
+				switch {
+				case done && secret.removed():
+					slog.Info("vault secret deleted", "cert", cert, "path", secretPath(cert))
+				case done:
+					slog.Info("vault secret written", "cert", cert, "path", secretPath(cert))
+				}
+			}
+		}
+	}()
+	return &vaultDestination{queue: q, current: make(map[string]vaultSecret)}
+}
+
+func (d *vaultDestination) write(cert string, files []certFile, changed bool) {
+	if _, seen := d.synced.LoadOrStore(cert, true); seen && !changed {
+		return
+	}
+	var secret vaultSecret
+	var modified time.Time
+	for _, f := range files {
+		if f.modified.After(modified) {
+			modified = f.modified
+		}
+		switch f.suffix {
+		case ".key":
+			secret.Key = string(f.data)
+		case ".crt":
+			secret.Crt = string(f.data)
+			secret.Fingerprint, _, _ = fingerprints(f.data)
+		}
+	}
+	if secret.removed() {
+		return
+	}
+	secret.Modified = modified.UTC().Format(time.RFC3339Nano)
+	d.mu.Lock()
+	d.current[cert] = secret
+	d.mu.Unlock()
+	d.queue.push(cert, secret)
+}
+
+func (d *vaultDestination) remove(cert string, suf string) {
+	d.mu.Lock()
+	secret := d.current[cert]
+	switch suf {
+	case ".key":
+		secret.Key = ""
+	case ".crt":
+		secret.Crt = ""
+		secret.Fingerprint = ""
+	}
+	if secret.removed() {
+		delete(d.current, cert)
+	} else {
+		d.current[cert] = secret
+	}
+	d.mu.Unlock()
+	d.queue.push(cert, secret)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestVaultRemove(t *testing.T) {
+	d := &vaultDestination{
+		queue:   &vaultQueue{pending: make(map[string]vaultSecret), wake: make(chan struct{}, 1)},
+		current: make(map[string]vaultSecret),
+	}
+	modified := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	d.write("www.example.com", []certFile{
+		{suffix: ".key", data: []byte("key"), modified: modified},
+		{suffix: ".crt", data: []byte("crt"), modified: modified},
+	}, true)
+	if got := d.queue.take()["www.example.com"]; got.Key != "key" || got.Crt != "crt" {
+		t.Fatalf("written %+v", got)
+	}
+	tests := []struct {
+		suf     string
+		removed bool
+		crt     string
+	}{
+		{".key", false, "crt"},
+		{".crt", true, ""},
+	}
+	for _, tt := range tests {
+		d.remove("www.example.com", tt.suf)
+		got, ok := d.queue.take()["www.example.com"]
+		if !ok {
+			t.Fatalf("remove %s: nothing queued", tt.suf)
+		}
+		if got.removed() != tt.removed || got.Crt != tt.crt || len(got.Key) > 0 {
+			t.Errorf("remove %s: queued %+v", tt.suf, got)
+		}
+	}
+}
+
+func TestVaultDelete(t *testing.T) {
+	oldToken, oldMount, oldPath := config.VaultToken, config.VaultMount, config.VaultPath
+	config.VaultToken, config.VaultMount, config.VaultPath = "token", "secret", "certwatch"
+	defer func() { config.VaultToken, config.VaultMount, config.VaultPath = oldToken, oldMount, oldPath }()
+	exists := true
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/v1/auth/token/lookup-self":
+			w.Write([]byte(`{"data":{"ttl":0}}`))
+		case r.Method == http.MethodDelete && r.URL.Path == "/v1/secret/data/certwatch/www.example.com":
+			if !exists {
+				http.NotFound(w, r)
+				return
+			}
+			exists = false
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			t.Errorf("unexpected %s %s", r.Method, r.URL.Path)
+			http.Error(w, "unexpected", http.StatusBadRequest)
+		}
+	}))
+	defer srv.Close()
+	v := &vaultClient{addr: srv.URL}
+	for _, want := range []bool{true, false} {
+		deleted, err := v.delete(context.Background(), "www.example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if deleted != want {
+			t.Errorf("deleted %v, want %v", deleted, want)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"net"
+	"os"
+	"slices"
+	"strings"
+)
+
+// verifyRoots holds the roots loaded from -roots, nil selects the system
+// roots.
+var verifyRoots *x509.CertPool
+
+// loadRoots reads a PEM bundle of trusted roots.
+func loadRoots(fname string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, errors.New(fname + ": no certificates found")
+	}
+	return pool, nil
+}
+
+// verifyChain verifies that the leaf in the PEM data chains up to a trusted
+// root using only the intermediates contained in the data.
+func verifyChain(data []byte) error {
+	ders := certBlocks(data)
+	if len(ders) == 0 {
+		return errors.New("no CERTIFICATE block found")
+	}
+	leaf, err := x509.ParseCertificate(ders[0])
+	if err != nil {
+		return err
+	}
+	intermediates := x509.NewCertPool()
+	for _, der := range ders[1:] {
+		c, err := x509.ParseCertificate(der)
+		if err != nil {
+			return err
+		}
+		intermediates.AddCert(c)
+	}
+	_, err = leaf.Verify(x509.VerifyOptions{
+		Roots:         verifyRoots,
+		Intermediates: intermediates,
+	})
+	return err
+}
+
+// verifyCert returns the watched cert that the server of the -verify-serve
+// name must present: the cert of that name, or else the wildcard cert for
+// the parent domain, so www.example.com checks *.example.com.
+func verifyCert(name string) string {
+	if slices.Contains(config.Certs, name) {
+		return name
+	}
+	if _, rest, ok := strings.Cut(name, "."); ok && slices.Contains(config.Certs, "*."+rest) {
+		return "*." + rest
+	}
+	return name
+}
+
+// verifyServed connects to the -verify-serve address of each changed cert
+// and checks that the leaf presented there is the one in the local file.
+// The -verify-serve name is sent for SNI. Mismatches and failures are
+// logged, they do not affect the sync.
+func verifyServed(ctx context.Context, changed []string) {
+	var names []string
+	for name := range config.VerifyServe {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		addr := config.VerifyServe[name]
+		cert := verifyCert(name)
+		if !slices.Contains(changed, cert) {
+			continue
+		}
+		data, err := readLocal(localPath(cert, ".crt"))
+		if err != nil {
+			slog.Warn("verify served cert", "cert", cert, "err", err)
+			continue
+		}
+		want, _, err := fingerprints(data)
+		if err != nil {
+			slog.Warn("verify served cert", "cert", cert, "err", err)
+			continue
+		}
+		got, err := servedFingerprint(ctx, addr, name)
+		switch {
+		case err != nil:
+			slog.Warn("verify served cert", "cert", cert, "name", name, "addr", addr, "err", err)
+		case got != want:
+			slog.Warn("served cert does not match installed cert", "cert", cert, "name", name, "addr", addr, "served", got, "installed", want)
+		default:
+			slog.Info("served cert matches", "cert", cert, "name", name, "addr", addr, "fingerprint", got)
+		}
+	}
+}
+
+// servedFingerprint returns the SHA-256 fingerprint of the leaf presented by
+// the TLS server at addr for server name name. The presented chain is not
+// verified, only compared.
+func servedFingerprint(ctx context.Context, addr string, name string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, config.VerifyServeTimeout)
+	defer cancel()
+	d := tls.Dialer{
+		NetDialer: &net.Dialer{},
+		Config: &tls.Config{
+			ServerName:         name,
+			InsecureSkipVerify: true,
+		},
+	}
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	certs := conn.(*tls.Conn).ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return "", errors.New("no certificate presented")
+	}
+	sum := sha256.Sum256(certs[0].Raw)
+	return hex.EncodeToString(sum[:]), nil
+}
@@ -0,0 +1,23 @@
+package main
+
+import "testing"
+
+func TestVerifyCert(t *testing.T) {
+	useTestConfig(t)
+	config.Certs = []string{"*.example.com", "api.example.com", "example.org"}
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"www.example.com", "*.example.com"},
+		{"api.example.com", "api.example.com"},
+		{"example.org", "example.org"},
+		{"a.b.example.com", "a.b.example.com"},
+		{"www.example.org", "www.example.org"},
+	}
+	for _, tt := range tests {
+		if got := verifyCert(tt.name); got != tt.want {
+			t.Errorf("verifyCert(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
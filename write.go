@@ -0,0 +1,362 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// writeFileAtomic writes data to fname by way of a temporary file in the
+// same directory that is renamed over fname once complete.
+func writeFileAtomic(fname string, data []byte, modified time.Time) error {
+	tmpname, err := stageFile(fname, data, modified)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmpname, fname)
+	if err != nil {
+		os.Remove(tmpname)
+	}
+	return err
+}
+
+// staleTempRegexp matches the names of the temporary files of stageFile.
+var staleTempRegexp = regexp.MustCompile(`^\..+\.[0-9]+\.tmp$`)
+
+// removeStaleTemps removes the temporary files left below CertDir and the
+// directories of the -config file by a certwatch that was killed while
+// writing, before the first sync starts.
+func removeStaleTemps() error {
+	for _, dir := range certDirs() {
+		err := removeStaleTempsIn(dir)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeStaleTempsIn implements removeStaleTemps for one directory.
+func removeStaleTempsIn(dir string) error {
+	return filepath.WalkDir(dir, func(fname string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() || !staleTempRegexp.MatchString(d.Name()) {
+			return nil
+		}
+		err = os.Remove(fname)
+		if err != nil {
+			return err
+		}
+		slog.Info("removed stale temporary file", "file", fname)
+		return nil
+	})
+}
+
+// writeChunk is the size of the writes stageFile issues. The value is held
+// in memory anyway, bounded by -max-value-size, so the chunks do not lower
+// the memory used, they keep every single write small.
+const writeChunk = 64 << 10
+
+// stageFile writes data to a new temporary file next to fname and returns
+// its name, ready to be renamed over fname. The temporary file is created
+// exclusively with mode 0600 and its permissions are checked before any data
+// is written, so key material is never visible with looser permissions, even
+// momentarily. Data is written in chunks of writeChunk bytes and both the
+// bytes written and the size of the result are checked against len(data).
+func stageFile(fname string, data []byte, modified time.Time) (_ string, err error) {
+	f, err := os.CreateTemp(filepath.Dir(fname), "."+filepath.Base(fname)+".*.tmp")
+	if err != nil {
+		return "", err
+	}
+	tmpname := f.Name()
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(tmpname)
+		}
+	}()
+	finfo, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	if finfo.Mode().Perm()&0077 != 0 {
+		err = f.Chmod(0600)
+		if err != nil {
+			return "", err
+		}
+		finfo, err = f.Stat()
+		if err != nil {
+			return "", err
+		}
+		if finfo.Mode().Perm()&0077 != 0 {
+			return "", &fs.PathError{Op: "create", Path: tmpname, Err: fmt.Errorf("unexpected mode %v", finfo.Mode().Perm())}
+		}
+	}
+	written := 0
+	for len(data[written:]) > 0 {
+		chunk := data[written:min(written+writeChunk, len(data))]
+		n, err := f.Write(chunk)
+		written += n
+		if err != nil {
+			return "", err
+		}
+		if n != len(chunk) {
+			break
+		}
+	}
+	finfo, err = f.Stat()
+	if err != nil {
+		return "", err
+	}
+	if written != len(data) || finfo.Size() != int64(len(data)) {
+		return "", &fs.PathError{Op: "write", Path: tmpname, Err: fmt.Errorf("short write %d of %d bytes", finfo.Size(), len(data))}
+	}
+	err = f.Close()
+	if err != nil {
+		return "", err
+	}
+	if !modified.IsZero() {
+		err = os.Chtimes(tmpname, modified, modified)
+		if err != nil {
+			return "", err
+		}
+	}
+	return tmpname, nil
+}
+
+// errInsecureKey is returned for a key file found accessible by group or
+// others after it was written.
+var errInsecureKey = errors.New("key file is accessible by group or others, removed it, check -umask, ACLs and the target of symlinks, or use -allow-insecure-key")
+
+// checkKeyMode checks the permissions of a key file just written against
+// the allowed mode, 0600 unless the -config file sets one. A key accessible
+// by group or others beyond that is removed again, unless
+// -allow-insecure-key is set, in which case it is only logged. stageFile
+// creates files with mode 0600, this guards against anything loosening that
+// on the way, such as a symlink target on a filesystem with its own idea of
+// permissions.
+func checkKeyMode(fname string, allowed fs.FileMode) error {
+	finfo, err := os.Stat(fname)
+	if err != nil {
+		return err
+	}
+	if finfo.Mode().Perm()&0077&^allowed == 0 {
+		return nil
+	}
+	if config.AllowInsecureKey {
+		slog.Warn("key file is accessible by group or others", "file", fname, "mode", finfo.Mode().Perm())
+		return nil
+	}
+	err = os.Remove(fname)
+	if err != nil {
+		return err
+	}
+	return &fs.PathError{Op: "write", Path: fname, Err: fmt.Errorf("%w: mode %v", errInsecureKey, finfo.Mode().Perm())}
+}
+
+// maxDiskBackoff bounds the delay between write attempts while CertDir is
+// read-only or full.
+const maxDiskBackoff = 5 * time.Minute
+
+// errDiskBackoff is returned instead of attempting a write while backing off
+// from a read-only or full CertDir.
+var errDiskBackoff = errors.New("certdir unavailable, backing off from writes")
+
+// errCertDirUnavailable is returned while CertDir itself cannot be
+// accessed, such as during an outage of the network mount holding it.
+var errCertDirUnavailable = errors.New("certdir unavailable")
+
+var diskBackoff struct {
+	sync.Mutex
+	until time.Time
+	delay time.Duration
+	// lost is set while CertDir itself is unavailable
+	lost bool
+}
+
+// isDiskFault reports whether err indicates that CertDir cannot be written
+// because the filesystem is read-only, full or unavailable.
+func isDiskFault(err error) bool {
+	return errors.Is(err, errDiskBackoff) || errors.Is(err, errCertDirUnavailable) ||
+		errors.Is(err, syscall.EROFS) || errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.EDQUOT)
+}
+
+// checkCertDir checks that CertDir and the directories of the -config file
+// are accessible before their files are looked at, so an unavailable mount
+// is reported as a single fault of the directory instead of an error for
+// every file.
+func checkCertDir() error {
+	for _, dir := range certDirs() {
+		finfo, err := os.Stat(dir)
+		if err == nil && !finfo.IsDir() {
+			err = &fs.PathError{Op: "stat", Path: dir, Err: errNotDir}
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %w", errCertDirUnavailable, err)
+		}
+	}
+	return nil
+}
+
+// diskFault records a write failure caused by a read-only or full CertDir
+// and doubles the delay before the next write is attempted.
+func diskFault(err error) {
+	diskBackoff.Lock()
+	defer diskBackoff.Unlock()
+	if diskBackoff.delay == 0 {
+		diskBackoff.delay = config.SleepTime
+	} else {
+		diskBackoff.delay = min(2*diskBackoff.delay, maxDiskBackoff)
+	}
+	diskBackoff.until = clk.Now().Add(diskBackoff.delay)
+	if errors.Is(err, errCertDirUnavailable) {
+		diskBackoff.lost = true
+	}
+	slog.Error("CERTDIR NOT WRITABLE, certificates are not being updated", "certdir", config.CertDir, "err", err, "retry", diskBackoff.delay)
+	state.setDiskError(err)
+}
+
+// diskRecovered clears a previous write failure after a successful write.
+func diskRecovered() {
+	diskBackoff.Lock()
+	defer diskBackoff.Unlock()
+	if diskBackoff.delay == 0 {
+		return
+	}
+	slog.Info("certdir writable again", "certdir", config.CertDir)
+	diskBackoff.delay = 0
+	diskBackoff.until = time.Time{}
+	diskBackoff.lost = false
+	state.setDiskError(nil)
+}
+
+// certDirReturned reports whether CertDir has become accessible again after
+// it was unavailable, once the backoff has passed. The write failure is
+// cleared then, the caller is expected to reconcile all certs since any of
+// them may have changed meanwhile.
+func certDirReturned() bool {
+	diskBackoff.Lock()
+	lost := diskBackoff.lost && !clk.Now().Before(diskBackoff.until)
+	diskBackoff.Unlock()
+	if !lost || checkCertDir() != nil {
+		return false
+	}
+	diskRecovered()
+	return true
+}
+
+// diskBlocked reports whether writes are currently suspended.
+func diskBlocked() bool {
+	diskBackoff.Lock()
+	defer diskBackoff.Unlock()
+	return clk.Now().Before(diskBackoff.until)
+}
+
+// errSymlink is returned for symlinked targets unless -follow-symlinks is
+// set.
+var errSymlink = errors.New("is a symlink, use -follow-symlinks to write through it")
+
+// resolveTarget returns the file to write for fname. Symlinks are refused
+// unless -follow-symlinks is set, in which case the final target of the link
+// is returned so the link itself is kept and its target replaced.
+func resolveTarget(fname string) (string, error) {
+	finfo, err := os.Lstat(fname)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return fname, nil
+		}
+		return "", err
+	}
+	if finfo.Mode()&fs.ModeSymlink == 0 {
+		return fname, nil
+	}
+	if !config.FollowSymlinks {
+		return "", &fs.PathError{Op: "write", Path: fname, Err: errSymlink}
+	}
+	target, err := filepath.EvalSymlinks(fname)
+	if err == nil {
+		return target, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return "", err
+	}
+	// dangling link, create its target
+	link, err := os.Readlink(fname)
+	if err != nil {
+		return "", err
+	}
+	if !filepath.IsAbs(link) {
+		link = filepath.Join(filepath.Dir(fname), link)
+	}
+	return link, nil
+}
+
+// resolveCertDir applies the symlink policy to CertDir itself.
+func resolveCertDir() error {
+	finfo, err := os.Lstat(config.CertDir)
+	if err != nil || finfo.Mode()&fs.ModeSymlink == 0 {
+		return nil
+	}
+	if !config.FollowSymlinks {
+		return &fs.PathError{Op: "certdir", Path: config.CertDir, Err: errSymlink}
+	}
+	dir, err := filepath.EvalSymlinks(config.CertDir)
+	if err != nil {
+		return err
+	}
+	slog.Info("certdir is a symlink", "certdir", config.CertDir, "target", dir)
+	config.CertDir = dir
+	return nil
+}
+
+// errIsDir is returned for a target that is a directory unless -force-file
+// is set.
+var errIsDir = errors.New("is a directory, remove it or use -force-file")
+
+// errNotDir is returned for a file where a directory is expected unless
+// -force-file is set.
+var errNotDir = errors.New("is not a directory, remove it or use -force-file")
+
+// prepareTarget checks that fname can be written: a directory in its place
+// and a file in place of its parent directory are errors, or are removed
+// with -force-file. Missing parent directories below CertDir are created.
+func prepareTarget(fname string) error {
+	finfo, err := os.Lstat(fname)
+	if err == nil && finfo.IsDir() {
+		if !config.ForceFile {
+			return &fs.PathError{Op: "write", Path: fname, Err: errIsDir}
+		}
+		slog.Warn("removing directory in place of cert file", "path", fname)
+		err = os.RemoveAll(fname)
+		if err != nil {
+			return err
+		}
+	}
+	dir := filepath.Dir(fname)
+	finfo, err = os.Stat(dir)
+	switch {
+	case err == nil && finfo.IsDir():
+		return nil
+	case err == nil:
+		if !config.ForceFile {
+			return &fs.PathError{Op: "write", Path: dir, Err: errNotDir}
+		}
+		slog.Warn("removing file in place of directory", "path", dir)
+		err = os.Remove(dir)
+		if err != nil {
+			return err
+		}
+	case !errors.Is(err, fs.ErrNotExist):
+		return err
+	}
+	return os.MkdirAll(dir, 0700)
+}
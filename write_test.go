@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/fs"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStageFile(t *testing.T) {
+	modified := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		size int
+	}{
+		{"empty", 0},
+		{"small", 100},
+		{"one chunk", writeChunk},
+		{"chunk and a byte", writeChunk + 1},
+		{"multi-megabyte", 3<<20 + 17},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := make([]byte, tt.size)
+			rand.New(rand.NewSource(int64(tt.size))).Read(data)
+			fname := filepath.Join(t.TempDir(), "www.example.com.crt")
+			tmpname, err := stageFile(fname, data, modified)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := os.ReadFile(tmpname)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Errorf("staged %d bytes differ from the %d written", len(got), len(data))
+			}
+			finfo, err := os.Stat(tmpname)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if finfo.Mode().Perm() != 0600 {
+				t.Errorf("mode %v, want 0600", finfo.Mode().Perm())
+			}
+			if !finfo.ModTime().Equal(modified) {
+				t.Errorf("modified %v, want %v", finfo.ModTime(), modified)
+			}
+		})
+	}
+}
+
+func TestResolveTarget(t *testing.T) {
+	oldFollow := config.FollowSymlinks
+	defer func() { config.FollowSymlinks = oldFollow }()
+	dir := t.TempDir()
+	file := filepath.Join(dir, "archive.crt")
+	err := os.WriteFile(file, []byte("crt"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	link := func(name string, target string) string {
+		fname := filepath.Join(dir, name)
+		err := os.Symlink(target, fname)
+		if err != nil {
+			t.Skip("symlinks not supported:", err)
+		}
+		return fname
+	}
+	live := link("live.crt", "archive.crt")
+	chained := link("chained.crt", "live.crt")
+	dangling := link("dangling.crt", "missing.crt")
+	tests := []struct {
+		name   string
+		fname  string
+		follow bool
+		want   string
+		err    error
+	}{
+		{"file", file, false, file, nil},
+		{"missing", filepath.Join(dir, "new.crt"), false, filepath.Join(dir, "new.crt"), nil},
+		{"link refused", live, false, "", errSymlink},
+		{"link followed", live, true, file, nil},
+		{"link to link followed", chained, true, file, nil},
+		{"dangling link refused", dangling, false, "", errSymlink},
+		{"dangling link followed", dangling, true, filepath.Join(dir, "missing.crt"), nil},
+	}
+	for _, tt := range tests {
+		config.FollowSymlinks = tt.follow
+		got, err := resolveTarget(tt.fname)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%s: got error %v, want %v", tt.name, err, tt.err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSymlinkedCertDir(t *testing.T) {
+	useTestConfig(t)
+	target := config.CertDir
+	config.CertDir = filepath.Join(t.TempDir(), "certs")
+	err := os.Symlink(target, config.CertDir)
+	if err != nil {
+		t.Skip("symlinks not supported:", err)
+	}
+	linked := config.CertDir
+	tests := []struct {
+		follow bool
+		err    error
+		want   string
+	}{
+		{false, errSymlink, linked},
+		{true, nil, target},
+	}
+	for _, tt := range tests {
+		config.CertDir = linked
+		config.FollowSymlinks = tt.follow
+		err := resolveCertDir()
+		if !errors.Is(err, tt.err) {
+			t.Errorf("follow %v: got error %v, want %v", tt.follow, err, tt.err)
+		}
+		if config.CertDir != tt.want {
+			t.Errorf("follow %v: certdir %s, want %s", tt.follow, config.CertDir, tt.want)
+		}
+	}
+}
+
+func TestHandleCertSymlinkedFile(t *testing.T) {
+	useTestConfig(t)
+	const cert = "www.example.com"
+	v := newTestVersion(t)
+	archive := filepath.Join(config.CertDir, "archive")
+	err := os.Mkdir(archive, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, suf := range certSuffixes {
+		err = os.MkdirAll(filepath.Dir(localPath(cert, suf)), 0700)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.Symlink(filepath.Join(archive, cert+suf), localPath(cert, suf))
+		if err != nil {
+			t.Skip("symlinks not supported:", err)
+		}
+	}
+	tests := []struct {
+		follow bool
+		err    error
+	}{
+		{false, errSymlink},
+		{true, nil},
+	}
+	for _, tt := range tests {
+		config.FollowSymlinks = tt.follow
+		_, err := handleCert(withValues(context.Background(), cert, v, 1), cert)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("follow %v: got error %v, want %v", tt.follow, err, tt.err)
+		}
+	}
+	want := map[string][]byte{".key": v.key, ".crt": v.crt}
+	for _, suf := range certSuffixes {
+		finfo, err := os.Lstat(localPath(cert, suf))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if finfo.Mode()&fs.ModeSymlink == 0 {
+			t.Errorf("%s: link replaced by a file", suf)
+		}
+		got, err := os.ReadFile(filepath.Join(archive, cert+suf))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want[suf]) {
+			t.Errorf("%s: link target not written", suf)
+		}
+	}
+}
+
+func TestPrepareTargetCollisions(t *testing.T) {
+	oldForce := config.ForceFile
+	defer func() { config.ForceFile = oldForce }()
+	tests := []struct {
+		name string
+		// setup creates the colliding path in dir and returns the file to
+		// write
+		setup func(t *testing.T, dir string) string
+		force bool
+		err   error
+	}{
+		{"directory in place of file", dirInPlaceOfFile, false, errIsDir},
+		{"directory in place of file forced", dirInPlaceOfFile, true, nil},
+		{"file in place of directory", fileInPlaceOfDir, false, errNotDir},
+		{"file in place of directory forced", fileInPlaceOfDir, true, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.ForceFile = tt.force
+			fname := tt.setup(t, t.TempDir())
+			err := prepareTarget(fname)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("got error %v, want %v", err, tt.err)
+			}
+			if err != nil {
+				return
+			}
+			err = writeFileAtomic(fname, []byte("crt"), time.Time{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			finfo, err := os.Stat(fname)
+			if err != nil || !finfo.Mode().IsRegular() {
+				t.Errorf("%s not written as a file: %v", fname, err)
+			}
+		})
+	}
+}
+
+// dirInPlaceOfFile creates a directory holding a file where the cert file
+// goes.
+func dirInPlaceOfFile(t *testing.T, dir string) string {
+	fname := filepath.Join(dir, "www.example.com.crt")
+	err := os.MkdirAll(filepath.Join(fname, "stale"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fname
+}
+
+// fileInPlaceOfDir creates a file where the directory of the cert file goes.
+func fileInPlaceOfDir(t *testing.T, dir string) string {
+	sub := filepath.Join(dir, "www.example.com")
+	err := os.WriteFile(sub, []byte("stale"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(sub, "www.example.com.crt")
+}
+
+func TestCheckCertDirTargets(t *testing.T) {
+	useTestConfig(t)
+	oldTargets := certTargets
+	t.Cleanup(func() { certTargets = oldTargets })
+	dir := filepath.Join(t.TempDir(), "postfix")
+	certTargets = map[string]certTarget{"mail.example.com": {dir: dir, uid: -1, gid: -1}}
+	if err := checkCertDir(); !errors.Is(err, errCertDirUnavailable) {
+		t.Errorf("missing target dir: got %v", err)
+	}
+	err := os.Mkdir(dir, 0o700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkCertDir(); err != nil {
+		t.Errorf("existing target dir: %v", err)
+	}
+}